@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/gomoni/amble/internal/auth/jwt"
+	"github.com/gomoni/amble/internal/provision"
+	"github.com/gomoni/amble/internal/services/accounts"
+	"github.com/gomoni/amble/internal/services/audit"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nkeys"
+)
+
+// config of the callout, relative paths are resolved against the directory
+// of the config file
+type config struct {
+	// NatsURL of the nats-server, default is nats.DefaultURL
+	NatsURL string `json:"nats_url"`
+	// NatsUser and NatsPassword of the user listed in auth_users
+	NatsUser     string `json:"nats_user"`
+	NatsPassword string `json:"nats_password"`
+	// NatsCreds of the user listed in auth_users in operator mode
+	NatsCreds string `json:"nats_creds"`
+	// IssuerSeed is the account nkey seed of the callout issuer
+	IssuerSeed string `json:"issuer_seed"`
+	// XKeySeed is the curve nkey seed to decrypt requests
+	XKeySeed string `json:"xkey_seed"`
+	// JWTSeed is the ed25519 seed of the web tokens
+	JWTSeed string `json:"jwt_seed"`
+	// Policy is an optional json file with user permissions
+	Policy string `json:"policy"`
+	// AccountKeysDir enables the operator mode with tenants signing keys
+	AccountKeysDir string `json:"account_keys_dir"`
+	// ShutdownTimeout to finish in-flight requests, default is 10s
+	ShutdownTimeout string `json:"shutdown_timeout"`
+	// CacheSize of the callout lookups, zero disables the cache
+	CacheSize int `json:"cache_size"`
+	// CacheTTL of the callout lookups, default is 1m
+	CacheTTL string `json:"cache_ttl"`
+	// Buckets are optional settings of buckets and streams by the name
+	Buckets provision.Config `json:"buckets"`
+}
+
+func main() {
+	configPath := flag.String("config", "secrets/callout.json", "path to callout config")
+	flag.Parse()
+	if err := run(*configPath); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(configPath string) error {
+	conf, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	shutdownTimeout, err := time.ParseDuration(conf.ShutdownTimeout)
+	if err != nil {
+		return fmt.Errorf("parse shutdown_timeout: %w", err)
+	}
+	cacheTTL, err := time.ParseDuration(conf.CacheTTL)
+	if err != nil {
+		return fmt.Errorf("parse cache_ttl: %w", err)
+	}
+	buckets, err := provision.Amble().WithConfig(conf.Buckets)
+	if err != nil {
+		return fmt.Errorf("parse buckets: %w", err)
+	}
+
+	issuer, err := loadNkey(conf.IssuerSeed)
+	if err != nil {
+		return fmt.Errorf("load issuer: %w", err)
+	}
+	xkey, err := loadNkey(conf.XKeySeed)
+	if err != nil {
+		return fmt.Errorf("load xkey: %w", err)
+	}
+	jwtSecret, err := loadJWTSecret(conf.JWTSeed)
+	if err != nil {
+		return fmt.Errorf("load jwt secrets: %w", err)
+	}
+
+	opts := []nats.Option{nats.Name(accounts.ServiceName)}
+	if conf.NatsCreds != "" {
+		opts = append(opts, nats.UserCredentials(conf.NatsCreds))
+	} else {
+		opts = append(opts, nats.UserInfo(conf.NatsUser, conf.NatsPassword))
+	}
+	nc, err := nats.Connect(conf.NatsURL, opts...)
+	if err != nil {
+		return fmt.Errorf("connect to nats: %w", err)
+	}
+	defer nc.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return fmt.Errorf("create jetstream: %w", err)
+	}
+	err = provision.EnsureBuckets(ctx, js, buckets)
+	if err != nil {
+		return fmt.Errorf("ensure buckets: %w", err)
+	}
+	kv, err := js.KeyValue(ctx, accounts.Bucket)
+	if err != nil {
+		return fmt.Errorf("open accounts bucket: %w", err)
+	}
+
+	store := accounts.NewNats(kv)
+	svc, err := accounts.NewService(xkey, issuer, store, jwt.NewDecoder(jwtSecret.Public()))
+	if err != nil {
+		return fmt.Errorf("create auth callout: %w", err)
+	}
+	svc = svc.WithAudit(audit.NewNats(js)).
+		WithLogger(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+	if conf.Policy != "" {
+		policy, err := loadPolicy(conf.Policy)
+		if err != nil {
+			return fmt.Errorf("load policy: %w", err)
+		}
+		svc = svc.WithPolicy(policy)
+	}
+	if conf.AccountKeysDir != "" {
+		svc = svc.WithAccountKeys(accounts.NewDirKeys(conf.AccountKeysDir))
+	}
+	if conf.CacheSize > 0 {
+		cache := accounts.NewCache(store, conf.CacheSize, cacheTTL)
+		go func() {
+			err := cache.Run(ctx)
+			if err != nil {
+				log.Printf("cache: %s", err)
+			}
+		}()
+		svc = svc.WithCache(cache)
+	}
+
+	// Run drains the connection of the service, while the store, the cache
+	// and the audit keep using nc to finish the requests
+	svcNc, err := nats.Connect(conf.NatsURL, opts...)
+	if err != nil {
+		return fmt.Errorf("connect to nats: %w", err)
+	}
+	defer svcNc.Close()
+
+	log.Printf("Serving %s %s on %s", accounts.ServiceName, accounts.ServiceVersion, accounts.AuthCalloutSubject)
+	err = svc.Run(ctx, svcNc, shutdownTimeout)
+	if err != nil {
+		return err
+	}
+	log.Printf("Stopped %s", accounts.ServiceName)
+	return nil
+}
+
+func loadConfig(path string) (config, error) {
+	conf := config{
+		NatsURL:         nats.DefaultURL,
+		ShutdownTimeout: "10s",
+		CacheSize:       accounts.DefaultCacheSize,
+		CacheTTL:        accounts.DefaultCacheTTL.String(),
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return conf, fmt.Errorf("open config file %s: %w", path, err)
+	}
+	defer f.Close()
+	err = json.NewDecoder(f).Decode(&conf)
+	if err != nil {
+		return conf, fmt.Errorf("decode config from json %s: %w", path, err)
+	}
+	if conf.IssuerSeed == "" || conf.XKeySeed == "" || conf.JWTSeed == "" {
+		return conf, errors.New("config: issuer_seed, xkey_seed and jwt_seed are required")
+	}
+
+	dir := filepath.Dir(path)
+	for _, p := range []*string{&conf.NatsCreds, &conf.IssuerSeed, &conf.XKeySeed, &conf.JWTSeed, &conf.Policy, &conf.AccountKeysDir} {
+		if *p != "" && !filepath.IsAbs(*p) {
+			*p = filepath.Join(dir, *p)
+		}
+	}
+	return conf, nil
+}
+
+func loadNkey(path string) (nkeys.KeyPair, error) {
+	seed, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read seed file %s: %w", path, err)
+	}
+	kp, err := nkeys.FromSeed(bytes.TrimSpace(seed))
+	if err != nil {
+		return nil, fmt.Errorf("parse seed file %s: %w", path, err)
+	}
+	return kp, nil
+}
+
+func loadJWTSecret(path string) (jwt.Secret, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return jwt.Secret{}, fmt.Errorf("open secrets file %s: %w", path, err)
+	}
+	defer f.Close()
+	ret, err := jwt.LoadSecret(f)
+	if err != nil {
+		return jwt.Secret{}, fmt.Errorf("read from secrets file %s: %w", path, err)
+	}
+	return ret, nil
+}
+
+func loadPolicy(path string) (accounts.Policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return accounts.Policy{}, fmt.Errorf("open policy file %s: %w", path, err)
+	}
+	defer f.Close()
+	return accounts.LoadPolicy(f)
+}
@@ -0,0 +1,77 @@
+// Command migrate upgrades stored accounts to the current schema version
+//
+//	go run ./cmd/migrate -dry-run
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/gomoni/amble/internal/services/accounts"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func main() {
+	natsURL := flag.String("nats-url", nats.DefaultURL, "nats-server url")
+	creds := flag.String("creds", "", "optional .creds file of the nats user")
+	dryRun := flag.Bool("dry-run", false, "count the accounts to migrate without writing them")
+	flag.Parse()
+	if err := run(*natsURL, *creds, *dryRun); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(natsURL, creds string, dryRun bool) error {
+	opts := []nats.Option{nats.Name("amble-migrate")}
+	if creds != "" {
+		opts = append(opts, nats.UserCredentials(creds))
+	}
+	nc, err := nats.Connect(natsURL, opts...)
+	if err != nil {
+		return fmt.Errorf("connect to nats: %w", err)
+	}
+	defer nc.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return fmt.Errorf("create jetstream: %w", err)
+	}
+	kv, err := js.KeyValue(ctx, accounts.Bucket)
+	if err != nil {
+		return fmt.Errorf("open accounts bucket: %w", err)
+	}
+
+	migrator := accounts.NewNats(kv).Migrator().WithProgress(func(p accounts.MigrationProgress) {
+		if p.Done%100 == 0 || p.Done == p.Total {
+			log.Printf("%d/%d accounts, %d to migrate, %d failed", p.Done, p.Total, p.Migrated, p.Failed)
+		}
+	})
+	if dryRun {
+		migrator = migrator.WithDryRun()
+	}
+	report, err := migrator.Run(ctx)
+	for uid, err := range report.Errors {
+		log.Printf("%s: %s", uid, err)
+	}
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		log.Printf("Dry run: %d of %d accounts would be migrated to v%d", report.Migrated, report.Total, accounts.SchemaVersion)
+	} else {
+		log.Printf("Migrated %d of %d accounts to v%d", report.Migrated, report.Total, accounts.SchemaVersion)
+	}
+	if report.Failed > 0 {
+		return fmt.Errorf("%d accounts failed to migrate", report.Failed)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+// Command tenant creates a tenant. In the operator mode it creates the NATS
+// account of the tenant too, stores its signing key and pushes the account
+// JWT to the account resolver.
+//
+//	go run ./cmd/tenant -name plainsof -operator-seed secrets/operator.nk -account-keys secrets/accounts -sys-creds secrets/sys.creds
+//	go run ./cmd/tenant -name plainsof -account PLA
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/gomoni/amble/internal/services/accounts"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nkeys"
+)
+
+type options struct {
+	natsURL      string
+	creds        string
+	sysCreds     string
+	operatorSeed string
+	accountKeys  string
+	name         string
+	account      string
+}
+
+func main() {
+	var o options
+	flag.StringVar(&o.natsURL, "nats-url", nats.DefaultURL, "nats-server url")
+	flag.StringVar(&o.creds, "creds", "", "optional .creds file of the nats user")
+	flag.StringVar(&o.sysCreds, "sys-creds", "", ".creds file of a system account user, operator mode")
+	flag.StringVar(&o.operatorSeed, "operator-seed", "", "operator or operator signing key seed file, operator mode")
+	flag.StringVar(&o.accountKeys, "account-keys", "", "directory of account signing keys shared with the callout, operator mode")
+	flag.StringVar(&o.name, "name", "", "name of the tenant")
+	flag.StringVar(&o.account, "account", "", "existing NATS account of the tenant, no account is created")
+	flag.Parse()
+	if err := run(o); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(o options) error {
+	if o.name == "" {
+		return errors.New("-name is required")
+	}
+	if o.account == "" && (o.sysCreds == "" || o.operatorSeed == "" || o.accountKeys == "") {
+		return errors.New("either -account or -sys-creds, -operator-seed and -account-keys are required")
+	}
+	opts := []nats.Option{nats.Name("amble-tenant")}
+	if o.creds != "" {
+		opts = append(opts, nats.UserCredentials(o.creds))
+	}
+	nc, err := nats.Connect(o.natsURL, opts...)
+	if err != nil {
+		return fmt.Errorf("connect to nats: %w", err)
+	}
+	defer nc.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return fmt.Errorf("create jetstream: %w", err)
+	}
+	kv, err := js.KeyValue(ctx, accounts.Bucket)
+	if err != nil {
+		return fmt.Errorf("open accounts bucket: %w", err)
+	}
+
+	account := o.account
+	if account == "" {
+		account, err = createAccount(ctx, o)
+		if err != nil {
+			return err
+		}
+		log.Printf("Created NATS account %s", account)
+	}
+	tenant, err := accounts.NewNats(kv).CreateTenant(ctx, o.name, account)
+	if err != nil {
+		// the account is usable already, retry with -account
+		return fmt.Errorf("create tenant of account %s: %w", account, err)
+	}
+	log.Printf("Created tenant %s %q in NATS account %s", tenant.ID, tenant.Name, tenant.Account)
+	return nil
+}
+
+// createAccount creates the NATS account by the operator and returns its
+// public key
+func createAccount(ctx context.Context, o options) (string, error) {
+	seed, err := os.ReadFile(o.operatorSeed)
+	if err != nil {
+		return "", fmt.Errorf("read seed file %s: %w", o.operatorSeed, err)
+	}
+	kp, err := nkeys.FromSeed(bytes.TrimSpace(seed))
+	if err != nil {
+		return "", fmt.Errorf("parse seed file %s: %w", o.operatorSeed, err)
+	}
+	sys, err := nats.Connect(o.natsURL, nats.Name("amble-tenant-sys"), nats.UserCredentials(o.sysCreds))
+	if err != nil {
+		return "", fmt.Errorf("connect to nats system account: %w", err)
+	}
+	defer sys.Close()
+	operator, err := accounts.NewOperator(kp, accounts.NewDirKeys(o.accountKeys), sys)
+	if err != nil {
+		return "", fmt.Errorf("load operator: %w", err)
+	}
+	return operator.CreateAccount(ctx, o.name)
+}
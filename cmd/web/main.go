@@ -1,35 +1,63 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/gomoni/amble/internal/auth"
+	"github.com/gomoni/amble/internal/auth/email"
 	"github.com/gomoni/amble/internal/auth/github"
+	"github.com/gomoni/amble/internal/auth/impersonate"
 	"github.com/gomoni/amble/internal/auth/jwt"
+	"github.com/gomoni/amble/internal/auth/passkey"
+	"github.com/gomoni/amble/internal/auth/totp"
+	"github.com/gomoni/amble/internal/mail"
+	"github.com/gomoni/amble/internal/provision"
+	"github.com/gomoni/amble/internal/services/accounts"
+	"github.com/gomoni/amble/internal/services/audit"
+	"github.com/gomoni/amble/internal/services/export"
+	"github.com/gomoni/amble/internal/tid"
 	"github.com/gomoni/amble/internal/web"
 	"github.com/justinas/alice"
 	"github.com/justinas/nosurf"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/skip2/go-qrcode"
 )
 
 const credentialsDir = `secrets/`
 const servingSchema = "http://"
 const servingAddress = "localhost:8000"
+const servingOrigin = servingSchema + servingAddress
+const natsURL = nats.DefaultURL
+const smtpAddress = "localhost:1025"
+const mailFrom = "Amble.app <noreply@amble.app>"
+
+// eraseInterval is how often accounts after the grace period are erased
+const eraseInterval = time.Hour
 
 var csrfMW = nosurf.NewPure
 
 func main() {
-	if err := run(); err != nil {
+	approvalQueue := flag.Bool("approval-queue", false, "new accounts wait for an admin to approve them")
+	defaultTenant := flag.String("default-tenant", "", "tenant id new accounts become members of")
+	flag.Parse()
+	if err := run(*approvalQueue, *defaultTenant); err != nil {
 		log.Fatal(err)
 	}
 }
 
-func run() error {
+func run(approvalQueue bool, defaultTenant string) error {
 	githubSecrets, err := loadAuthSecrets(credentialsDir, "github.secrets.json")
 	if err != nil {
 		return fmt.Errorf("load github secrets: %w", err)
@@ -42,21 +70,188 @@ func run() error {
 	jwtEncoder := jwt.NewEncoder(jwtSecrets)
 	jwtDecoder := jwt.NewDecoder(jwtSecrets.Public())
 
-	githubLogin := github.NewFromSecrets(githubSecrets, jwtEncoder)
-	logged := logged{jwtDecoder: jwtDecoder}
+	totpSealer, err := loadTOTPSealer(credentialsDir, "totp.aes.key")
+	if err != nil {
+		return fmt.Errorf("load totp secrets: %w", err)
+	}
+
+	admins, err := loadAdmins(credentialsDir, "admins.json")
+	if err != nil {
+		return fmt.Errorf("load admins: %w", err)
+	}
+
+	buckets, err := loadBuckets(credentialsDir, "buckets.json")
+	if err != nil {
+		return fmt.Errorf("load buckets: %w", err)
+	}
+
+	ctx := context.Background()
+	nc, err := nats.Connect(natsURL)
+	if err != nil {
+		return fmt.Errorf("connect to nats: %w", err)
+	}
+	defer nc.Close()
+	sysNc, err := connectSys(credentialsDir, "nats.sys.json")
+	if err != nil {
+		return fmt.Errorf("connect to nats system account: %w", err)
+	}
+	if sysNc != nil {
+		defer sysNc.Close()
+	} else {
+		log.Printf("Missing %s, live NATS connections of deleted accounts are not kicked", "nats.sys.json")
+	}
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return fmt.Errorf("create jetstream: %w", err)
+	}
+	err = provision.EnsureBuckets(ctx, js, buckets)
+	if err != nil {
+		return fmt.Errorf("ensure buckets: %w", err)
+	}
+	kv, err := js.KeyValue(ctx, accounts.Bucket)
+	if err != nil {
+		return fmt.Errorf("open accounts bucket: %w", err)
+	}
+	magicLinks, err := js.KeyValue(ctx, email.Bucket)
+	if err != nil {
+		return fmt.Errorf("open magic links bucket: %w", err)
+	}
+	auditLog := audit.NewNats(js)
+	exportJobs, err := js.KeyValue(ctx, export.Bucket)
+	if err != nil {
+		return fmt.Errorf("open exports bucket: %w", err)
+	}
+	exportFiles, err := js.ObjectStore(ctx, export.Bucket)
+	if err != nil {
+		return fmt.Errorf("open exports object store: %w", err)
+	}
+
+	accountsStore := accounts.NewNats(kv)
+	if approvalQueue {
+		accountsStore = accountsStore.WithApprovalQueue()
+	}
+	if defaultTenant != "" {
+		id, err := tid.ParseTenantID(defaultTenant)
+		if err != nil {
+			return fmt.Errorf("parse default tenant: %w", err)
+		}
+		_, err = accountsStore.Tenant(ctx, id)
+		if err != nil {
+			return fmt.Errorf("default tenant: %w", err)
+		}
+		accountsStore = accountsStore.WithDefaultTenant(id)
+	}
+	// download links are signed by own key, so they never work as a session
+	linkSecrets := jwtSecrets.Derive("export")
+	exportService := export.NewService(exportJobs, exportFiles, accountsStore, auditLog, jwt.NewEncoder(linkSecrets), jwt.NewDecoder(linkSecrets.Public()))
+	// the erasure event recorded afterwards is the only trace of the user
+	accountsStore = accountsStore.WithErasers(auditLog, exportService)
+	kicker := accounts.NewKicker(accountsStore, sysNc)
+	go eraseDue(ctx, kicker, auditLog)
+	go func() {
+		err := exportService.Run(ctx)
+		if err != nil {
+			log.Printf("export: %s", err)
+		}
+	}()
+	totpService := totp.NewService(accountsStore, totpSealer, jwtEncoder, jwtDecoder).
+		WithAudit(auditLog)
+	githubLogin := github.NewFromSecrets(githubSecrets, jwtEncoder).
+		WithAccounts(accountsStore).
+		WithAudit(auditLog).
+		WithSecondFactor(totpService)
+	passkeyLogin, err := passkey.NewFromOrigin(servingOrigin, accountsStore, jwtEncoder, jwtDecoder)
+	if err != nil {
+		return fmt.Errorf("create passkey login: %w", err)
+	}
+	passkeyLogin = passkeyLogin.WithAudit(auditLog)
+	emailLogin := email.NewLogin(
+		servingOrigin,
+		mailFrom,
+		mail.NewSMTP(smtpAddress, nil),
+		email.NewNatsNonces(magicLinks),
+		accountsStore,
+		jwtEncoder,
+		jwtDecoder,
+	).WithAudit(auditLog).WithSecondFactor(totpService)
+	impersonation := impersonate.NewService(accountsStore, jwtEncoder, jwtDecoder).
+		WithAudit(auditLog)
+	logged := logged{
+		jwtDecoder:    jwtDecoder,
+		admins:        admins,
+		audit:         auditLog,
+		totp:          totpService,
+		impersonation: impersonation,
+		accounts:      accountsStore,
+		kicker:        kicker,
+		export:        exportService,
+	}
 
 	mux := http.NewServeMux()
 
 	loginForm := alice.New(csrfMW)
 	auth := alice.New(csrfMW)
+	admin := alice.New(logged.adminOnly)
+	adminForm := alice.New(csrfMW, logged.adminOnly)
+	// keys and credentials can't be changed by an admin acting as the user
+	credentials := alice.New(csrfMW, logged.notImpersonated)
+	// users of accounts, which are not active, can export or delete them only
+	activeForm := alice.New(csrfMW, logged.activeOnly)
+	activeCredentials := alice.New(csrfMW, logged.notImpersonated, logged.activeOnly)
 
 	mux.Handle("GET /{$}", loginForm.ThenFunc(handleIndex))
-	mux.HandleFunc("/dashboard", logged.handleDashboard)
+	mux.Handle("/dashboard", loginForm.ThenFunc(logged.handleDashboard))
 	mux.Handle("/auth/github/login", auth.ThenFunc(githubLogin.LoginHandler))
 	mux.Handle("/auth/github/callback", auth.ThenFunc(githubLogin.CallbackHandler))
+	mux.Handle("POST /auth/email/login", auth.ThenFunc(emailLogin.LoginHandler))
+	mux.Handle("GET /auth/email/callback", auth.ThenFunc(emailLogin.CallbackHandler))
+	mux.HandleFunc("GET /auth/email/sent", handleEmailSent)
+	mux.Handle("POST /auth/passkey/login/begin", auth.ThenFunc(passkeyLogin.LoginBeginHandler))
+	mux.Handle("POST /auth/passkey/login/finish", auth.ThenFunc(passkeyLogin.LoginFinishHandler))
+	mux.Handle("POST /auth/passkey/register/begin", activeCredentials.ThenFunc(passkeyLogin.RegisterBeginHandler))
+	mux.Handle("POST /auth/passkey/register/finish", activeCredentials.ThenFunc(passkeyLogin.RegisterFinishHandler))
+	mux.Handle("GET /auth/mfa", loginForm.ThenFunc(handleSecondFactor))
+	mux.Handle("POST /auth/mfa", auth.ThenFunc(totpService.VerifyHandler))
+	mux.Handle("GET /account/totp", activeForm.ThenFunc(logged.handleTOTP))
+	mux.Handle("POST /account/totp/enroll", activeCredentials.ThenFunc(logged.handleTOTPEnroll))
+	mux.Handle("POST /account/totp/confirm", activeCredentials.ThenFunc(logged.handleTOTPConfirm))
+	mux.Handle("POST /account/totp/disable", activeCredentials.ThenFunc(logged.handleTOTPDisable))
+	mux.Handle("GET /account/devices", activeForm.ThenFunc(logged.handleDevices))
+	mux.Handle("POST /account/devices/creds", activeCredentials.ThenFunc(logged.handleDeviceCreds))
+	mux.Handle("POST /account/devices/add", activeCredentials.ThenFunc(logged.handleDeviceAdd))
+	mux.Handle("POST /account/devices/remove", activeCredentials.ThenFunc(logged.handleDeviceRemove))
+	mux.Handle("GET /account/profile", activeForm.ThenFunc(logged.handleProfile))
+	mux.Handle("POST /account/profile", activeForm.ThenFunc(logged.handleProfilePins))
+	mux.Handle("GET /account/export", loginForm.ThenFunc(logged.handleExport))
+	mux.Handle("POST /account/export", credentials.ThenFunc(logged.handleExportRequest))
+	mux.HandleFunc("GET /account/export/download", exportService.DownloadHandler)
+	mux.Handle("GET /account/delete", loginForm.ThenFunc(logged.handleDeletion))
+	mux.Handle("POST /account/delete", credentials.ThenFunc(logged.handleDeletionRequest))
+	mux.Handle("POST /account/delete/cancel", credentials.ThenFunc(logged.handleDeletionCancel))
+	mux.Handle("POST /auth/logout", auth.ThenFunc(logged.handleLogout))
+	mux.Handle("POST /auth/logout/everywhere", credentials.ThenFunc(logged.handleLogoutEverywhere))
+	mux.Handle("POST /auth/impersonate/stop", auth.ThenFunc(impersonation.StopHandler))
+	mux.Handle("GET /admin/audit", admin.ThenFunc(logged.handleAudit))
+	mux.Handle("GET /admin/impersonate", adminForm.ThenFunc(handleImpersonate))
+	mux.Handle("POST /admin/impersonate", adminForm.ThenFunc(impersonation.StartHandler))
+	mux.Handle("GET /admin/accounts/delete", adminForm.ThenFunc(handleAdminDeletion))
+	mux.Handle("POST /admin/accounts/delete", adminForm.ThenFunc(logged.handleAdminDeletionRequest))
+	mux.Handle("POST /admin/accounts/delete/cancel", adminForm.ThenFunc(logged.handleAdminDeletionCancel))
+	mux.Handle("GET /admin/accounts/approvals", adminForm.ThenFunc(logged.handleAdminApprovals))
+	mux.Handle("GET /admin/accounts/status", adminForm.ThenFunc(logged.handleAdminStatus))
+	mux.Handle("POST /admin/accounts/status", adminForm.ThenFunc(logged.handleAdminStatusChange))
+	mux.Handle("POST /admin/accounts/revoke", adminForm.ThenFunc(logged.handleAdminRevoke))
+	mux.Handle("GET /admin/plans", adminForm.ThenFunc(logged.handleAdminPlans))
+	mux.Handle("POST /admin/plans", adminForm.ThenFunc(logged.handleAdminPlanPut))
+	mux.Handle("POST /admin/plans/assign", adminForm.ThenFunc(logged.handleAdminPlanAssign))
+	mux.Handle("GET /admin/tenants", adminForm.ThenFunc(logged.handleAdminTenants))
+	mux.Handle("POST /admin/tenants", adminForm.ThenFunc(logged.handleAdminTenantCreate))
+	mux.Handle("POST /admin/tenants/members", adminForm.ThenFunc(logged.handleAdminMemberAdd))
+	mux.Handle("POST /admin/tenants/members/remove", adminForm.ThenFunc(logged.handleAdminMemberRemove))
 
 	log.Printf("Listening on: %s%s\n", servingSchema, servingAddress)
-	return http.ListenAndServe(servingAddress, mux)
+	// every request of an admin acting as a user is in the audit trail
+	return http.ListenAndServe(servingAddress, impersonation.Recorded(mux))
 }
 
 func handleIndex(w http.ResponseWriter, r *http.Request) {
@@ -64,31 +259,868 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
 	web.Serve(index, w, r)
 }
 
+func handleSecondFactor(w http.ResponseWriter, r *http.Request) {
+	page := web.SecondFactor(nosurf.FormFieldName, nosurf.Token(r), r.URL.Query().Get("next_url"))
+	web.Serve(page, w, r)
+}
+
+func handleEmailSent(w http.ResponseWriter, r *http.Request) {
+	web.Serve(web.EmailSent(), w, r)
+}
+
+func handleImpersonate(w http.ResponseWriter, r *http.Request) {
+	page := web.Impersonate(nosurf.FormFieldName, nosurf.Token(r), r.URL.Query().Get("uid"))
+	web.Serve(page, w, r)
+}
+
+func handleAdminDeletion(w http.ResponseWriter, r *http.Request) {
+	page := web.AdminAccountDeletion(nosurf.FormFieldName, nosurf.Token(r), r.URL.Query().Get("uid"))
+	web.Serve(page, w, r)
+}
+
 type logged struct {
-	jwtDecoder jwt.Decoder
+	jwtDecoder    jwt.Decoder
+	admins        map[tid.UserID]struct{}
+	audit         audit.Log
+	totp          totp.Service
+	impersonation impersonate.Service
+	accounts      accounts.Accounts
+	kicker        accounts.Kicker
+	export        export.Service
 }
 
-func (l logged) handleDashboard(w http.ResponseWriter, r *http.Request) {
+func (l logged) claims(r *http.Request) (jwt.Claims, error) {
 	cookie, err := r.Cookie("Authorization")
 	if err != nil {
-		http.Error(w, "missing cookie", http.StatusUnauthorized)
-		return
+		return jwt.Claims{}, errors.New("missing cookie")
 	}
 	claims, err := l.jwtDecoder.Decode(strings.TrimPrefix(cookie.Value, "Bearer "))
 	if err != nil {
-		http.Error(w, "can't decode authorization cookie: "+err.Error(), http.StatusUnauthorized)
+		return jwt.Claims{}, fmt.Errorf("can't decode authorization cookie: %w", err)
+	}
+	if slices.Contains(claims.Audience, jwt.AudiencePending) {
+		return jwt.Claims{}, errors.New("second factor required")
+	}
+	// download and email links are signed tokens too
+	if !slices.Contains(claims.Audience, jwt.AudienceApp) {
+		return jwt.Claims{}, errors.New("not a session token")
+	}
+	var issuedAt time.Time
+	if claims.IssuedAt != nil {
+		issuedAt = claims.IssuedAt.Time
+	}
+	err = l.accounts.ValidToken(r.Context(), claims.UserID, issuedAt)
+	if err != nil {
+		return jwt.Claims{}, fmt.Errorf("invalid authorization cookie: %w", err)
+	}
+	return claims, nil
+}
+
+func (l logged) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	claims, err := l.claims(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	status, err := l.accounts.Status(r.Context(), claims.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if status.Status != accounts.StatusActive {
+		web.Serve(web.AccountStatus(nosurf.FormFieldName, nosurf.Token(r), status), w, r)
+		return
+	}
+
+	web.Serve(web.Dashboard(nosurf.FormFieldName, nosurf.Token(r), claims), w, r)
+}
+
+func (l logged) handleTOTP(w http.ResponseWriter, r *http.Request) {
+	claims, err := l.claims(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	enabled, err := l.totp.Required(r.Context(), claims.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	web.Serve(web.TOTP(nosurf.FormFieldName, nosurf.Token(r), enabled), w, r)
+}
+
+func (l logged) handleTOTPEnroll(w http.ResponseWriter, r *http.Request) {
+	claims, err := l.claims(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	account := claims.Email
+	if account == "" {
+		account = claims.UserID.String()
+	}
+	enrollment, err := l.totp.Enroll(r.Context(), claims.UserID, account)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	png, err := qrcode.Encode(enrollment.URI, qrcode.Medium, 256)
+	if err != nil {
+		http.Error(w, "encode qr code: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	web.Serve(web.TOTPEnroll(nosurf.FormFieldName, nosurf.Token(r), enrollment, png), w, r)
+}
+
+func (l logged) handleTOTPConfirm(w http.ResponseWriter, r *http.Request) {
+	claims, err := l.claims(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	err = l.totp.Confirm(r.Context(), claims.UserID, r.Form.Get("code"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, "/account/totp", http.StatusSeeOther)
+}
+
+func (l logged) handleTOTPDisable(w http.ResponseWriter, r *http.Request) {
+	claims, err := l.claims(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	err = l.totp.Disable(r.Context(), claims.UserID, r.Form.Get("code"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, "/account/totp", http.StatusSeeOther)
+}
+
+func (l logged) handleProfile(w http.ResponseWriter, r *http.Request) {
+	claims, err := l.claims(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
+	account, err := l.accounts.Get(r.Context(), claims.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	profiles, err := l.accounts.Profiles(r.Context(), claims.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	pins, err := l.accounts.ProfilePins(r.Context(), claims.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	web.Serve(web.Profile(nosurf.FormFieldName, nosurf.Token(r), account, profiles, pins), w, r)
+}
+
+// handleProfilePins pins the providers of the name and the picture, the
+// token keeps the old ones until the next login
+func (l logged) handleProfilePins(w http.ResponseWriter, r *http.Request) {
+	claims, err := l.claims(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	_, err = l.accounts.PinProfile(r.Context(), claims.UserID, accounts.ProfilePins{
+		Name:    r.Form.Get("name"),
+		Picture: r.Form.Get("picture"),
+	})
+	if errors.Is(err, accounts.ErrProfileProvider) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/account/profile", http.StatusSeeOther)
+}
+
+func (l logged) handleDevices(w http.ResponseWriter, r *http.Request) {
+	claims, err := l.claims(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	devices, err := l.accounts.Devices(r.Context(), claims.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	web.Serve(web.Devices(nosurf.FormFieldName, nosurf.Token(r), devices), w, r)
+}
+
+// handleDeviceCreds registers a new device and sends its .creds file. The
+// seed is not stored, so the file can't be downloaded again.
+func (l logged) handleDeviceCreds(w http.ResponseWriter, r *http.Request) {
+	claims, err := l.claims(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	policy, err := devicePolicy(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := r.Form.Get("name")
+	device, creds, err := accounts.NewCreds(claims.UserID, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	device.Policy = policy
+	err = l.accounts.AddDevice(r.Context(), device)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", credsFilename(name)))
+	_, _ = w.Write(creds)
+}
+
+func (l logged) handleDeviceAdd(w http.ResponseWriter, r *http.Request) {
+	claims, err := l.claims(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	policy, err := devicePolicy(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = l.accounts.AddDevice(r.Context(), accounts.Device{
+		PublicKey: strings.TrimSpace(r.Form.Get("public_key")),
+		UserID:    claims.UserID,
+		Name:      r.Form.Get("name"),
+		Policy:    policy,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, "/account/devices", http.StatusSeeOther)
+}
+
+func (l logged) handleDeviceRemove(w http.ResponseWriter, r *http.Request) {
+	claims, err := l.claims(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	err = l.accounts.RemoveDevice(r.Context(), claims.UserID, r.Form.Get("public_key"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// the device is refused already, its live connections are dropped too
+	_, err = l.kicker.Kick(r.Context(), claims.UserID)
+	if err != nil {
+		log.Printf("remove device of %s: %s", claims.UserID, err)
+	}
+	http.Redirect(w, r, "/account/devices", http.StatusSeeOther)
+}
+
+// devicePolicy returns the policy chosen for a new device, nil grants the
+// permissions of users
+func devicePolicy(r *http.Request) (*accounts.Policy, error) {
+	switch r.Form.Get("access") {
+	case "", "full":
+		return nil, nil
+	case "read_only":
+		policy := accounts.ReadOnlyPolicy()
+		return &policy, nil
+	case "scoped":
+		policy, err := accounts.ScopedPolicy(strings.TrimSpace(r.Form.Get("scope")))
+		if err != nil {
+			return nil, err
+		}
+		return &policy, nil
+	default:
+		return nil, fmt.Errorf("unknown access %q", r.Form.Get("access"))
+	}
+}
+
+// credsFilename returns a safe name of the downloaded file
+func credsFilename(name string) string {
+	safe := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+	if safe == "" {
+		safe = "amble"
+	}
+	return safe + ".creds"
+}
+
+func (l logged) handleExport(w http.ResponseWriter, r *http.Request) {
+	claims, err := l.claims(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	jobs, err := l.export.Jobs(r.Context(), claims.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	links := make(map[string]string)
+	for _, job := range jobs {
+		if job.Status != export.StatusReady {
+			continue
+		}
+		links[job.ID], err = l.export.Link(job, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	web.Serve(web.Export(nosurf.FormFieldName, nosurf.Token(r), jobs, links), w, r)
+}
 
-	const rootHTML = `
-<body>
-	<h1>Hello, %s</h1>
-	<p>Authenticated via %s</p>
-	<p>Email address: %s</p>
-	<img src="%s" alt="avatar">
-</body>
-`
-	fmt.Fprintf(w, rootHTML, claims.Name, claims.Issuer, claims.Email, claims.Picture)
+func (l logged) handleExportRequest(w http.ResponseWriter, r *http.Request) {
+	claims, err := l.claims(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	_, err = l.export.Request(r.Context(), claims.UserID, export.Format(r.Form.Get("format")))
+	if errors.Is(err, export.ErrInProgress) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, "/account/export", http.StatusSeeOther)
+}
+
+func (l logged) handleDeletion(w http.ResponseWriter, r *http.Request) {
+	claims, err := l.claims(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	var pending *accounts.Deletion
+	deletion, err := l.accounts.Deletion(r.Context(), claims.UserID)
+	if err == nil {
+		pending = &deletion
+	} else if !errors.Is(err, jetstream.ErrKeyNotFound) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	web.Serve(web.AccountDeletion(nosurf.FormFieldName, nosurf.Token(r), pending), w, r)
+}
+
+// handleDeletionRequest schedules the deletion of the user's own account.
+// Tokens are revoked, so the user is signed out.
+func (l logged) handleDeletionRequest(w http.ResponseWriter, r *http.Request) {
+	claims, err := l.claims(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if r.Form.Get("confirm") != "yes" {
+		http.Error(w, "deletion not confirmed", http.StatusBadRequest)
+		return
+	}
+	deletion, _, err := l.kicker.RequestDeletion(r.Context(), claims.UserID, claims.UserID, accounts.DefaultGracePeriod)
+	if deletion.RequestedAt.IsZero() {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if err != nil {
+		log.Printf("delete account %s: %s", claims.UserID, err)
+	}
+	l.recordEvent(r, audit.DeletionRequest, claims.UserID, "", "erase at "+deletion.EraseAt.Format(time.RFC3339))
+	l.recordEvent(r, audit.Revocation, claims.UserID, "", "deletion request")
+	clearAuthorization(w)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (l logged) handleDeletionCancel(w http.ResponseWriter, r *http.Request) {
+	claims, err := l.claims(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	err = l.accounts.CancelDeletion(r.Context(), claims.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	l.recordEvent(r, audit.DeletionCancel, claims.UserID, "", "")
+	http.Redirect(w, r, "/account/delete", http.StatusSeeOther)
+}
+
+// handleAdminDeletionRequest schedules the deletion of an account or erases
+// it immediately
+func (l logged) handleAdminDeletionRequest(w http.ResponseWriter, r *http.Request) {
+	claims, err := l.claims(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	uid, err := tid.ParseUserID(r.Form.Get("uid"))
+	if err != nil {
+		http.Error(w, "parse uid: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := r.Form.Get("now") == "yes"
+	grace := accounts.DefaultGracePeriod
+	if now {
+		grace = 0
+	}
+	deletion, _, err := l.kicker.RequestDeletion(r.Context(), uid, claims.UserID, grace)
+	if deletion.RequestedAt.IsZero() {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("delete account %s: %s", uid, err)
+	}
+	l.recordEvent(r, audit.DeletionRequest, uid, claims.UserID.String(), "erase at "+deletion.EraseAt.Format(time.RFC3339))
+	l.recordEvent(r, audit.Revocation, uid, claims.UserID.String(), "deletion request")
+	if now {
+		_, err = l.kicker.Erase(r.Context(), uid)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		l.recordEvent(r, audit.Erasure, uid, claims.UserID.String(), "")
+	}
+	http.Redirect(w, r, "/admin/accounts/delete?uid="+uid.String(), http.StatusSeeOther)
+}
+
+func (l logged) handleAdminDeletionCancel(w http.ResponseWriter, r *http.Request) {
+	claims, err := l.claims(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	uid, err := tid.ParseUserID(r.Form.Get("uid"))
+	if err != nil {
+		http.Error(w, "parse uid: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = l.accounts.CancelDeletion(r.Context(), uid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	l.recordEvent(r, audit.DeletionCancel, uid, claims.UserID.String(), "")
+	http.Redirect(w, r, "/admin/accounts/delete?uid="+uid.String(), http.StatusSeeOther)
+}
+
+func (l logged) handleAdminApprovals(w http.ResponseWriter, r *http.Request) {
+	var queue []auth.UserInfo
+	for account, err := range l.accounts.Lister().WithStatus(accounts.StatusPendingApproval).Iter(r.Context()) {
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		queue = append(queue, account)
+	}
+	web.Serve(web.AdminApprovals(nosurf.FormFieldName, nosurf.Token(r), queue), w, r)
+}
+
+func (l logged) handleAdminStatus(w http.ResponseWriter, r *http.Request) {
+	var current *accounts.AccountStatus
+	if s := r.URL.Query().Get("uid"); s != "" {
+		uid, err := tid.ParseUserID(s)
+		if err != nil {
+			http.Error(w, "parse uid: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		status, err := l.accounts.Status(r.Context(), uid)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		current = &status
+	}
+	page := web.AdminAccountStatus(nosurf.FormFieldName, nosurf.Token(r), r.URL.Query().Get("uid"), current)
+	web.Serve(page, w, r)
+}
+
+// handleAdminStatusChange approves, suspends, reactivates or deletes an
+// account if the transition is allowed
+func (l logged) handleAdminStatusChange(w http.ResponseWriter, r *http.Request) {
+	claims, err := l.claims(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	uid, err := tid.ParseUserID(r.Form.Get("uid"))
+	if err != nil {
+		http.Error(w, "parse uid: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	to := accounts.Status(r.Form.Get("status"))
+	previous, err := l.accounts.Status(r.Context(), uid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	status, _, err := l.kicker.Transition(r.Context(), uid, to, r.Form.Get("reason"), claims.UserID)
+	if errors.Is(err, accounts.ErrTransition) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil && status.Status != to {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if err != nil {
+		log.Printf("status of %s: %s", uid, err)
+	}
+	event := audit.FromRequest(r, audit.StatusChange)
+	event.UserID = uid
+	event.Actor = claims.UserID.String()
+	event.Reason = string(previous.Status) + " to " + string(status.Status)
+	if reason := r.Form.Get("reason"); reason != "" {
+		event.Reason += ": " + reason
+	}
+	err = l.audit.Record(r.Context(), event)
+	if err != nil {
+		log.Printf("%s: %s", audit.StatusChange, err)
+	}
+	// the deletion request revokes tokens
+	if status.Status == accounts.StatusDeletionPending && previous.Status != accounts.StatusDeletionPending {
+		l.recordEvent(r, audit.Revocation, uid, claims.UserID.String(), "deletion request")
+	}
+	// the transition to deleted erases the account at once
+	if status.Status == accounts.StatusDeleted && previous.Status != accounts.StatusDeleted {
+		l.recordEvent(r, audit.Erasure, uid, claims.UserID.String(), r.Form.Get("reason"))
+	}
+	if previous.Status == accounts.StatusPendingApproval {
+		http.Redirect(w, r, "/admin/accounts/approvals", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/admin/accounts/status?uid="+uid.String(), http.StatusSeeOther)
+}
+
+func (l logged) handleAdminPlans(w http.ResponseWriter, r *http.Request) {
+	plans, err := l.accounts.Plans(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	web.Serve(web.AdminPlans(nosurf.FormFieldName, nosurf.Token(r), plans), w, r)
+}
+
+// handleAdminPlanPut creates or replaces the plan
+func (l logged) handleAdminPlanPut(w http.ResponseWriter, r *http.Request) {
+	claims, err := l.claims(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	plan := accounts.Plan{
+		Name:            strings.TrimSpace(r.Form.Get("name")),
+		ConnectionTypes: r.Form["connection_type"],
+	}
+	err = l.accounts.PutPlan(r.Context(), plan)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	l.recordEvent(r, audit.PlanPut, tid.UserID{}, claims.UserID.String(), plan.Name+" "+strings.Join(plan.ConnectionTypes, ","))
+	http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+}
+
+// handleAdminPlanAssign assigns the plan to the user, it applies to the next
+// connections
+func (l logged) handleAdminPlanAssign(w http.ResponseWriter, r *http.Request) {
+	claims, err := l.claims(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	uid, err := tid.ParseUserID(strings.TrimSpace(r.Form.Get("uid")))
+	if err != nil {
+		http.Error(w, "parse uid: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := r.Form.Get("plan")
+	err = l.accounts.SetUserPlan(r.Context(), uid, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	l.recordEvent(r, audit.PlanAssign, uid, claims.UserID.String(), name)
+	http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+}
+
+func (l logged) handleAdminTenants(w http.ResponseWriter, r *http.Request) {
+	tenants, err := l.accounts.Tenants(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	members := make(map[tid.TenantID][]tid.UserID, len(tenants))
+	for _, tenant := range tenants {
+		members[tenant.ID], err = l.accounts.Members(r.Context(), tenant.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	web.Serve(web.AdminTenants(nosurf.FormFieldName, nosurf.Token(r), tenants, members), w, r)
+}
+
+// handleAdminTenantCreate creates a tenant placed into an existing NATS
+// account
+func (l logged) handleAdminTenantCreate(w http.ResponseWriter, r *http.Request) {
+	claims, err := l.claims(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	tenant, err := l.accounts.CreateTenant(r.Context(), r.Form.Get("name"), r.Form.Get("account"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	l.recordEvent(r, audit.TenantCreate, tid.UserID{}, claims.UserID.String(), tenant.ID.String()+" "+tenant.Account)
+	http.Redirect(w, r, "/admin/tenants", http.StatusSeeOther)
+}
+
+func (l logged) handleAdminMemberAdd(w http.ResponseWriter, r *http.Request) {
+	l.changeMember(w, r, audit.MemberAdd, l.accounts.AddMember)
+}
+
+func (l logged) handleAdminMemberRemove(w http.ResponseWriter, r *http.Request) {
+	l.changeMember(w, r, audit.MemberRemove, l.accounts.RemoveMember)
+}
+
+func (l logged) changeMember(w http.ResponseWriter, r *http.Request, typ audit.Type, change func(context.Context, tid.TenantID, tid.UserID) error) {
+	claims, err := l.claims(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	id, err := tid.ParseTenantID(r.Form.Get("tenant"))
+	if err != nil {
+		http.Error(w, "parse tenant: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	uid, err := tid.ParseUserID(strings.TrimSpace(r.Form.Get("uid")))
+	if err != nil {
+		http.Error(w, "parse uid: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = change(r.Context(), id, uid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	l.recordEvent(r, typ, uid, claims.UserID.String(), id.String())
+	http.Redirect(w, r, "/admin/tenants", http.StatusSeeOther)
+}
+
+func (l logged) recordEvent(r *http.Request, typ audit.Type, uid tid.UserID, actor, reason string) {
+	event := audit.FromRequest(r, typ)
+	event.UserID = uid
+	event.Actor = actor
+	event.Reason = reason
+	err := l.audit.Record(r.Context(), event)
+	if err != nil {
+		log.Printf("%s: %s", typ, err)
+	}
+}
+
+// eraseDue erases accounts after the grace period until ctx is done
+func eraseDue(ctx context.Context, kicker accounts.Kicker, auditLog audit.Log) {
+	ticker := time.NewTicker(eraseInterval)
+	defer ticker.Stop()
+	for {
+		erased, err := kicker.EraseDue(ctx, time.Now())
+		if err != nil {
+			log.Printf("erase due accounts: %s", err)
+		}
+		for _, uid := range erased {
+			err = auditLog.Record(ctx, audit.Event{Type: audit.Erasure, UserID: uid})
+			if err != nil {
+				log.Printf("%s: %s", audit.Erasure, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func clearAuthorization(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "Authorization",
+		Value:    "",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Path:     "/",
+	})
+}
+
+func (l logged) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if !nosurf.VerifyToken(nosurf.Token(r), r.Form.Get(nosurf.FormFieldName)) {
+		http.Error(w, "CSFR protection failed", http.StatusBadRequest)
+		return
+	}
+	claims, err := l.claims(r)
+	if err == nil {
+		event := audit.FromRequest(r, audit.Logout)
+		event.Provider = claims.Issuer
+		event.Subject = claims.Subject
+		event.UserID = claims.UserID
+		err = l.audit.Record(r.Context(), event)
+		if err != nil {
+			log.Printf("logout: %s", err)
+		}
+	}
+	clearAuthorization(w)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// handleLogoutEverywhere revokes all web tokens of the user including the
+// current one and disconnects its NATS connections
+func (l logged) handleLogoutEverywhere(w http.ResponseWriter, r *http.Request) {
+	claims, err := l.claims(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	_, err = l.kicker.RevokeTokens(r.Context(), claims.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	l.recordEvent(r, audit.Revocation, claims.UserID, "", "log out everywhere")
+	clearAuthorization(w)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// handleAdminRevoke signs the user out of all sessions
+func (l logged) handleAdminRevoke(w http.ResponseWriter, r *http.Request) {
+	claims, err := l.claims(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	uid, err := tid.ParseUserID(r.Form.Get("uid"))
+	if err != nil {
+		http.Error(w, "parse uid: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, err = l.kicker.RevokeTokens(r.Context(), uid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	l.recordEvent(r, audit.Revocation, uid, claims.UserID.String(), "log out everywhere")
+	http.Redirect(w, r, "/admin/accounts/status?uid="+uid.String(), http.StatusSeeOther)
+}
+
+func (l logged) adminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := l.claims(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if _, ok := l.admins[claims.UserID]; !ok || claims.Impersonated() {
+			http.Error(w, "admin only", http.StatusForbidden)
+			return
+		}
+		// a suspended or deleted admin is not an admin anymore
+		err = l.accounts.Admit(r.Context(), claims.UserID, time.Time{})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// activeOnly refuses users of accounts, which are not active, like waiting
+// for an approval or suspended
+func (l logged) activeOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := l.claims(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		// the token was checked by claims already
+		err = l.accounts.Admit(r.Context(), claims.UserID, time.Time{})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (l logged) notImpersonated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := l.claims(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		err = l.impersonation.Refuse(r, claims)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (l logged) handleAudit(w http.ResponseWriter, r *http.Request) {
+	var query audit.Query
+	var err error
+	if uid := r.URL.Query().Get("uid"); uid != "" {
+		query.UserID, err = tid.ParseUserID(uid)
+		if err != nil {
+			http.Error(w, "parse uid: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	query.Since, err = web.ParseTime(r.URL.Query().Get("since"))
+	if err != nil {
+		http.Error(w, "parse since: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	query.Until, err = web.ParseTime(r.URL.Query().Get("until"))
+	if err != nil {
+		http.Error(w, "parse until: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if query.Since.IsZero() && query.Until.IsZero() {
+		query.Since = time.Now().Add(-24 * time.Hour)
+	}
+	query.Limit = 500
+
+	events, err := l.audit.Query(r.Context(), query)
+	if err != nil {
+		http.Error(w, "query audit trail: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	web.Serve(web.Audit(query, events), w, r)
 }
 
 func loadAuthSecrets(credentialsDir string, path string) (auth.Secrets, error) {
@@ -111,6 +1143,19 @@ func loadAuthSecrets(credentialsDir string, path string) (auth.Secrets, error) {
 	return secrets, nil
 }
 
+func loadTOTPSealer(credentialsDir, path string) (totp.Sealer, error) {
+	f, err := os.Open(filepath.Join(credentialsDir, path))
+	if err != nil {
+		return totp.Sealer{}, fmt.Errorf("open secrets file %s: %w", path, err)
+	}
+	defer f.Close()
+	ret, err := totp.LoadSealer(f)
+	if err != nil {
+		return totp.Sealer{}, fmt.Errorf("read from secrets file %s: %w", path, err)
+	}
+	return ret, nil
+}
+
 func loadJWTSecrets(credentialsDir, path string) (jwt.Secret, error) {
 	f, err := os.Open(filepath.Join(credentialsDir, path))
 	if err != nil {
@@ -123,3 +1168,70 @@ func loadJWTSecrets(credentialsDir, path string) (jwt.Secret, error) {
 	}
 	return ret, nil
 }
+
+// connectSys connects to the system account by a json file with `user` and
+// `password` or `creds` relative to credentialsDir. Missing file returns nil.
+func connectSys(credentialsDir, path string) (*nats.Conn, error) {
+	f, err := os.Open(filepath.Join(credentialsDir, path))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("open nats sys file %s: %w", path, err)
+	}
+	defer f.Close()
+	var conf struct {
+		User     string `json:"user"`
+		Password string `json:"password"`
+		Creds    string `json:"creds"`
+	}
+	err = json.NewDecoder(f).Decode(&conf)
+	if err != nil {
+		return nil, fmt.Errorf("decode nats sys from json %s: %w", path, err)
+	}
+	opts := []nats.Option{nats.Name("amble-web-sys")}
+	if conf.Creds != "" {
+		opts = append(opts, nats.UserCredentials(filepath.Join(credentialsDir, conf.Creds)))
+	} else {
+		opts = append(opts, nats.UserInfo(conf.User, conf.Password))
+	}
+	return nats.Connect(natsURL, opts...)
+}
+
+// loadBuckets returns amble buckets with the optional settings of the
+// deployment, see provision.Config
+func loadBuckets(credentialsDir, path string) (provision.Buckets, error) {
+	f, err := os.Open(filepath.Join(credentialsDir, path))
+	if errors.Is(err, os.ErrNotExist) {
+		return provision.Amble(), nil
+	} else if err != nil {
+		return provision.Buckets{}, fmt.Errorf("open buckets file %s: %w", path, err)
+	}
+	defer f.Close()
+	var config provision.Config
+	err = json.NewDecoder(f).Decode(&config)
+	if err != nil {
+		return provision.Buckets{}, fmt.Errorf("decode buckets from json %s: %w", path, err)
+	}
+	return provision.Amble().WithConfig(config)
+}
+
+// loadAdmins reads a json list of admin user ids. Missing file means there are no admins.
+func loadAdmins(credentialsDir, path string) (map[tid.UserID]struct{}, error) {
+	admins := make(map[tid.UserID]struct{})
+	f, err := os.Open(filepath.Join(credentialsDir, path))
+	if errors.Is(err, os.ErrNotExist) {
+		return admins, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("open admins file %s: %w", path, err)
+	}
+	defer f.Close()
+	var uids []tid.UserID
+	err = json.NewDecoder(f).Decode(&uids)
+	if err != nil {
+		return nil, fmt.Errorf("decode admins from json %s: %w", path, err)
+	}
+	for _, uid := range uids {
+		admins[uid] = struct{}{}
+	}
+	return admins, nil
+}
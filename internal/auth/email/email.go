@@ -0,0 +1,375 @@
+/*
+Package email implements a passwordless sign in by a magic link.
+
+ 1. User submits an email address
+ 2. A single use nonce is stored in NATS KV and a link with a short lived JWT
+    signed by amble is sent to the address
+ 3. Clicking on the link verifies the JWT, consumes the nonce and signs the
+    user in via accounts like any other provider
+
+Email addresses are not valid NATS KV keys, so the provider id is a sha256 of
+normalized address, see ID.
+*/
+package email
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	netmail "net/mail"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gomoni/amble/internal/auth"
+	"github.com/gomoni/amble/internal/auth/jwt"
+	"github.com/gomoni/amble/internal/mail"
+	"github.com/gomoni/amble/internal/services/audit"
+	"github.com/gomoni/amble/internal/tid"
+
+	gojwt "github.com/golang-jwt/jwt/v5"
+	"github.com/justinas/nosurf"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	provider     = "email"
+	linkAudience = "email_link"
+	LinkTTL      = 15 * time.Minute
+	// Bucket of the pending links
+	Bucket = "magic_links"
+)
+
+// KeyValueConfig is a configuration of a bucket links are stored in
+func KeyValueConfig() jetstream.KeyValueConfig {
+	return jetstream.KeyValueConfig{
+		Bucket: Bucket,
+		TTL:    LinkTTL,
+	}
+}
+
+// Normalize returns the address in a form used for comparison
+func Normalize(address string) string {
+	return strings.ToLower(strings.TrimSpace(address))
+}
+
+// ID returns the provider id of an email address
+func ID(address string) string {
+	sum := sha256.Sum256([]byte(Normalize(address)))
+	return hex.EncodeToString(sum[:])
+}
+
+type Encoder interface {
+	Encode(jwt.Claims) (string, error)
+}
+
+type Decoder interface {
+	Decode(string) (jwt.Claims, error)
+}
+
+type Accounts interface {
+	SignIn(ctx context.Context, provider, id string, userInfo auth.UserInfo, raw map[string]any) (auth.UserInfo, error)
+}
+
+type Auditor interface {
+	Record(context.Context, audit.Event) error
+}
+
+// SecondFactor completes the login when user has enabled one
+type SecondFactor interface {
+	Required(ctx context.Context, uid tid.UserID) (bool, error)
+	Begin(w http.ResponseWriter, r *http.Request, claims jwt.Claims, redirectURL string)
+}
+
+// Link is stored under the nonce until the link is clicked
+type Link struct {
+	Email       string `json:"email"`
+	RedirectURL string `json:"next,omitempty"`
+}
+
+// Nonces stores pending links, each one can be taken only once
+type Nonces interface {
+	Create(ctx context.Context, nonce string, link Link) error
+	Take(ctx context.Context, nonce string) (Link, error)
+}
+
+type Login struct {
+	origin       string
+	from         string
+	transport    mail.Transport
+	nonces       Nonces
+	accounts     Accounts
+	jwtEncoder   Encoder
+	jwtDecoder   Decoder
+	auditor      Auditor
+	secondFactor SecondFactor
+}
+
+// NewLogin returns a login sending links pointing to origin like http://localhost:8000 from a given address
+func NewLogin(origin, from string, transport mail.Transport, nonces Nonces, accounts Accounts, encoder Encoder, decoder Decoder) Login {
+	return Login{
+		origin:     origin,
+		from:       from,
+		transport:  transport,
+		nonces:     nonces,
+		accounts:   accounts,
+		jwtEncoder: encoder,
+		jwtDecoder: decoder,
+	}
+}
+
+// WithAudit returns a login, which records login success and failures
+func (l Login) WithAudit(auditor Auditor) Login {
+	l.auditor = auditor
+	return l
+}
+
+// WithSecondFactor returns a login, which hands the login over to the second
+// factor if user has one enabled
+func (l Login) WithSecondFactor(secondFactor SecondFactor) Login {
+	l.secondFactor = secondFactor
+	return l
+}
+
+// LoginHandler sends the magic link to the submitted email address
+func (l Login) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	if !nosurf.VerifyToken(nosurf.Token(r), r.Form.Get(nosurf.FormFieldName)) {
+		var reason string
+		nosurfErr := nosurf.Reason(r)
+		if nosurfErr != nil {
+			reason = ": " + nosurfErr.Error()
+		}
+		http.Error(w, "CSFR protection failed"+reason, http.StatusBadRequest)
+		return
+	}
+
+	address, err := netmail.ParseAddress(r.Form.Get("email"))
+	if err != nil {
+		http.Error(w, "invalid email address: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		http.Error(w, "generate nonce: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = l.nonces.Create(r.Context(), nonce, Link{
+		Email:       address.Address,
+		RedirectURL: r.Form.Get("next_url"),
+	})
+	if err != nil {
+		http.Error(w, "store nonce: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	token, err := l.jwtEncoder.Encode(jwt.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "amble",
+			Subject:   ID(address.Address),
+			Audience:  []string{linkAudience},
+			ExpiresAt: gojwt.NewNumericDate(time.Now().Add(LinkTTL)),
+			NotBefore: gojwt.NewNumericDate(time.Now()),
+			IssuedAt:  gojwt.NewNumericDate(time.Now()),
+			ID:        nonce,
+		},
+		UserInfo: auth.UserInfo{
+			Email: address.Address,
+		},
+	})
+	if err != nil {
+		http.Error(w, "encode JWT: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	link := l.origin + "/auth/email/callback?token=" + url.QueryEscape(token)
+	err = l.transport.Send(r.Context(), mail.Message{
+		From:    l.from,
+		To:      address.Address,
+		Subject: "Sign in to Amble.app",
+		Body: "Click the link below to sign in to Amble.app\n\n" + link +
+			"\n\nThe link is valid for " + LinkTTL.String() + " and can be used only once." +
+			"\nIf you did not ask for it, you can ignore this email.\n",
+	})
+	if err != nil {
+		http.Error(w, "send email: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/auth/email/sent", http.StatusSeeOther)
+}
+
+// CallbackHandler verifies the link, signs the user in and sets the Authorization cookie
+func (l Login) CallbackHandler(w http.ResponseWriter, r *http.Request) {
+	linkClaims, err := l.jwtDecoder.Decode(r.URL.Query().Get("token"))
+	if err != nil {
+		l.fail(w, r, "invalid link: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if !slices.Contains(linkClaims.Audience, linkAudience) {
+		l.fail(w, r, "invalid link: not a sign in link", http.StatusUnauthorized)
+		return
+	}
+	link, err := l.nonces.Take(r.Context(), linkClaims.ID)
+	if err != nil {
+		l.fail(w, r, "invalid link: already used or expired", http.StatusUnauthorized)
+		return
+	}
+	if Normalize(link.Email) != Normalize(linkClaims.Email) {
+		l.fail(w, r, "invalid link: email does not match", http.StatusUnauthorized)
+		return
+	}
+
+	id := ID(link.Email)
+	name, _, _ := strings.Cut(link.Email, "@")
+	account, err := l.accounts.SignIn(
+		r.Context(),
+		provider,
+		id,
+		auth.UserInfo{Name: name, Email: link.Email, EmailVerified: true},
+		map[string]any{"email": link.Email, "email_verified": true},
+	)
+	if errors.Is(err, auth.ErrEmailTaken) {
+		l.fail(w, r, auth.EmailTakenMessage, http.StatusConflict)
+		return
+	} else if err != nil {
+		l.fail(w, r, "sign in email account: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// allow local redirects only
+	redirectURL := link.RedirectURL
+	if !strings.HasPrefix(redirectURL, "/") || strings.HasPrefix(redirectURL, "//") {
+		redirectURL = "/dashboard"
+	}
+
+	claims := Claims(id, account)
+	if l.secondFactor != nil {
+		required, err := l.secondFactor.Required(r.Context(), account.UserID)
+		if err != nil {
+			l.fail(w, r, "check second factor: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if required {
+			l.secondFactor.Begin(w, r, claims, redirectURL)
+			return
+		}
+	}
+
+	jwtToken, err := l.jwtEncoder.Encode(claims)
+	if err != nil {
+		l.fail(w, r, "encode JWT: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	event := audit.FromRequest(r, audit.LoginSuccess)
+	event.Provider = provider
+	event.Subject = id
+	event.UserID = account.UserID
+	l.record(r.Context(), event)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "Authorization",
+		Value:    "Bearer " + jwtToken,
+		Expires:  time.Now().Add(24 * time.Hour),
+		HttpOnly: true,
+		Secure:   false, // Use secure cookies in production
+		Path:     "/",
+	})
+	http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+}
+
+// Claims returns the claims of an email login
+func Claims(id string, userInfo auth.UserInfo) jwt.Claims {
+	return jwt.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    provider,
+			Subject:   id,
+			Audience:  []string{jwt.AudienceApp},
+			ExpiresAt: gojwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
+			NotBefore: gojwt.NewNumericDate(time.Now()),
+			IssuedAt:  gojwt.NewNumericDate(time.Now()),
+			ID:        "jti",
+		},
+		UserInfo: userInfo,
+		AMR:      []string{provider},
+	}
+}
+
+// fail records the failed login and replies with an error
+func (l Login) fail(w http.ResponseWriter, r *http.Request, reason string, code int) {
+	event := audit.FromRequest(r, audit.LoginFailure)
+	event.Provider = provider
+	event.Reason = reason
+	l.record(r.Context(), event)
+	http.Error(w, reason, code)
+}
+
+func (l Login) record(ctx context.Context, event audit.Event) {
+	if l.auditor == nil {
+		return
+	}
+	err := l.auditor.Record(ctx, event)
+	if err != nil {
+		log.Printf("[email.Login]: %s", err)
+	}
+}
+
+func newNonce() (string, error) {
+	var buf [16]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
+
+// NatsNonces stores the nonces in `magic_link.$nonce` keys. The bucket
+// is expected to have a TTL, so unused links expire.
+type NatsNonces struct {
+	kv jetstream.KeyValue
+}
+
+func NewNatsNonces(kv jetstream.KeyValue) NatsNonces {
+	return NatsNonces{kv: kv}
+}
+
+func (n NatsNonces) Create(ctx context.Context, nonce string, link Link) error {
+	b, err := json.Marshal(link)
+	if err != nil {
+		return fmt.Errorf("nonce create: marshal link: %w", err)
+	}
+	_, err = n.kv.Create(ctx, "magic_link."+nonce, b)
+	if err != nil {
+		return fmt.Errorf("nonce create: %w", err)
+	}
+	return nil
+}
+
+// Take returns the link and deletes the nonce. Deleting with the last revision
+// ensures the nonce is taken only once even by concurrent requests.
+func (n NatsNonces) Take(ctx context.Context, nonce string) (Link, error) {
+	key := "magic_link." + nonce
+	entry, err := n.kv.Get(ctx, key)
+	if err != nil {
+		return Link{}, fmt.Errorf("nonce take: %w", err)
+	}
+	err = n.kv.Purge(ctx, key, jetstream.LastRevision(entry.Revision()))
+	if err != nil {
+		return Link{}, fmt.Errorf("nonce take: %w", err)
+	}
+	var link Link
+	err = json.Unmarshal(entry.Value(), &link)
+	if err != nil {
+		return Link{}, fmt.Errorf("nonce take: unmarshal link: %w", err)
+	}
+	if link.Email == "" {
+		return Link{}, errors.New("nonce take: empty link")
+	}
+	return link, nil
+}
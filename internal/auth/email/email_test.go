@@ -0,0 +1,210 @@
+package email_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gomoni/amble/internal/auth"
+	"github.com/gomoni/amble/internal/auth/email"
+	"github.com/gomoni/amble/internal/auth/jwt"
+	"github.com/gomoni/amble/internal/mail"
+	"github.com/gomoni/amble/internal/test"
+	"github.com/gomoni/amble/internal/tid"
+	"github.com/justinas/alice"
+	"github.com/justinas/nosurf"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmailLogin(t *testing.T) {
+	var buf [ed25519.SeedSize]byte
+	_, err := rand.Read(buf[:])
+	require.NoError(t, err)
+	secret, err := jwt.LoadSecret(bytes.NewReader(buf[:]))
+	require.NoError(t, err)
+	encoder := jwt.NewEncoder(secret)
+	decoder := jwt.NewDecoder(secret.Public())
+
+	transport := mail.NewMemory()
+	accounts := &accountsMock{}
+	login := email.NewLogin(
+		"http://localhost:8000",
+		"noreply@amble.example.net",
+		transport,
+		newNonces(),
+		accounts,
+		encoder,
+		decoder,
+	)
+
+	// given a CSRF protection cookie exists
+	csrfMW := alice.New(nosurf.NewPure)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	var requestToken string
+	csrfMW.ThenFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestToken = nosurf.Token(r)
+	}).ServeHTTP(w, r)
+	cookies := w.Result().Cookies()
+
+	sendLink := func() []string {
+		t.Helper()
+		form := url.Values{}
+		form.Set("email", "Cat@Octocat.example.net")
+		form.Set("next_url", "/dashboard")
+		form.Set(nosurf.FormFieldName, requestToken)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/auth/email/login", strings.NewReader(form.Encode()))
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		csrfMW.ThenFunc(login.LoginHandler).ServeHTTP(w, r)
+		require.Equal(t, http.StatusSeeOther, w.Code, w.Body.String())
+		messages := transport.Messages()
+		link := regexp.MustCompile(`http://localhost:8000(/auth/email/callback\?token=\S+)`).FindStringSubmatch(messages[len(messages)-1].Body)
+		require.Len(t, link, 2)
+		return link
+	}
+
+	// when user submits an email address
+	link := sendLink()
+
+	// then the link is sent
+	messages := transport.Messages()
+	require.Len(t, messages, 1)
+	require.Equal(t, "Cat@Octocat.example.net", messages[0].To)
+
+	// when the link is clicked
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, link[1], nil)
+	login.CallbackHandler(w, r)
+
+	// then user is signed in
+	require.Equal(t, http.StatusSeeOther, w.Code, w.Body.String())
+	require.Equal(t, "/dashboard", w.Header().Get("Location"))
+	var token string
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "Authorization" {
+			token = strings.TrimPrefix(cookie.Value, "Bearer ")
+		}
+	}
+	claims, err := decoder.Decode(token)
+	require.NoError(t, err)
+	require.Equal(t, "email", claims.Issuer)
+	require.Equal(t, email.ID("cat@octocat.example.net"), claims.Subject)
+	require.Equal(t, accounts.uid, claims.UserID)
+	require.Equal(t, email.ID("cat@octocat.example.net"), accounts.id)
+
+	// when the link is clicked again
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, link[1], nil)
+	login.CallbackHandler(w, r)
+
+	// then it is refused
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// when the email belongs to another account
+	accounts.err = fmt.Errorf("account sign in: %w", auth.ErrEmailTaken)
+	link = sendLink()
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, link[1], nil)
+	login.CallbackHandler(w, r)
+
+	// then it is a conflict without the internal error
+	require.Equal(t, http.StatusConflict, w.Code)
+	require.Equal(t, auth.EmailTakenMessage+"\n", w.Body.String())
+}
+
+func TestNatsNonces(t *testing.T) {
+	server, err := test.NewNatsContainer(context.Background(), test.NatsContainerOpts{})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := server.Terminate()
+		require.NoError(t, err)
+	})
+
+	nc, err := nats.Connect(server.Endpoint())
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	js, err := jetstream.New(nc)
+	require.NoError(t, err)
+	kv, err := js.CreateKeyValue(ctx, email.KeyValueConfig())
+	require.NoError(t, err)
+	nonces := email.NewNatsNonces(kv)
+
+	link := email.Link{Email: "cat@octocat.example.net", RedirectURL: "/dashboard"}
+	err = nonces.Create(ctx, "c0ffee", link)
+	require.NoError(t, err)
+
+	taken, err := nonces.Take(ctx, "c0ffee")
+	require.NoError(t, err)
+	require.Equal(t, link, taken)
+
+	_, err = nonces.Take(ctx, "c0ffee")
+	require.Error(t, err)
+}
+
+type accountsMock struct {
+	uid tid.UserID
+	id  string
+	err error
+}
+
+func (a *accountsMock) SignIn(_ context.Context, provider, id string, userInfo auth.UserInfo, raw map[string]any) (auth.UserInfo, error) {
+	if a.err != nil {
+		return auth.UserInfo{}, a.err
+	}
+	if provider != "email" || raw["email_verified"] != true {
+		return auth.UserInfo{}, errors.New("unexpected sign in")
+	}
+	uid, err := tid.NewUserID()
+	if err != nil {
+		return auth.UserInfo{}, err
+	}
+	a.uid = uid
+	a.id = id
+	userInfo.UserID = uid
+	return userInfo, nil
+}
+
+type nonces struct {
+	mu sync.Mutex
+	m  map[string]email.Link
+}
+
+func newNonces() *nonces {
+	return &nonces{m: make(map[string]email.Link)}
+}
+
+func (n *nonces) Create(_ context.Context, nonce string, link email.Link) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.m[nonce] = link
+	return nil
+}
+
+func (n *nonces) Take(_ context.Context, nonce string) (email.Link, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	link, ok := n.m[nonce]
+	if !ok {
+		return email.Link{}, errors.New("not found")
+	}
+	delete(n.m, nonce)
+	return link, nil
+}
@@ -1,7 +1,9 @@
 package github
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -11,6 +13,8 @@ import (
 
 	"github.com/gomoni/amble/internal/auth"
 	"github.com/gomoni/amble/internal/auth/jwt"
+	"github.com/gomoni/amble/internal/services/audit"
+	"github.com/gomoni/amble/internal/tid"
 
 	gojwt "github.com/golang-jwt/jwt/v5"
 	"github.com/justinas/nosurf"
@@ -24,9 +28,27 @@ type Encoder interface {
 	Encode(jwt.Claims) (string, error)
 }
 
+// Accounts links the github login with an amble account
+type Accounts interface {
+	SignIn(ctx context.Context, provider, id string, userInfo auth.UserInfo, raw map[string]any) (auth.UserInfo, error)
+}
+
+type Auditor interface {
+	Record(context.Context, audit.Event) error
+}
+
+// SecondFactor completes the login when user has enabled one
+type SecondFactor interface {
+	Required(ctx context.Context, uid tid.UserID) (bool, error)
+	Begin(w http.ResponseWriter, r *http.Request, claims jwt.Claims, redirectURL string)
+}
+
 type Login struct {
-	conf       auth.OAuth2
-	jwtEncoder Encoder
+	conf         auth.OAuth2
+	jwtEncoder   Encoder
+	accounts     Accounts
+	auditor      Auditor
+	secondFactor SecondFactor
 }
 
 func NewLogin(conf auth.OAuth2, encoder Encoder) Login {
@@ -48,6 +70,26 @@ func NewFromSecrets(secrets auth.Secrets, encoder Encoder) Login {
 	}
 }
 
+// WithAccounts returns a login, which signs in the amble account linked with
+// github user
+func (gh Login) WithAccounts(accounts Accounts) Login {
+	gh.accounts = accounts
+	return gh
+}
+
+// WithAudit returns a login, which records login success and failures
+func (gh Login) WithAudit(auditor Auditor) Login {
+	gh.auditor = auditor
+	return gh
+}
+
+// WithSecondFactor returns a login, which hands the login over to the second
+// factor if user has one enabled
+func (gh Login) WithSecondFactor(secondFactor SecondFactor) Login {
+	gh.secondFactor = secondFactor
+	return gh
+}
+
 func (gh Login) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	if !nosurf.VerifyToken(nosurf.Token(r), r.Form.Get(nosurf.FormFieldName)) {
 		var reason string
@@ -77,7 +119,7 @@ func (gh Login) CallbackHandler(w http.ResponseWriter, r *http.Request) {
 	var state auth.State
 	err := state.Decode(r.URL.Query().Get("state"))
 	if err != nil {
-		http.Error(w, "decoding state parameter from authentication system: "+err.Error(), http.StatusInternalServerError)
+		gh.fail(w, r, "decoding state parameter from authentication system: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -87,50 +129,79 @@ func (gh Login) CallbackHandler(w http.ResponseWriter, r *http.Request) {
 		if nosurfErr != nil {
 			reason = ": " + nosurfErr.Error()
 		}
-		http.Error(w, "CSFR protection failed"+reason, http.StatusBadRequest)
+		gh.fail(w, r, "CSFR protection failed"+reason, http.StatusBadRequest)
 		return
 	}
 
 	code := r.URL.Query().Get("code")
 	tok, err := gh.conf.Exchange(r.Context(), code)
 	if err != nil {
-		http.Error(w, "code exchange failed: "+err.Error(), http.StatusInternalServerError)
+		gh.fail(w, r, "code exchange failed: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	log.Printf("GitHub token: %v", tok)
 
 	// This client will have a bearer token to access the GitHub API on
 	// the user's behalf.
 	client := gh.conf.Client(r.Context(), tok)
 	resp, err := client.Get(userInfoEndpoint)
 	if err != nil {
-		http.Error(w, "get user info: "+err.Error(), http.StatusInternalServerError)
+		gh.fail(w, r, "get user info: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 	respbody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		http.Error(w, "read user info: "+err.Error(), http.StatusInternalServerError)
+		gh.fail(w, r, "read user info: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 	var userInfo map[string]any
 	err = json.Unmarshal(respbody, &userInfo)
 	if err != nil {
-		http.Error(w, "parse user info: "+err.Error(), http.StatusInternalServerError)
+		gh.fail(w, r, "parse user info: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	claims, err := Claims(userInfo)
 	if err != nil {
-		http.Error(w, "convert github user info to claims: "+err.Error(), http.StatusInternalServerError)
+		gh.fail(w, r, "convert github user info to claims: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	if gh.accounts != nil {
+		account, err := gh.accounts.SignIn(r.Context(), "github", claims.Subject, claims.UserInfo, userInfo)
+		if errors.Is(err, auth.ErrEmailTaken) {
+			gh.fail(w, r, auth.EmailTakenMessage, http.StatusConflict)
+			return
+		} else if err != nil {
+			gh.fail(w, r, "sign in github account: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		claims.UserInfo = account
+	}
+
+	if gh.secondFactor != nil && !claims.UserID.IsZero() {
+		required, err := gh.secondFactor.Required(r.Context(), claims.UserID)
+		if err != nil {
+			gh.fail(w, r, "check second factor: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if required {
+			gh.secondFactor.Begin(w, r, claims, state.RedirectURL)
+			return
+		}
+	}
+
 	jwtToken, err := gh.jwtEncoder.Encode(claims)
 	if err != nil {
-		http.Error(w, "encode JWT: "+err.Error(), http.StatusInternalServerError)
+		gh.fail(w, r, "encode JWT: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	event := audit.FromRequest(r, audit.LoginSuccess)
+	event.Provider = "github"
+	event.Subject = claims.Subject
+	event.UserID = claims.UserID
+	gh.record(r.Context(), event)
+
 	http.SetCookie(w, &http.Cookie{
 		Name:     "Authorization",
 		Value:    "Bearer " + jwtToken,
@@ -149,6 +220,25 @@ func (gh Login) CallbackHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// fail records the failed login and replies with an error
+func (gh Login) fail(w http.ResponseWriter, r *http.Request, reason string, code int) {
+	event := audit.FromRequest(r, audit.LoginFailure)
+	event.Provider = "github"
+	event.Reason = reason
+	gh.record(r.Context(), event)
+	http.Error(w, reason, code)
+}
+
+func (gh Login) record(ctx context.Context, event audit.Event) {
+	if gh.auditor == nil {
+		return
+	}
+	err := gh.auditor.Record(ctx, event)
+	if err != nil {
+		log.Printf("[github.Login]: %s", err)
+	}
+}
+
 func Claims(userInfo map[string]any) (claims jwt.Claims, err error) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -170,7 +260,7 @@ func Claims(userInfo map[string]any) (claims jwt.Claims, err error) {
 		RegisteredClaims: jwt.RegisteredClaims{
 			Issuer:    "github",
 			Subject:   strconv.Itoa(smap.MustInt("id")),
-			Audience:  []string{"app"},
+			Audience:  []string{jwt.AudienceApp},
 			ExpiresAt: gojwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
 			NotBefore: gojwt.NewNumericDate(time.Now()),
 			IssuedAt:  gojwt.NewNumericDate(time.Now()),
@@ -181,6 +271,9 @@ func Claims(userInfo map[string]any) (claims jwt.Claims, err error) {
 			Email:   smap.MustString("email"),
 			Picture: smap.MustString("avatar_url"),
 		},
+		AMR: []string{"github"},
 	}
+	// only a verified email can be the public email of a github user
+	claims.EmailVerified = claims.Email != ""
 	return
 }
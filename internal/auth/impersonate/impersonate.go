@@ -0,0 +1,268 @@
+/*
+Package impersonate lets admins see the application as a given user.
+
+The admin gets a short lived token for the target user with an act claim
+naming the admin (RFC 8693). The original admin token is kept aside in a
+separate cookie and restored when the impersonation stops. Handlers changing
+keys or credentials must refuse impersonated tokens, see Refuse. Recorded
+puts every request of the admin into the audit trail and the claims into the
+request context, so pages can show a banner.
+*/
+package impersonate
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gomoni/amble/internal/auth"
+	"github.com/gomoni/amble/internal/auth/jwt"
+	"github.com/gomoni/amble/internal/services/audit"
+	"github.com/gomoni/amble/internal/tid"
+
+	gojwt "github.com/golang-jwt/jwt/v5"
+	"github.com/justinas/nosurf"
+)
+
+const (
+	// Issuer of impersonation tokens, the subject is the target user id
+	Issuer = "impersonation"
+	// TTL is how long can admin act as the user
+	TTL = 30 * time.Minute
+
+	adminCookie = "Authorization_admin"
+)
+
+type Encoder interface {
+	Encode(jwt.Claims) (string, error)
+}
+
+type Decoder interface {
+	Decode(string) (jwt.Claims, error)
+}
+
+type Accounts interface {
+	Get(ctx context.Context, uid tid.UserID) (auth.UserInfo, error)
+}
+
+type Auditor interface {
+	Record(context.Context, audit.Event) error
+}
+
+type Service struct {
+	accounts   Accounts
+	jwtEncoder Encoder
+	jwtDecoder Decoder
+	auditor    Auditor
+}
+
+func NewService(accounts Accounts, encoder Encoder, decoder Decoder) Service {
+	return Service{
+		accounts:   accounts,
+		jwtEncoder: encoder,
+		jwtDecoder: decoder,
+	}
+}
+
+// WithAudit returns a service, which records start and stop of impersonations
+func (s Service) WithAudit(auditor Auditor) Service {
+	s.auditor = auditor
+	return s
+}
+
+// Claims returns the claims of the target user acted by the admin
+func Claims(admin jwt.Claims, target auth.UserInfo, now time.Time) jwt.Claims {
+	return jwt.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    Issuer,
+			Subject:   target.UserID.String(),
+			Audience:  []string{jwt.AudienceApp},
+			ExpiresAt: gojwt.NewNumericDate(now.Add(TTL)),
+			NotBefore: gojwt.NewNumericDate(now),
+			IssuedAt:  gojwt.NewNumericDate(now),
+		},
+		UserInfo: target,
+		Act: &jwt.Actor{
+			UserID: admin.UserID,
+			Name:   admin.Name,
+		},
+	}
+}
+
+// StartHandler issues an impersonation token for the uid form value. The
+// caller must ensure the request comes from an admin.
+func (s Service) StartHandler(w http.ResponseWriter, r *http.Request) {
+	if !nosurf.VerifyToken(nosurf.Token(r), r.Form.Get(nosurf.FormFieldName)) {
+		http.Error(w, "CSFR protection failed", http.StatusBadRequest)
+		return
+	}
+	cookie, err := r.Cookie("Authorization")
+	if err != nil {
+		http.Error(w, "missing cookie", http.StatusUnauthorized)
+		return
+	}
+	admin, err := s.jwtDecoder.Decode(strings.TrimPrefix(cookie.Value, "Bearer "))
+	if err != nil {
+		http.Error(w, "can't decode authorization cookie: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if admin.Impersonated() {
+		http.Error(w, "already impersonating", http.StatusForbidden)
+		return
+	}
+	uid, err := tid.ParseUserID(r.Form.Get("uid"))
+	if err != nil {
+		http.Error(w, "parse uid: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if uid == admin.UserID {
+		http.Error(w, "can't impersonate yourself", http.StatusBadRequest)
+		return
+	}
+	target, err := s.accounts.Get(r.Context(), uid)
+	if err != nil {
+		http.Error(w, "get user: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	target.UserID = uid
+
+	now := time.Now()
+	token, err := s.jwtEncoder.Encode(Claims(admin, target, now))
+	if err != nil {
+		http.Error(w, "encode JWT: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	event := audit.FromRequest(r, audit.ImpersonationStart)
+	event.Provider = Issuer
+	event.Subject = uid.String()
+	event.UserID = uid
+	event.Actor = admin.UserID.String()
+	s.record(r.Context(), event)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     adminCookie,
+		Value:    cookie.Value,
+		Expires:  now.Add(TTL),
+		HttpOnly: true,
+		Secure:   false, // Use secure cookies in production
+		Path:     "/",
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     "Authorization",
+		Value:    "Bearer " + token,
+		Expires:  now.Add(TTL),
+		HttpOnly: true,
+		Secure:   false, // Use secure cookies in production
+		Path:     "/",
+	})
+	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+}
+
+// StopHandler ends the impersonation and restores the admin token if it is
+// still valid
+func (s Service) StopHandler(w http.ResponseWriter, r *http.Request) {
+	if !nosurf.VerifyToken(nosurf.Token(r), r.Form.Get(nosurf.FormFieldName)) {
+		http.Error(w, "CSFR protection failed", http.StatusBadRequest)
+		return
+	}
+	if cookie, err := r.Cookie("Authorization"); err == nil {
+		claims, err := s.jwtDecoder.Decode(strings.TrimPrefix(cookie.Value, "Bearer "))
+		if err == nil && claims.Impersonated() {
+			event := audit.FromRequest(r, audit.ImpersonationStop)
+			event.Provider = Issuer
+			event.Subject = claims.Subject
+			event.UserID = claims.UserID
+			event.Actor = claims.Act.UserID.String()
+			s.record(r.Context(), event)
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:   adminCookie,
+		MaxAge: -1,
+		Path:   "/",
+	})
+	redirectURL := "/"
+	authorization := &http.Cookie{
+		Name:     "Authorization",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   false, // Use secure cookies in production
+		Path:     "/",
+	}
+	if cookie, err := r.Cookie(adminCookie); err == nil {
+		_, err := s.jwtDecoder.Decode(strings.TrimPrefix(cookie.Value, "Bearer "))
+		if err == nil {
+			authorization.Value = cookie.Value
+			authorization.MaxAge = 0
+			authorization.Expires = time.Now().Add(24 * time.Hour)
+			redirectURL = "/dashboard"
+		}
+	}
+	http.SetCookie(w, authorization)
+	http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+}
+
+// ErrImpersonated is returned for actions not allowed while impersonating
+var ErrImpersonated = errors.New("not allowed while impersonating a user")
+
+// Refuse returns ErrImpersonated for impersonated claims and records the
+// refused attempt
+func (s Service) Refuse(r *http.Request, claims jwt.Claims) error {
+	if !claims.Impersonated() {
+		return nil
+	}
+	event := audit.FromRequest(r, audit.ImpersonationRefused)
+	event.Provider = Issuer
+	event.Subject = claims.Subject
+	event.UserID = claims.UserID
+	event.Actor = claims.Act.UserID.String()
+	event.Reason = r.Method + " " + r.URL.Path
+	s.record(r.Context(), event)
+	return ErrImpersonated
+}
+
+type claimsKey struct{}
+
+// FromContext returns the claims of an admin acting as a user passed by
+// Recorded
+func FromContext(ctx context.Context) (jwt.Claims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(jwt.Claims)
+	return claims, ok
+}
+
+// Recorded returns a handler, which records every request of an admin acting
+// as a user with the method and the path as the reason. The claims are passed
+// in the request context, see FromContext.
+func (s Service) Recorded(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie("Authorization"); err == nil {
+			claims, err := s.jwtDecoder.Decode(strings.TrimPrefix(cookie.Value, "Bearer "))
+			if err == nil && claims.Impersonated() {
+				event := audit.FromRequest(r, audit.ImpersonationAction)
+				event.Provider = Issuer
+				event.Subject = claims.Subject
+				event.UserID = claims.UserID
+				event.Actor = claims.Act.UserID.String()
+				event.Reason = r.Method + " " + r.URL.Path
+				s.record(r.Context(), event)
+				r = r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s Service) record(ctx context.Context, event audit.Event) {
+	if s.auditor == nil {
+		return
+	}
+	err := s.auditor.Record(ctx, event)
+	if err != nil {
+		log.Printf("[impersonate.Service]: %s", err)
+	}
+}
@@ -0,0 +1,155 @@
+package impersonate_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gomoni/amble/internal/auth"
+	"github.com/gomoni/amble/internal/auth/impersonate"
+	"github.com/gomoni/amble/internal/auth/jwt"
+	"github.com/gomoni/amble/internal/services/audit"
+	"github.com/gomoni/amble/internal/tid"
+	"github.com/justinas/alice"
+	"github.com/justinas/nosurf"
+
+	gojwt "github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImpersonate(t *testing.T) {
+	var buf [ed25519.SeedSize]byte
+	_, err := rand.Read(buf[:])
+	require.NoError(t, err)
+	secret, err := jwt.LoadSecret(bytes.NewReader(buf[:]))
+	require.NoError(t, err)
+	encoder := jwt.NewEncoder(secret)
+	decoder := jwt.NewDecoder(secret.Public())
+
+	adminID, err := tid.NewUserID()
+	require.NoError(t, err)
+	octocatID, err := tid.NewUserID()
+	require.NoError(t, err)
+	accounts := accountsMock{octocatID: {Name: "Octocat"}}
+	auditor := &auditMock{}
+	service := impersonate.NewService(accounts, encoder, decoder).WithAudit(auditor)
+
+	// given an admin is logged in
+	adminToken, err := encoder.Encode(jwt.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "github",
+			Subject:   "583231",
+			Audience:  []string{"app"},
+			ExpiresAt: gojwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+		UserInfo: auth.UserInfo{UserID: adminID, Name: "Admin"},
+	})
+	require.NoError(t, err)
+	csrfMW := alice.New(nosurf.NewPure)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/admin/impersonate", nil)
+	var requestToken string
+	csrfMW.ThenFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestToken = nosurf.Token(r)
+	}).ServeHTTP(w, r)
+	cookies := append(w.Result().Cookies(), &http.Cookie{Name: "Authorization", Value: "Bearer " + adminToken})
+
+	post := func(path string, handler http.HandlerFunc, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		form := url.Values{}
+		form.Set("uid", octocatID.String())
+		form.Set(nosurf.FormFieldName, requestToken)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		csrfMW.ThenFunc(handler).ServeHTTP(w, r)
+		return w
+	}
+
+	// when admin starts to view as octocat
+	w = post("/admin/impersonate", service.StartHandler, cookies)
+
+	// then the token for octocat names the admin
+	require.Equal(t, http.StatusSeeOther, w.Code, w.Body.String())
+	impersonated := cookieMap(w.Result().Cookies())
+	require.Equal(t, "Bearer "+adminToken, impersonated["Authorization_admin"])
+	claims, err := decoder.Decode(strings.TrimPrefix(impersonated["Authorization"], "Bearer "))
+	require.NoError(t, err)
+	require.Equal(t, impersonate.Issuer, claims.Issuer)
+	require.Equal(t, octocatID, claims.UserID)
+	require.Equal(t, "Octocat", claims.Name)
+	require.True(t, claims.Impersonated())
+	require.Equal(t, adminID, claims.Act.UserID)
+	require.WithinDuration(t, time.Now().Add(impersonate.TTL), claims.ExpiresAt.Time, 5*time.Second)
+
+	// and dangerous actions are refused
+	r = httptest.NewRequest(http.MethodPost, "/account/totp/enroll", nil)
+	require.ErrorIs(t, service.Refuse(r, claims), impersonate.ErrImpersonated)
+
+	// and the pages viewed as octocat are recorded
+	r = httptest.NewRequest(http.MethodGet, "/account/devices", nil)
+	r.AddCookie(&http.Cookie{Name: "Authorization", Value: impersonated["Authorization"]})
+	service.Recorded(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), r)
+	require.Equal(t, "GET /account/devices", auditor.events[len(auditor.events)-1].Reason)
+
+	// when admin stops
+	var stopCookies []*http.Cookie
+	for _, cookie := range cookies {
+		if cookie.Name != "Authorization" {
+			stopCookies = append(stopCookies, cookie)
+		}
+	}
+	for _, cookie := range w.Result().Cookies() {
+		stopCookies = append(stopCookies, cookie)
+	}
+	w = post("/auth/impersonate/stop", service.StopHandler, stopCookies)
+
+	// then admin token is restored
+	require.Equal(t, http.StatusSeeOther, w.Code, w.Body.String())
+	require.Equal(t, "Bearer "+adminToken, cookieMap(w.Result().Cookies())["Authorization"])
+
+	// and everything is in the audit trail
+	require.Len(t, auditor.events, 4)
+	for i, typ := range []audit.Type{audit.ImpersonationStart, audit.ImpersonationRefused, audit.ImpersonationAction, audit.ImpersonationStop} {
+		require.Equal(t, typ, auditor.events[i].Type)
+		require.Equal(t, octocatID, auditor.events[i].UserID)
+		require.Equal(t, adminID.String(), auditor.events[i].Actor)
+	}
+}
+
+func cookieMap(cookies []*http.Cookie) map[string]string {
+	m := make(map[string]string, len(cookies))
+	for _, cookie := range cookies {
+		m[cookie.Name] = cookie.Value
+	}
+	return m
+}
+
+type accountsMock map[tid.UserID]auth.UserInfo
+
+func (a accountsMock) Get(_ context.Context, uid tid.UserID) (auth.UserInfo, error) {
+	info, ok := a[uid]
+	if !ok {
+		return auth.UserInfo{}, errors.New("not found")
+	}
+	return info, nil
+}
+
+type auditMock struct {
+	events []audit.Event
+}
+
+func (a *auditMock) Record(_ context.Context, e audit.Event) error {
+	a.events = append(a.events, e)
+	return nil
+}
@@ -3,15 +3,40 @@ package jwt
 import (
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/gomoni/amble/internal/auth"
+	"github.com/gomoni/amble/internal/tid"
 )
 
 type RegisteredClaims = jwt.RegisteredClaims
 
+// AudiencePending is an audience of a token issued after the first factor
+// only. Such token must not be accepted as a session.
+const AudiencePending = "mfa"
+
+// AudienceApp is an audience of a session token, tokens of other audiences
+// like links sent by email must not be accepted as a session
+const AudienceApp = "app"
+
 // Claims is a standard JWT claims with and a few stuff from OpenID Connect https://openid.net/specs/openid-connect-core-1_0.html#StandardClaims
 // simplifying an usage
 type Claims struct {
 	RegisteredClaims
 	auth.UserInfo
+	// AMR lists the authentication methods used, like github, otp and mfa
+	AMR []string `json:"amr,omitempty"`
+	// Act is set when the token is used by someone else than the subject, see
+	// https://www.rfc-editor.org/rfc/rfc8693.html#name-act-actor-claim
+	Act *Actor `json:"act,omitempty"`
+}
+
+// Actor identifies an admin acting on behalf of the user
+type Actor struct {
+	UserID tid.UserID `json:"sub"`
+	Name   string     `json:"name,omitempty"`
+}
+
+// Impersonated returns true if the token was issued to an admin acting as the user
+func (c Claims) Impersonated() bool {
+	return c.Act != nil
 }
 
 type Encoder struct {
@@ -42,6 +42,8 @@ func TestEncoder_Encode(t *testing.T) {
 			Email:   "email@example.net",
 			Picture: "https://example.net/joe.png?v42",
 		},
+		[]string{"github", "otp", "mfa"},
+		&Actor{UserID: uid, Name: "admin"},
 	}
 
 	token, err := encoder.Encode(claims)
@@ -3,6 +3,8 @@ package jwt
 import (
 	"crypto"
 	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
 	"fmt"
 	"io"
 )
@@ -30,3 +32,11 @@ func (s Secret) Private() crypto.PrivateKey {
 func (s Secret) Public() crypto.PublicKey {
 	return s.private.Public()
 }
+
+// Derive returns a secret of another purpose derived from this one, so its
+// tokens are never valid for the other
+func (s Secret) Derive(purpose string) Secret {
+	mac := hmac.New(sha256.New, s.private.Seed())
+	mac.Write([]byte(purpose))
+	return Secret{private: ed25519.NewKeyFromSeed(mac.Sum(nil))}
+}
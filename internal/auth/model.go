@@ -2,17 +2,27 @@ package auth
 
 import (
 	"context"
+	"errors"
 	"net/http"
 
 	"github.com/gomoni/amble/internal/tid"
 	"golang.org/x/oauth2"
 )
 
+// ErrEmailTaken is returned by sign ins, when the verified email belongs to
+// another account
+var ErrEmailTaken = errors.New("email is used by another account")
+
+// EmailTakenMessage is shown to users refused by ErrEmailTaken
+const EmailTakenMessage = "The email address belongs to another account, sign in with the login of that account."
+
 type UserInfo struct {
 	UserID  tid.UserID `json:"uid"`
 	Name    string     `json:"name"`
 	Email   string     `json:"email"`
 	Picture string     `json:"picture"`
+	// EmailVerified is true if the provider verified the user owns the email
+	EmailVerified bool `json:"email_verified,omitempty"`
 }
 
 type OAuth2 interface {
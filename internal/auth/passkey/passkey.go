@@ -0,0 +1,409 @@
+/*
+Package passkey implements a WebAuthn registration and login.
+
+The registration is available for logged users only and stores the credential
+in accounts store. The login is discoverable, so the user does not need to
+type anything, the authenticator returns the user handle, which is the amble
+user id.
+
+Both ceremonies are split into begin/finish handlers exchanging JSON with a
+browser. The session data between them are kept in memory for a short period
+of time.
+*/
+package passkey
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gomoni/amble/internal/auth"
+	"github.com/gomoni/amble/internal/auth/jwt"
+	"github.com/gomoni/amble/internal/services/audit"
+	"github.com/gomoni/amble/internal/tid"
+
+	gojwt "github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	sessionCookie = "passkey_session"
+	sessionTTL    = 5 * time.Minute
+)
+
+type Encoder interface {
+	Encode(jwt.Claims) (string, error)
+}
+
+type Decoder interface {
+	Decode(string) (jwt.Claims, error)
+}
+
+// Store keeps the webauthn credentials per user
+type Store interface {
+	Get(ctx context.Context, uid tid.UserID) (auth.UserInfo, error)
+	Passkeys(ctx context.Context, uid tid.UserID) ([]webauthn.Credential, error)
+	AddPasskey(ctx context.Context, uid tid.UserID, credential webauthn.Credential) error
+	UpdatePasskey(ctx context.Context, uid tid.UserID, credential webauthn.Credential) error
+}
+
+type Auditor interface {
+	Record(context.Context, audit.Event) error
+}
+
+type Login struct {
+	webauthn   *webauthn.WebAuthn
+	store      Store
+	jwtEncoder Encoder
+	jwtDecoder Decoder
+	auditor    Auditor
+	sessions   *sessions
+}
+
+func NewLogin(wa *webauthn.WebAuthn, store Store, encoder Encoder, decoder Decoder) Login {
+	return Login{
+		webauthn:   wa,
+		store:      store,
+		jwtEncoder: encoder,
+		jwtDecoder: decoder,
+		sessions:   newSessions(),
+	}
+}
+
+// NewFromOrigin returns a login for a relying party identified by its origin like http://localhost:8000
+func NewFromOrigin(origin string, store Store, encoder Encoder, decoder Decoder) (Login, error) {
+	rpID := strings.TrimPrefix(strings.TrimPrefix(origin, "https://"), "http://")
+	rpID, _, _ = strings.Cut(rpID, ":")
+	wa, err := webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: "Amble.app",
+		RPOrigins:     []string{origin},
+	})
+	if err != nil {
+		return Login{}, fmt.Errorf("configure webauthn: %w", err)
+	}
+	return NewLogin(wa, store, encoder, decoder), nil
+}
+
+// WithAudit returns a login, which records login success and failures
+func (p Login) WithAudit(auditor Auditor) Login {
+	p.auditor = auditor
+	return p
+}
+
+// RegisterBeginHandler returns credential creation options for the logged user
+func (p Login) RegisterBeginHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := p.claims(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	u, err := p.user(r.Context(), claims.UserID)
+	if err != nil {
+		http.Error(w, "load user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(u.credentials))
+	for _, c := range u.credentials {
+		exclusions = append(exclusions, c.Descriptor())
+	}
+	creation, session, err := p.webauthn.BeginRegistration(
+		u,
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+		webauthn.WithExclusions(exclusions),
+	)
+	if err != nil {
+		http.Error(w, "begin registration: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.begin(w, *session, creation)
+}
+
+// RegisterFinishHandler verifies the attestation and stores the new credential
+func (p Login) RegisterFinishHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := p.claims(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	session, err := p.session(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	u, err := p.user(r.Context(), claims.UserID)
+	if err != nil {
+		http.Error(w, "load user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	credential, err := p.webauthn.FinishRegistration(u, session, r)
+	if err != nil {
+		http.Error(w, "finish registration: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = p.store.AddPasskey(r.Context(), claims.UserID, *credential)
+	if err != nil {
+		http.Error(w, "store passkey: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// LoginBeginHandler returns credential request options for a discoverable login
+func (p Login) LoginBeginHandler(w http.ResponseWriter, r *http.Request) {
+	assertion, session, err := p.webauthn.BeginDiscoverableLogin()
+	if err != nil {
+		http.Error(w, "begin login: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.begin(w, *session, assertion)
+}
+
+// LoginFinishHandler verifies the assertion, checks the sign counter and sets
+// the Authorization cookie
+func (p Login) LoginFinishHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := p.session(w, r)
+	if err != nil {
+		p.fail(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var u user
+	credential, err := p.webauthn.FinishDiscoverableLogin(
+		func(rawID, userHandle []byte) (webauthn.User, error) {
+			uid, err := tid.ParseUserID(string(userHandle))
+			if err != nil {
+				return nil, fmt.Errorf("parse user handle: %w", err)
+			}
+			u, err = p.user(r.Context(), uid)
+			return u, err
+		},
+		session,
+		r,
+	)
+	if err != nil {
+		p.fail(w, r, "finish login: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if credential.Authenticator.CloneWarning {
+		p.fail(w, r, "sign counter did not increase, the authenticator may be cloned", http.StatusUnauthorized)
+		return
+	}
+	err = p.store.UpdatePasskey(r.Context(), u.info.UserID, *credential)
+	if err != nil {
+		p.fail(w, r, "update passkey: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	claims := Claims(credential.ID, u.info)
+	jwtToken, err := p.jwtEncoder.Encode(claims)
+	if err != nil {
+		p.fail(w, r, "encode JWT: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	event := audit.FromRequest(r, audit.LoginSuccess)
+	event.Provider = "passkey"
+	event.Subject = claims.Subject
+	event.UserID = claims.UserID
+	p.record(r.Context(), event)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "Authorization",
+		Value:    "Bearer " + jwtToken,
+		Expires:  time.Now().Add(24 * time.Hour),
+		HttpOnly: true,
+		Secure:   false, // Use secure cookies in production
+		Path:     "/",
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Claims returns the claims of a passkey login. The subject is the credential
+// id, so it can be resolved via accounts link like any other provider.
+func Claims(credentialID []byte, userInfo auth.UserInfo) jwt.Claims {
+	return jwt.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "passkey",
+			Subject:   base64.RawURLEncoding.EncodeToString(credentialID),
+			Audience:  []string{jwt.AudienceApp},
+			ExpiresAt: gojwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
+			NotBefore: gojwt.NewNumericDate(time.Now()),
+			IssuedAt:  gojwt.NewNumericDate(time.Now()),
+			ID:        "jti",
+		},
+		UserInfo: userInfo,
+		AMR:      []string{"passkey"},
+	}
+}
+
+func (p Login) claims(r *http.Request) (jwt.Claims, error) {
+	cookie, err := r.Cookie("Authorization")
+	if err != nil {
+		return jwt.Claims{}, errors.New("missing cookie")
+	}
+	claims, err := p.jwtDecoder.Decode(strings.TrimPrefix(cookie.Value, "Bearer "))
+	if err != nil {
+		return jwt.Claims{}, fmt.Errorf("can't decode authorization cookie: %w", err)
+	}
+	if claims.UserID.IsZero() {
+		return jwt.Claims{}, errors.New("authorization cookie has no user id")
+	}
+	if claims.Impersonated() {
+		return jwt.Claims{}, errors.New("passkeys can't be registered while impersonating a user")
+	}
+	return claims, nil
+}
+
+func (p Login) user(ctx context.Context, uid tid.UserID) (user, error) {
+	info, err := p.store.Get(ctx, uid)
+	if err != nil {
+		return user{}, err
+	}
+	credentials, err := p.store.Passkeys(ctx, uid)
+	if err != nil {
+		return user{}, err
+	}
+	return user{info: info, credentials: credentials}, nil
+}
+
+// begin stores the session and replies with the options for the browser
+func (p Login) begin(w http.ResponseWriter, session webauthn.SessionData, options any) {
+	id, err := p.sessions.put(session)
+	if err != nil {
+		http.Error(w, "store session: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		MaxAge:   int(sessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   false, // Use secure cookies in production
+		Path:     "/auth/passkey/",
+	})
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(options)
+	if err != nil {
+		log.Printf("[passkey.Login]: encode options: %s", err)
+	}
+}
+
+// session returns the session started by begin handler, each session can be
+// used only once
+func (p Login) session(w http.ResponseWriter, r *http.Request) (webauthn.SessionData, error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return webauthn.SessionData{}, errors.New("missing passkey session cookie")
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   sessionCookie,
+		MaxAge: -1,
+		Path:   "/auth/passkey/",
+	})
+	session, ok := p.sessions.take(cookie.Value)
+	if !ok {
+		return webauthn.SessionData{}, errors.New("passkey session not found or expired")
+	}
+	return session, nil
+}
+
+// fail records the failed login and replies with an error
+func (p Login) fail(w http.ResponseWriter, r *http.Request, reason string, code int) {
+	event := audit.FromRequest(r, audit.LoginFailure)
+	event.Provider = "passkey"
+	event.Reason = reason
+	p.record(r.Context(), event)
+	http.Error(w, reason, code)
+}
+
+func (p Login) record(ctx context.Context, event audit.Event) {
+	if p.auditor == nil {
+		return
+	}
+	err := p.auditor.Record(ctx, event)
+	if err != nil {
+		log.Printf("[passkey.Login]: %s", err)
+	}
+}
+
+// user implements webauthn.User for an amble account
+type user struct {
+	info        auth.UserInfo
+	credentials []webauthn.Credential
+}
+
+func (u user) WebAuthnID() []byte {
+	return []byte(u.info.UserID.String())
+}
+
+func (u user) WebAuthnName() string {
+	if u.info.Email != "" {
+		return u.info.Email
+	}
+	return u.info.UserID.String()
+}
+
+func (u user) WebAuthnDisplayName() string {
+	return u.info.Name
+}
+
+func (u user) WebAuthnCredentials() []webauthn.Credential {
+	return u.credentials
+}
+
+// sessions keeps the ceremony data between begin and finish handler
+type sessions struct {
+	mu sync.Mutex
+	m  map[string]webauthn.SessionData
+}
+
+func newSessions() *sessions {
+	return &sessions{m: make(map[string]webauthn.SessionData)}
+}
+
+func (s *sessions) put(session webauthn.SessionData) (string, error) {
+	var buf [16]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		return "", err
+	}
+	id := base64.RawURLEncoding.EncodeToString(buf[:])
+	if session.Expires.IsZero() {
+		session.Expires = time.Now().Add(sessionTTL)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for k, v := range s.m {
+		if now.After(v.Expires) {
+			delete(s.m, k)
+		}
+	}
+	s.m[id] = session
+	return id, nil
+}
+
+func (s *sessions) take(id string) (webauthn.SessionData, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.m[id]
+	if !ok {
+		return webauthn.SessionData{}, false
+	}
+	delete(s.m, id)
+	if time.Now().After(session.Expires) {
+		return webauthn.SessionData{}, false
+	}
+	return session, true
+}
@@ -0,0 +1,177 @@
+package passkey_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/descope/virtualwebauthn"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gomoni/amble/internal/auth"
+	"github.com/gomoni/amble/internal/auth/jwt"
+	"github.com/gomoni/amble/internal/auth/passkey"
+	"github.com/gomoni/amble/internal/tid"
+
+	gojwt "github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+)
+
+const origin = "http://localhost:8000"
+
+func TestPasskey(t *testing.T) {
+	var buf [ed25519.SeedSize]byte
+	_, err := rand.Read(buf[:])
+	require.NoError(t, err)
+	secret, err := jwt.LoadSecret(bytes.NewReader(buf[:]))
+	require.NoError(t, err)
+	encoder := jwt.NewEncoder(secret)
+	decoder := jwt.NewDecoder(secret.Public())
+
+	// given there is an octocat user logged in via github
+	uid, err := tid.NewUserID()
+	require.NoError(t, err)
+	octocat := auth.UserInfo{
+		UserID:  uid,
+		Name:    "Octocat",
+		Email:   "cat@octocat.example.net",
+		Picture: "https://example.net/octocat.png",
+	}
+	store := newStore(octocat)
+	webToken, err := encoder.Encode(jwt.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "github",
+			Subject:   "583231",
+			ExpiresAt: gojwt.NewNumericDate(time.Now().Add(10 * time.Second)),
+		},
+		UserInfo: octocat,
+	})
+	require.NoError(t, err)
+	authorization := &http.Cookie{Name: "Authorization", Value: "Bearer " + webToken}
+
+	login, err := passkey.NewFromOrigin(origin, store, encoder, decoder)
+	require.NoError(t, err)
+
+	rp := virtualwebauthn.RelyingParty{Name: "Amble.app", ID: "localhost", Origin: origin}
+	authenticator := virtualwebauthn.NewAuthenticator()
+	credential := virtualwebauthn.NewCredential(virtualwebauthn.KeyTypeEC2)
+
+	// when user registers a passkey
+	options, session := call(t, login.RegisterBeginHandler, "", authorization)
+	attestationOptions, err := virtualwebauthn.ParseAttestationOptions(options)
+	require.NoError(t, err)
+	require.Equal(t, uid.String(), attestationOptions.UserID)
+	attestation := virtualwebauthn.CreateAttestationResponse(rp, authenticator, credential, *attestationOptions)
+	_, _ = call(t, login.RegisterFinishHandler, attestation, authorization, session)
+
+	// then it is stored
+	credentials, err := store.Passkeys(context.Background(), uid)
+	require.NoError(t, err)
+	require.Len(t, credentials, 1)
+	require.Equal(t, credential.ID, credentials[0].ID)
+
+	authenticator.Options.UserHandle = []byte(uid.String())
+	authenticator.AddCredential(credential)
+
+	// when user logs in with the passkey
+	credential.Counter = 1
+	w := loginWith(t, login, rp, authenticator, credential)
+
+	// then the authorization cookie is set
+	require.Equal(t, http.StatusNoContent, w.Code)
+	var token string
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "Authorization" {
+			token = strings.TrimPrefix(cookie.Value, "Bearer ")
+		}
+	}
+	claims, err := decoder.Decode(token)
+	require.NoError(t, err)
+	require.Equal(t, "passkey", claims.Issuer)
+	require.Equal(t, uid, claims.UserID)
+	require.Equal(t, "Octocat", claims.Name)
+
+	// when the sign counter does not increase
+	w = loginWith(t, login, rp, authenticator, credential)
+
+	// then login is refused
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.Contains(t, w.Body.String(), "sign counter")
+}
+
+func loginWith(t *testing.T, login passkey.Login, rp virtualwebauthn.RelyingParty, authenticator virtualwebauthn.Authenticator, credential virtualwebauthn.Credential) *httptest.ResponseRecorder {
+	t.Helper()
+	options, session := call(t, login.LoginBeginHandler, "")
+	assertionOptions, err := virtualwebauthn.ParseAssertionOptions(options)
+	require.NoError(t, err)
+	assertion := virtualwebauthn.CreateAssertionResponse(rp, authenticator, credential, *assertionOptions)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/auth/passkey/login/finish", strings.NewReader(assertion))
+	r.AddCookie(session)
+	login.LoginFinishHandler(w, r)
+	return w
+}
+
+// call runs a handler expecting success, returns the body and a passkey session cookie
+func call(t *testing.T, handler http.HandlerFunc, body string, cookies ...*http.Cookie) (string, *http.Cookie) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/auth/passkey/", strings.NewReader(body))
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	handler(w, r)
+	require.Less(t, w.Code, 300, w.Body.String())
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "passkey_session" && cookie.MaxAge > 0 {
+			return w.Body.String(), cookie
+		}
+	}
+	return w.Body.String(), nil
+}
+
+type store struct {
+	mu          sync.Mutex
+	info        auth.UserInfo
+	credentials map[string]webauthn.Credential
+}
+
+func newStore(info auth.UserInfo) *store {
+	return &store{info: info, credentials: make(map[string]webauthn.Credential)}
+}
+
+func (s *store) Get(_ context.Context, uid tid.UserID) (auth.UserInfo, error) {
+	if uid != s.info.UserID {
+		return auth.UserInfo{}, errors.New("not found")
+	}
+	return s.info, nil
+}
+
+func (s *store) Passkeys(_ context.Context, uid tid.UserID) ([]webauthn.Credential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ret []webauthn.Credential
+	for _, c := range s.credentials {
+		ret = append(ret, c)
+	}
+	return ret, nil
+}
+
+func (s *store) AddPasskey(_ context.Context, uid tid.UserID, credential webauthn.Credential) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.credentials[string(credential.ID)] = credential
+	return nil
+}
+
+func (s *store) UpdatePasskey(_ context.Context, uid tid.UserID, credential webauthn.Credential) error {
+	return s.AddPasskey(context.Background(), uid, credential)
+}
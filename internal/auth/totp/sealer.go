@@ -0,0 +1,58 @@
+package totp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const keySize = 32
+
+// Sealer encrypts the shared secrets at rest using AES-256-GCM. The user id
+// is used as an additional data, so sealed secret can't be moved to other user.
+type Sealer struct {
+	aead cipher.AEAD
+}
+
+func LoadSealer(r io.Reader) (Sealer, error) {
+	key, err := io.ReadAll(r)
+	if err != nil {
+		return Sealer{}, fmt.Errorf("read totp aes key: %w", err)
+	}
+	if len(key) != keySize {
+		return Sealer{}, fmt.Errorf("insufficient len of totp aes key: got %d, expected %d", len(key), keySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return Sealer{}, fmt.Errorf("create aes cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return Sealer{}, fmt.Errorf("create gcm: %w", err)
+	}
+	return Sealer{aead: aead}, nil
+}
+
+func (s Sealer) Seal(secret []byte, uid string) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("seal: generate nonce: %w", err)
+	}
+	return s.aead.Seal(nonce, nonce, secret, []byte(uid)), nil
+}
+
+func (s Sealer) Open(sealed []byte, uid string) ([]byte, error) {
+	if len(sealed) < s.aead.NonceSize() {
+		return nil, errors.New("open: sealed secret too short")
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	secret, err := s.aead.Open(nil, nonce, ciphertext, []byte(uid))
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+	return secret, nil
+}
@@ -0,0 +1,313 @@
+package totp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gomoni/amble/internal/auth/jwt"
+	"github.com/gomoni/amble/internal/services/audit"
+	"github.com/gomoni/amble/internal/tid"
+
+	gojwt "github.com/golang-jwt/jwt/v5"
+	"github.com/justinas/nosurf"
+)
+
+const (
+	issuer            = "Amble.app"
+	pendingCookie     = "mfa_pending"
+	pendingTTL        = 5 * time.Minute
+	recoveryCodeCount = 10
+
+	MethodOTP      = "otp"
+	MethodRecovery = "recovery"
+	MethodMFA      = "mfa"
+)
+
+var ErrNotEnrolled = errors.New("totp not enrolled")
+
+type Store interface {
+	TOTP(ctx context.Context, uid tid.UserID) (Record, error)
+	// UpdateTOTP is a read-modify-write of the record, merge may be called
+	// more times and must not have side effects
+	UpdateTOTP(ctx context.Context, uid tid.UserID, merge func(current Record, exists bool) (Record, error)) (Record, error)
+	DeleteTOTP(ctx context.Context, uid tid.UserID) error
+}
+
+type Encoder interface {
+	Encode(jwt.Claims) (string, error)
+}
+
+type Decoder interface {
+	Decode(string) (jwt.Claims, error)
+}
+
+type Auditor interface {
+	Record(context.Context, audit.Event) error
+}
+
+// Service manages the enrollment and implements the second step of a login
+type Service struct {
+	store      Store
+	sealer     Sealer
+	jwtEncoder Encoder
+	jwtDecoder Decoder
+	auditor    Auditor
+	now        func() time.Time
+}
+
+func NewService(store Store, sealer Sealer, encoder Encoder, decoder Decoder) Service {
+	return Service{
+		store:      store,
+		sealer:     sealer,
+		jwtEncoder: encoder,
+		jwtDecoder: decoder,
+		now:        time.Now,
+	}
+}
+
+// WithAudit returns a service, which records second factor success and failures
+func (s Service) WithAudit(auditor Auditor) Service {
+	s.auditor = auditor
+	return s
+}
+
+// Enrollment is displayed to the user once
+type Enrollment struct {
+	URI           string
+	Secret        string
+	RecoveryCodes []string
+}
+
+// Enroll generates a new secret and recovery codes. The second factor is not
+// required until it is confirmed by a valid code.
+func (s Service) Enroll(ctx context.Context, uid tid.UserID, account string) (Enrollment, error) {
+	secret, err := NewSecret()
+	if err != nil {
+		return Enrollment{}, fmt.Errorf("totp enroll: %w", err)
+	}
+	sealed, err := s.sealer.Seal(secret, uid.String())
+	if err != nil {
+		return Enrollment{}, fmt.Errorf("totp enroll: %w", err)
+	}
+	codes, hashes, err := NewRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return Enrollment{}, fmt.Errorf("totp enroll: %w", err)
+	}
+	_, err = s.store.UpdateTOTP(ctx, uid, func(current Record, exists bool) (Record, error) {
+		if exists && current.Enabled {
+			return Record{}, errors.New("already enabled")
+		}
+		return Record{
+			Secret:        sealed,
+			RecoveryCodes: hashes,
+		}, nil
+	})
+	if err != nil {
+		return Enrollment{}, fmt.Errorf("totp enroll: %w", err)
+	}
+	return Enrollment{
+		URI:           URI(issuer, account, secret),
+		Secret:        EncodeSecret(secret),
+		RecoveryCodes: codes,
+	}, nil
+}
+
+// Confirm enables the second factor if the code is valid
+func (s Service) Confirm(ctx context.Context, uid tid.UserID, code string) error {
+	_, err := s.store.UpdateTOTP(ctx, uid, func(record Record, exists bool) (Record, error) {
+		if !exists {
+			return Record{}, ErrNotEnrolled
+		}
+		secret, err := s.sealer.Open(record.Secret, uid.String())
+		if err != nil {
+			return Record{}, err
+		}
+		counter, ok := Validate(secret, code, s.now(), record.LastCounter)
+		if !ok {
+			return Record{}, errors.New("invalid code")
+		}
+		record.LastCounter = counter
+		record.Enabled = true
+		return record, nil
+	})
+	if err != nil {
+		return fmt.Errorf("totp confirm: %w", err)
+	}
+	return nil
+}
+
+// Disable removes the second factor, a valid code or a recovery code is required
+func (s Service) Disable(ctx context.Context, uid tid.UserID, code string) error {
+	_, err := s.Verify(ctx, uid, code)
+	if err != nil {
+		return fmt.Errorf("totp disable: %w", err)
+	}
+	err = s.store.DeleteTOTP(ctx, uid)
+	if err != nil {
+		return fmt.Errorf("totp disable: %w", err)
+	}
+	return nil
+}
+
+// Required returns true if user has enabled the second factor
+func (s Service) Required(ctx context.Context, uid tid.UserID) (bool, error) {
+	record, err := s.store.TOTP(ctx, uid)
+	if errors.Is(err, ErrNotEnrolled) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("totp required: %w", err)
+	}
+	return record.Enabled, nil
+}
+
+// Verify checks the code or a recovery code and returns the method used.
+// The check and the write of the counter, the failures or the used recovery
+// code are a single update, so parallel guesses are all counted.
+func (s Service) Verify(ctx context.Context, uid tid.UserID, code string) (string, error) {
+	now := s.now()
+	var method string
+	_, err := s.store.UpdateTOTP(ctx, uid, func(record Record, exists bool) (Record, error) {
+		method = ""
+		if !exists {
+			return Record{}, ErrNotEnrolled
+		}
+		if !record.Enabled {
+			return Record{}, errors.New("not enabled")
+		}
+		if record.Locked(now) {
+			return Record{}, errors.New("too many failed attempts, try again later")
+		}
+		secret, err := s.sealer.Open(record.Secret, uid.String())
+		if err != nil {
+			return Record{}, err
+		}
+		if counter, ok := Validate(secret, code, now, record.LastCounter); ok {
+			record.LastCounter = counter
+			record.Failures = 0
+			method = MethodOTP
+		} else if record.UseRecoveryCode(code) {
+			record.Failures = 0
+			method = MethodRecovery
+		} else {
+			record.Fail(now)
+		}
+		return record, nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("totp verify: %w", err)
+	}
+	if method == "" {
+		return "", errors.New("totp verify: invalid code")
+	}
+	return method, nil
+}
+
+// Begin stores the claims of the first factor in a short lived pending token
+// and redirects user to the second step
+func (s Service) Begin(w http.ResponseWriter, r *http.Request, claims jwt.Claims, redirectURL string) {
+	claims.Audience = []string{jwt.AudiencePending}
+	claims.ExpiresAt = gojwt.NewNumericDate(time.Now().Add(pendingTTL))
+	token, err := s.jwtEncoder.Encode(claims)
+	if err != nil {
+		http.Error(w, "encode JWT: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     pendingCookie,
+		Value:    token,
+		MaxAge:   int(pendingTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   false, // Use secure cookies in production
+		Path:     "/auth/mfa",
+	})
+	http.Redirect(w, r, "/auth/mfa?next_url="+url.QueryEscape(redirectURL), http.StatusSeeOther)
+}
+
+// VerifyHandler verifies the code submitted for a pending login and issues
+// the final JWT with amr claim
+func (s Service) VerifyHandler(w http.ResponseWriter, r *http.Request) {
+	if !nosurf.VerifyToken(nosurf.Token(r), r.Form.Get(nosurf.FormFieldName)) {
+		http.Error(w, "CSFR protection failed", http.StatusBadRequest)
+		return
+	}
+	cookie, err := r.Cookie(pendingCookie)
+	if err != nil {
+		s.fail(w, r, jwt.Claims{}, "missing pending login, log in again", http.StatusUnauthorized)
+		return
+	}
+	claims, err := s.jwtDecoder.Decode(cookie.Value)
+	if err != nil || !slices.Contains(claims.Audience, jwt.AudiencePending) {
+		s.fail(w, r, jwt.Claims{}, "invalid pending login, log in again", http.StatusUnauthorized)
+		return
+	}
+
+	method, err := s.Verify(r.Context(), claims.UserID, r.Form.Get("code"))
+	if err != nil {
+		s.fail(w, r, claims, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	claims.Audience = []string{jwt.AudienceApp}
+	claims.ExpiresAt = gojwt.NewNumericDate(time.Now().Add(24 * time.Hour))
+	claims.AMR = append(claims.AMR, method, MethodMFA)
+	jwtToken, err := s.jwtEncoder.Encode(claims)
+	if err != nil {
+		http.Error(w, "encode JWT: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	event := audit.FromRequest(r, audit.LoginSuccess)
+	event.Provider = claims.Issuer
+	event.Subject = claims.Subject
+	event.UserID = claims.UserID
+	event.Reason = "second factor: " + method
+	s.record(r.Context(), event)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:   pendingCookie,
+		MaxAge: -1,
+		Path:   "/auth/mfa",
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     "Authorization",
+		Value:    "Bearer " + jwtToken,
+		Expires:  time.Now().Add(24 * time.Hour),
+		HttpOnly: true,
+		Secure:   false, // Use secure cookies in production
+		Path:     "/",
+	})
+	// allow local redirects only
+	redirectURL := r.Form.Get("next_url")
+	if !strings.HasPrefix(redirectURL, "/") || strings.HasPrefix(redirectURL, "//") {
+		redirectURL = "/dashboard"
+	}
+	http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+}
+
+// fail records the failed second factor and replies with an error
+func (s Service) fail(w http.ResponseWriter, r *http.Request, claims jwt.Claims, reason string, code int) {
+	event := audit.FromRequest(r, audit.LoginFailure)
+	event.Provider = claims.Issuer
+	event.Subject = claims.Subject
+	event.UserID = claims.UserID
+	event.Reason = "second factor: " + reason
+	s.record(r.Context(), event)
+	http.Error(w, reason, code)
+}
+
+func (s Service) record(ctx context.Context, event audit.Event) {
+	if s.auditor == nil {
+		return
+	}
+	err := s.auditor.Record(ctx, event)
+	if err != nil {
+		log.Printf("[totp.Service]: %s", err)
+	}
+}
@@ -0,0 +1,164 @@
+/*
+Package totp implements an optional second factor using time based one time
+passwords (RFC 6238) with one time recovery codes.
+
+The shared secret is encrypted by Sealer before it is stored, recovery codes
+are stored as sha256 hashes only.
+*/
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	digits      = 6
+	period      = 30 * time.Second
+	secretSize  = 20
+	skew        = 1
+	maxFailures = 5
+	lockout     = 15 * time.Minute
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Record is stored per user. Secret is sealed.
+type Record struct {
+	Secret        []byte    `json:"secret"`
+	RecoveryCodes []string  `json:"recovery_codes"`
+	LastCounter   int64     `json:"last_counter"`
+	Enabled       bool      `json:"enabled"`
+	Failures      int       `json:"failures,omitempty"`
+	LockedUntil   time.Time `json:"locked_until,omitempty"`
+}
+
+// NewSecret returns a random shared secret
+func NewSecret() ([]byte, error) {
+	secret := make([]byte, secretSize)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, fmt.Errorf("generate totp secret: %w", err)
+	}
+	return secret, nil
+}
+
+// EncodeSecret returns the secret in the base32 form users can type into an app
+func EncodeSecret(secret []byte) string {
+	return b32.EncodeToString(secret)
+}
+
+// URI returns the otpauth provisioning URI, which is usually displayed as a QR code
+// https://github.com/google/google-authenticator/wiki/Key-Uri-Format
+func URI(issuer, account string, secret []byte) string {
+	v := url.Values{}
+	v.Set("secret", EncodeSecret(secret))
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(digits))
+	v.Set("period", fmt.Sprint(int(period.Seconds())))
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: v.Encode(),
+	}
+	return u.String()
+}
+
+func counter(t time.Time) int64 {
+	return t.Unix() / int64(period.Seconds())
+}
+
+// Code returns the code for a given time
+func Code(secret []byte, t time.Time) string {
+	return hotp(secret, counter(t))
+}
+
+func hotp(secret []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", digits, value%1_000_000)
+}
+
+// Validate checks the code allowing one period of a clock skew. A code
+// already used (counter <= last) is refused. Returns the counter to be stored.
+func Validate(secret []byte, code string, t time.Time, last int64) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != digits {
+		return 0, false
+	}
+	now := counter(t)
+	for c := now - skew; c <= now+skew; c++ {
+		if c <= last {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(secret, c)), []byte(code)) == 1 {
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+// NewRecoveryCodes returns n codes for the user and their hashes to be stored
+func NewRecoveryCodes(n int) (codes []string, hashes []string, err error) {
+	for range n {
+		var buf [10]byte
+		_, err = rand.Read(buf[:])
+		if err != nil {
+			return nil, nil, fmt.Errorf("generate recovery code: %w", err)
+		}
+		code := strings.ToLower(b32.EncodeToString(buf[:]))
+		code = code[:8] + "-" + code[8:]
+		codes = append(codes, code)
+		hashes = append(hashes, HashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+func HashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// UseRecoveryCode removes the code from the record, returns false if code is not valid
+func (r *Record) UseRecoveryCode(code string) bool {
+	hash := HashRecoveryCode(code)
+	for i, h := range r.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			r.RecoveryCodes = append(r.RecoveryCodes[:i], r.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Locked returns true if there were too many failed attempts recently
+func (r Record) Locked(now time.Time) bool {
+	return now.Before(r.LockedUntil)
+}
+
+// Fail counts the failed attempt and locks the record after too many of them
+func (r *Record) Fail(now time.Time) {
+	r.Failures++
+	if r.Failures >= maxFailures {
+		r.Failures = 0
+		r.LockedUntil = now.Add(lockout)
+	}
+}
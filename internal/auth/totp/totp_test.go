@@ -0,0 +1,295 @@
+package totp_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base32"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomoni/amble/internal/auth"
+	"github.com/gomoni/amble/internal/auth/jwt"
+	"github.com/gomoni/amble/internal/auth/totp"
+	"github.com/gomoni/amble/internal/tid"
+	"github.com/justinas/alice"
+	"github.com/justinas/nosurf"
+
+	gojwt "github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCode(t *testing.T) {
+	t.Parallel()
+	// RFC 6238 Appendix B test vectors, the last 6 digits
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprint(test.unix), func(t *testing.T) {
+			t.Parallel()
+			require.Equal(t, test.code, totp.Code(secret, time.Unix(test.unix, 0)))
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+	secret, err := totp.NewSecret()
+	require.NoError(t, err)
+	now := time.Now()
+
+	// code from the previous period is accepted
+	counter, ok := totp.Validate(secret, totp.Code(secret, now.Add(-30*time.Second)), now, 0)
+	require.True(t, ok)
+
+	// the same code can't be used twice
+	_, ok = totp.Validate(secret, totp.Code(secret, now.Add(-30*time.Second)), now, counter)
+	require.False(t, ok)
+
+	// too old code is refused
+	_, ok = totp.Validate(secret, totp.Code(secret, now.Add(-2*time.Minute)), now, 0)
+	require.False(t, ok)
+
+	require.Contains(t, totp.URI("Amble.app", "cat@octocat.example.net", secret), "otpauth://totp/Amble.app:cat@octocat.example.net?")
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	t.Parallel()
+	codes, hashes, err := totp.NewRecoveryCodes(3)
+	require.NoError(t, err)
+	require.Len(t, codes, 3)
+	record := totp.Record{RecoveryCodes: hashes}
+
+	require.True(t, record.UseRecoveryCode(strings.ToUpper(codes[1])))
+	require.False(t, record.UseRecoveryCode(codes[1]))
+	require.Len(t, record.RecoveryCodes, 2)
+}
+
+func TestSealer(t *testing.T) {
+	t.Parallel()
+	sealer := newSealer(t)
+	sealed, err := sealer.Seal([]byte("secret"), "usr_a")
+	require.NoError(t, err)
+
+	secret, err := sealer.Open(sealed, "usr_a")
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret"), secret)
+
+	// sealed secret of other user can't be opened
+	_, err = sealer.Open(sealed, "usr_b")
+	require.Error(t, err)
+}
+
+func TestSecondFactor(t *testing.T) {
+	var buf [ed25519.SeedSize]byte
+	_, err := rand.Read(buf[:])
+	require.NoError(t, err)
+	secret, err := jwt.LoadSecret(bytes.NewReader(buf[:]))
+	require.NoError(t, err)
+	encoder := jwt.NewEncoder(secret)
+	decoder := jwt.NewDecoder(secret.Public())
+
+	ctx := context.Background()
+	uid, err := tid.NewUserID()
+	require.NoError(t, err)
+	store := &store{m: make(map[tid.UserID]totp.Record)}
+	service := totp.NewService(store, newSealer(t), encoder, decoder)
+
+	// given user has enrolled and confirmed the second factor
+	enrollment, err := service.Enroll(ctx, uid, "cat@octocat.example.net")
+	require.NoError(t, err)
+	required, err := service.Required(ctx, uid)
+	require.NoError(t, err)
+	require.False(t, required)
+	u, err := url.Parse(enrollment.URI)
+	require.NoError(t, err)
+	sharedSecret, err := totpSecret(u.Query().Get("secret"))
+	require.NoError(t, err)
+	err = service.Confirm(ctx, uid, totp.Code(sharedSecret, time.Now().Add(-30*time.Second)))
+	require.NoError(t, err)
+	required, err = service.Required(ctx, uid)
+	require.NoError(t, err)
+	require.True(t, required)
+
+	// when user logs in via github
+	csrfMW := alice.New(nosurf.NewPure)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/auth/github/callback", nil)
+	var requestToken string
+	csrfMW.ThenFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestToken = nosurf.Token(r)
+		service.Begin(w, r, jwt.Claims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    "github",
+				Subject:   "583231",
+				Audience:  []string{"app"},
+				ExpiresAt: gojwt.NewNumericDate(time.Now().Add(time.Hour)),
+			},
+			UserInfo: auth.UserInfo{UserID: uid},
+			AMR:      []string{"github"},
+		}, "/dashboard")
+	}).ServeHTTP(w, r)
+
+	// then a pending token is issued instead of the final one
+	require.Equal(t, http.StatusSeeOther, w.Code)
+	require.Equal(t, "/auth/mfa?next_url=%2Fdashboard", w.Header().Get("Location"))
+	cookies := w.Result().Cookies()
+	for _, cookie := range cookies {
+		require.NotEqual(t, "Authorization", cookie.Name)
+	}
+
+	verify := func(code string) *httptest.ResponseRecorder {
+		form := url.Values{}
+		form.Set("code", code)
+		form.Set("next_url", "/dashboard")
+		form.Set(nosurf.FormFieldName, requestToken)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/auth/mfa", strings.NewReader(form.Encode()))
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		csrfMW.ThenFunc(service.VerifyHandler).ServeHTTP(w, r)
+		return w
+	}
+
+	// when the code is wrong
+	w = verify("000000")
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// when the code is valid
+	w = verify(totp.Code(sharedSecret, time.Now()))
+	require.Equal(t, http.StatusSeeOther, w.Code, w.Body.String())
+	require.Equal(t, "/dashboard", w.Header().Get("Location"))
+	var token string
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "Authorization" {
+			token = strings.TrimPrefix(cookie.Value, "Bearer ")
+		}
+	}
+	claims, err := decoder.Decode(token)
+	require.NoError(t, err)
+	require.Equal(t, []string{"github", totp.MethodOTP, totp.MethodMFA}, claims.AMR)
+	require.Equal(t, gojwt.ClaimStrings{"app"}, claims.Audience)
+
+	// when a recovery code is used
+	w = verify(enrollment.RecoveryCodes[0])
+	require.Equal(t, http.StatusSeeOther, w.Code, w.Body.String())
+	record, err := store.TOTP(ctx, uid)
+	require.NoError(t, err)
+	require.Len(t, record.RecoveryCodes, len(enrollment.RecoveryCodes)-1)
+}
+
+func TestVerifyConcurrent(t *testing.T) {
+	ctx := context.Background()
+	uid, err := tid.NewUserID()
+	require.NoError(t, err)
+	store := &store{m: make(map[tid.UserID]totp.Record)}
+	service := totp.NewService(store, newSealer(t), nil, nil)
+
+	// given user has confirmed the second factor
+	enrollment, err := service.Enroll(ctx, uid, "cat@octocat.example.net")
+	require.NoError(t, err)
+	u, err := url.Parse(enrollment.URI)
+	require.NoError(t, err)
+	sharedSecret, err := totpSecret(u.Query().Get("secret"))
+	require.NoError(t, err)
+	require.NoError(t, service.Confirm(ctx, uid, totp.Code(sharedSecret, time.Now().Add(-30*time.Second))))
+
+	// when the same recovery code is used in parallel, then it works once
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	used := 0
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := service.Verify(ctx, uid, enrollment.RecoveryCodes[0]); err == nil {
+				mu.Lock()
+				used++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 1, used)
+
+	// when wrong codes are guessed in parallel, then every guess is counted
+	// and the valid code is refused by the lockout
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = service.Verify(ctx, uid, "000000")
+		}()
+	}
+	wg.Wait()
+	_, err = service.Verify(ctx, uid, totp.Code(sharedSecret, time.Now()))
+	require.ErrorContains(t, err, "too many failed attempts")
+}
+
+func totpSecret(s string) ([]byte, error) {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(s)
+}
+
+func newSealer(t *testing.T) totp.Sealer {
+	t.Helper()
+	var key [32]byte
+	_, err := rand.Read(key[:])
+	require.NoError(t, err)
+	sealer, err := totp.LoadSealer(bytes.NewReader(key[:]))
+	require.NoError(t, err)
+	return sealer
+}
+
+type store struct {
+	mu sync.Mutex
+	m  map[tid.UserID]totp.Record
+}
+
+func (s *store) TOTP(_ context.Context, uid tid.UserID) (totp.Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.m[uid]
+	if !ok {
+		return totp.Record{}, totp.ErrNotEnrolled
+	}
+	return record, nil
+}
+
+func (s *store) UpdateTOTP(_ context.Context, uid tid.UserID, merge func(totp.Record, bool) (totp.Record, error)) (totp.Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, exists := s.m[uid]
+	current.RecoveryCodes = slices.Clone(current.RecoveryCodes)
+	record, err := merge(current, exists)
+	if err != nil {
+		return totp.Record{}, err
+	}
+	s.m[uid] = record
+	return record, nil
+}
+
+func (s *store) DeleteTOTP(_ context.Context, uid tid.UserID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.m, uid)
+	return nil
+}
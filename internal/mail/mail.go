@@ -0,0 +1,110 @@
+/*
+Package mail sends emails through a pluggable transport.
+
+SMTP transport is meant for production and for local mail catchers like
+mailpit, Dir and Memory transports are for development and tests.
+*/
+package mail
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Message struct {
+	From    string
+	To      string
+	Subject string
+	Body    string // text/plain body
+}
+
+type Transport interface {
+	Send(context.Context, Message) error
+}
+
+// Bytes returns the message in RFC 5322 format
+func (m Message) Bytes() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", m.From)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(m.Body, "\n", "\r\n"))
+	return b.Bytes()
+}
+
+// SMTP sends messages through an SMTP server. Auth can be nil for servers
+// without authentication like local mail catchers.
+type SMTP struct {
+	addr string
+	auth smtp.Auth
+}
+
+func NewSMTP(addr string, auth smtp.Auth) SMTP {
+	return SMTP{addr: addr, auth: auth}
+}
+
+func (s SMTP) Send(_ context.Context, m Message) error {
+	err := smtp.SendMail(s.addr, s.auth, m.From, []string{m.To}, m.Bytes())
+	if err != nil {
+		return fmt.Errorf("smtp send to %s: %w", s.addr, err)
+	}
+	return nil
+}
+
+// Dir writes every message into a file in a directory
+type Dir struct {
+	dir string
+}
+
+func NewDir(dir string) Dir {
+	return Dir{dir: dir}
+}
+
+func (d Dir) Send(_ context.Context, m Message) error {
+	err := os.MkdirAll(d.dir, 0o700)
+	if err != nil {
+		return fmt.Errorf("dir send: %w", err)
+	}
+	name := filepath.Join(d.dir, fmt.Sprintf("%d.eml", time.Now().UnixNano()))
+	err = os.WriteFile(name, m.Bytes(), 0o600)
+	if err != nil {
+		return fmt.Errorf("dir send: %w", err)
+	}
+	return nil
+}
+
+// Memory keeps all the messages sent
+type Memory struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+func (m *Memory) Send(_ context.Context, msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// Messages returns a copy of all sent messages
+func (m *Memory) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.messages...)
+}
@@ -0,0 +1,326 @@
+/*
+Package provision creates the JetStream buckets and streams amble needs.
+
+Buckets are declared by the packages using them, like accounts.KeyValueConfig,
+and tuned by Settings of the deployment. EnsureBuckets creates the missing
+ones and compares the existing ones with the declaration. A bucket is never
+updated, a drift is reported by DriftError, so it is fixed by an operator
+instead of silently running with the wrong settings.
+*/
+package provision
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomoni/amble/internal/auth/email"
+	"github.com/gomoni/amble/internal/services/accounts"
+	"github.com/gomoni/amble/internal/services/audit"
+	"github.com/gomoni/amble/internal/services/export"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// ErrDrift matches DriftError
+var ErrDrift = errors.New("bucket config drift")
+
+// Drift is a setting of an existing bucket or stream, which differs from
+// the declared one
+type Drift struct {
+	// Bucket like `key value accounts` or `stream AUDIT`
+	Bucket   string
+	Setting  string
+	Declared string
+	Actual   string
+}
+
+func (d Drift) String() string {
+	return fmt.Sprintf("%s %s: declared %s, actual %s", d.Bucket, d.Setting, d.Declared, d.Actual)
+}
+
+// DriftError is returned by EnsureBuckets if existing buckets differ from
+// the declaration
+type DriftError struct {
+	Drifts []Drift
+}
+
+func (e *DriftError) Error() string {
+	drifts := make([]string, len(e.Drifts))
+	for i, d := range e.Drifts {
+		drifts[i] = d.String()
+	}
+	return fmt.Sprintf("%s: %s", ErrDrift, strings.Join(drifts, "; "))
+}
+
+func (e *DriftError) Is(target error) bool {
+	return target == ErrDrift
+}
+
+// Settings of a bucket or a stream, zero keeps the declared value
+type Settings struct {
+	// History of a key value bucket, ignored by other kinds
+	History uint8 `json:"history"`
+	// Replicas of the underlying stream
+	Replicas int `json:"replicas"`
+	// Storage is `file` or `memory`
+	Storage string `json:"storage"`
+	// MaxBytes of the bucket, -1 is unlimited
+	MaxBytes int64 `json:"max_bytes"`
+	// TTL of values, max age of stream messages, -1s keeps them forever
+	TTL string `json:"ttl"`
+}
+
+// Config are the settings by the name of a bucket or a stream. A name
+// shared by a key value and an object store bucket applies to both.
+type Config map[string]Settings
+
+// Buckets are the declared buckets and streams
+type Buckets struct {
+	KeyValues    []jetstream.KeyValueConfig
+	ObjectStores []jetstream.ObjectStoreConfig
+	Streams      []jetstream.StreamConfig
+}
+
+// Amble returns all the buckets and streams of amble
+func Amble() Buckets {
+	return Buckets{
+		KeyValues: []jetstream.KeyValueConfig{
+			accounts.KeyValueConfig(),
+			email.KeyValueConfig(),
+			export.KeyValueConfig(),
+		},
+		ObjectStores: []jetstream.ObjectStoreConfig{
+			export.ObjectStoreConfig(),
+		},
+		Streams: []jetstream.StreamConfig{
+			audit.StreamConfig(),
+		},
+	}
+}
+
+// WithConfig returns the buckets with the settings applied. It fails for
+// a name, which is not declared, or an invalid setting.
+func (b Buckets) WithConfig(config Config) (Buckets, error) {
+	b.KeyValues = append([]jetstream.KeyValueConfig(nil), b.KeyValues...)
+	b.ObjectStores = append([]jetstream.ObjectStoreConfig(nil), b.ObjectStores...)
+	b.Streams = append([]jetstream.StreamConfig(nil), b.Streams...)
+	for name, s := range config {
+		storage, err := parseStorage(s.Storage)
+		if err != nil {
+			return Buckets{}, fmt.Errorf("bucket %s: %w", name, err)
+		}
+		var ttl time.Duration
+		if s.TTL != "" {
+			ttl, err = time.ParseDuration(s.TTL)
+			if err != nil {
+				return Buckets{}, fmt.Errorf("bucket %s: parse ttl: %w", name, err)
+			}
+			// zero is unlimited for nats
+			ttl = max(ttl, 0)
+		}
+		if s.History > jetstream.KeyValueMaxHistory {
+			return Buckets{}, fmt.Errorf("bucket %s: %w", name, jetstream.ErrHistoryTooLarge)
+		}
+
+		found := false
+		for i := range b.KeyValues {
+			c := &b.KeyValues[i]
+			if c.Bucket != name {
+				continue
+			}
+			found = true
+			c.History = or(s.History, c.History)
+			c.Replicas = or(s.Replicas, c.Replicas)
+			c.Storage = override(s.Storage != "", storage, c.Storage)
+			c.MaxBytes = or(s.MaxBytes, c.MaxBytes)
+			c.TTL = override(s.TTL != "", ttl, c.TTL)
+		}
+		for i := range b.ObjectStores {
+			c := &b.ObjectStores[i]
+			if c.Bucket != name {
+				continue
+			}
+			found = true
+			c.Replicas = or(s.Replicas, c.Replicas)
+			c.Storage = override(s.Storage != "", storage, c.Storage)
+			c.MaxBytes = or(s.MaxBytes, c.MaxBytes)
+			c.TTL = override(s.TTL != "", ttl, c.TTL)
+		}
+		for i := range b.Streams {
+			c := &b.Streams[i]
+			if c.Name != name {
+				continue
+			}
+			found = true
+			c.Replicas = or(s.Replicas, c.Replicas)
+			c.Storage = override(s.Storage != "", storage, c.Storage)
+			c.MaxBytes = or(s.MaxBytes, c.MaxBytes)
+			c.MaxAge = override(s.TTL != "", ttl, c.MaxAge)
+		}
+		if !found {
+			return Buckets{}, fmt.Errorf("bucket %s: not declared", name)
+		}
+	}
+	return b, nil
+}
+
+// EnsureBuckets creates the missing buckets and streams and returns
+// DriftError listing settings of existing ones, which differ from the
+// declaration. It is safe to run by several processes at once.
+func EnsureBuckets(ctx context.Context, js jetstream.JetStream, buckets Buckets) error {
+	var drifts []Drift
+	for _, c := range buckets.KeyValues {
+		found, err := ensure(ctx, js, "key value "+c.Bucket, "KV_"+c.Bucket, kvSettings(c), func() error {
+			_, err := js.CreateKeyValue(ctx, c)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		drifts = append(drifts, found...)
+	}
+	for _, c := range buckets.ObjectStores {
+		found, err := ensure(ctx, js, "object store "+c.Bucket, "OBJ_"+c.Bucket, settings{
+			replicas: max(c.Replicas, 1),
+			storage:  c.Storage,
+			maxBytes: limit(c.MaxBytes),
+			ttl:      c.TTL,
+		}, func() error {
+			_, err := js.CreateObjectStore(ctx, c)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		drifts = append(drifts, found...)
+	}
+	for _, c := range buckets.Streams {
+		found, err := ensure(ctx, js, "stream "+c.Name, c.Name, streamSettings(c, false), func() error {
+			_, err := js.CreateStream(ctx, c)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		drifts = append(drifts, found...)
+	}
+	if len(drifts) > 0 {
+		return &DriftError{Drifts: drifts}
+	}
+	return nil
+}
+
+// ensure creates the stream if it is missing or compares its settings
+func ensure(ctx context.Context, js jetstream.JetStream, bucket, stream string, declared settings, create func() error) ([]Drift, error) {
+	info, err := js.Stream(ctx, stream)
+	if errors.Is(err, jetstream.ErrStreamNotFound) {
+		err = create()
+		if err == nil {
+			return nil, nil
+		}
+		// created by another process meanwhile
+		if !errors.Is(err, jetstream.ErrBucketExists) && !errors.Is(err, jetstream.ErrStreamNameAlreadyInUse) {
+			return nil, fmt.Errorf("create %s: %w", bucket, err)
+		}
+		info, err = js.Stream(ctx, stream)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get %s: %w", bucket, err)
+	}
+	actual := streamSettings(info.CachedInfo().Config, strings.HasPrefix(stream, "KV_"))
+	return diff(bucket, declared, actual), nil
+}
+
+// settings compared between the declared bucket and the underlying stream
+// in the form the stream has them
+type settings struct {
+	// history is zero for all, but key value buckets
+	history  int64
+	replicas int
+	storage  jetstream.StorageType
+	maxBytes int64
+	ttl      time.Duration
+}
+
+func kvSettings(c jetstream.KeyValueConfig) settings {
+	return settings{
+		history:  int64(max(c.History, 1)),
+		replicas: max(c.Replicas, 1),
+		storage:  c.Storage,
+		maxBytes: limit(c.MaxBytes),
+		ttl:      c.TTL,
+	}
+}
+
+func streamSettings(c jetstream.StreamConfig, keyValue bool) settings {
+	s := settings{
+		replicas: max(c.Replicas, 1),
+		storage:  c.Storage,
+		maxBytes: limit(c.MaxBytes),
+		ttl:      c.MaxAge,
+	}
+	if keyValue {
+		s.history = c.MaxMsgsPerSubject
+	}
+	return s
+}
+
+func diff(bucket string, declared, actual settings) []Drift {
+	var drifts []Drift
+	add := func(setting, d, a string) {
+		if d != a {
+			drifts = append(drifts, Drift{Bucket: bucket, Setting: setting, Declared: d, Actual: a})
+		}
+	}
+	add("history", strconv.FormatInt(declared.history, 10), strconv.FormatInt(actual.history, 10))
+	add("replicas", strconv.Itoa(declared.replicas), strconv.Itoa(actual.replicas))
+	add("storage", storageString(declared.storage), storageString(actual.storage))
+	add("max_bytes", strconv.FormatInt(declared.maxBytes, 10), strconv.FormatInt(actual.maxBytes, 10))
+	add("ttl", declared.ttl.String(), actual.ttl.String())
+	return drifts
+}
+
+func parseStorage(s string) (jetstream.StorageType, error) {
+	switch s {
+	case "", "file":
+		return jetstream.FileStorage, nil
+	case "memory":
+		return jetstream.MemoryStorage, nil
+	}
+	return 0, fmt.Errorf("unknown storage %q", s)
+}
+
+func storageString(storage jetstream.StorageType) string {
+	if storage == jetstream.MemoryStorage {
+		return "memory"
+	}
+	return "file"
+}
+
+// limit returns the unlimited size the way nats stores it
+func limit(maxBytes int64) int64 {
+	if maxBytes == 0 {
+		return -1
+	}
+	return maxBytes
+}
+
+// or returns the setting unless it is zero
+func or[T comparable](setting, declared T) T {
+	var zero T
+	if setting == zero {
+		return declared
+	}
+	return setting
+}
+
+// override returns the parsed setting if it is set, for the zero is valid
+func override[T any](set bool, setting, declared T) T {
+	if !set {
+		return declared
+	}
+	return setting
+}
@@ -0,0 +1,78 @@
+package provision_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gomoni/amble/internal/provision"
+	"github.com/gomoni/amble/internal/services/accounts"
+	"github.com/gomoni/amble/internal/services/audit"
+	"github.com/gomoni/amble/internal/test"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnsureBuckets(t *testing.T) {
+	server, err := test.NewNatsContainer(context.Background(), test.NatsContainerOpts{})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := server.Terminate()
+		require.NoError(t, err)
+	})
+
+	nc, err := nats.Connect(server.Endpoint())
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	js, err := jetstream.New(nc)
+	require.NoError(t, err)
+
+	// given the accounts bucket with history and a retention of audit events
+	buckets, err := provision.Amble().WithConfig(provision.Config{
+		accounts.Bucket:  {History: 5, Storage: "memory"},
+		audit.StreamName: {TTL: "720h", MaxBytes: 1 << 20},
+	})
+	require.NoError(t, err)
+
+	// when ensured twice, then buckets are created once with the settings
+	require.NoError(t, provision.EnsureBuckets(ctx, js, buckets))
+	require.NoError(t, provision.EnsureBuckets(ctx, js, buckets))
+	kv, err := js.KeyValue(ctx, accounts.Bucket)
+	require.NoError(t, err)
+	status, err := kv.Status(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), status.History())
+	stream, err := js.Stream(ctx, "KV_"+accounts.Bucket)
+	require.NoError(t, err)
+	require.Equal(t, jetstream.MemoryStorage, stream.CachedInfo().Config.Storage)
+	stream, err = js.Stream(ctx, audit.StreamName)
+	require.NoError(t, err)
+	require.Equal(t, 720*time.Hour, stream.CachedInfo().Config.MaxAge)
+
+	// when the declaration differs from the existing buckets, then the drift
+	// is reported
+	err = provision.EnsureBuckets(ctx, js, provision.Amble())
+	require.ErrorIs(t, err, provision.ErrDrift)
+	var drift *provision.DriftError
+	require.ErrorAs(t, err, &drift)
+	require.ElementsMatch(t, []provision.Drift{
+		{Bucket: "key value accounts", Setting: "history", Declared: "1", Actual: "5"},
+		{Bucket: "key value accounts", Setting: "storage", Declared: "file", Actual: "memory"},
+		{Bucket: "stream AUDIT", Setting: "max_bytes", Declared: "-1", Actual: "1048576"},
+		{Bucket: "stream AUDIT", Setting: "ttl", Declared: "0s", Actual: "720h0m0s"},
+	}, drift.Drifts)
+
+	// and the bucket is not changed
+	status, err = kv.Status(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), status.History())
+
+	// when settings are invalid, then they are refused
+	_, err = provision.Amble().WithConfig(provision.Config{"sessions": {}})
+	require.Error(t, err)
+	_, err = provision.Amble().WithConfig(provision.Config{accounts.Bucket: {Storage: "tape"}})
+	require.Error(t, err)
+}
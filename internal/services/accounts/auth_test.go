@@ -17,15 +17,20 @@ import (
 	"context"
 	"crypto/ed25519"
 	"crypto/rand"
+	"encoding/json"
 	"errors"
 	"html/template"
 	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/gomoni/amble/internal/auth"
 	"github.com/gomoni/amble/internal/auth/jwt"
 	"github.com/gomoni/amble/internal/test"
+	"github.com/gomoni/amble/internal/tid"
 
 	gojwt "github.com/golang-jwt/jwt/v5"
 	"github.com/nats-io/nats.go"
@@ -37,6 +42,7 @@ import (
 const conf = `
 jetstream: {}
 
+# a nkey user makes nats-server to send a nonce, so devices can sign it
 accounts {
   AUTH: {
 	jetstream: enabled,
@@ -45,18 +51,21 @@ accounts {
 		user: auth,
 		password: auth,
 	  }
+      { nkey: {{.User}} }
     ]
   }
   PLA: {}
   DDI: {}
-  SYS: {}
+  SYS: {
+    users: [ { user: sys, password: sys } ]
+  }
 }
 system_account: SYS
 
 authorization {
   auth_callout {
     issuer: {{.Issuer}}
-    auth_users: [ auth ]
+    auth_users: [ auth, sys, {{.User}} ]
     account: AUTH
     xkey: {{.Xkey}}
   }
@@ -64,14 +73,259 @@ authorization {
 `
 
 func TestAuthCallout(t *testing.T) {
+	// given there is an auth callout service
+	policy := DefaultPolicy()
+	policy.Shared = []string{"amble.shared.>"}
+	endpoint, store, encoder := requireCallout(t, policy)
+
+	// and given there are octocat and hubot users in the same tenant
+	ctx := context.Background()
+	tenant, err := store.CreateTenant(ctx, "plainsof", "PLA")
+	require.NoError(t, err)
+	octocat := requireUser(t, store, "543219", "Octocat")
+	hubot := requireUser(t, store, "583231", "Hubot")
+	require.NoError(t, store.AddMember(ctx, tenant.ID, octocat))
+	require.NoError(t, store.AddMember(ctx, tenant.ID, hubot))
+
+	// when octocat connects with web claims
+	webToken, err := encoder.Encode(webClaims("543219"))
+	require.NoError(t, err)
+	t.Logf("Web token: %s", webToken)
+	errs := make(chan error, 16)
+	octocatNc, err := nats.Connect(
+		endpoint,
+		nats.Token(webToken),
+		nats.CustomInboxPrefix("_INBOX."+octocat.String()),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			errs <- err
+		}),
+	)
+	require.NoError(t, err)
+	t.Cleanup(octocatNc.Close)
+
+	// then octocat can use own namespace
+	sub, err := octocatNc.SubscribeSync("amble." + octocat.String() + ".>")
+	require.NoError(t, err)
+	err = octocatNc.Publish("amble."+octocat.String()+".hello", []byte("github"))
+	require.NoError(t, err)
+	msg, err := sub.NextMsg(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "github", string(msg.Data))
+
+	// and can use request reply via own inbox
+	_, err = octocatNc.Subscribe("amble."+octocat.String()+".echo", func(msg *nats.Msg) {
+		_ = msg.Respond(msg.Data)
+	})
+	require.NoError(t, err)
+	reply, err := octocatNc.Request("amble."+octocat.String()+".echo", []byte("ping"), time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(reply.Data))
+
+	// and can read shared subjects
+	_, err = octocatNc.SubscribeSync("amble.shared.>")
+	require.NoError(t, err)
+	require.NoError(t, octocatNc.Flush())
+	requireNoPermissionsViolation(t, errs)
+
+	// but can't read hubot's namespace
+	_, err = octocatNc.SubscribeSync("amble." + hubot.String() + ".>")
+	require.NoError(t, err)
+	require.NoError(t, octocatNc.Flush())
+	requirePermissionsViolation(t, errs)
+
+	// nor others inboxes
+	_, err = octocatNc.SubscribeSync("_INBOX.>")
+	require.NoError(t, err)
+	require.NoError(t, octocatNc.Flush())
+	requirePermissionsViolation(t, errs)
+
+	// nor publish to hubot's namespace
+	err = octocatNc.Publish("amble."+hubot.String()+".hello", []byte("github"))
+	require.NoError(t, err)
+	require.NoError(t, octocatNc.Flush())
+	requirePermissionsViolation(t, errs)
+
+	// nor to shared subjects
+	err = octocatNc.Publish("amble.shared.hello", []byte("github"))
+	require.NoError(t, err)
+	require.NoError(t, octocatNc.Flush())
+	requirePermissionsViolation(t, errs)
+}
+
+func TestAuthCalloutPlacement(t *testing.T) {
+	// given users may ask the server about themselves
+	policy := DefaultPolicy()
+	policy.Publish = append(policy.Publish, "$SYS.REQ.USER.INFO")
+	endpoint, store, encoder := requireCallout(t, policy)
+
+	// and given there are plainsof and devdist tenants
+	ctx := context.Background()
+	pla, err := store.CreateTenant(ctx, "plainsof", "PLA")
+	require.NoError(t, err)
+	ddi, err := store.CreateTenant(ctx, "devdist", "DDI")
+	require.NoError(t, err)
+
+	// and octocat is a member of plainsof, hubot of both with devdist as a default
+	octocat := requireUser(t, store, "543219", "Octocat")
+	hubot := requireUser(t, store, "583231", "Hubot")
+	requireUser(t, store, "1", "Nobody")
+	require.NoError(t, store.AddMember(ctx, pla.ID, octocat))
+	require.NoError(t, store.AddMember(ctx, pla.ID, hubot))
+	require.NoError(t, store.AddMember(ctx, ddi.ID, hubot))
+	require.NoError(t, store.SetDefaultTenant(ctx, hubot, ddi.ID))
+
+	connect := func(githubID string, uid tid.UserID, opts ...nats.Option) (*nats.Conn, error) {
+		token, err := encoder.Encode(webClaims(githubID))
+		require.NoError(t, err)
+		opts = append(opts, nats.Token(token), nats.CustomInboxPrefix("_INBOX."+uid.String()))
+		return nats.Connect(endpoint, opts...)
+	}
+
+	tests := []struct {
+		name     string
+		githubID string
+		uid      tid.UserID
+		opts     []nats.Option
+		account  string
+	}{
+		{"the only membership", "543219", octocat, nil, "PLA"},
+		{"default tenant", "583231", hubot, nil, "DDI"},
+		{"selected tenant", "583231", hubot, []nats.Option{nats.UserInfo(pla.ID.String(), "")}, "PLA"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nc, err := connect(test.githubID, test.uid, test.opts...)
+			require.NoError(t, err)
+			defer nc.Close()
+			require.Equal(t, test.account, userAccount(t, nc))
+		})
+	}
+
+	// when octocat selects a tenant of hubot, then connection is rejected
+	_, err = connect("543219", octocat, nats.UserInfo(ddi.ID.String(), ""))
+	require.ErrorIs(t, err, nats.ErrAuthorization)
+
+	// when user without a membership connects, then connection is rejected
+	_, err = connect("1", tid.UserID{})
+	require.ErrorIs(t, err, nats.ErrAuthorization)
+}
+
+// userAccount returns the NATS account of the connection
+func userAccount(t *testing.T, nc *nats.Conn) string {
+	t.Helper()
+	msg, err := nc.Request("$SYS.REQ.USER.INFO", nil, time.Second)
+	require.NoError(t, err)
+	var info struct {
+		Data struct {
+			Account string `json:"account"`
+		} `json:"data"`
+	}
+	err = json.Unmarshal(msg.Data, &info)
+	require.NoError(t, err)
+	return info.Data.Account
+}
+
+func TestAuthCalloutNkey(t *testing.T) {
+	endpoint, store, _ := requireCallout(t, DefaultPolicy())
+
+	// given octocat is a member of a tenant
+	ctx := context.Background()
+	tenant, err := store.CreateTenant(ctx, "plainsof", "PLA")
+	require.NoError(t, err)
+	octocat := requireUser(t, store, "543219", "Octocat")
+	require.NoError(t, store.AddMember(ctx, tenant.ID, octocat))
+
+	// and registered a nkey of a cli
+	cli, err := nkeys.CreateUser()
+	require.NoError(t, err)
+	cliPublic, err := cli.PublicKey()
+	require.NoError(t, err)
+	err = store.AddDevice(ctx, Device{PublicKey: cliPublic, UserID: octocat, Name: "cli"})
+	require.NoError(t, err)
+
+	// and downloaded a read only .creds file for an agent
+	agent, creds, err := NewCreds(octocat, "agent")
+	require.NoError(t, err)
+	readOnly := ReadOnlyPolicy()
+	agent.Policy = &readOnly
+	err = store.AddDevice(ctx, agent)
+	require.NoError(t, err)
+	credsPath := filepath.Join(t.TempDir(), "agent.creds")
+	require.NoError(t, os.WriteFile(credsPath, creds, 0o600))
+
+	devices, err := store.Devices(ctx, octocat)
+	require.NoError(t, err)
+	require.Len(t, devices, 2)
+
+	// when cli connects with the nkey
+	cliNc, err := nats.Connect(
+		endpoint,
+		nats.Nkey(cliPublic, cli.Sign),
+		nats.CustomInboxPrefix("_INBOX."+octocat.String()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(cliNc.Close)
+
+	// then it acts as octocat
+	sub, err := cliNc.SubscribeSync("amble." + octocat.String() + ".>")
+	require.NoError(t, err)
+
+	// when agent connects with the .creds file, server in config mode
+	// ignores the user JWT, so the seed is used
+	agentSeed, err := nats.NkeyOptionFromSeed(credsPath)
+	require.NoError(t, err)
+	errs := make(chan error, 16)
+	agentNc, err := nats.Connect(
+		endpoint,
+		agentSeed,
+		nats.CustomInboxPrefix("_INBOX."+octocat.String()),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			errs <- err
+		}),
+	)
+	require.NoError(t, err)
+	t.Cleanup(agentNc.Close)
+
+	// then it has own permissions
+	err = agentNc.Publish("amble."+octocat.String()+".hello", []byte("agent"))
+	require.NoError(t, err)
+	require.NoError(t, agentNc.Flush())
+	requirePermissionsViolation(t, errs)
+	err = cliNc.Publish("amble."+octocat.String()+".hello", []byte("cli"))
+	require.NoError(t, err)
+	msg, err := sub.NextMsg(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "cli", string(msg.Data))
+
+	// when unknown nkey connects, then it is rejected
+	unknown, err := nkeys.CreateUser()
+	require.NoError(t, err)
+	unknownPublic, err := unknown.PublicKey()
+	require.NoError(t, err)
+	_, err = nats.Connect(endpoint, nats.Nkey(unknownPublic, unknown.Sign))
+	require.ErrorIs(t, err, nats.ErrAuthorization)
+
+	// when nkey is signed by other key, then it is rejected
+	_, err = nats.Connect(endpoint, nats.Nkey(cliPublic, unknown.Sign))
+	require.ErrorIs(t, err, nats.ErrAuthorization)
+
+	// when cli is removed, then it can't connect anymore
+	err = store.RemoveDevice(ctx, octocat, cliPublic)
+	require.NoError(t, err)
+	_, err = nats.Connect(endpoint, nats.Nkey(cliPublic, cli.Sign))
+	require.ErrorIs(t, err, nats.ErrAuthorization)
+}
+
+// requireCallout runs nats-server with the auth callout service connected
+func requireCallout(t *testing.T, policy Policy) (string, Accounts, jwt.Encoder) {
+	t.Helper()
 	var buf [ed25519.SeedSize]byte
 	_, err := rand.Read(buf[:])
 	require.NoError(t, err)
 	secret, err := jwt.LoadSecret(bytes.NewReader(buf[:]))
 	require.NoError(t, err)
-
 	encoder := jwt.NewEncoder(secret)
-	//decoder := jwt.NewDecoder(secret.Public())
+	decoder := jwt.NewDecoder(secret.Public())
 
 	calloutServer := requireServer(t)
 	t.Cleanup(func() {
@@ -82,61 +336,91 @@ func TestAuthCallout(t *testing.T) {
 
 	authNc, err := nats.Connect(endpoint, nats.UserInfo("auth", "auth"))
 	require.NoError(t, err)
+	t.Cleanup(authNc.Close)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	t.Cleanup(cancel)
 	js, err := jetstream.New(authNc)
 	require.NoError(t, err)
-	kv, err := js.CreateKeyValue(ctx, jetstream.KeyValueConfig{
-		Bucket: "accounts",
-	})
+	kv, err := js.CreateKeyValue(ctx, KeyValueConfig())
 	require.NoError(t, err)
-	// nats: API error: code=503 err_code=10039 description=jetstream not enabled for account
 
-	// given there is an octocat user
 	store := NewNats(kv)
-	uid, err := store.Create(context.Background(), auth.UserInfo{
-		Name:    "Octocat",
-		Email:   "cat@octocat.example.net",
-		Picture: "https://example.net/octocat.png",
+	svc, err := NewService(calloutServer.xkey.kp, calloutServer.account.kp, store, decoder)
+	require.NoError(t, err)
+	svc = svc.WithPolicy(policy)
+	requireRun(t, svc, authNc)
+	return endpoint, store, encoder
+}
+
+// requireRun runs the callout until the test ends and checks it stopped
+// cleanly. The callout gets own connection with the options of nc, as Run
+// drains it.
+func requireRun(t *testing.T, svc Service, nc *nats.Conn) {
+	t.Helper()
+	nc, err := nc.Opts.Connect()
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- svc.Run(ctx, nc, time.Second)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-errs)
+	})
+	// wait for the service to be registered
+	require.Eventually(t, func() bool {
+		_, err := nc.Request("$SRV.PING."+ServiceName, nil, 100*time.Millisecond)
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func requireUser(t testing.TB, store Accounts, githubID, name string) tid.UserID {
+	t.Helper()
+	ctx := context.Background()
+	uid, err := store.Create(ctx, auth.UserInfo{
+		Name:    name,
+		Email:   strings.ToLower(name) + "@octocat.example.net",
+		Picture: "https://example.net/" + strings.ToLower(name) + ".png",
 	})
 	require.NoError(t, err)
-	const githubID = "543219"
 	err = store.Link(ctx, "github", githubID, uid)
 	require.NoError(t, err)
+	return uid
+}
 
-	// and given there are web Claims
-	webToken, err := encoder.Encode(jwt.Claims{
+func webClaims(githubID string) jwt.Claims {
+	return jwt.Claims{
 		RegisteredClaims: jwt.RegisteredClaims{
 			Issuer:    "github",
 			Subject:   githubID,
-			Audience:  []string{},
+			Audience:  []string{jwt.AudienceApp},
 			ExpiresAt: gojwt.NewNumericDate(time.Now().Add(10 * time.Second)),
 			NotBefore: gojwt.NewNumericDate(time.Now()),
 			IssuedAt:  gojwt.NewNumericDate(time.Now()),
 			ID:        githubID,
 		},
-		UserInfo: auth.UserInfo{
-			Name:    "",
-			Email:   "",
-			Picture: "",
-		},
-	})
-	require.NoError(t, err)
-
-	t.Logf("Web token: %s", webToken)
-	octocatNc, err := nats.Connect(endpoint, nats.Token(webToken))
-	require.NoError(t, err)
-	t.Logf("octocatNc.Opts.Token: %s", octocatNc.Opts.Token)
-
-	err = octocatNc.Publish("auth", []byte("github"))
-	require.NoError(t, err)
+	}
+}
 
-	// TODO: once this will work, then the user data - like a octocat's user id and so shall be returned
-	// TODO: more users with more accounts
-	// TODO: auth user must NOT be able to create accounts! This is just a short-cut
+func requirePermissionsViolation(t *testing.T, errs <-chan error) {
+	t.Helper()
+	select {
+	case err := <-errs:
+		require.ErrorContains(t, err, "Permissions Violation")
+	case <-time.After(time.Second):
+		t.Fatal("expected permissions violation")
+	}
+}
 
-	time.Sleep(5 * time.Second)
+func requireNoPermissionsViolation(t *testing.T, errs <-chan error) {
+	t.Helper()
+	select {
+	case err := <-errs:
+		t.Fatalf("unexpected error: %s", err)
+	case <-time.After(100 * time.Millisecond):
+	}
 }
 
 type authCalloutServer struct {
@@ -157,12 +441,12 @@ func requireServer(t *testing.T) authCalloutServer {
 	xkey, err := nscC()
 	require.NoError(t, err)
 	// nsc generate nkey --curve
-	//user, err := nscU()
-	//require.NoError(t, err)
+	user, err := nscU()
+	require.NoError(t, err)
 
 	// generate config
 	var conf bytes.Buffer
-	err = mkconf(&conf, xkey, account)
+	err = mkconf(&conf, xkey, account, user)
 	require.NoError(t, err)
 	t.Logf("config: %s", conf.String())
 
@@ -223,7 +507,7 @@ func nsc(prefix nkeys.PrefixByte) (keypair, error) {
 	return keypair{public: public, seed: seed, kp: kp}, nil
 }
 
-func mkconf(w io.Writer, xkey, account keypair) error {
+func mkconf(w io.Writer, xkey, account, user keypair) error {
 	if !nkeys.IsValidPublicCurveKey(xkey.public) {
 		return errors.New("Invalid curve key")
 	}
@@ -239,6 +523,7 @@ func mkconf(w io.Writer, xkey, account keypair) error {
 		map[string]string{
 			"Issuer": account.public,
 			"Xkey":   xkey.public,
+			"User":   user.public,
 		},
 	)
 }
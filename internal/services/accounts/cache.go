@@ -0,0 +1,334 @@
+package accounts
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomoni/amble/internal/auth"
+	"github.com/gomoni/amble/internal/tid"
+)
+
+const (
+	// DefaultCacheSize is the number of entries kept by Cache
+	DefaultCacheSize = 10_000
+	// DefaultCacheTTL bounds how long a missed change can be served
+	DefaultCacheTTL = time.Minute
+)
+
+// CacheStats are reported in the data of the auth-callout endpoint
+type CacheStats struct {
+	Hits          uint64 `json:"hits"`
+	Misses        uint64 `json:"misses"`
+	Evictions     uint64 `json:"evictions"`
+	Invalidations uint64 `json:"invalidations"`
+	Size          int    `json:"size"`
+}
+
+// Cache is a read-through cache of links, accounts, admissions, plans and
+// placements for the auth callout. Entries are keyed like the keys in the
+// bucket, the least recently used one is evicted when the cache is full. Run
+// invalidates changed entries, the TTL bounds the staleness when a change is
+// missed.
+type Cache struct {
+	accounts Accounts
+	size     int
+	ttl      time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// order has the most recently used entry in front
+	order *list.List
+	// epoch grows with every invalidation, a value read from the bucket
+	// before it might be stale and is not stored
+	epoch uint64
+
+	hits          atomic.Uint64
+	misses        atomic.Uint64
+	evictions     atomic.Uint64
+	invalidations atomic.Uint64
+}
+
+type cacheEntry struct {
+	key      string
+	uid      tid.UserID
+	userInfo auth.UserInfo
+	// admission is the error of Accounts.Admit without a token and revoked
+	// the unix time of the last revocation
+	admission error
+	revoked   int64
+	plan      Plan
+	tenant    Tenant
+	expires   time.Time
+}
+
+// NewCache returns a cache of up to size entries, each kept for the ttl at
+// most
+func NewCache(accounts Accounts, size int, ttl time.Duration) *Cache {
+	return &Cache{
+		accounts: accounts,
+		size:     size,
+		ttl:      ttl,
+		now:      time.Now,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// Linked returns the user id for given provider/provider id pair like
+// Accounts.Linked. Missing links are not cached.
+func (c *Cache) Linked(ctx context.Context, provider, id string) (tid.UserID, error) {
+	key := strings.Join([]string{"auth_link", provider, id}, ".")
+	if entry, ok := c.get(key); ok {
+		return entry.uid, nil
+	}
+	epoch := c.current()
+	uid, err := c.accounts.Linked(ctx, provider, id)
+	if err != nil {
+		return tid.UserID{}, err
+	}
+	c.put(epoch, cacheEntry{key: key, uid: uid})
+	return uid, nil
+}
+
+// Get returns the account like Accounts.Get
+func (c *Cache) Get(ctx context.Context, uid tid.UserID) (auth.UserInfo, error) {
+	key := "user_info." + uid.String() + ".app"
+	if entry, ok := c.get(key); ok {
+		return entry.userInfo, nil
+	}
+	epoch := c.current()
+	userInfo, err := c.accounts.Get(ctx, uid)
+	if err != nil {
+		return auth.UserInfo{}, err
+	}
+	c.put(epoch, cacheEntry{key: key, userInfo: userInfo})
+	return userInfo, nil
+}
+
+// Admit returns the same errors as Accounts.Admit. Admitted and refused users
+// are cached, failed lookups are not.
+func (c *Cache) Admit(ctx context.Context, uid tid.UserID, issuedAt time.Time) error {
+	key := "admit." + uid.String()
+	entry, ok := c.get(key)
+	if !ok {
+		epoch := c.current()
+		admission := c.accounts.Admit(ctx, uid, time.Time{})
+		if admission != nil && !refused(admission) {
+			return admission
+		}
+		revoked, err := c.accounts.revokedAt(ctx, uid)
+		if err != nil {
+			return fmt.Errorf("account admit: %w", err)
+		}
+		entry = cacheEntry{key: key, admission: admission, revoked: revoked}
+		c.put(epoch, entry)
+	}
+	// in the order of Accounts.Admit
+	if errors.Is(entry.admission, ErrErased) || errors.Is(entry.admission, ErrSuspended) {
+		return entry.admission
+	}
+	err := revokedSince(issuedAt, entry.revoked)
+	if err != nil {
+		return fmt.Errorf("account admit: %w", err)
+	}
+	return entry.admission
+}
+
+// refused reports an error of Admit refusing the user
+func refused(err error) bool {
+	for _, target := range []error{ErrErased, ErrSuspended, ErrDeletionPending, ErrPendingApproval} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// UserPlan returns the plan of the user like Accounts.UserPlan
+func (c *Cache) UserPlan(ctx context.Context, uid tid.UserID) (Plan, error) {
+	key := userPlanKey(uid)
+	if entry, ok := c.get(key); ok {
+		return entry.plan, nil
+	}
+	epoch := c.current()
+	plan, err := c.accounts.UserPlan(ctx, uid)
+	if err != nil {
+		return Plan{}, err
+	}
+	c.put(epoch, cacheEntry{key: key, plan: plan})
+	return plan, nil
+}
+
+// Placement returns the tenant of the user like Accounts.Placement. Refused
+// placements are not cached.
+func (c *Cache) Placement(ctx context.Context, uid tid.UserID, requested string) (Tenant, error) {
+	key := "placement." + uid.String() + "." + requested
+	if entry, ok := c.get(key); ok {
+		return entry.tenant, nil
+	}
+	epoch := c.current()
+	tenant, err := c.accounts.Placement(ctx, uid, requested)
+	if err != nil {
+		return Tenant{}, err
+	}
+	c.put(epoch, cacheEntry{key: key, tenant: tenant})
+	return tenant, nil
+}
+
+// Run invalidates entries by the account change feed until ctx is done. The
+// watch is resumed from the last revision if it stops, the cache is purged
+// when changes could be lost.
+func (c *Cache) Run(ctx context.Context) error {
+	var from uint64
+	for {
+		for event, err := range c.accounts.Watch(ctx, WatchFilter{FromRevision: from}) {
+			if err != nil {
+				// the key of the change is unknown
+				c.Purge()
+				continue
+			}
+			c.invalidate(event)
+			from = event.Revision + 1
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if from == 0 {
+			// a live watch starts after the changes made meanwhile
+			c.Purge()
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// Purge drops all the entries
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epoch++
+	c.invalidations.Add(uint64(len(c.entries)))
+	clear(c.entries)
+	c.order.Init()
+}
+
+// Stats returns the counts since the cache was created
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	size := len(c.entries)
+	c.mu.Unlock()
+	return CacheStats{
+		Hits:          c.hits.Load(),
+		Misses:        c.misses.Load(),
+		Evictions:     c.evictions.Load(),
+		Invalidations: c.invalidations.Load(),
+		Size:          size,
+	}
+}
+
+// invalidate removes the entry of the event. A change of a plan or a tenant
+// removes the entries of all users, which may have it.
+func (c *Cache) invalidate(event Event) {
+	var key, prefix string
+	switch event.Type {
+	case EventLinked, EventUnlinked:
+		key = strings.Join([]string{"auth_link", event.Provider, event.ID}, ".")
+	case EventCreated, EventDeleted:
+		key = "user_info." + event.UserID.String() + ".app"
+	case EventProfileUpdated:
+		if event.Provider != "app" {
+			return
+		}
+		key = "user_info." + event.UserID.String() + ".app"
+	case EventStatusChanged:
+		key = "admit." + event.UserID.String()
+	case EventPlanChanged:
+		if event.UserID.IsZero() {
+			prefix = "user_plan."
+		} else {
+			key = userPlanKey(event.UserID)
+		}
+	case EventPlacementChanged:
+		if event.UserID.IsZero() {
+			prefix = "placement."
+		} else {
+			prefix = "placement." + event.UserID.String() + "."
+		}
+	default:
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epoch++
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+		c.invalidations.Add(1)
+	}
+	if prefix == "" {
+		return
+	}
+	for k, elem := range c.entries {
+		if strings.HasPrefix(k, prefix) {
+			c.remove(elem)
+			c.invalidations.Add(1)
+		}
+	}
+}
+
+func (c *Cache) current() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.epoch
+}
+
+func (c *Cache) get(key string) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if ok && c.now().After(elem.Value.(*cacheEntry).expires) {
+		c.remove(elem)
+		ok = false
+	}
+	if !ok {
+		c.misses.Add(1)
+		return cacheEntry{}, false
+	}
+	c.hits.Add(1)
+	c.order.MoveToFront(elem)
+	return *elem.Value.(*cacheEntry), true
+}
+
+// put stores the entry unless an invalidation happened since the epoch
+func (c *Cache) put(epoch uint64, entry cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if epoch != c.epoch || c.size <= 0 {
+		return
+	}
+	entry.expires = c.now().Add(c.ttl)
+	if elem, ok := c.entries[entry.key]; ok {
+		*elem.Value.(*cacheEntry) = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[entry.key] = c.order.PushFront(&entry)
+	for len(c.entries) > c.size {
+		c.remove(c.order.Back())
+		c.evictions.Add(1)
+	}
+}
+
+func (c *Cache) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+}
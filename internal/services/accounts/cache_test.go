@@ -0,0 +1,255 @@
+package accounts
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gomoni/amble/internal/auth"
+	appJWT "github.com/gomoni/amble/internal/auth/jwt"
+	"github.com/gomoni/amble/internal/services/audit"
+	"github.com/gomoni/amble/internal/test"
+
+	gojwt "github.com/golang-jwt/jwt/v5"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewMemory()
+	octocat := requireUser(t, store, "543219", "Octocat")
+	hubot := requireUser(t, store, "583231", "Hubot")
+	now := time.Now()
+	cache := NewCache(store, 2, time.Minute)
+	cache.now = func() time.Time { return now }
+
+	// when the link is looked up twice, then the second is a hit
+	for range 2 {
+		uid, err := cache.Linked(ctx, "github", "543219")
+		require.NoError(t, err)
+		require.Equal(t, octocat, uid)
+	}
+	require.Equal(t, CacheStats{Hits: 1, Misses: 1, Size: 1}, cache.Stats())
+
+	// and missing links are not cached
+	_, err := cache.Linked(ctx, "github", "1")
+	require.ErrorIs(t, err, jetstream.ErrKeyNotFound)
+	require.Equal(t, 1, cache.Stats().Size)
+
+	// when the cache is full, then the least recently used entry is evicted
+	_, err = cache.Get(ctx, octocat)
+	require.NoError(t, err)
+	_, err = cache.Get(ctx, hubot)
+	require.NoError(t, err)
+	stats := cache.Stats()
+	require.Equal(t, uint64(1), stats.Evictions)
+	require.Equal(t, 2, stats.Size)
+
+	// when the ttl passes, then the account is read again
+	now = now.Add(time.Minute + time.Second)
+	_, err = cache.Get(ctx, hubot)
+	require.NoError(t, err)
+	require.Equal(t, stats.Misses+1, cache.Stats().Misses)
+
+	// when the cache runs
+	runCtx, cancel := context.WithCancel(ctx)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- cache.Run(runCtx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-errs)
+	})
+
+	// then a changed account is invalidated
+	require.Eventually(t, func() bool {
+		_, err := store.Update(ctx, hubot, func(current auth.UserInfo) (auth.UserInfo, error) {
+			current.Name = "Hubot2"
+			return current, nil
+		})
+		require.NoError(t, err)
+		userInfo, err := cache.Get(ctx, hubot)
+		require.NoError(t, err)
+		return userInfo.Name == "Hubot2"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// and an erased link is not served
+	_, err = cache.Linked(ctx, "github", "543219")
+	require.NoError(t, err)
+	require.NoError(t, store.Erase(ctx, octocat))
+	require.Eventually(t, func() bool {
+		_, err := cache.Linked(ctx, "github", "543219")
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Positive(t, cache.Stats().Invalidations)
+}
+
+func TestCacheAdmission(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewMemory()
+	octocat := requireUser(t, store, "543219", "Octocat")
+	hubot := requireUser(t, store, "583231", "Hubot")
+	cache := NewCache(store, DefaultCacheSize, time.Minute)
+
+	// given cached admissions, plans and placements
+	issuedAt := time.Now().Add(-time.Hour)
+	for range 2 {
+		require.NoError(t, cache.Admit(ctx, octocat, issuedAt))
+		require.NoError(t, cache.Admit(ctx, hubot, time.Time{}))
+		plan, err := cache.UserPlan(ctx, hubot)
+		require.NoError(t, err)
+		require.Equal(t, DefaultPlanName, plan.Name)
+	}
+	require.Equal(t, uint64(3), cache.Stats().Hits)
+	_, err := cache.Placement(ctx, hubot, "")
+	require.ErrorIs(t, err, ErrNoMembership)
+
+	// when the cache runs
+	runCtx, cancel := context.WithCancel(ctx)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- cache.Run(runCtx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-errs)
+	})
+
+	// then a suspension refuses hubot
+	require.Eventually(t, func() bool {
+		require.NoError(t, store.Suspend(ctx, hubot, "spam"))
+		return errors.Is(cache.Admit(ctx, hubot, time.Time{}), ErrSuspended)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// and a revocation refuses the token of octocat, but not a new one
+	require.NoError(t, store.RevokeTokens(ctx, octocat))
+	require.Eventually(t, func() bool {
+		return errors.Is(cache.Admit(ctx, octocat, issuedAt), ErrRevoked)
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, cache.Admit(ctx, octocat, time.Now().Add(time.Hour)))
+
+	// and an assigned plan is served
+	require.NoError(t, store.PutPlan(ctx, Plan{Name: "pro"}))
+	require.NoError(t, store.SetUserPlan(ctx, hubot, "pro"))
+	require.Eventually(t, func() bool {
+		plan, err := cache.UserPlan(ctx, hubot)
+		require.NoError(t, err)
+		return plan.Name == "pro"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// and a changed plan is served to its users
+	require.NoError(t, store.PutPlan(ctx, Plan{Name: "pro", ConnectionTypes: []string{"MQTT"}}))
+	require.Eventually(t, func() bool {
+		plan, err := cache.UserPlan(ctx, hubot)
+		require.NoError(t, err)
+		return len(plan.ConnectionTypes) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// and a new membership places hubot
+	pla, err := store.CreateTenant(ctx, "plainsof", "PLA")
+	require.NoError(t, err)
+	require.NoError(t, store.AddMember(ctx, pla.ID, hubot))
+	tenant, err := cache.Placement(ctx, hubot, "")
+	require.NoError(t, err)
+	require.Equal(t, pla, tenant)
+
+	// and a removed one does not
+	require.NoError(t, store.RemoveMember(ctx, pla.ID, hubot))
+	require.Eventually(t, func() bool {
+		_, err := cache.Placement(ctx, hubot, "")
+		return errors.Is(err, ErrNoMembership)
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// BenchmarkAuthorize compares the callout latency with and without the cache
+// under concurrent connects of the users
+//
+//	go test -run '^$' -bench Authorize ./internal/services/accounts
+func BenchmarkAuthorize(b *testing.B) {
+	ctx := context.Background()
+	server, err := test.NewNatsContainer(ctx, test.NatsContainerOpts{})
+	require.NoError(b, err)
+	b.Cleanup(func() {
+		require.NoError(b, server.Terminate())
+	})
+	nc, err := nats.Connect(server.Endpoint())
+	require.NoError(b, err)
+	b.Cleanup(nc.Close)
+	js, err := jetstream.New(nc)
+	require.NoError(b, err)
+	kv, err := js.CreateKeyValue(ctx, KeyValueConfig())
+	require.NoError(b, err)
+	store := NewNats(kv)
+
+	var buf [ed25519.SeedSize]byte
+	_, err = rand.Read(buf[:])
+	require.NoError(b, err)
+	secret, err := appJWT.LoadSecret(bytes.NewReader(buf[:]))
+	require.NoError(b, err)
+	encoder := appJWT.NewEncoder(secret)
+	xkey, err := nkeys.CreateCurveKeys()
+	require.NoError(b, err)
+	issuer, err := nkeys.CreateAccount()
+	require.NoError(b, err)
+	svc, err := NewService(xkey, issuer, store, appJWT.NewDecoder(secret.Public()))
+	require.NoError(b, err)
+
+	// given a hundred users in a tenant
+	pla, err := store.CreateTenant(ctx, "plainsof", "PLA")
+	require.NoError(b, err)
+	const users = 100
+	requests := make([]*jwt.AuthorizationRequestClaims, users)
+	for i := range users {
+		githubID := fmt.Sprint(i)
+		uid := requireUser(b, store, githubID, "user"+githubID)
+		require.NoError(b, store.AddMember(ctx, pla.ID, uid))
+		claims := webClaims(githubID)
+		claims.ExpiresAt = gojwt.NewNumericDate(time.Now().Add(time.Hour))
+		token, err := encoder.Encode(claims)
+		require.NoError(b, err)
+		user, err := nkeys.CreateUser()
+		require.NoError(b, err)
+		public, err := user.PublicKey()
+		require.NoError(b, err)
+		rc := jwt.NewAuthorizationRequestClaims(public)
+		rc.UserNkey = public
+		rc.ConnectOptions.Token = token
+		requests[i] = rc
+	}
+
+	bench := func(b *testing.B, svc Service) {
+		b.RunParallel(func(pb *testing.PB) {
+			i := 0
+			for pb.Next() {
+				event := audit.Event{}
+				_, err := svc.authorize(ctx, requests[i%users], &event)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				i++
+			}
+		})
+	}
+	b.Run("kv", func(b *testing.B) {
+		bench(b, svc)
+	})
+	b.Run("cache", func(b *testing.B) {
+		cache := NewCache(store, DefaultCacheSize, DefaultCacheTTL)
+		bench(b, svc.WithCache(cache))
+		stats := cache.Stats()
+		b.ReportMetric(float64(stats.Hits)/float64(stats.Hits+stats.Misses), "hits/op")
+	})
+}
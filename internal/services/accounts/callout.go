@@ -0,0 +1,126 @@
+package accounts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+)
+
+const (
+	// AuthCalloutSubject is where nats-server sends authorization requests
+	AuthCalloutSubject = "$SYS.REQ.USER.AUTH"
+	ServiceName        = "auth-callout"
+	ServiceVersion     = "0.1.0"
+)
+
+// Stats are reported as data of the auth-callout endpoint in micro stats,
+// see `nats micro stats auth-callout`. Latency is reported by micro itself as
+// processing_time and average_processing_time.
+type Stats struct {
+	Accepted uint64 `json:"accepted"`
+	Rejected uint64 `json:"rejected"`
+	// Refused counts rejections by ErrorClass
+	Refused map[ErrorClass]uint64 `json:"refused,omitempty"`
+	// Cache is set for a service WithCache
+	Cache *CacheStats `json:"cache,omitempty"`
+}
+
+type calloutStats struct {
+	accepted atomic.Uint64
+	rejected atomic.Uint64
+	mu       sync.Mutex
+	refused  map[ErrorClass]uint64
+	cache    *Cache
+}
+
+func (c *calloutStats) record(err error) {
+	if err == nil {
+		c.accepted.Add(1)
+		return
+	}
+	c.rejected.Add(1)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.refused == nil {
+		c.refused = make(map[ErrorClass]uint64)
+	}
+	c.refused[classOf(err)]++
+}
+
+func (c *calloutStats) stats(*micro.Endpoint) any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := Stats{
+		Accepted: c.accepted.Load(),
+		Rejected: c.rejected.Load(),
+		Refused:  maps.Clone(c.refused),
+	}
+	if c.cache != nil {
+		cache := c.cache.Stats()
+		stats.Cache = &cache
+	}
+	return stats
+}
+
+// Run registers the auth-callout micro service on nc and serves requests until
+// ctx is done. Then nc is drained, so requests delivered meanwhile are served,
+// and closed. Run waits for it up to the shutdownTimeout, so nc must be
+// dedicated to the service.
+func (s Service) Run(ctx context.Context, nc *nats.Conn, shutdownTimeout time.Duration) error {
+	var stats calloutStats
+	stats.cache = s.cache
+	handler := func(r micro.Request) {
+		stats.record(s.authCallout(r))
+	}
+
+	mode := "server"
+	if s.accountKeys != nil {
+		mode = "operator"
+	}
+	_, err := micro.AddService(nc, micro.Config{
+		Name:        ServiceName,
+		Version:     ServiceVersion,
+		Description: "Authorizes NATS connections by amble web tokens and device nkeys",
+		Metadata: map[string]string{
+			"mode": mode,
+		},
+		Endpoint: &micro.EndpointConfig{
+			Subject: AuthCalloutSubject,
+			Handler: micro.HandlerFunc(handler),
+			Metadata: map[string]string{
+				"encrypted": fmt.Sprint(s.xKeyPair != nil),
+			},
+		},
+		StatsHandler: stats.stats,
+	})
+	if err != nil {
+		return fmt.Errorf("auth callout run: add service: %w", err)
+	}
+
+	<-ctx.Done()
+	// the subscriptions are removed after the callbacks of the delivered
+	// requests returned, the connection is closed after all of them
+	err = nc.Drain()
+	if err != nil {
+		return fmt.Errorf("auth callout run: drain: %w", err)
+	}
+	timeout := time.After(shutdownTimeout)
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for !nc.IsClosed() {
+		select {
+		case <-ticker.C:
+		case <-timeout:
+			nc.Close()
+			return errors.New("auth callout run: in-flight requests not finished in time")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package accounts
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunStats(t *testing.T) {
+	// given the callout runs as a micro service
+	endpoint, store, encoder := requireCallout(t, DefaultPolicy())
+	ctx := context.Background()
+	pla, err := store.CreateTenant(ctx, "plainsof", "PLA")
+	require.NoError(t, err)
+	octocat := requireUser(t, store, "543219", "Octocat")
+	require.NoError(t, store.AddMember(ctx, pla.ID, octocat))
+
+	// when octocat connects and an unknown token is rejected
+	token, err := encoder.Encode(webClaims("543219"))
+	require.NoError(t, err)
+	nc, err := nats.Connect(endpoint, nats.Token(token))
+	require.NoError(t, err)
+	nc.Close()
+	_, err = nats.Connect(endpoint, nats.Token("garbage"))
+	require.ErrorIs(t, err, nats.ErrAuthorization)
+
+	// then micro stats report the counts and latency
+	authNc, err := nats.Connect(endpoint, nats.UserInfo("auth", "auth"))
+	require.NoError(t, err)
+	t.Cleanup(authNc.Close)
+	msg, err := authNc.Request("$SRV.STATS."+ServiceName, nil, time.Second)
+	require.NoError(t, err)
+	var info micro.Stats
+	require.NoError(t, json.Unmarshal(msg.Data, &info))
+	require.Equal(t, ServiceVersion, info.Version)
+	require.Len(t, info.Endpoints, 1)
+	require.Equal(t, AuthCalloutSubject, info.Endpoints[0].Subject)
+	require.Equal(t, 2, info.Endpoints[0].NumRequests)
+	require.Positive(t, info.Endpoints[0].AverageProcessingTime)
+	var stats Stats
+	require.NoError(t, json.Unmarshal(info.Endpoints[0].Data, &stats))
+	require.Equal(t, Stats{Accepted: 1, Rejected: 1, Refused: map[ErrorClass]uint64{ClassBadToken: 1}}, stats)
+	require.Contains(t, info.Endpoints[0].LastError, StatusUnauthorized)
+	require.Contains(t, info.Endpoints[0].LastError, ClassBadToken.Message())
+}
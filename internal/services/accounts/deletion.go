@@ -0,0 +1,251 @@
+package accounts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/gomoni/amble/internal/tid"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// DefaultGracePeriod is how long a deletion can be canceled
+const DefaultGracePeriod = 30 * 24 * time.Hour
+
+var (
+	// ErrDeletionPending is returned for users of an account scheduled for
+	// deletion
+	ErrDeletionPending = errors.New("account is scheduled for deletion")
+	// ErrErased is returned for user ids of erased accounts
+	ErrErased = errors.New("account was erased")
+)
+
+// Deletion of the account requested by the user itself or by an admin. The
+// account is erased at EraseAt unless the deletion is canceled.
+type Deletion struct {
+	RequestedAt time.Time  `json:"requested_at"`
+	EraseAt     time.Time  `json:"erase_at"`
+	By          tid.UserID `json:"by"`
+}
+
+// Tombstone is all that is left of an erased account, so the user id is
+// never used again
+type Tombstone struct {
+	ErasedAt time.Time `json:"erased_at"`
+}
+
+func deletionKey(uid tid.UserID) string {
+	return "deletion." + uid.String()
+}
+
+func erasedKey(uid tid.UserID) string {
+	return "erased." + uid.String()
+}
+
+// RequestDeletion schedules the erasure of the account after the grace period
+// and revokes its web tokens. Requesting again can only move the erasure
+// closer. Stored in `deletion.$uid`
+func (n Accounts) RequestDeletion(ctx context.Context, uid tid.UserID, by tid.UserID, grace time.Duration) (Deletion, error) {
+	_, err := n.Get(ctx, uid)
+	if err != nil {
+		return Deletion{}, fmt.Errorf("account request deletion: %w", err)
+	}
+	now := time.Now().UTC()
+	deletion, _, err := updateJSON(ctx, n.kv, deletionKey(uid), func(current Deletion, exists bool) (Deletion, error) {
+		eraseAt := now.Add(grace)
+		if !exists {
+			return Deletion{RequestedAt: now, EraseAt: eraseAt, By: by}, nil
+		}
+		if eraseAt.Before(current.EraseAt) {
+			current.EraseAt = eraseAt
+			current.By = by
+		}
+		return current, nil
+	})
+	if err != nil {
+		return Deletion{}, fmt.Errorf("account request deletion: %w", err)
+	}
+	err = n.RevokeTokens(ctx, uid)
+	if err != nil {
+		return Deletion{}, fmt.Errorf("account request deletion: %w", err)
+	}
+	return deletion, nil
+}
+
+// Deletion returns the pending deletion of the account
+func (n Accounts) Deletion(ctx context.Context, uid tid.UserID) (Deletion, error) {
+	entry, err := n.kv.Get(ctx, deletionKey(uid))
+	if err != nil {
+		return Deletion{}, fmt.Errorf("account deletion: %w", err)
+	}
+	var deletion Deletion
+	err = json.Unmarshal(entry.Value(), &deletion)
+	if err != nil {
+		return Deletion{}, fmt.Errorf("account deletion: unmarshal: %w", err)
+	}
+	return deletion, nil
+}
+
+// CancelDeletion keeps the account, tokens revoked by RequestDeletion stay
+// revoked
+func (n Accounts) CancelDeletion(ctx context.Context, uid tid.UserID) error {
+	entry, err := n.kv.Get(ctx, deletionKey(uid))
+	if err != nil {
+		return fmt.Errorf("account cancel deletion: %w", err)
+	}
+	err = n.kv.Delete(ctx, deletionKey(uid), jetstream.LastRevision(entry.Revision()))
+	if err != nil {
+		return fmt.Errorf("account cancel deletion: %w", err)
+	}
+	return nil
+}
+
+// DueDeletions returns the accounts to be erased at now
+func (n Accounts) DueDeletions(ctx context.Context, now time.Time) ([]tid.UserID, error) {
+	entries, err := WatchEntries(ctx, n.kv, "deletion.*", jetstream.IgnoreDeletes())
+	if err != nil {
+		return nil, fmt.Errorf("account due deletions: %w", err)
+	}
+
+	uids := make([]tid.UserID, 0)
+	for _, entry := range entries {
+		var deletion Deletion
+		err = json.Unmarshal(entry.Value(), &deletion)
+		if err != nil {
+			return nil, fmt.Errorf("account due deletions: unmarshal %s: %w", entry.Key(), err)
+		}
+		if deletion.EraseAt.After(now) {
+			continue
+		}
+		uid, err := tid.ParseUserID(entry.Key()[len("deletion."):])
+		if err != nil {
+			return nil, fmt.Errorf("account due deletions: parse %s: %w", entry.Key(), err)
+		}
+		uids = append(uids, uid)
+	}
+	return uids, nil
+}
+
+// Eraser erases the data of the user kept outside of the accounts bucket,
+// like the audit trail or exports
+type Eraser interface {
+	Erase(ctx context.Context, uid tid.UserID) error
+}
+
+// WithErasers returns accounts, which Erase the data of the user by the
+// erasers too
+func (n Accounts) WithErasers(erasers ...Eraser) Accounts {
+	n.erasers = append(slices.Clip(n.erasers), erasers...)
+	return n
+}
+
+// Erase purges all keys of the account including the history: user info of
+// all providers, links of logins, passkeys, devices, TOTP, memberships, plan,
+// suspension and revocation, then the data of the erasers. Only the tombstone
+// `erased.$uid` stays. Erase can be called again if it failed in the middle.
+func (n Accounts) Erase(ctx context.Context, uid tid.UserID) error {
+	// tombstone first, so the account is refused while being erased
+	b, err := json.Marshal(Tombstone{ErasedAt: time.Now().UTC()})
+	if err != nil {
+		return fmt.Errorf("account erase: marshal: %w", err)
+	}
+	_, err = n.kv.Create(ctx, erasedKey(uid), b)
+	if err != nil && !errors.Is(err, jetstream.ErrKeyExists) {
+		return fmt.Errorf("account erase: %w", err)
+	}
+
+	keys, err := n.accountKeys(ctx, uid)
+	if err != nil {
+		return fmt.Errorf("account erase: %w", err)
+	}
+	for _, key := range keys {
+		err = n.kv.Purge(ctx, key)
+		if err != nil {
+			return fmt.Errorf("account erase: purge %s: %w", key, err)
+		}
+	}
+	for _, eraser := range n.erasers {
+		err = eraser.Erase(ctx, uid)
+		if err != nil {
+			return fmt.Errorf("account erase: %w", err)
+		}
+	}
+	return nil
+}
+
+// accountKeys returns keys owned by the user including deleted ones, their
+// history may still have values
+func (n Accounts) accountKeys(ctx context.Context, uid tid.UserID) ([]string, error) {
+	u := uid.String()
+	patterns := []string{
+		"totp." + u,
+		"default_tenant." + u,
+		userPlanKey(uid),
+		suspendedKey(uid),
+		revokedKey(uid),
+		deletionKey(uid),
+		approvalKey(uid),
+		profilePinsKey(uid),
+		"user_info." + u + ".*",
+		"passkey." + u + ".*",
+		"device." + u + ".*",
+		"member." + u + ".*",
+	}
+	var keys []string
+	for _, pattern := range patterns {
+		found, err := watchKeys(ctx, n.kv, pattern)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, found...)
+	}
+
+	// auth_link.$provider.$id -> $uid including the overwritten values
+	links, err := n.pointers(ctx, "auth_link.>", uid, jetstream.IncludeHistory())
+	if err != nil {
+		return nil, err
+	}
+	keys = append(keys, links...)
+	// email.$hash -> $uid, a released email may be indexed for another
+	// account now
+	emails, err := n.pointers(ctx, "email.*", uid)
+	if err != nil {
+		return nil, err
+	}
+	keys = append(keys, emails...)
+	return keys, nil
+}
+
+// ValidToken returns ErrErased or ErrRevoked if a web token of the user issued
+// at issuedAt can't be used anymore. Unlike Admit, users of suspended accounts
+// and accounts scheduled for deletion pass, so they can sign in to the web.
+func (n Accounts) ValidToken(ctx context.Context, uid tid.UserID, issuedAt time.Time) error {
+	err := n.erased(ctx, uid)
+	if err != nil {
+		return err
+	}
+	return n.revoked(ctx, uid, issuedAt)
+}
+
+func (n Accounts) erased(ctx context.Context, uid tid.UserID) error {
+	_, err := n.kv.Get(ctx, erasedKey(uid))
+	if err == nil {
+		return ErrErased
+	} else if !errors.Is(err, jetstream.ErrKeyNotFound) {
+		return err
+	}
+	return nil
+}
+
+func (n Accounts) deletionPending(ctx context.Context, uid tid.UserID) error {
+	deletion, err := n.Deletion(ctx, uid)
+	if err == nil {
+		return fmt.Errorf("%w: erased at %s", ErrDeletionPending, deletion.EraseAt.Format(time.RFC3339))
+	} else if !errors.Is(err, jetstream.ErrKeyNotFound) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package accounts
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gomoni/amble/internal/auth"
+	"github.com/gomoni/amble/internal/tid"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeletion(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewMemory()
+	octocat, err := store.Create(ctx, auth.UserInfo{Name: "Octocat"})
+	require.NoError(t, err)
+	require.NoError(t, store.Link(ctx, "github", "543219", octocat))
+	require.NoError(t, store.UpdateUserInfo(ctx, "github", octocat, map[string]any{"login": "octocat"}))
+	hubot, err := store.Create(ctx, auth.UserInfo{Name: "Hubot"})
+	require.NoError(t, err)
+	require.NoError(t, store.Link(ctx, "github", "583231", hubot))
+
+	// and octocat has a passkey, a device and a membership
+	require.NoError(t, store.AddPasskey(ctx, octocat, webauthn.Credential{ID: []byte("octocat-key")}))
+	cli, err := nkeys.CreateUser()
+	require.NoError(t, err)
+	cliPublic, err := cli.PublicKey()
+	require.NoError(t, err)
+	require.NoError(t, store.AddDevice(ctx, Device{PublicKey: cliPublic, UserID: octocat, Name: "cli"}))
+	pla, err := store.CreateTenant(ctx, "plainsof", "PLA")
+	require.NoError(t, err)
+	require.NoError(t, store.AddMember(ctx, pla.ID, octocat))
+	require.NoError(t, store.SetDefaultTenant(ctx, octocat, pla.ID))
+	issuedAt := time.Now().Add(-time.Minute)
+
+	// when octocat requests the deletion
+	deletion, err := store.RequestDeletion(ctx, octocat, octocat, DefaultGracePeriod)
+	require.NoError(t, err)
+	require.Equal(t, octocat, deletion.By)
+
+	// then connections are refused and tokens revoked
+	require.ErrorIs(t, store.Admit(ctx, octocat, time.Time{}), ErrDeletionPending)
+	require.ErrorIs(t, store.ValidToken(ctx, octocat, issuedAt), ErrRevoked)
+	require.NoError(t, store.ValidToken(ctx, octocat, time.Now().Add(time.Minute)))
+	pending, err := store.Lister().WithStatus(StatusDeletionPending).Page(ctx)
+	require.NoError(t, err)
+	require.Len(t, pending.Accounts, 1)
+	require.Equal(t, octocat, pending.Accounts[0].UserID)
+	active, err := store.Lister().WithStatus(StatusActive).Page(ctx)
+	require.NoError(t, err)
+	require.Len(t, active.Accounts, 1)
+	require.Equal(t, hubot, active.Accounts[0].UserID)
+
+	// and a repeated request can only move the erasure closer
+	again, err := store.RequestDeletion(ctx, octocat, octocat, 2*DefaultGracePeriod)
+	require.NoError(t, err)
+	require.Equal(t, deletion.EraseAt, again.EraseAt)
+
+	// and it is not due during the grace period
+	due, err := store.DueDeletions(ctx, time.Now())
+	require.NoError(t, err)
+	require.Empty(t, due)
+	due, err = store.DueDeletions(ctx, deletion.EraseAt)
+	require.NoError(t, err)
+	require.Equal(t, []tid.UserID{octocat}, due)
+
+	// when the deletion is canceled, then octocat is admitted again
+	require.NoError(t, store.CancelDeletion(ctx, octocat))
+	require.NoError(t, store.Admit(ctx, octocat, time.Time{}))
+	_, err = store.Deletion(ctx, octocat)
+	require.ErrorIs(t, err, jetstream.ErrKeyNotFound)
+
+	// and the erasure is watched
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	events := make(chan Event, 64)
+	go func() {
+		for event, err := range store.Watch(watchCtx, WatchFilter{UserID: octocat}) {
+			if err != nil {
+				return
+			}
+			events <- event
+		}
+	}()
+	// an unchanged user info is not written, so each write differs
+	writes := 0
+	require.Eventually(t, func() bool {
+		writes++
+		require.NoError(t, store.UpdateUserInfo(ctx, "github", octocat, map[string]any{"login": "octocat", "writes": writes}))
+		select {
+		case <-events:
+			return true
+		case <-time.After(50 * time.Millisecond):
+			return false
+		}
+	}, 5*time.Second, time.Millisecond)
+
+	// when octocat is erased
+	require.NoError(t, store.Erase(ctx, octocat))
+
+	// then the link and the account are reported as gone
+	var gone []Event
+	for len(gone) < 2 {
+		select {
+		case event := <-events:
+			if event.Type == EventUnlinked || event.Type == EventDeleted {
+				gone = append(gone, event)
+			}
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "no event")
+		}
+	}
+	require.ElementsMatch(t, []EventType{EventUnlinked, EventDeleted}, []EventType{gone[0].Type, gone[1].Type})
+	for _, event := range gone {
+		if event.Type == EventUnlinked {
+			require.Equal(t, "543219", event.ID)
+		}
+	}
+	cancel()
+
+	// then nothing but the tombstone and purge markers stay
+	w, err := store.kv.Watch(ctx, ">", jetstream.IncludeHistory())
+	require.NoError(t, err)
+	for entry := range w.Updates() {
+		if entry == nil {
+			break
+		}
+		if entry.Key() == erasedKey(octocat) || entry.Operation() != jetstream.KeyValuePut {
+			continue
+		}
+		require.NotContains(t, entry.Key(), octocat.String())
+		require.NotEqual(t, octocat.String(), string(entry.Value()))
+	}
+	require.NoError(t, w.Stop())
+	_, err = store.Linked(ctx, "github", "543219")
+	require.ErrorIs(t, err, jetstream.ErrKeyNotFound)
+	_, err = store.Device(ctx, cliPublic)
+	require.ErrorIs(t, err, jetstream.ErrKeyNotFound)
+
+	// and the user id is refused
+	require.ErrorIs(t, store.Admit(ctx, octocat, time.Time{}), ErrErased)
+	require.ErrorIs(t, store.ValidToken(ctx, octocat, time.Now()), ErrErased)
+	require.ErrorIs(t, store.Link(ctx, "github", "543219", octocat), ErrErased)
+
+	// and erase can be repeated
+	require.NoError(t, store.Erase(ctx, octocat))
+
+	// and hubot is kept
+	_, err = store.Linked(ctx, "github", "583231")
+	require.NoError(t, err)
+	require.NoError(t, store.Admit(ctx, hubot, time.Time{}))
+}
+
+func TestEraseDue(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewMemory()
+	octocat, err := store.Create(ctx, auth.UserInfo{Name: "Octocat"})
+	require.NoError(t, err)
+	hubot, err := store.Create(ctx, auth.UserInfo{Name: "Hubot"})
+	require.NoError(t, err)
+
+	// given an admin erasing octocat now and hubot later
+	_, err = store.RequestDeletion(ctx, octocat, hubot, 0)
+	require.NoError(t, err)
+	_, err = store.RequestDeletion(ctx, hubot, hubot, DefaultGracePeriod)
+	require.NoError(t, err)
+
+	// when due accounts are erased by a kicker without a system connection
+	erased, err := NewKicker(store, nil).EraseDue(ctx, time.Now())
+	require.NoError(t, err)
+
+	// then only octocat is erased
+	require.Equal(t, []tid.UserID{octocat}, erased)
+	_, err = store.Get(ctx, octocat)
+	require.ErrorIs(t, err, jetstream.ErrKeyNotFound)
+	require.ErrorIs(t, store.Admit(ctx, hubot, time.Time{}), ErrDeletionPending)
+}
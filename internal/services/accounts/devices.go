@@ -0,0 +1,177 @@
+package accounts
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gomoni/amble/internal/tid"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nkeys"
+)
+
+// Device is a user nkey of an agent or a CLI registered by the user
+type Device struct {
+	PublicKey string     `json:"public_key"`
+	UserID    tid.UserID `json:"uid"`
+	Name      string     `json:"name"`
+	Created   time.Time  `json:"created"`
+	// Policy overrides the permissions granted to users
+	Policy *Policy `json:"policy,omitempty"`
+}
+
+func deviceKey(uid tid.UserID, public string) string {
+	return "device." + uid.String() + "." + public
+}
+
+// AddDevice registers the user nkey public key of a device. Stored in
+// `device.$uid.$nkey` and linked as `auth_link.nkey.$nkey`
+func (n Accounts) AddDevice(ctx context.Context, device Device) error {
+	if !nkeys.IsValidPublicUserKey(device.PublicKey) {
+		return fmt.Errorf("account add device: invalid user nkey %q", device.PublicKey)
+	}
+	if device.Created.IsZero() {
+		device.Created = time.Now().UTC()
+	}
+	b, err := json.Marshal(device)
+	if err != nil {
+		return fmt.Errorf("account add device: marshal: %w", err)
+	}
+	_, err = n.kv.Create(ctx, deviceKey(device.UserID, device.PublicKey), b)
+	if err != nil {
+		return fmt.Errorf("account add device: %w", err)
+	}
+	err = n.Link(ctx, "nkey", device.PublicKey, device.UserID)
+	if err != nil {
+		return fmt.Errorf("account add device: link: %w", err)
+	}
+	return nil
+}
+
+// Device returns the device registered for the user nkey public key
+func (n Accounts) Device(ctx context.Context, public string) (Device, error) {
+	uid, err := n.Linked(ctx, "nkey", public)
+	if err != nil {
+		return Device{}, fmt.Errorf("account device: %w", err)
+	}
+	entry, err := n.kv.Get(ctx, deviceKey(uid, public))
+	if err != nil {
+		return Device{}, fmt.Errorf("account device: %w", err)
+	}
+	var device Device
+	err = json.Unmarshal(entry.Value(), &device)
+	if err != nil {
+		return Device{}, fmt.Errorf("account device: unmarshal: %w", err)
+	}
+	return device, nil
+}
+
+// Devices returns all devices of the user
+func (n Accounts) Devices(ctx context.Context, uid tid.UserID) ([]Device, error) {
+	entries, err := WatchEntries(ctx, n.kv, "device."+uid.String()+".*", jetstream.IgnoreDeletes())
+	if err != nil {
+		return nil, fmt.Errorf("account devices: %w", err)
+	}
+
+	devices := make([]Device, 0)
+	for _, entry := range entries {
+		var device Device
+		err = json.Unmarshal(entry.Value(), &device)
+		if err != nil {
+			return nil, fmt.Errorf("account devices: unmarshal %s: %w", entry.Key(), err)
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// RemoveDevice deletes the device and its link, so it can't connect anymore
+func (n Accounts) RemoveDevice(ctx context.Context, uid tid.UserID, public string) error {
+	// the device must belong to the user, so others' links are kept
+	device, err := n.kv.Get(ctx, deviceKey(uid, public))
+	if err != nil {
+		return fmt.Errorf("account remove device: %w", err)
+	}
+	link, err := n.kv.Get(ctx, "auth_link.nkey."+public)
+	if err == nil && string(link.Value()) == uid.String() {
+		err = n.kv.Delete(ctx, "auth_link.nkey."+public, jetstream.LastRevision(link.Revision()))
+	} else if errors.Is(err, jetstream.ErrKeyNotFound) {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("account remove device: unlink: %w", err)
+	}
+	err = n.kv.Delete(ctx, deviceKey(uid, public), jetstream.LastRevision(device.Revision()))
+	if err != nil {
+		return fmt.Errorf("account remove device: %w", err)
+	}
+	return nil
+}
+
+// NewCreds returns a new device with a fresh user nkey and the content of
+// .creds file for nats.UserCredentials. The seed is not stored anywhere.
+//
+// The auth callout trusts the registered nkey only, so the user JWT in the
+// file is signed by a throw away account key and serves as a nkey carrier.
+// nats-server discards user JWTs in config mode, so clients load the file as
+// a seed there, like nats.NkeyOptionFromSeed or nats --nkey do.
+func NewCreds(uid tid.UserID, name string) (Device, []byte, error) {
+	user, err := nkeys.CreateUser()
+	if err != nil {
+		return Device{}, nil, fmt.Errorf("new creds: %w", err)
+	}
+	public, err := user.PublicKey()
+	if err != nil {
+		return Device{}, nil, fmt.Errorf("new creds: %w", err)
+	}
+	seed, err := user.Seed()
+	if err != nil {
+		return Device{}, nil, fmt.Errorf("new creds: %w", err)
+	}
+	issuer, err := nkeys.CreateAccount()
+	if err != nil {
+		return Device{}, nil, fmt.Errorf("new creds: %w", err)
+	}
+	claims := jwt.NewUserClaims(public)
+	claims.Name = name
+	token, err := claims.Encode(issuer)
+	if err != nil {
+		return Device{}, nil, fmt.Errorf("new creds: encode: %w", err)
+	}
+	creds, err := jwt.FormatUserConfig(token, seed)
+	if err != nil {
+		return Device{}, nil, fmt.Errorf("new creds: %w", err)
+	}
+	return Device{
+		PublicKey: public,
+		UserID:    uid,
+		Name:      name,
+	}, creds, nil
+}
+
+// verifyNonce checks the client signed the nonce by the user nkey
+func verifyNonce(public, nonce, signed string) error {
+	if nonce == "" || signed == "" {
+		return errors.New("missing signed nonce, configure at least one nkey user in nats-server")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(signed)
+	if err != nil {
+		sig, err = base64.StdEncoding.DecodeString(signed)
+		if err != nil {
+			return fmt.Errorf("decode signed nonce: %w", err)
+		}
+	}
+	pub, err := nkeys.FromPublicKey(public)
+	if err != nil {
+		return fmt.Errorf("user nkey: %w", err)
+	}
+	err = pub.Verify([]byte(nonce), sig)
+	if err != nil {
+		return fmt.Errorf("verify signed nonce: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package accounts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/gomoni/amble/internal/auth"
+	"github.com/gomoni/amble/internal/auth/email"
+	"github.com/gomoni/amble/internal/tid"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// ErrEmailTaken matches EmailConflictError
+var ErrEmailTaken = auth.ErrEmailTaken
+
+// EmailConflictError is returned when a verified email of an account is
+// already verified by another one
+type EmailConflictError struct {
+	Email string
+	// Owner is the account the email is indexed for
+	Owner tid.UserID
+}
+
+func (e *EmailConflictError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrEmailTaken, e.Email)
+}
+
+func (e *EmailConflictError) Is(target error) bool {
+	return target == ErrEmailTaken
+}
+
+// emailKey returns the index key of the address, the hash is the same as the
+// provider id of the email login
+func emailKey(address string) string {
+	return "email." + email.ID(address)
+}
+
+// ByEmail returns the account with the verified email address
+func (n Accounts) ByEmail(ctx context.Context, address string) (auth.UserInfo, error) {
+	entry, err := n.kv.Get(ctx, emailKey(address))
+	if err != nil {
+		return auth.UserInfo{}, fmt.Errorf("account by email: %w", err)
+	}
+	uid, err := tid.ParseUserID(string(entry.Value()))
+	if err != nil {
+		return auth.UserInfo{}, fmt.Errorf("account by email: parse user id: %w", err)
+	}
+	userInfo, err := n.Get(ctx, uid)
+	if err != nil {
+		return auth.UserInfo{}, fmt.Errorf("account by email: %w", err)
+	}
+	return userInfo, nil
+}
+
+// claimEmail indexes the verified email of the account. Claiming the email
+// again by the same account is a no-op.
+func (n Accounts) claimEmail(ctx context.Context, userInfo auth.UserInfo) error {
+	if !userInfo.EmailVerified || userInfo.Email == "" {
+		return nil
+	}
+	key := emailKey(userInfo.Email)
+	_, err := n.kv.Create(ctx, key, []byte(userInfo.UserID.String()))
+	if !errors.Is(err, jetstream.ErrKeyExists) {
+		return err
+	}
+	entry, err := n.kv.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if string(entry.Value()) == userInfo.UserID.String() {
+		return nil
+	}
+	owner, _ := tid.ParseUserID(string(entry.Value()))
+	return &EmailConflictError{Email: userInfo.Email, Owner: owner}
+}
+
+// releaseEmail drops the index of the address if it still points to the
+// account
+func (n Accounts) releaseEmail(ctx context.Context, uid tid.UserID, address string) error {
+	if address == "" {
+		return nil
+	}
+	key := emailKey(address)
+	entry, err := n.kv.Get(ctx, key)
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if string(entry.Value()) != uid.String() {
+		return nil
+	}
+	err = n.kv.Delete(ctx, key, jetstream.LastRevision(entry.Revision()))
+	if errors.Is(err, jetstream.ErrKeyExists) {
+		// claimed again meanwhile
+		return nil
+	}
+	return err
+}
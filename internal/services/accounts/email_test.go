@@ -0,0 +1,119 @@
+package accounts
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomoni/amble/internal/auth"
+	"github.com/gomoni/amble/internal/tid"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmailIndex(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewMemory()
+	octocat, err := store.Create(ctx, auth.UserInfo{Name: "Octocat", Email: "cat@octocat.example.net", EmailVerified: true})
+	require.NoError(t, err)
+	hubot, err := store.Create(ctx, auth.UserInfo{Name: "Hubot", Email: "hubot@octocat.example.net", EmailVerified: true})
+	require.NoError(t, err)
+
+	// when octocat changes the email
+	_, err = store.Update(ctx, octocat, func(current auth.UserInfo) (auth.UserInfo, error) {
+		current.Email = "octocat@octocat.example.net"
+		return current, nil
+	})
+	require.NoError(t, err)
+
+	// then the new one is indexed and the old one released
+	account, err := store.ByEmail(ctx, "octocat@octocat.example.net")
+	require.NoError(t, err)
+	require.Equal(t, octocat, account.UserID)
+	_, err = store.ByEmail(ctx, "cat@octocat.example.net")
+	require.ErrorIs(t, err, jetstream.ErrKeyNotFound)
+
+	// when hubot takes the email of octocat, then it is refused and hubot
+	// keeps own
+	_, err = store.Update(ctx, hubot, func(current auth.UserInfo) (auth.UserInfo, error) {
+		current.Email = "OCTOCAT@octocat.example.net"
+		return current, nil
+	})
+	require.ErrorIs(t, err, ErrEmailTaken)
+	account, err = store.ByEmail(ctx, "hubot@octocat.example.net")
+	require.NoError(t, err)
+	require.Equal(t, hubot, account.UserID)
+
+	// when the email is no longer verified, then it is released
+	_, err = store.Update(ctx, hubot, func(current auth.UserInfo) (auth.UserInfo, error) {
+		current.EmailVerified = false
+		return current, nil
+	})
+	require.NoError(t, err)
+	_, err = store.ByEmail(ctx, "hubot@octocat.example.net")
+	require.ErrorIs(t, err, jetstream.ErrKeyNotFound)
+
+	// when octocat is erased, then the email can be used again
+	_, err = store.RequestDeletion(ctx, octocat, octocat, 0)
+	require.NoError(t, err)
+	require.NoError(t, store.Erase(ctx, octocat))
+	_, err = store.ByEmail(ctx, "octocat@octocat.example.net")
+	require.ErrorIs(t, err, jetstream.ErrKeyNotFound)
+	_, err = store.Update(ctx, hubot, func(current auth.UserInfo) (auth.UserInfo, error) {
+		current.Email = "octocat@octocat.example.net"
+		current.EmailVerified = true
+		return current, nil
+	})
+	require.NoError(t, err)
+}
+
+func TestEmailSignIn(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	store := NewMemory()
+	cat := auth.UserInfo{Name: "cat", Email: "cat@octocat.example.net", EmailVerified: true}
+
+	// when first logins by a verified email race, then all of them get the
+	// same account
+	var wg sync.WaitGroup
+	accounts := make([]auth.UserInfo, 8)
+	errs := make([]error, len(accounts))
+	for i := range accounts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			accounts[i], errs[i] = store.SignIn(ctx, "email", "c4t", cat, nil)
+		}()
+	}
+	wg.Wait()
+	for i, account := range accounts {
+		require.NoError(t, errs[i])
+		require.Equal(t, accounts[0].UserID, account.UserID)
+	}
+	account, err := store.ByEmail(ctx, cat.Email)
+	require.NoError(t, err)
+	require.Equal(t, accounts[0].UserID, account.UserID)
+
+	// when another login has the same verified email, then it signs in to
+	// the same account
+	account, err = store.SignIn(ctx, "github", "583231", cat, nil)
+	require.NoError(t, err)
+	require.Equal(t, accounts[0].UserID, account.UserID)
+	uid, err := store.Linked(ctx, "github", "583231")
+	require.NoError(t, err)
+	require.Equal(t, accounts[0].UserID, uid)
+
+	// when the owner of the email is erased, then a new login gets an account
+	// without claiming the email
+	gone, err := tid.NewUserID()
+	require.NoError(t, err)
+	_, err = store.kv.Put(ctx, emailKey("dog@octocat.example.net"), []byte(gone.String()))
+	require.NoError(t, err)
+	dog := auth.UserInfo{Name: "dog", Email: "dog@octocat.example.net", EmailVerified: true}
+	account, err = store.SignIn(ctx, "github", "1", dog, nil)
+	require.NoError(t, err)
+	require.NotEqual(t, accounts[0].UserID, account.UserID)
+}
@@ -0,0 +1,116 @@
+package accounts
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// ErrorClass of a refused connection. Each class maps to a micro error code
+// and a generic message for the client, so no internals leak out.
+type ErrorClass string
+
+const (
+	ClassMalformedRequest ErrorClass = "malformed_request"
+	ClassBadToken         ErrorClass = "bad_token"
+	ClassUnknownIdentity  ErrorClass = "unknown_identity"
+	ClassSuspended        ErrorClass = "suspended"
+	ClassDeletionPending  ErrorClass = "deletion_pending"
+	ClassPendingApproval  ErrorClass = "pending_approval"
+	ClassForbidden        ErrorClass = "forbidden"
+	ClassInternal         ErrorClass = "internal"
+)
+
+const (
+	StatusBadRequest   = "400"
+	StatusUnauthorized = "401"
+	StatusForbidden    = "403"
+	StatusNotFound     = "404"
+	StatusInternal     = "500"
+)
+
+// Code returns the micro error code of the class
+func (c ErrorClass) Code() string {
+	switch c {
+	case ClassMalformedRequest:
+		return StatusBadRequest
+	case ClassBadToken:
+		return StatusUnauthorized
+	case ClassUnknownIdentity:
+		return StatusNotFound
+	case ClassSuspended, ClassDeletionPending, ClassPendingApproval, ClassForbidden:
+		return StatusForbidden
+	default:
+		return StatusInternal
+	}
+}
+
+// Message returns the client facing message. Unknown identity looks like a
+// bad token, so clients can't probe for registered users.
+func (c ErrorClass) Message() string {
+	switch c {
+	case ClassMalformedRequest:
+		return "malformed authorization request"
+	case ClassBadToken, ClassUnknownIdentity:
+		return "invalid credentials"
+	case ClassSuspended:
+		return "account suspended"
+	case ClassDeletionPending:
+		return "account scheduled for deletion"
+	case ClassPendingApproval:
+		return "account pending approval"
+	case ClassForbidden:
+		return "not authorized"
+	default:
+		return "internal error"
+	}
+}
+
+// CalloutError is a refusal of a connection with the detailed reason in Err
+type CalloutError struct {
+	Class ErrorClass
+	Err   error
+}
+
+func (e *CalloutError) Error() string {
+	return string(e.Class) + ": " + e.Err.Error()
+}
+
+func (e *CalloutError) Unwrap() error {
+	return e.Err
+}
+
+func refuse(class ErrorClass, err error) error {
+	return &CalloutError{Class: class, Err: err}
+}
+
+// lookupError classifies an error of a store lookup, missing key means the
+// identity is not known
+func lookupError(err error) error {
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return refuse(ClassUnknownIdentity, err)
+	}
+	return refuse(ClassInternal, err)
+}
+
+// classOf returns the class of the error, unclassified errors are internal
+func classOf(err error) ErrorClass {
+	var cerr *CalloutError
+	if errors.As(err, &cerr) {
+		return cerr.Class
+	}
+	return ClassInternal
+}
+
+// Redact returns a prefix of a token or a key, so it can be logged
+func Redact(token string) string {
+	const keep = 8
+	if token == "" {
+		return ""
+	}
+	if len(token) <= keep {
+		return strings.Repeat("*", len(token))
+	}
+	return token[:keep] + "...[REDACTED]"
+}
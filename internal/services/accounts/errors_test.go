@@ -0,0 +1,47 @@
+package accounts
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorClass(t *testing.T) {
+	tests := []struct {
+		err     error
+		class   ErrorClass
+		code    string
+		message string
+	}{
+		{refuse(ClassMalformedRequest, errors.New("curve open")), ClassMalformedRequest, StatusBadRequest, "malformed authorization request"},
+		{refuse(ClassBadToken, errors.New("token is expired")), ClassBadToken, StatusUnauthorized, "invalid credentials"},
+		{lookupError(fmt.Errorf("account get linked: %w", jetstream.ErrKeyNotFound)), ClassUnknownIdentity, StatusNotFound, "invalid credentials"},
+		{refuse(ClassSuspended, ErrSuspended), ClassSuspended, StatusForbidden, "account suspended"},
+		{refuse(ClassDeletionPending, ErrDeletionPending), ClassDeletionPending, StatusForbidden, "account scheduled for deletion"},
+		{refuse(ClassPendingApproval, ErrPendingApproval), ClassPendingApproval, StatusForbidden, "account pending approval"},
+		{lookupError(errors.New("nats: timeout")), ClassInternal, StatusInternal, "internal error"},
+		{errors.New("unclassified"), ClassInternal, StatusInternal, "internal error"},
+	}
+	for _, test := range tests {
+		t.Run(string(test.class), func(t *testing.T) {
+			class := classOf(fmt.Errorf("wrapped: %w", test.err))
+			require.Equal(t, test.class, class)
+			require.Equal(t, test.code, class.Code())
+			require.Equal(t, test.message, class.Message())
+		})
+	}
+
+	// details stay reachable for logs
+	err := refuse(ClassSuspended, fmt.Errorf("%w: spam", ErrSuspended))
+	require.ErrorIs(t, err, ErrSuspended)
+	require.Equal(t, "suspended: account is suspended: spam", err.Error())
+}
+
+func TestRedact(t *testing.T) {
+	require.Equal(t, "", Redact(""))
+	require.Equal(t, "*****", Redact("short"))
+	require.Equal(t, "eyJ0eXAi...[REDACTED]", Redact("eyJ0eXAiOiJKV1QiLCJhbGciOiJlZDI1NTE5LW5rZXkifQ.eyJqdGki.sig"))
+}
@@ -0,0 +1,245 @@
+package accounts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gomoni/amble/internal/tid"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// connzPingSubject asks all servers of the cluster for connections
+	connzPingSubject = "$SYS.REQ.SERVER.PING.CONNZ"
+	// kickSubject disconnects a client of the server
+	kickSubject = "$SYS.REQ.SERVER.%s.KICK"
+	// gatherTimeout is how long to wait for another server to respond
+	gatherTimeout = 250 * time.Millisecond
+)
+
+// Connection is a live NATS connection of a user
+type Connection struct {
+	ServerID string `json:"server_id"`
+	CID      uint64 `json:"cid"`
+	Account  string `json:"account"`
+	IP       string `json:"ip"`
+	Name     string `json:"name,omitempty"`
+}
+
+// Kicker disconnects live connections of users. Users issued by the callout
+// are named by their user id, so they can be found by monitoring requests of
+// the system account.
+type Kicker struct {
+	accounts Accounts
+	sys      *nats.Conn
+}
+
+// NewKicker returns a kicker, sys must be connected to the system account.
+// Kicker with nil sys only changes the accounts, live connections stay until
+// the user JWT expires.
+func NewKicker(accounts Accounts, sys *nats.Conn) Kicker {
+	return Kicker{accounts: accounts, sys: sys}
+}
+
+// Suspend suspends the account and disconnects all connections of the user
+func (k Kicker) Suspend(ctx context.Context, uid tid.UserID, reason string) (int, error) {
+	err := k.accounts.Suspend(ctx, uid, reason)
+	if err != nil {
+		return 0, err
+	}
+	return k.Kick(ctx, uid)
+}
+
+// RevokeTokens revokes web tokens of the user and disconnects all its
+// connections. Devices may connect again as they don't use tokens.
+func (k Kicker) RevokeTokens(ctx context.Context, uid tid.UserID) (int, error) {
+	err := k.accounts.RevokeTokens(ctx, uid)
+	if err != nil {
+		return 0, err
+	}
+	return k.Kick(ctx, uid)
+}
+
+// RequestDeletion schedules the erasure of the account, revokes its tokens and
+// disconnects all connections of the user
+func (k Kicker) RequestDeletion(ctx context.Context, uid, by tid.UserID, grace time.Duration) (Deletion, int, error) {
+	deletion, err := k.accounts.RequestDeletion(ctx, uid, by, grace)
+	if err != nil {
+		return Deletion{}, 0, err
+	}
+	n, err := k.Kick(ctx, uid)
+	return deletion, n, err
+}
+
+// Transition changes the status of the account and disconnects all
+// connections of the user unless it is active
+func (k Kicker) Transition(ctx context.Context, uid tid.UserID, to Status, reason string, by tid.UserID) (AccountStatus, int, error) {
+	status, err := k.accounts.Transition(ctx, uid, to, reason, by)
+	if err != nil {
+		return status, 0, err
+	}
+	if status.Status == StatusActive {
+		return status, 0, nil
+	}
+	n, err := k.Kick(ctx, uid)
+	return status, n, err
+}
+
+// Erase erases the account and disconnects all connections of the user
+func (k Kicker) Erase(ctx context.Context, uid tid.UserID) (int, error) {
+	err := k.accounts.Erase(ctx, uid)
+	if err != nil {
+		return 0, err
+	}
+	return k.Kick(ctx, uid)
+}
+
+// EraseDue erases accounts whose grace period is over and returns them
+func (k Kicker) EraseDue(ctx context.Context, now time.Time) ([]tid.UserID, error) {
+	uids, err := k.accounts.DueDeletions(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	erased := make([]tid.UserID, 0, len(uids))
+	for _, uid := range uids {
+		err = k.accounts.Erase(ctx, uid)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("erase %s: %w", uid, err))
+			continue
+		}
+		erased = append(erased, uid)
+		_, err = k.Kick(ctx, uid)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("erase %s: %w", uid, err))
+		}
+	}
+	return erased, errors.Join(errs...)
+}
+
+// Kick disconnects all live connections of the user and returns their number
+func (k Kicker) Kick(ctx context.Context, uid tid.UserID) (int, error) {
+	if k.sys == nil {
+		return 0, nil
+	}
+	conns, err := k.Connections(ctx, uid)
+	if err != nil {
+		return 0, err
+	}
+	var errs []error
+	kicked := 0
+	for _, conn := range conns {
+		err = k.kick(ctx, conn)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		kicked++
+	}
+	return kicked, errors.Join(errs...)
+}
+
+// Connections returns live connections of the user on all servers
+func (k Kicker) Connections(ctx context.Context, uid tid.UserID) ([]Connection, error) {
+	req, err := json.Marshal(map[string]any{
+		"user": uid.String(),
+		"auth": true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("connections: marshal: %w", err)
+	}
+
+	inbox := k.sys.NewRespInbox()
+	sub, err := k.sys.SubscribeSync(inbox)
+	if err != nil {
+		return nil, fmt.Errorf("connections: subscribe: %w", err)
+	}
+	defer func() { _ = sub.Unsubscribe() }()
+	err = k.sys.PublishRequest(connzPingSubject, inbox, req)
+	if err != nil {
+		return nil, fmt.Errorf("connections: %w", err)
+	}
+
+	conns := make([]Connection, 0)
+	// each server responds once, wait until none responds in time
+	for {
+		timeout := gatherTimeout
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+			timeout = time.Until(deadline)
+		}
+		msg, err := sub.NextMsg(timeout)
+		if errors.Is(err, nats.ErrTimeout) {
+			return conns, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("connections: %w", err)
+		}
+		var resp struct {
+			Server struct {
+				ID string `json:"id"`
+			} `json:"server"`
+			Data *struct {
+				Conns []struct {
+					CID     uint64 `json:"cid"`
+					Account string `json:"account"`
+					IP      string `json:"ip"`
+					Name    string `json:"name"`
+				} `json:"connections"`
+			} `json:"data"`
+			Error *apiError `json:"error"`
+		}
+		err = json.Unmarshal(msg.Data, &resp)
+		if err != nil {
+			return nil, fmt.Errorf("connections: unmarshal: %w", err)
+		}
+		if resp.Error != nil {
+			return nil, fmt.Errorf("connections: %s", resp.Error)
+		}
+		if resp.Data == nil {
+			continue
+		}
+		for _, c := range resp.Data.Conns {
+			conns = append(conns, Connection{
+				ServerID: resp.Server.ID,
+				CID:      c.CID,
+				Account:  c.Account,
+				IP:       c.IP,
+				Name:     c.Name,
+			})
+		}
+	}
+}
+
+func (k Kicker) kick(ctx context.Context, conn Connection) error {
+	req, err := json.Marshal(map[string]uint64{"cid": conn.CID})
+	if err != nil {
+		return fmt.Errorf("kick: marshal: %w", err)
+	}
+	msg, err := k.sys.RequestWithContext(ctx, fmt.Sprintf(kickSubject, conn.ServerID), req)
+	if err != nil {
+		return fmt.Errorf("kick %s/%d: %w", conn.ServerID, conn.CID, err)
+	}
+	var resp struct {
+		Error *apiError `json:"error"`
+	}
+	err = json.Unmarshal(msg.Data, &resp)
+	if err != nil {
+		return fmt.Errorf("kick %s/%d: unmarshal: %w", conn.ServerID, conn.CID, err)
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("kick %s/%d: %s", conn.ServerID, conn.CID, resp.Error)
+	}
+	return nil
+}
+
+// apiError is an error of the system account API
+type apiError struct {
+	Code        int    `json:"code"`
+	Description string `json:"description"`
+}
+
+func (e *apiError) String() string {
+	return fmt.Sprintf("%d %s", e.Code, e.Description)
+}
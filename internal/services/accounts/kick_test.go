@@ -0,0 +1,107 @@
+package accounts
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gomoni/amble/internal/tid"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKicker(t *testing.T) {
+	// given octocat and hubot are members of plainsof
+	endpoint, store, encoder := requireCallout(t, DefaultPolicy())
+	ctx := context.Background()
+	pla, err := store.CreateTenant(ctx, "plainsof", "PLA")
+	require.NoError(t, err)
+	octocat := requireUser(t, store, "543219", "Octocat")
+	hubot := requireUser(t, store, "583231", "Hubot")
+	require.NoError(t, store.AddMember(ctx, pla.ID, octocat))
+	require.NoError(t, store.AddMember(ctx, pla.ID, hubot))
+
+	// and octocat has a cli
+	cli, err := nkeys.CreateUser()
+	require.NoError(t, err)
+	cliPublic, err := cli.PublicKey()
+	require.NoError(t, err)
+	require.NoError(t, store.AddDevice(ctx, Device{PublicKey: cliPublic, UserID: octocat, Name: "cli"}))
+
+	sysNc, err := nats.Connect(endpoint, nats.UserInfo("sys", "sys"))
+	require.NoError(t, err)
+	t.Cleanup(sysNc.Close)
+	kicker := NewKicker(store, sysNc)
+
+	octocatToken, err := encoder.Encode(webClaims("543219"))
+	require.NoError(t, err)
+	hubotToken, err := encoder.Encode(webClaims("583231"))
+	require.NoError(t, err)
+	connect := func(token string, uid tid.UserID) (*nats.Conn, error) {
+		return nats.Connect(endpoint, nats.Token(token), nats.CustomInboxPrefix("_INBOX."+uid.String()), nats.NoReconnect())
+	}
+	connectCli := func() (*nats.Conn, error) {
+		return nats.Connect(endpoint, nats.Nkey(cliPublic, cli.Sign), nats.NoReconnect())
+	}
+
+	// when both are connected
+	octocatNc, err := connect(octocatToken, octocat)
+	require.NoError(t, err)
+	t.Cleanup(octocatNc.Close)
+	cliNc, err := connectCli()
+	require.NoError(t, err)
+	t.Cleanup(cliNc.Close)
+	hubotNc, err := connect(hubotToken, hubot)
+	require.NoError(t, err)
+	t.Cleanup(hubotNc.Close)
+
+	// then octocat's connections are found
+	conns, err := kicker.Connections(ctx, octocat)
+	require.NoError(t, err)
+	require.Len(t, conns, 2)
+
+	// when web tokens of octocat are revoked
+	n, err := kicker.RevokeTokens(ctx, octocat)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	// then octocat is disconnected, hubot is not
+	require.Eventually(t, octocatNc.IsClosed, time.Second, 10*time.Millisecond)
+	require.Eventually(t, cliNc.IsClosed, time.Second, 10*time.Millisecond)
+	require.True(t, hubotNc.IsConnected())
+
+	// and the revoked token is refused, while devices can connect again
+	_, err = connect(octocatToken, octocat)
+	require.ErrorIs(t, err, nats.ErrAuthorization)
+	cliNc, err = connectCli()
+	require.NoError(t, err)
+	t.Cleanup(cliNc.Close)
+
+	// when octocat is suspended
+	n, err = kicker.Suspend(ctx, octocat, "spam")
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	// then the device is disconnected and refused with the reason
+	require.Eventually(t, cliNc.IsClosed, time.Second, 10*time.Millisecond)
+	_, err = connectCli()
+	require.ErrorIs(t, err, nats.ErrAuthorization)
+	require.ErrorIs(t, store.Admit(ctx, octocat, time.Time{}), ErrSuspended)
+
+	// when octocat is unsuspended, then the device can connect
+	require.NoError(t, store.Unsuspend(ctx, octocat))
+	cliNc, err = connectCli()
+	require.NoError(t, err)
+	t.Cleanup(cliNc.Close)
+
+	// when the device is removed and octocat kicked, then it is disconnected
+	// and refused
+	require.NoError(t, store.RemoveDevice(ctx, octocat, cliPublic))
+	n, err = kicker.Kick(ctx, octocat)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Eventually(t, cliNc.IsClosed, time.Second, 10*time.Millisecond)
+	_, err = connectCli()
+	require.ErrorIs(t, err, nats.ErrAuthorization)
+}
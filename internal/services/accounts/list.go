@@ -0,0 +1,274 @@
+package accounts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"slices"
+	"strings"
+
+	"github.com/gomoni/amble/internal/auth"
+	"github.com/gomoni/amble/internal/tid"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	// DefaultPageSize is used by Lister without a limit
+	DefaultPageSize = 50
+	// MaxPageSize caps the limit of Lister
+	MaxPageSize = 1000
+)
+
+var (
+	// ErrInvalidCursor is returned for a cursor not returned by a previous Page
+	ErrInvalidCursor = errors.New("invalid cursor")
+	// ErrUnsupportedStatus is returned by Lister filtering a status it can't
+	// list like StatusDeleted, erased accounts have no user info left
+	ErrUnsupportedStatus = errors.New("unsupported status filter")
+)
+
+// Page of listed accounts. Next is the cursor of the following page, empty
+// on the last one.
+type Page struct {
+	Accounts []auth.UserInfo
+	Next     string
+}
+
+// Lister lists accounts sorted by creation time, which is derived from
+// the UUIDv7 of the user id. Filters narrow down the accounts by login
+// provider or status. Accounts are fetched a page at time, the page ends
+// with the cursor of the next one.
+type Lister struct {
+	accounts   Accounts
+	provider   string
+	status     Status
+	limit      int
+	cursor     string
+	descending bool
+}
+
+func (n Accounts) Lister() Lister {
+	return Lister{
+		accounts: n,
+		limit:    DefaultPageSize,
+	}
+}
+
+// WithProvider lists accounts having user info of the login provider like
+// `github` or `email`
+func (l Lister) WithProvider(provider string) Lister {
+	l.provider = provider
+	return l
+}
+
+// WithStatus lists accounts of the status only. Page fails with
+// ErrUnsupportedStatus for StatusDeleted and unknown statuses.
+func (l Lister) WithStatus(status Status) Lister {
+	l.status = status
+	return l
+}
+
+// WithLimit sets the page size, it is capped by MaxPageSize
+func (l Lister) WithLimit(limit int) Lister {
+	l.limit = min(max(limit, 1), MaxPageSize)
+	return l
+}
+
+// WithCursor continues the listing after a page
+func (l Lister) WithCursor(cursor string) Lister {
+	l.cursor = cursor
+	return l
+}
+
+// WithDescending lists the newest accounts first
+func (l Lister) WithDescending() Lister {
+	l.descending = true
+	return l
+}
+
+// Page returns accounts of a page after the cursor
+func (l Lister) Page(ctx context.Context) (Page, error) {
+	var after tid.UserID
+	switch l.status {
+	case "", StatusActive, StatusSuspended, StatusPendingApproval, StatusDeletionPending:
+	default:
+		return Page{}, fmt.Errorf("account list: %w: %q", ErrUnsupportedStatus, l.status)
+	}
+	if l.cursor != "" {
+		var err error
+		after, err = tid.ParseUserID(l.cursor)
+		if err != nil {
+			return Page{}, fmt.Errorf("account list: %w: %w", ErrInvalidCursor, err)
+		}
+	}
+
+	uids, err := l.uids(ctx)
+	if err != nil {
+		return Page{}, fmt.Errorf("account list: %w", err)
+	}
+	if !after.IsZero() {
+		i, found := slices.BinarySearchFunc(uids, after, func(uid tid.UserID, after tid.UserID) int {
+			return l.compare(uid, after)
+		})
+		if found {
+			i++
+		}
+		uids = uids[i:]
+	}
+
+	page := Page{Accounts: make([]auth.UserInfo, 0, min(l.limit, len(uids)))}
+	for _, uid := range uids {
+		if len(page.Accounts) == l.limit {
+			page.Next = page.Accounts[len(page.Accounts)-1].UserID.String()
+			break
+		}
+		account, err := l.accounts.Get(ctx, uid)
+		if errors.Is(err, jetstream.ErrKeyNotFound) {
+			// deleted in the meantime
+			continue
+		} else if err != nil {
+			return Page{}, fmt.Errorf("account list: %w", err)
+		}
+		page.Accounts = append(page.Accounts, account)
+	}
+	return page, nil
+}
+
+// Iter iterates over all accounts starting after the cursor, page by page.
+// The iteration stops after the first error.
+func (l Lister) Iter(ctx context.Context) iter.Seq2[auth.UserInfo, error] {
+	return func(yield func(auth.UserInfo, error) bool) {
+		for {
+			page, err := l.Page(ctx)
+			if err != nil {
+				yield(auth.UserInfo{}, err)
+				return
+			}
+			for _, account := range page.Accounts {
+				if !yield(account, nil) {
+					return
+				}
+			}
+			if page.Next == "" {
+				return
+			}
+			l.cursor = page.Next
+		}
+	}
+}
+
+// uids returns sorted user ids matching the filters
+func (l Lister) uids(ctx context.Context) ([]tid.UserID, error) {
+	// user_info.$uid.$provider
+	infos, err := watchKeys(ctx, l.accounts.kv, "user_info.*.*", jetstream.IgnoreDeletes())
+	if err != nil {
+		return nil, err
+	}
+	// suspended.$uid, deletion.$uid and approval.$uid
+	suspended := make(map[string]bool)
+	pending := make(map[string]bool)
+	approval := make(map[string]bool)
+	if l.status != "" {
+		for prefix, ids := range map[string]map[string]bool{"suspended.": suspended, "deletion.": pending, "approval.": approval} {
+			keys, err := watchKeys(ctx, l.accounts.kv, prefix+"*", jetstream.IgnoreDeletes())
+			if err != nil {
+				return nil, err
+			}
+			for _, key := range keys {
+				ids[strings.TrimPrefix(key, prefix)] = true
+			}
+		}
+	}
+
+	accounts := make(map[string]bool)
+	providers := make(map[string]bool)
+	for _, key := range infos {
+		parts := strings.Split(key, ".")
+		switch parts[2] {
+		case "app":
+			accounts[parts[1]] = true
+		case l.provider:
+			providers[parts[1]] = true
+		}
+	}
+
+	uids := make([]tid.UserID, 0, len(accounts))
+	for id := range accounts {
+		if l.provider != "" && l.provider != "app" && !providers[id] {
+			continue
+		}
+		switch l.status {
+		case StatusActive:
+			if suspended[id] || pending[id] || approval[id] {
+				continue
+			}
+		case StatusSuspended:
+			if !suspended[id] || pending[id] {
+				continue
+			}
+		case StatusPendingApproval:
+			if !approval[id] || suspended[id] || pending[id] {
+				continue
+			}
+		case StatusDeletionPending:
+			if !pending[id] {
+				continue
+			}
+		}
+		uid, err := tid.ParseUserID(id)
+		if err != nil {
+			return nil, fmt.Errorf("parse user id %q: %w", id, err)
+		}
+		uids = append(uids, uid)
+	}
+	slices.SortFunc(uids, l.compare)
+	return uids, nil
+}
+
+// compare orders user ids by the creation time. Suffix of a typeid is
+// a sortable encoding of UUIDv7, so it breaks ties within a millisecond.
+func (l Lister) compare(a, b tid.UserID) int {
+	ret := a.CreatedAt().Compare(b.CreatedAt())
+	if ret == 0 {
+		ret = strings.Compare(a.Suffix(), b.Suffix())
+	}
+	if l.descending {
+		return -ret
+	}
+	return ret
+}
+
+// watchKeys returns keys matching the pattern, use jetstream.IgnoreDeletes to
+// skip deleted ones
+func watchKeys(ctx context.Context, kv jetstream.KeyValue, pattern string, opts ...jetstream.WatchOpt) ([]string, error) {
+	entries, err := WatchEntries(ctx, kv, pattern, append(opts, jetstream.MetaOnly())...)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		keys = append(keys, entry.Key())
+	}
+	return keys, nil
+}
+
+// WatchEntries returns the current entries matching the pattern, use
+// jetstream.IgnoreDeletes to skip deleted ones
+func WatchEntries(ctx context.Context, kv jetstream.KeyValue, pattern string, opts ...jetstream.WatchOpt) ([]jetstream.KeyValueEntry, error) {
+	w, err := kv.Watch(ctx, pattern, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("watch %s: %w", pattern, err)
+	}
+	defer func() { _ = w.Stop() }()
+
+	var entries []jetstream.KeyValueEntry
+	for entry := range w.Updates() {
+		// nil entry marks all initial values were delivered
+		if entry == nil {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
@@ -0,0 +1,89 @@
+package accounts_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gomoni/amble/internal/auth"
+	"github.com/gomoni/amble/internal/services/accounts"
+	"github.com/gomoni/amble/internal/tid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLister(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := accounts.NewMemory()
+
+	// given five accounts, even ones logged via github and the last is suspended
+	var uids []tid.UserID
+	for i := range 5 {
+		uid, err := store.Create(ctx, auth.UserInfo{Name: "user"})
+		require.NoError(t, err)
+		require.WithinDuration(t, time.Now(), uid.CreatedAt(), time.Second)
+		if i%2 == 0 {
+			require.NoError(t, store.UpdateUserInfo(ctx, "github", uid, map[string]any{"login": "user"}))
+		}
+		uids = append(uids, uid)
+	}
+	require.NoError(t, store.Suspend(ctx, uids[4], "spam"))
+
+	list := func(l accounts.Lister) []tid.UserID {
+		t.Helper()
+		var ret []tid.UserID
+		for account, err := range l.Iter(ctx) {
+			require.NoError(t, err)
+			ret = append(ret, account.UserID)
+		}
+		return ret
+	}
+
+	// then accounts are sorted by creation
+	require.Equal(t, uids, list(store.Lister()))
+	require.Equal(t, []tid.UserID{uids[4], uids[3], uids[2], uids[1], uids[0]}, list(store.Lister().WithDescending()))
+
+	// and filtered
+	require.Equal(t, []tid.UserID{uids[0], uids[2], uids[4]}, list(store.Lister().WithProvider("github")))
+	require.Empty(t, list(store.Lister().WithProvider("email")))
+	require.Equal(t, []tid.UserID{uids[4]}, list(store.Lister().WithStatus(accounts.StatusSuspended)))
+	require.Equal(t, []tid.UserID{uids[0], uids[2]}, list(store.Lister().WithProvider("github").WithStatus(accounts.StatusActive)))
+
+	// when filtered by deleted or an unknown status, then the listing fails
+	for _, status := range []accounts.Status{accounts.StatusDeleted, "unknown"} {
+		_, err := store.Lister().WithStatus(status).Page(ctx)
+		require.ErrorIs(t, err, accounts.ErrUnsupportedStatus)
+	}
+
+	// when listed by pages of two
+	page, err := store.Lister().WithLimit(2).Page(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []tid.UserID{uids[0], uids[1]}, userIDs(page))
+	require.Equal(t, uids[1].String(), page.Next)
+
+	page, err = store.Lister().WithLimit(2).WithCursor(page.Next).Page(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []tid.UserID{uids[2], uids[3]}, userIDs(page))
+
+	page, err = store.Lister().WithLimit(2).WithCursor(page.Next).Page(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []tid.UserID{uids[4]}, userIDs(page))
+	require.Empty(t, page.Next)
+
+	// and descending pages continue backwards
+	page, err = store.Lister().WithLimit(2).WithDescending().WithCursor(uids[3].String()).Page(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []tid.UserID{uids[2], uids[1]}, userIDs(page))
+
+	// and a garbage cursor is an error
+	_, err = store.Lister().WithCursor("garbage").Page(ctx)
+	require.ErrorIs(t, err, accounts.ErrInvalidCursor)
+}
+
+func userIDs(page accounts.Page) []tid.UserID {
+	ret := make([]tid.UserID, len(page.Accounts))
+	for i, account := range page.Accounts {
+		ret[i] = account.UserID
+	}
+	return ret
+}
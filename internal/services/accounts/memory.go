@@ -0,0 +1,605 @@
+package accounts
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// NewMemory returns accounts stored in the process memory. It behaves like
+// NewNats with a bucket of default config, so it's good for tests and single
+// node setups. Nothing survives the restart.
+func NewMemory() Accounts {
+	return NewNats(newMemoryKV("accounts", 1))
+}
+
+// memoryKV implements jetstream.KeyValue on top of a map. Revisions are
+// shared by the whole bucket like stream sequences are, delete markers and
+// history are kept the same way JetStream does.
+type memoryKV struct {
+	bucket  string
+	history int
+
+	mu       sync.Mutex
+	seq      uint64
+	entries  []*memoryEntry // ordered by revision
+	watchers map[*memoryWatcher]struct{}
+}
+
+func newMemoryKV(bucket string, history int) *memoryKV {
+	return &memoryKV{
+		bucket:   bucket,
+		history:  history,
+		watchers: make(map[*memoryWatcher]struct{}),
+	}
+}
+
+var _ jetstream.KeyValue = (*memoryKV)(nil)
+
+// copied from nats.go, as keyValid is not exported
+var validKeyRe = regexp.MustCompile(`\A[-/_=\.a-zA-Z0-9]+\z`)
+
+func keyValid(key string) bool {
+	if len(key) == 0 || key[0] == '.' || key[len(key)-1] == '.' {
+		return false
+	}
+	return validKeyRe.MatchString(key)
+}
+
+// wrongLastSequence is the error JetStream returns when an expected revision
+// does not match
+func wrongLastSequence(revision uint64) error {
+	return fmt.Errorf("nats: %w", &jetstream.APIError{
+		Code:        400,
+		ErrorCode:   jetstream.JSErrCodeStreamWrongLastSequence,
+		Description: fmt.Sprintf("wrong last sequence: %d", revision),
+	})
+}
+
+func (m *memoryKV) Get(ctx context.Context, key string) (jetstream.KeyValueEntry, error) {
+	if !keyValid(key) {
+		return nil, jetstream.ErrInvalidKey
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := m.last(key)
+	if e == nil || e.op != jetstream.KeyValuePut {
+		return nil, jetstream.ErrKeyNotFound
+	}
+	return e.clone(false), nil
+}
+
+func (m *memoryKV) GetRevision(ctx context.Context, key string, revision uint64) (jetstream.KeyValueEntry, error) {
+	if !keyValid(key) {
+		return nil, jetstream.ErrInvalidKey
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, e := range m.entries {
+		if e.revision == revision && e.key == key && e.op == jetstream.KeyValuePut {
+			return e.clone(false), nil
+		}
+	}
+	return nil, jetstream.ErrKeyNotFound
+}
+
+func (m *memoryKV) Put(ctx context.Context, key string, value []byte) (uint64, error) {
+	if !keyValid(key) {
+		return 0, jetstream.ErrInvalidKey
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.append(key, value, jetstream.KeyValuePut), nil
+}
+
+func (m *memoryKV) PutString(ctx context.Context, key string, value string) (uint64, error) {
+	return m.Put(ctx, key, []byte(value))
+}
+
+func (m *memoryKV) Create(ctx context.Context, key string, value []byte) (uint64, error) {
+	if !keyValid(key) {
+		return 0, jetstream.ErrInvalidKey
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// deleted keys can be created again
+	if e := m.last(key); e != nil && e.op == jetstream.KeyValuePut {
+		return 0, fmt.Errorf("%w: %s", wrongLastSequence(e.revision), "key exists")
+	}
+	return m.append(key, value, jetstream.KeyValuePut), nil
+}
+
+func (m *memoryKV) Update(ctx context.Context, key string, value []byte, revision uint64) (uint64, error) {
+	if !keyValid(key) {
+		return 0, jetstream.ErrInvalidKey
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if last := m.lastRevision(key); last != revision {
+		return 0, wrongLastSequence(last)
+	}
+	return m.append(key, value, jetstream.KeyValuePut), nil
+}
+
+func (m *memoryKV) Delete(ctx context.Context, key string, opts ...jetstream.KVDeleteOpt) error {
+	o, err := deleteOptions(opts)
+	if err != nil {
+		return err
+	}
+	return m.delete(key, o)
+}
+
+func (m *memoryKV) Purge(ctx context.Context, key string, opts ...jetstream.KVDeleteOpt) error {
+	o, err := deleteOptions(opts)
+	if err != nil {
+		return err
+	}
+	o.purge = true
+	return m.delete(key, o)
+}
+
+func (m *memoryKV) delete(key string, o deleteOpts) error {
+	if !keyValid(key) {
+		return jetstream.ErrInvalidKey
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if o.revision != 0 {
+		if last := m.lastRevision(key); last != o.revision {
+			return wrongLastSequence(last)
+		}
+	}
+	op := jetstream.KeyValueDelete
+	if o.purge {
+		op = jetstream.KeyValuePurge
+	}
+	m.append(key, nil, op)
+	return nil
+}
+
+func (m *memoryKV) Watch(ctx context.Context, keys string, opts ...jetstream.WatchOpt) (jetstream.KeyWatcher, error) {
+	o, err := watchOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	w := &memoryWatcher{
+		kv:      m,
+		pattern: keys,
+		opts:    o,
+		updates: make(chan jetstream.KeyValueEntry),
+		notify:  make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+
+	m.mu.Lock()
+	if !o.updatesOnly {
+		initial := m.initial(keys, o)
+		for i, e := range initial {
+			e = e.clone(o.metaOnly)
+			e.delta = uint64(len(initial) - 1 - i)
+			if o.ignoreDeletes && e.op != jetstream.KeyValuePut {
+				continue
+			}
+			w.queue = append(w.queue, e)
+		}
+		// nil marks the end of initial values
+		w.queue = append(w.queue, nil)
+	}
+	m.watchers[w] = struct{}{}
+	m.mu.Unlock()
+
+	go w.run(ctx)
+	return w, nil
+}
+
+func (m *memoryKV) WatchAll(ctx context.Context, opts ...jetstream.WatchOpt) (jetstream.KeyWatcher, error) {
+	return m.Watch(ctx, jetstream.AllKeys, opts...)
+}
+
+func (m *memoryKV) Keys(ctx context.Context, opts ...jetstream.WatchOpt) ([]string, error) {
+	kl, err := m.ListKeys(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for key := range kl.Keys() {
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, jetstream.ErrNoKeysFound
+	}
+	return keys, nil
+}
+
+func (m *memoryKV) ListKeys(ctx context.Context, opts ...jetstream.WatchOpt) (jetstream.KeyLister, error) {
+	opts = append(opts, jetstream.IgnoreDeletes(), jetstream.MetaOnly())
+	watcher, err := m.WatchAll(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	kl := &memoryKeyLister{watcher: watcher, keys: make(chan string)}
+	go func() {
+		defer close(kl.keys)
+		defer watcher.Stop()
+		for {
+			select {
+			case entry := <-watcher.Updates():
+				if entry == nil {
+					return
+				}
+				select {
+				case kl.keys <- entry.Key():
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return kl, nil
+}
+
+func (m *memoryKV) History(ctx context.Context, key string, opts ...jetstream.WatchOpt) ([]jetstream.KeyValueEntry, error) {
+	o, err := watchOptions(append(opts, jetstream.IncludeHistory()))
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var entries []jetstream.KeyValueEntry
+	initial := m.initial(key, o)
+	for i, e := range initial {
+		e = e.clone(o.metaOnly)
+		e.delta = uint64(len(initial) - 1 - i)
+		if o.ignoreDeletes && e.op != jetstream.KeyValuePut {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) == 0 {
+		return nil, jetstream.ErrKeyNotFound
+	}
+	return entries, nil
+}
+
+func (m *memoryKV) Bucket() string {
+	return m.bucket
+}
+
+// PurgeDeletes removes all keys with a delete marker. The options are
+// ignored, so delete markers of any age are removed.
+func (m *memoryKV) PurgeDeletes(ctx context.Context, opts ...jetstream.KVPurgeOpt) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	deleted := make(map[string]bool)
+	for _, e := range m.entries {
+		deleted[e.key] = e.op != jetstream.KeyValuePut
+	}
+	entries := m.entries[:0]
+	for _, e := range m.entries {
+		if !deleted[e.key] {
+			entries = append(entries, e)
+		}
+	}
+	m.entries = entries
+	return nil
+}
+
+func (m *memoryKV) Status(ctx context.Context) (jetstream.KeyValueStatus, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := memoryStatus{bucket: m.bucket, history: int64(m.history)}
+	for _, e := range m.entries {
+		status.values++
+		status.bytes += uint64(len(e.key) + len(e.value))
+	}
+	return status, nil
+}
+
+// last returns the latest entry of a key including delete markers or nil
+func (m *memoryKV) last(key string) *memoryEntry {
+	for i := len(m.entries) - 1; i >= 0; i-- {
+		if m.entries[i].key == key {
+			return m.entries[i]
+		}
+	}
+	return nil
+}
+
+func (m *memoryKV) lastRevision(key string) uint64 {
+	if e := m.last(key); e != nil {
+		return e.revision
+	}
+	return 0
+}
+
+// initial returns the entries a new watcher starts with
+func (m *memoryKV) initial(pattern string, o watchOpts) []*memoryEntry {
+	var ret []*memoryEntry
+	for _, e := range m.entries {
+		if !MatchSubject(pattern, e.key) || e.revision < o.resumeFromRevision {
+			continue
+		}
+		if !o.includeHistory && o.resumeFromRevision == 0 && m.last(e.key) != e {
+			continue
+		}
+		ret = append(ret, e)
+	}
+	return ret
+}
+
+// append stores a new revision, drops the history over the limit and
+// notifies the watchers, must be called under the lock
+func (m *memoryKV) append(key string, value []byte, op jetstream.KeyValueOp) uint64 {
+	m.seq++
+	e := &memoryEntry{
+		bucket:   m.bucket,
+		key:      key,
+		value:    append([]byte(nil), value...),
+		revision: m.seq,
+		created:  time.Now(),
+		op:       op,
+	}
+	m.entries = append(m.entries, e)
+
+	keep := m.history
+	if op == jetstream.KeyValuePurge {
+		keep = 1
+	}
+	var n int
+	for i := len(m.entries) - 1; i >= 0; i-- {
+		if m.entries[i].key != key {
+			continue
+		}
+		n++
+		if n > keep {
+			m.entries = append(m.entries[:i], m.entries[i+1:]...)
+		}
+	}
+
+	for w := range m.watchers {
+		w.push(e)
+	}
+	return e.revision
+}
+
+type memoryEntry struct {
+	bucket   string
+	key      string
+	value    []byte
+	revision uint64
+	created  time.Time
+	delta    uint64
+	op       jetstream.KeyValueOp
+}
+
+func (e *memoryEntry) Bucket() string                  { return e.bucket }
+func (e *memoryEntry) Key() string                     { return e.key }
+func (e *memoryEntry) Value() []byte                   { return e.value }
+func (e *memoryEntry) Revision() uint64                { return e.revision }
+func (e *memoryEntry) Created() time.Time              { return e.created }
+func (e *memoryEntry) Delta() uint64                   { return e.delta }
+func (e *memoryEntry) Operation() jetstream.KeyValueOp { return e.op }
+
+// clone returns a copy, so callers can't modify the stored value
+func (e *memoryEntry) clone(metaOnly bool) *memoryEntry {
+	ret := *e
+	ret.value = nil
+	if !metaOnly {
+		ret.value = append([]byte(nil), e.value...)
+	}
+	return &ret
+}
+
+// memoryWatcher queues the updates, so writers never block on slow readers
+type memoryWatcher struct {
+	kv      *memoryKV
+	pattern string
+	opts    watchOpts
+
+	mu      sync.Mutex
+	queue   []jetstream.KeyValueEntry
+	updates chan jetstream.KeyValueEntry
+	notify  chan struct{}
+	stop    chan struct{}
+	once    sync.Once
+}
+
+// push queues the entry if it matches, must be called under the kv lock
+func (w *memoryWatcher) push(e *memoryEntry) {
+	if !MatchSubject(w.pattern, e.key) {
+		return
+	}
+	if w.opts.ignoreDeletes && e.op != jetstream.KeyValuePut {
+		return
+	}
+	w.mu.Lock()
+	w.queue = append(w.queue, e.clone(w.opts.metaOnly))
+	w.mu.Unlock()
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (w *memoryWatcher) run(ctx context.Context) {
+	defer close(w.updates)
+	for {
+		w.mu.Lock()
+		var next jetstream.KeyValueEntry
+		ok := len(w.queue) > 0
+		if ok {
+			next = w.queue[0]
+			w.queue = w.queue[1:]
+		}
+		w.mu.Unlock()
+
+		if !ok {
+			select {
+			case <-w.notify:
+				continue
+			case <-w.stop:
+				return
+			case <-ctx.Done():
+				_ = w.Stop()
+				return
+			}
+		}
+		select {
+		case w.updates <- next:
+		case <-w.stop:
+			return
+		case <-ctx.Done():
+			_ = w.Stop()
+			return
+		}
+	}
+}
+
+func (w *memoryWatcher) Updates() <-chan jetstream.KeyValueEntry {
+	return w.updates
+}
+
+func (w *memoryWatcher) Stop() error {
+	w.once.Do(func() {
+		w.kv.mu.Lock()
+		delete(w.kv.watchers, w)
+		w.kv.mu.Unlock()
+		close(w.stop)
+	})
+	return nil
+}
+
+type memoryKeyLister struct {
+	watcher jetstream.KeyWatcher
+	keys    chan string
+}
+
+func (kl *memoryKeyLister) Keys() <-chan string {
+	return kl.keys
+}
+
+func (kl *memoryKeyLister) Stop() error {
+	return kl.watcher.Stop()
+}
+
+type memoryStatus struct {
+	bucket  string
+	values  uint64
+	history int64
+	bytes   uint64
+}
+
+func (s memoryStatus) Bucket() string       { return s.bucket }
+func (s memoryStatus) Values() uint64       { return s.values }
+func (s memoryStatus) History() int64       { return s.history }
+func (s memoryStatus) TTL() time.Duration   { return 0 }
+func (s memoryStatus) BackingStore() string { return "Memory" }
+func (s memoryStatus) Bytes() uint64        { return s.bytes }
+func (s memoryStatus) IsCompressed() bool   { return false }
+
+// watchOpts mirrors the unexported options of jetstream
+type watchOpts struct {
+	ignoreDeletes      bool
+	includeHistory     bool
+	updatesOnly        bool
+	metaOnly           bool
+	resumeFromRevision uint64
+}
+
+// deleteOpts mirrors the unexported options of jetstream
+type deleteOpts struct {
+	purge    bool
+	revision uint64
+}
+
+// jetstream options are functions of unexported types, so they are applied
+// to a zero value of their argument via reflection and the fields are read
+// back by name. A renamed field fails as an unsupported option.
+func applyOption(opt any) (reflect.Value, error) {
+	fn := reflect.ValueOf(opt)
+	if fn.Kind() != reflect.Func || fn.Type().NumIn() != 1 || fn.Type().In(0).Kind() != reflect.Pointer {
+		return reflect.Value{}, fmt.Errorf("memory kv: unsupported option %T", opt)
+	}
+	arg := reflect.New(fn.Type().In(0).Elem())
+	out := fn.Call([]reflect.Value{arg})
+	if len(out) == 1 && !out[0].IsNil() {
+		return reflect.Value{}, out[0].Interface().(error)
+	}
+	return arg.Elem(), nil
+}
+
+// optionField returns the field of an applied option, it fails if jetstream
+// renamed the field or changed its type
+func optionField(v reflect.Value, name string, kind reflect.Kind) (reflect.Value, error) {
+	f := v.FieldByName(name)
+	if !f.IsValid() || f.Kind() != kind {
+		return reflect.Value{}, fmt.Errorf("memory kv: unsupported option %s: no %s field %s", v.Type(), kind, name)
+	}
+	return f, nil
+}
+
+func watchOptions(opts []jetstream.WatchOpt) (watchOpts, error) {
+	var o watchOpts
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		v, err := applyOption(opt)
+		if err != nil {
+			return o, err
+		}
+		for name, set := range map[string]*bool{
+			"ignoreDeletes":  &o.ignoreDeletes,
+			"includeHistory": &o.includeHistory,
+			"updatesOnly":    &o.updatesOnly,
+			"metaOnly":       &o.metaOnly,
+		} {
+			f, err := optionField(v, name, reflect.Bool)
+			if err != nil {
+				return o, err
+			}
+			*set = *set || f.Bool()
+		}
+		f, err := optionField(v, "resumeFromRevision", reflect.Uint64)
+		if err != nil {
+			return o, err
+		}
+		if rev := f.Uint(); rev != 0 {
+			o.resumeFromRevision = rev
+		}
+	}
+	return o, nil
+}
+
+func deleteOptions(opts []jetstream.KVDeleteOpt) (deleteOpts, error) {
+	var o deleteOpts
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		v, err := applyOption(opt)
+		if err != nil {
+			return o, err
+		}
+		purge, err := optionField(v, "purge", reflect.Bool)
+		if err != nil {
+			return o, err
+		}
+		o.purge = o.purge || purge.Bool()
+		revision, err := optionField(v, "revision", reflect.Uint64)
+		if err != nil {
+			return o, err
+		}
+		if rev := revision.Uint(); rev != 0 {
+			o.revision = rev
+		}
+	}
+	return o, nil
+}
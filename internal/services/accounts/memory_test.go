@@ -0,0 +1,220 @@
+package accounts
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	appJWT "github.com/gomoni/amble/internal/auth/jwt"
+	"github.com/gomoni/amble/internal/services/audit"
+	"github.com/gomoni/amble/internal/test"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+// TestKeyValue ensures the memory bucket behaves like JetStream one
+func TestKeyValue(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testKeyValue(t, newMemoryKV("accounts", 1))
+		testOptions(t, newMemoryKV("options", 5))
+
+		// options jetstream changed are refused instead of ignored
+		_, err := optionField(reflect.ValueOf(struct{ purge string }{}), "purge", reflect.Bool)
+		require.ErrorContains(t, err, "unsupported option")
+	})
+	t.Run("nats", func(t *testing.T) {
+		server, err := test.NewNatsContainer(context.Background(), test.NatsContainerOpts{})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			err := server.Terminate()
+			require.NoError(t, err)
+		})
+		nc, err := nats.Connect(server.Endpoint())
+		require.NoError(t, err)
+		t.Cleanup(nc.Close)
+		js, err := jetstream.New(nc)
+		require.NoError(t, err)
+		kv, err := js.CreateKeyValue(context.Background(), KeyValueConfig())
+		require.NoError(t, err)
+		testKeyValue(t, kv)
+		kv, err = js.CreateKeyValue(context.Background(), jetstream.KeyValueConfig{Bucket: "options", History: 5})
+		require.NoError(t, err)
+		testOptions(t, kv)
+	})
+}
+
+func testKeyValue(t *testing.T, kv jetstream.KeyValue) {
+	ctx := context.Background()
+
+	_, err := kv.Put(ctx, ".invalid", nil)
+	require.ErrorIs(t, err, jetstream.ErrInvalidKey)
+	_, err = kv.Get(ctx, "a.b")
+	require.ErrorIs(t, err, jetstream.ErrKeyNotFound)
+
+	// create and update
+	rev, err := kv.Create(ctx, "a.b", []byte("1"))
+	require.NoError(t, err)
+	_, err = kv.Create(ctx, "a.b", []byte("2"))
+	require.ErrorIs(t, err, jetstream.ErrKeyExists)
+	_, err = kv.Update(ctx, "a.b", []byte("2"), rev+100)
+	require.ErrorIs(t, err, jetstream.ErrKeyExists)
+	rev, err = kv.Update(ctx, "a.b", []byte("2"), rev)
+	require.NoError(t, err)
+	entry, err := kv.Get(ctx, "a.b")
+	require.NoError(t, err)
+	require.Equal(t, "2", string(entry.Value()))
+	require.Equal(t, rev, entry.Revision())
+	require.Equal(t, jetstream.KeyValuePut, entry.Operation())
+
+	// watch sends the latest values, nil marker and updates
+	_, err = kv.Put(ctx, "a.c", []byte("3"))
+	require.NoError(t, err)
+	w, err := kv.Watch(ctx, "a.*")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = w.Stop() })
+	var keys []string
+	for e := range w.Updates() {
+		if e == nil {
+			break
+		}
+		keys = append(keys, e.Key())
+	}
+	require.Equal(t, []string{"a.b", "a.c"}, keys)
+
+	// delete with a wrong revision fails
+	err = kv.Delete(ctx, "a.b", jetstream.LastRevision(1))
+	require.Error(t, err)
+	require.NoError(t, kv.Delete(ctx, "a.b"))
+	_, err = kv.Get(ctx, "a.b")
+	require.ErrorIs(t, err, jetstream.ErrKeyNotFound)
+	select {
+	case e := <-w.Updates():
+		require.Equal(t, "a.b", e.Key())
+		require.Equal(t, jetstream.KeyValueDelete, e.Operation())
+	case <-time.After(time.Second):
+		t.Fatal("no update")
+	}
+
+	// deleted keys are not listed and can be created again
+	listed, err := kv.Keys(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a.c"}, listed)
+	_, err = kv.Create(ctx, "a.b", []byte("4"))
+	require.NoError(t, err)
+
+	require.NoError(t, kv.Purge(ctx, "a.c"))
+	history, err := kv.History(ctx, "a.c")
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	require.Equal(t, jetstream.KeyValuePurge, history[0].Operation())
+}
+
+// testOptions checks the watch and delete options read by the memory bucket
+func testOptions(t *testing.T, kv jetstream.KeyValue) {
+	ctx := context.Background()
+	watch := func(opts ...jetstream.WatchOpt) []string {
+		t.Helper()
+		w, err := kv.Watch(ctx, "o.*", opts...)
+		require.NoError(t, err)
+		defer func() { _ = w.Stop() }()
+		var ret []string
+		for e := range w.Updates() {
+			if e == nil {
+				break
+			}
+			ret = append(ret, e.Key()+"="+string(e.Value())+" "+e.Operation().String())
+		}
+		return ret
+	}
+
+	// given o.a was written twice and o.b was deleted
+	first, err := kv.Put(ctx, "o.a", []byte("1"))
+	require.NoError(t, err)
+	second, err := kv.Put(ctx, "o.a", []byte("2"))
+	require.NoError(t, err)
+	created, err := kv.Put(ctx, "o.b", []byte("3"))
+	require.NoError(t, err)
+	require.NoError(t, kv.Delete(ctx, "o.b"))
+
+	require.Equal(t, []string{"o.a=2 KeyValuePutOp", "o.b= KeyValueDeleteOp"}, watch())
+	require.Equal(t, []string{"o.a=2 KeyValuePutOp"}, watch(jetstream.IgnoreDeletes()))
+	require.Equal(t, []string{"o.a= KeyValuePutOp", "o.b= KeyValueDeleteOp"}, watch(jetstream.MetaOnly()))
+	require.Equal(t, []string{"o.a=1 KeyValuePutOp", "o.a=2 KeyValuePutOp", "o.b=3 KeyValuePutOp", "o.b= KeyValueDeleteOp"}, watch(jetstream.IncludeHistory()))
+	require.Equal(t, []string{"o.b=3 KeyValuePutOp", "o.b= KeyValueDeleteOp"}, watch(jetstream.ResumeFromRevision(created)))
+
+	// when deleted with a stale revision, then the value is kept
+	require.Error(t, kv.Delete(ctx, "o.a", jetstream.LastRevision(first)))
+	require.NoError(t, kv.Delete(ctx, "o.a", jetstream.LastRevision(second)))
+	require.Empty(t, watch(jetstream.IgnoreDeletes()))
+}
+
+// TestAuthorizeMemory runs the callout logic without nats-server
+func TestAuthorizeMemory(t *testing.T) {
+	var buf [ed25519.SeedSize]byte
+	_, err := rand.Read(buf[:])
+	require.NoError(t, err)
+	secret, err := appJWT.LoadSecret(bytes.NewReader(buf[:]))
+	require.NoError(t, err)
+	encoder := appJWT.NewEncoder(secret)
+	xkey, err := nkeys.CreateCurveKeys()
+	require.NoError(t, err)
+	issuer, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+
+	store := NewMemory()
+	svc, err := NewService(xkey, issuer, store, appJWT.NewDecoder(secret.Public()))
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	pla, err := store.CreateTenant(ctx, "plainsof", "PLA")
+	require.NoError(t, err)
+	octocat := requireUser(t, store, "543219", "Octocat")
+	require.NoError(t, store.AddMember(ctx, pla.ID, octocat))
+
+	request := func(token string) (string, error) {
+		user, err := nkeys.CreateUser()
+		require.NoError(t, err)
+		userPublic, err := user.PublicKey()
+		require.NoError(t, err)
+		rc := jwt.NewAuthorizationRequestClaims(userPublic)
+		rc.UserNkey = userPublic
+		rc.ConnectOptions.Token = token
+		event := audit.Event{}
+		return svc.authorize(ctx, rc, &event)
+	}
+
+	token, err := encoder.Encode(webClaims("543219"))
+	require.NoError(t, err)
+	userJWT, err := request(token)
+	require.NoError(t, err)
+	claims, err := jwt.DecodeUserClaims(userJWT)
+	require.NoError(t, err)
+	require.Equal(t, octocat.String(), claims.Name)
+
+	// unknown user
+	token, err = encoder.Encode(webClaims("583231"))
+	require.NoError(t, err)
+	_, err = request(token)
+	require.Equal(t, ClassUnknownIdentity, classOf(err))
+
+	// user waiting for an approval
+	hubot := requireUser(t, store.WithApprovalQueue(), "583231", "Hubot")
+	require.NoError(t, store.AddMember(ctx, pla.ID, hubot))
+	_, err = request(token)
+	require.Equal(t, ClassPendingApproval, classOf(err))
+
+	// a link signed by the same key is not a session
+	link := webClaims("543219")
+	link.Audience = []string{"export_download"}
+	token, err = encoder.Encode(link)
+	require.NoError(t, err)
+	_, err = request(token)
+	require.Equal(t, ClassBadToken, classOf(err))
+}
@@ -11,10 +11,11 @@ Expected usage if from login subsystem
 package accounts
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"iter"
 	"strings"
 
 	"github.com/gomoni/amble/internal/auth"
@@ -24,25 +25,55 @@ import (
 
 type Accounts struct {
 	kv jetstream.KeyValue
+	// approvalQueue makes new accounts wait for an admin
+	approvalQueue bool
+	resolver      ProfileResolver
+	// defaultTenant every new account becomes a member of, zero for none
+	defaultTenant tid.TenantID
+	// erasers erase the data of the user kept outside of the bucket
+	erasers []Eraser
 }
 
 func NewNats(kv jetstream.KeyValue) Accounts {
-	return Accounts{kv: kv}
+	return Accounts{kv: kv, resolver: NewProfileResolver()}
 }
 
-// Create creates a new account based on user info. Store to `amble.$user_id.user_info` key
+// Create creates a new account based on user info. Store to `user_info.$uid.app` key.
+// A verified email is indexed, it fails with EmailConflictError if another
+// account has it.
 func (n Accounts) Create(ctx context.Context, userInfo auth.UserInfo) (tid.UserID, error) {
 	uid, err := tid.NewUserID()
 	if err != nil {
 		return tid.UserID{}, fmt.Errorf("account create: generate user id: %w", err)
 	}
+	// ids of erased accounts are never reused
+	err = n.erased(ctx, uid)
+	if err != nil {
+		return tid.UserID{}, fmt.Errorf("account create: %w", err)
+	}
 	userInfo.UserID = uid
-	b, err := json.Marshal(userInfo)
+	b, err := encodeAccount(userInfo)
 	if err != nil {
 		return tid.UserID{}, fmt.Errorf("account create: marshal user data: %w", err)
 	}
+	err = n.claimEmail(ctx, userInfo)
+	if err != nil {
+		return tid.UserID{}, fmt.Errorf("account create: %w", err)
+	}
+	// queued before the account exists, so it is never active
+	if n.approvalQueue {
+		err = n.requestApproval(ctx, uid)
+		if err != nil {
+			_ = n.releaseEmail(ctx, uid, userInfo.Email)
+			return tid.UserID{}, fmt.Errorf("account create: %w", err)
+		}
+	}
 	_, err = n.kv.Create(ctx, "user_info."+uid.String()+".app", b)
 	if err != nil {
+		_ = n.releaseEmail(ctx, uid, userInfo.Email)
+		if n.approvalQueue {
+			_ = n.kv.Delete(ctx, approvalKey(uid))
+		}
 		return tid.UserID{}, fmt.Errorf("account create: marshal user data: %w", err)
 	}
 	return uid, nil
@@ -53,8 +84,7 @@ func (n Accounts) Get(ctx context.Context, uid tid.UserID) (auth.UserInfo, error
 	if err != nil {
 		return auth.UserInfo{}, fmt.Errorf("account get: %w", err)
 	}
-	var userInfo auth.UserInfo
-	err = json.Unmarshal(b.Value(), &userInfo)
+	userInfo, _, err := decodeAccount(b.Value())
 	if err != nil {
 		return auth.UserInfo{}, fmt.Errorf("account get: unmarshal user data: %w", err)
 	}
@@ -62,8 +92,12 @@ func (n Accounts) Get(ctx context.Context, uid tid.UserID) (auth.UserInfo, error
 }
 
 func (n Accounts) Link(ctx context.Context, provider, id string, uid tid.UserID) error {
+	err := n.erased(ctx, uid)
+	if err != nil {
+		return err
+	}
 	key := strings.Join([]string{"auth_link", provider, id}, ".")
-	_, err := n.kv.Create(ctx, key, []byte(uid.String()))
+	_, err = n.kv.Create(ctx, key, []byte(uid.String()))
 	return err
 }
 
@@ -86,83 +120,100 @@ func (n Accounts) UpdateUserInfo(ctx context.Context, provider string, uid tid.U
 	if err != nil {
 		return fmt.Errorf("account update user info: marshal %s user data: %w", provider, err)
 	}
-	_, err = n.kv.Put(ctx, "user_info."+uid.String()+"."+provider, b)
-	if err != nil {
+	// the provider data is replaced, but an unchanged one is not written again
+	_, err = update(ctx, n.kv, "user_info."+uid.String()+"."+provider, func(current []byte, exists bool) ([]byte, error) {
+		if exists && bytes.Equal(current, b) {
+			return nil, errUnchanged
+		}
+		return b, nil
+	})
+	if err != nil && !errors.Is(err, errUnchanged) {
 		return fmt.Errorf("account update user info: %w", err)
 	}
 	return nil
 }
 
-// The nats docu says:
-// > lister will always close the channel when done (either all keys have
-// > been read or an error occurred) and therefore can be used in range loops.
-// > Stop can be used to stop the lister when not all keys have been read.
-// Does that really work?
-
-func (n Accounts) Lister() Lister {
-	return Lister{
-		kv: n.kv,
-		n:  n,
+// SignIn returns the account linked with the provider login. A new account
+// is created and linked on the first login. Provider's raw user info is
+// stored as is and the profile is recomputed from it, see ProfileResolver.
+func (n Accounts) SignIn(ctx context.Context, provider, id string, userInfo auth.UserInfo, raw map[string]any) (auth.UserInfo, error) {
+	uid, err := n.Linked(ctx, provider, id)
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		uid, err = n.signUp(ctx, provider, id, userInfo)
 	}
-}
-
-type Lister struct {
-	kv         jetstream.KeyValue
-	n          Accounts
-	keyMatcher func(string) bool
-	errs       []error
-}
-
-func (l Lister) WithKeyMatcher(f func(string) bool) Lister {
-	return Lister{
-		kv:         l.kv,
-		n:          l.n,
-		keyMatcher: f,
+	if err != nil {
+		return auth.UserInfo{}, fmt.Errorf("account sign in: %w", err)
 	}
-}
 
-func (l Lister) WithPattern(pattern string) Lister {
-	return Lister{
-		kv:         l.kv,
-		n:          l.n,
-		keyMatcher: func(subject string) bool { return MatchSubject(pattern, subject) },
+	if raw != nil {
+		err = n.UpdateUserInfo(ctx, provider, uid, raw)
+		if err != nil {
+			return auth.UserInfo{}, fmt.Errorf("account sign in: %w", err)
+		}
 	}
+	account, err := n.RefreshProfile(ctx, uid)
+	if err != nil {
+		return auth.UserInfo{}, fmt.Errorf("account sign in: %w", err)
+	}
+	return account, nil
 }
 
-func (l Lister) Iter(ctx context.Context) (iter.Seq[auth.UserInfo], error) {
-	l.errs = make([]error, 0)
-	kl, err := l.kv.ListKeys(ctx, jetstream.MetaOnly(), jetstream.IgnoreDeletes())
+// signUp creates and links an account on the first login. A login with
+// a verified email of an existing account is linked to it, both providers
+// verified the address. Racing first logins end up with the account of the
+// winner.
+func (n Accounts) signUp(ctx context.Context, provider, id string, userInfo auth.UserInfo) (tid.UserID, error) {
+	uid, err := n.Create(ctx, userInfo)
+	var conflict *EmailConflictError
+	if errors.As(err, &conflict) {
+		_, err = n.Get(ctx, conflict.Owner)
+		if err == nil {
+			return n.linkExisting(ctx, provider, id, conflict.Owner)
+		} else if !errors.Is(err, jetstream.ErrKeyNotFound) {
+			return tid.UserID{}, err
+		}
+		// the owner is gone meanwhile, the account does not claim the email
+		userInfo.EmailVerified = false
+		uid, err = n.Create(ctx, userInfo)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("account list: create key lister: %w", err)
+		return tid.UserID{}, err
 	}
-
-	s := func(yield func(auth.UserInfo) bool) {
-		for key := range kl.Keys() {
-			if !l.keyMatcher(key) {
-				continue
-			}
-			x := key[len("amble.") : len(key)-len(".user_info")]
-			uid, err := tid.ParseUserID(x)
-			if err != nil {
-				l.errs = append(l.errs, fmt.Errorf("account list: parse user id %q: %w", x, err))
-				continue
-			}
-			account, err := l.n.Get(ctx, uid)
-			if err != nil {
-				l.errs = append(l.errs, fmt.Errorf("account list: get id %s: %w", uid.String(), err))
-				continue
-			}
-			if !yield(account) {
-				_ = kl.Stop()
-				break
-			}
+	err = n.Link(ctx, provider, id, uid)
+	if errors.Is(err, jetstream.ErrKeyExists) {
+		linked, err := n.Linked(ctx, provider, id)
+		if err != nil {
+			return tid.UserID{}, err
+		}
+		if linked != uid {
+			// a concurrent first login won, drop the account just created
+			_ = n.kv.Delete(ctx, "user_info."+uid.String()+".app")
+			_ = n.releaseEmail(ctx, uid, userInfo.Email)
+			return linked, nil
+		}
+		// a concurrent first login with the same email linked it to this account
+	} else if err != nil {
+		return tid.UserID{}, fmt.Errorf("link %s: %w", provider, err)
+	}
+	if n.defaultTenant != (tid.TenantID{}) {
+		err = n.AddMember(ctx, n.defaultTenant, uid)
+		if err != nil {
+			return tid.UserID{}, fmt.Errorf("default tenant: %w", err)
 		}
 	}
-	return s, nil
+	return uid, nil
 }
 
-func (l Lister) Errors() []error {
-	return l.errs
+// linkExisting links the login to the account unless a concurrent first
+// login linked it already
+func (n Accounts) linkExisting(ctx context.Context, provider, id string, uid tid.UserID) (tid.UserID, error) {
+	err := n.Link(ctx, provider, id, uid)
+	if errors.Is(err, jetstream.ErrKeyExists) {
+		return n.Linked(ctx, provider, id)
+	} else if err != nil {
+		return tid.UserID{}, fmt.Errorf("link %s: %w", provider, err)
+	}
+	return uid, nil
 }
 
 // FIXME: seems implemented by https://pkg.go.dev/github.com/nats-io/jwt/v2#Subject.IsContainedIn
@@ -4,6 +4,7 @@ import (
 	"context"
 	"testing"
 
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/gomoni/amble/internal/auth"
 	"github.com/gomoni/amble/internal/services/accounts"
 	"github.com/gomoni/amble/internal/test"
@@ -29,9 +30,7 @@ func TestMe(t *testing.T) {
 	ctx := context.Background()
 	js, err := jetstream.New(nc)
 	require.NoError(t, err)
-	kv, err := js.CreateKeyValue(ctx, jetstream.KeyValueConfig{
-		Bucket: "accounts",
-	})
+	kv, err := js.CreateKeyValue(ctx, accounts.KeyValueConfig())
 	require.NoError(t, err)
 
 	store := accounts.NewNats(kv)
@@ -59,10 +58,9 @@ func TestMe(t *testing.T) {
 		t.Logf("Key: %s", key)
 	}
 
-	s, err := store.Lister().WithPattern("amble.*.user_info").Iter(ctx)
-	require.NoError(t, err)
 	var user auth.UserInfo
-	for u := range s {
+	for u, err := range store.Lister().Iter(ctx) {
+		require.NoError(t, err)
 		user = u
 	}
 
@@ -84,6 +82,97 @@ func TestMe(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestSignIn(t *testing.T) {
+	server, err := test.NewNatsContainer(context.Background(), test.NatsContainerOpts{})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := server.Terminate()
+		require.NoError(t, err)
+	})
+
+	nc, err := nats.Connect(server.Endpoint())
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	js, err := jetstream.New(nc)
+	require.NoError(t, err)
+	kv, err := js.CreateKeyValue(ctx, accounts.KeyValueConfig())
+	require.NoError(t, err)
+	store := accounts.NewNats(kv)
+
+	const githubID = "583231"
+	octocat := auth.UserInfo{
+		Name:    "Octocat",
+		Email:   "cat@octocat.example.net",
+		Picture: "https://example.net/octocat.png",
+	}
+
+	// when user signs in for the first time, then account is created and linked
+	account, err := store.SignIn(ctx, "github", githubID, octocat, map[string]any{"login": "octocat"})
+	require.NoError(t, err)
+	require.False(t, account.UserID.IsZero())
+	require.Equal(t, "Octocat", account.Name)
+	uid, err := store.Linked(ctx, "github", githubID)
+	require.NoError(t, err)
+	require.Equal(t, account.UserID, uid)
+
+	// when user signs in again, then the same account is returned
+	octocat.Name = "The Octocat"
+	again, err := store.SignIn(ctx, "github", githubID, octocat, nil)
+	require.NoError(t, err)
+	require.Equal(t, account, again)
+}
+
+func TestPasskeys(t *testing.T) {
+	server, err := test.NewNatsContainer(context.Background(), test.NatsContainerOpts{})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := server.Terminate()
+		require.NoError(t, err)
+	})
+
+	nc, err := nats.Connect(server.Endpoint())
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	js, err := jetstream.New(nc)
+	require.NoError(t, err)
+	kv, err := js.CreateKeyValue(ctx, accounts.KeyValueConfig())
+	require.NoError(t, err)
+	store := accounts.NewNats(kv)
+
+	uid, err := store.Create(ctx, auth.UserInfo{Name: "Octocat"})
+	require.NoError(t, err)
+
+	// given user has no passkeys
+	credentials, err := store.Passkeys(ctx, uid)
+	require.NoError(t, err)
+	require.Empty(t, credentials)
+
+	// when passkey is added
+	credential := webauthn.Credential{
+		ID:        []byte{0xfa, 0xce, 0xb0, 0x0c},
+		PublicKey: []byte("public key"),
+	}
+	err = store.AddPasskey(ctx, uid, credential)
+	require.NoError(t, err)
+
+	// then it is linked with the user
+	uid2, err := store.Linked(ctx, "passkey", accounts.PasskeyID(credential.ID))
+	require.NoError(t, err)
+	require.Equal(t, uid, uid2)
+
+	// when sign counter is updated
+	credential.Authenticator.SignCount = 42
+	err = store.UpdatePasskey(ctx, uid, credential)
+	require.NoError(t, err)
+
+	credentials, err = store.Passkeys(ctx, uid)
+	require.NoError(t, err)
+	require.Len(t, credentials, 1)
+	require.Equal(t, uint32(42), credentials[0].Authenticator.SignCount)
+}
+
 func TestMatchSubjects(t *testing.T) {
 	t.Parallel()
 	tests := []struct {
@@ -0,0 +1,164 @@
+package accounts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+// claimsUpdateSubject is where the full account resolver accepts account JWTs
+const claimsUpdateSubject = "$SYS.REQ.CLAIMS.UPDATE"
+
+// AccountKeys keeps the signing keys of NATS accounts of tenants in the
+// operator mode. Account identity keys are not needed once the account JWT is
+// signed by the operator.
+type AccountKeys interface {
+	SigningKey(ctx context.Context, account string) (nkeys.KeyPair, error)
+	PutSigningKey(ctx context.Context, account string, kp nkeys.KeyPair) error
+}
+
+// DirKeys stores the seeds of signing keys as $account.nk files readable by
+// the owner only, like nsc keystore does
+type DirKeys struct {
+	dir string
+}
+
+func NewDirKeys(dir string) DirKeys {
+	return DirKeys{dir: dir}
+}
+
+func (d DirKeys) path(account string) (string, error) {
+	if !nkeys.IsValidPublicAccountKey(account) {
+		return "", fmt.Errorf("invalid account key %q", account)
+	}
+	return filepath.Join(d.dir, account+".nk"), nil
+}
+
+func (d DirKeys) SigningKey(_ context.Context, account string) (nkeys.KeyPair, error) {
+	path, err := d.path(account)
+	if err != nil {
+		return nil, fmt.Errorf("signing key: %w", err)
+	}
+	seed, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("signing key: %w", err)
+	}
+	kp, err := nkeys.FromSeed(seed)
+	if err != nil {
+		return nil, fmt.Errorf("signing key: %w", err)
+	}
+	return kp, nil
+}
+
+func (d DirKeys) PutSigningKey(_ context.Context, account string, kp nkeys.KeyPair) error {
+	path, err := d.path(account)
+	if err != nil {
+		return fmt.Errorf("put signing key: %w", err)
+	}
+	seed, err := kp.Seed()
+	if err != nil {
+		return fmt.Errorf("put signing key: %w", err)
+	}
+	err = os.MkdirAll(d.dir, 0o700)
+	if err != nil {
+		return fmt.Errorf("put signing key: %w", err)
+	}
+	err = os.WriteFile(path, seed, 0o600)
+	if err != nil {
+		return fmt.Errorf("put signing key: %w", err)
+	}
+	return nil
+}
+
+// Operator creates NATS accounts for tenants in the operator (decentralized)
+// mode. Account JWTs are pushed through the system account to the account
+// resolver, so no restart of nats-server is needed.
+type Operator struct {
+	operator nkeys.KeyPair
+	keys     AccountKeys
+	sys      *nats.Conn
+}
+
+// NewOperator returns an operator signing account JWTs by operator key (or
+// an operator signing key). sys must be connected to the system account.
+func NewOperator(operator nkeys.KeyPair, keys AccountKeys, sys *nats.Conn) (Operator, error) {
+	public, err := operator.PublicKey()
+	if err != nil {
+		return Operator{}, err
+	}
+	if !nkeys.IsValidPublicOperatorKey(public) {
+		return Operator{}, errors.New("invalid operator key")
+	}
+	return Operator{
+		operator: operator,
+		keys:     keys,
+		sys:      sys,
+	}, nil
+}
+
+// CreateAccount creates a new NATS account with a signing key, stores the
+// signing key and pushes the account JWT to the resolver. Returns the account
+// public key to be used as Tenant.Account.
+func (o Operator) CreateAccount(ctx context.Context, name string) (string, error) {
+	account, err := nkeys.CreateAccount()
+	if err != nil {
+		return "", fmt.Errorf("operator create account: %w", err)
+	}
+	public, err := account.PublicKey()
+	if err != nil {
+		return "", fmt.Errorf("operator create account: %w", err)
+	}
+	signing, err := nkeys.CreateAccount()
+	if err != nil {
+		return "", fmt.Errorf("operator create account: signing key: %w", err)
+	}
+	signingPublic, err := signing.PublicKey()
+	if err != nil {
+		return "", fmt.Errorf("operator create account: signing key: %w", err)
+	}
+
+	claims := jwt.NewAccountClaims(public)
+	claims.Name = name
+	claims.SigningKeys.Add(signingPublic)
+
+	// store the key first, so pushed account is always usable
+	err = o.keys.PutSigningKey(ctx, public, signing)
+	if err != nil {
+		return "", fmt.Errorf("operator create account: %w", err)
+	}
+	err = o.PushAccount(ctx, claims)
+	if err != nil {
+		return "", fmt.Errorf("operator create account: %w", err)
+	}
+	return public, nil
+}
+
+// PushAccount signs the account claims and sends them to the account resolver
+func (o Operator) PushAccount(ctx context.Context, claims *jwt.AccountClaims) error {
+	token, err := claims.Encode(o.operator)
+	if err != nil {
+		return fmt.Errorf("push account: encode: %w", err)
+	}
+	msg, err := o.sys.RequestWithContext(ctx, claimsUpdateSubject, []byte(token))
+	if err != nil {
+		return fmt.Errorf("push account: %w", err)
+	}
+	var resp struct {
+		Error *apiError `json:"error,omitempty"`
+	}
+	err = json.Unmarshal(msg.Data, &resp)
+	if err != nil {
+		return fmt.Errorf("push account: unmarshal response: %w", err)
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("push account: %s", resp.Error)
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package accounts
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"html/template"
+	"testing"
+	"time"
+
+	appJWT "github.com/gomoni/amble/internal/auth/jwt"
+	"github.com/gomoni/amble/internal/test"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+const operatorConf = `
+operator: {{.Operator}}
+system_account: {{.System}}
+
+jetstream: {}
+
+resolver: {
+  type: full
+  dir: "{{.ResolverDir}}"
+}
+
+resolver_preload: {
+  {{.System}}: {{.SystemJWT}}
+  {{.Auth}}: {{.AuthJWT}}
+}
+`
+
+func TestAuthCalloutOperator(t *testing.T) {
+	var buf [ed25519.SeedSize]byte
+	_, err := rand.Read(buf[:])
+	require.NoError(t, err)
+	secret, err := appJWT.LoadSecret(bytes.NewReader(buf[:]))
+	require.NoError(t, err)
+	encoder := appJWT.NewEncoder(secret)
+	decoder := appJWT.NewDecoder(secret.Public())
+
+	// given nats-server runs in operator mode with an AUTH account doing the callout
+	op := requireOperator(t)
+	endpoint := op.natsContainer.Endpoint()
+
+	authNc, err := nats.Connect(endpoint, nats.UserJWTAndSeed(op.authUser.jwt, string(op.authUser.seed)))
+	require.NoError(t, err)
+	t.Cleanup(authNc.Close)
+	sysNc, err := nats.Connect(endpoint, nats.UserJWTAndSeed(op.sysUser.jwt, string(op.sysUser.seed)))
+	require.NoError(t, err)
+	t.Cleanup(sysNc.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	js, err := jetstream.New(authNc)
+	require.NoError(t, err)
+	kv, err := js.CreateKeyValue(ctx, KeyValueConfig())
+	require.NoError(t, err)
+	store := NewNats(kv)
+
+	// when a tenant account is created without a restart
+	keys := NewDirKeys(t.TempDir())
+	operator, err := NewOperator(op.operator.kp, keys, sysNc)
+	require.NoError(t, err)
+	account, err := operator.CreateAccount(ctx, "plainsof")
+	require.NoError(t, err)
+	tenant, err := store.CreateTenant(ctx, "plainsof", account)
+	require.NoError(t, err)
+
+	// and octocat is a member of it
+	octocat := requireUser(t, store, "543219", "Octocat")
+	require.NoError(t, store.AddMember(ctx, tenant.ID, octocat))
+
+	// and the callout signs users by the tenant's signing key
+	policy := DefaultPolicy()
+	policy.Publish = append(policy.Publish, "$SYS.REQ.USER.INFO")
+	svc, err := NewService(op.xkey.kp, op.auth.kp, store, decoder)
+	require.NoError(t, err)
+	svc = svc.WithPolicy(policy).WithAccountKeys(keys)
+	requireRun(t, svc, authNc)
+
+	// when octocat connects with the sentinel credentials and web claims
+	webToken, err := encoder.Encode(webClaims("543219"))
+	require.NoError(t, err)
+	octocatNc, err := nats.Connect(
+		endpoint,
+		nats.UserJWTAndSeed(op.sentinel.jwt, string(op.sentinel.seed)),
+		nats.Token(webToken),
+		nats.CustomInboxPrefix("_INBOX."+octocat.String()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(octocatNc.Close)
+
+	// then octocat is placed into the tenant's account
+	require.Equal(t, account, userAccount(t, octocatNc))
+
+	// and can use own namespace
+	sub, err := octocatNc.SubscribeSync("amble." + octocat.String() + ".>")
+	require.NoError(t, err)
+	err = octocatNc.Publish("amble."+octocat.String()+".hello", []byte("github"))
+	require.NoError(t, err)
+	msg, err := sub.NextMsg(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "github", string(msg.Data))
+}
+
+type operatorServer struct {
+	natsContainer test.NatsContainer
+	operator      keypair
+	auth          keypair
+	xkey          keypair
+	authUser      creds
+	sysUser       creds
+	sentinel      creds
+}
+
+type creds struct {
+	jwt  string
+	seed []byte
+}
+
+func requireOperator(t *testing.T) operatorServer {
+	t.Helper()
+	operator, err := nsc(nkeys.PrefixByteOperator)
+	require.NoError(t, err)
+	sys, err := nscA()
+	require.NoError(t, err)
+	auth, err := nscA()
+	require.NoError(t, err)
+	xkey, err := nscC()
+	require.NoError(t, err)
+
+	operatorClaims := jwt.NewOperatorClaims(operator.public)
+	operatorClaims.Name = "amble"
+	operatorClaims.SystemAccount = sys.public
+	operatorJWT, err := operatorClaims.Encode(operator.kp)
+	require.NoError(t, err)
+
+	sysClaims := jwt.NewAccountClaims(sys.public)
+	sysClaims.Name = "SYS"
+	sysJWT, err := sysClaims.Encode(operator.kp)
+	require.NoError(t, err)
+
+	authUser := requireCreds(t, auth, "auth", false)
+	sysUser := requireCreds(t, sys, "sys", false)
+	// sentinel is a user with no permissions clients connect with to reach the callout
+	sentinel := requireCreds(t, auth, "sentinel", true)
+
+	authClaims := jwt.NewAccountClaims(auth.public)
+	authClaims.Name = "AUTH"
+	authClaims.Authorization.AuthUsers.Add(authUser.public)
+	authClaims.Authorization.AllowedAccounts.Add(jwt.AnyAccount)
+	authClaims.Authorization.XKey = xkey.public
+	authClaims.Limits.JetStreamLimits.DiskStorage = -1
+	authClaims.Limits.JetStreamLimits.MemoryStorage = -1
+	authJWT, err := authClaims.Encode(operator.kp)
+	require.NoError(t, err)
+
+	tmpl, err := template.New("nats.conf").Parse(operatorConf)
+	require.NoError(t, err)
+	var conf bytes.Buffer
+	err = tmpl.Execute(&conf, map[string]string{
+		"Operator":    operatorJWT,
+		"System":      sys.public,
+		"SystemJWT":   sysJWT,
+		"Auth":        auth.public,
+		"AuthJWT":     authJWT,
+		"ResolverDir": t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	natsContainer, err := test.NewNatsContainer(context.TODO(), test.NatsContainerOpts{
+		Config: &conf,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := natsContainer.Terminate()
+		require.NoError(t, err)
+	})
+
+	return operatorServer{
+		natsContainer: natsContainer,
+		operator:      operator,
+		auth:          auth,
+		xkey:          xkey,
+		authUser:      authUser.creds,
+		sysUser:       sysUser.creds,
+		sentinel:      sentinel.creds,
+	}
+}
+
+type userCreds struct {
+	creds
+	public string
+}
+
+func requireCreds(t *testing.T, account keypair, name string, sentinel bool) userCreds {
+	t.Helper()
+	user, err := nscU()
+	require.NoError(t, err)
+	claims := jwt.NewUserClaims(user.public)
+	claims.Name = name
+	if sentinel {
+		claims.BearerToken = true
+		claims.Pub.Deny.Add(">")
+		claims.Sub.Deny.Add(">")
+	}
+	token, err := claims.Encode(account.kp)
+	require.NoError(t, err)
+	return userCreds{
+		creds:  creds{jwt: token, seed: user.seed},
+		public: user.public,
+	}
+}
@@ -0,0 +1,78 @@
+package accounts
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gomoni/amble/internal/tid"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func passkeyKey(uid tid.UserID, id []byte) string {
+	return "passkey." + uid.String() + "." + PasskeyID(id)
+}
+
+// PasskeyID returns the credential id in a form used in keys and as a passkey
+// login subject
+func PasskeyID(id []byte) string {
+	return base64.RawURLEncoding.EncodeToString(id)
+}
+
+// Passkeys returns the webauthn credentials of the user stored in
+// `passkey.$uid.$credential_id` keys
+func (n Accounts) Passkeys(ctx context.Context, uid tid.UserID) ([]webauthn.Credential, error) {
+	entries, err := WatchEntries(ctx, n.kv, "passkey."+uid.String()+".*", jetstream.IgnoreDeletes())
+	if err != nil {
+		return nil, fmt.Errorf("account passkeys: %w", err)
+	}
+
+	credentials := make([]webauthn.Credential, 0)
+	for _, entry := range entries {
+		var credential webauthn.Credential
+		err = json.Unmarshal(entry.Value(), &credential)
+		if err != nil {
+			return nil, fmt.Errorf("account passkeys: unmarshal %s: %w", entry.Key(), err)
+		}
+		credentials = append(credentials, credential)
+	}
+	return credentials, nil
+}
+
+// AddPasskey stores a new webauthn credential and links it with the user, so
+// passkey login is resolved by Linked like any other provider
+func (n Accounts) AddPasskey(ctx context.Context, uid tid.UserID, credential webauthn.Credential) error {
+	b, err := json.Marshal(credential)
+	if err != nil {
+		return fmt.Errorf("account add passkey: marshal credential: %w", err)
+	}
+	_, err = n.kv.Create(ctx, passkeyKey(uid, credential.ID), b)
+	if err != nil {
+		return fmt.Errorf("account add passkey: %w", err)
+	}
+	err = n.Link(ctx, "passkey", PasskeyID(credential.ID), uid)
+	if err != nil {
+		return fmt.Errorf("account add passkey: link: %w", err)
+	}
+	return nil
+}
+
+// UpdatePasskey stores the credential after a login, so the sign counter is
+// checked on the next one. The counter never goes back when logins race and
+// a removed passkey is not stored again.
+func (n Accounts) UpdatePasskey(ctx context.Context, uid tid.UserID, credential webauthn.Credential) error {
+	_, _, err := updateJSON(ctx, n.kv, passkeyKey(uid, credential.ID), func(current webauthn.Credential, exists bool) (webauthn.Credential, error) {
+		if !exists {
+			return current, jetstream.ErrKeyNotFound
+		}
+		next := credential
+		next.Authenticator.SignCount = max(current.Authenticator.SignCount, credential.Authenticator.SignCount)
+		return next, nil
+	})
+	if err != nil {
+		return fmt.Errorf("account update passkey: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package accounts
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/gomoni/amble/internal/tid"
+	"github.com/nats-io/jwt/v2"
+)
+
+// UserIDPlaceholder is replaced by the user id in the subjects of a Policy
+const UserIDPlaceholder = "{{uid}}"
+
+// Policy is a template of NATS permissions granted to every user by the auth
+// callout. Subjects may contain UserIDPlaceholder.
+type Policy struct {
+	Publish   []string `json:"publish"`
+	Subscribe []string `json:"subscribe"`
+	// Shared subjects can be read by every user
+	Shared []string `json:"shared,omitempty"`
+	// Responses allows to reply to a request once
+	Responses bool `json:"responses"`
+}
+
+// DefaultPolicy grants each user their own namespace amble.<uid>.> and an inbox
+// _INBOX.<uid>.> shared by all connections of the user, so they can talk
+// to each other. Clients must use nats.CustomInboxPrefix("_INBOX.<uid>").
+func DefaultPolicy() Policy {
+	return Policy{
+		Publish: []string{
+			"amble." + UserIDPlaceholder + ".>",
+			"_INBOX." + UserIDPlaceholder + ".>",
+		},
+		Subscribe: []string{
+			"amble." + UserIDPlaceholder + ".>",
+			"_INBOX." + UserIDPlaceholder + ".>",
+		},
+		Responses: true,
+	}
+}
+
+// ReadOnlyPolicy lets a device read the namespace of the user only
+func ReadOnlyPolicy() Policy {
+	return Policy{
+		Subscribe: []string{"amble." + UserIDPlaceholder + ".>"},
+	}
+}
+
+// ScopedPolicy limits a device to the scope amble.<uid>.<scope>.> of the
+// user namespace and the inbox. Scope is a single subject token.
+func ScopedPolicy(scope string) (Policy, error) {
+	if scope == "" || strings.ContainsAny(scope, ". *>\t\r\n") {
+		return Policy{}, fmt.Errorf("invalid scope %q", scope)
+	}
+	return Policy{
+		Publish: []string{
+			"amble." + UserIDPlaceholder + "." + scope + ".>",
+			"_INBOX." + UserIDPlaceholder + ".>",
+		},
+		Subscribe: []string{
+			"amble." + UserIDPlaceholder + "." + scope + ".>",
+			"_INBOX." + UserIDPlaceholder + ".>",
+		},
+		Responses: true,
+	}, nil
+}
+
+// LoadPolicy reads the policy from json
+func LoadPolicy(r io.Reader) (Policy, error) {
+	var p Policy
+	err := json.NewDecoder(r).Decode(&p)
+	if err != nil {
+		return Policy{}, fmt.Errorf("decode policy: %w", err)
+	}
+	return p, nil
+}
+
+// Permissions returns the permissions of the user
+func (p Policy) Permissions(uid tid.UserID) jwt.Permissions {
+	var perms jwt.Permissions
+	perms.Pub.Allow = expand(p.Publish, uid)
+	perms.Sub.Allow = expand(p.Subscribe, uid)
+	perms.Sub.Allow.Add(p.Shared...)
+	if len(perms.Pub.Allow) == 0 {
+		perms.Pub.Deny.Add(">")
+	}
+	if len(perms.Sub.Allow) == 0 {
+		perms.Sub.Deny.Add(">")
+	}
+	if p.Responses {
+		perms.Resp = &jwt.ResponsePermission{
+			MaxMsgs: 1,
+			Expires: time.Minute,
+		}
+	}
+	return perms
+}
+
+// ReadOnly returns the permissions of the user without a right to publish
+func (p Policy) ReadOnly(uid tid.UserID) jwt.Permissions {
+	perms := p.Permissions(uid)
+	perms.Pub = jwt.Permission{Deny: jwt.StringList{">"}}
+	perms.Resp = nil
+	return perms
+}
+
+func expand(subjects []string, uid tid.UserID) jwt.StringList {
+	ret := make(jwt.StringList, 0, len(subjects))
+	for _, subject := range subjects {
+		ret.Add(strings.ReplaceAll(subject, UserIDPlaceholder, uid.String()))
+	}
+	return ret
+}
@@ -0,0 +1,184 @@
+package accounts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gomoni/amble/internal/auth"
+	"github.com/gomoni/amble/internal/auth/totp"
+	"github.com/gomoni/amble/internal/tid"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Identity is a login linked with the account by `auth_link.$provider.$id`
+type Identity struct {
+	Provider string `json:"provider"`
+	ID       string `json:"id"`
+}
+
+// PersonalData is everything stored under the user id. Secrets of the TOTP
+// and recovery codes are left out, only the fact it is enabled is exported.
+type PersonalData struct {
+	Account       auth.UserInfo              `json:"account"`
+	Profiles      map[string]json.RawMessage `json:"profiles"`
+	Identities    []Identity                 `json:"identities"`
+	Passkeys      []webauthn.Credential      `json:"passkeys"`
+	Devices       []Device                   `json:"devices"`
+	Memberships   []tid.TenantID             `json:"memberships"`
+	DefaultTenant *tid.TenantID              `json:"default_tenant,omitempty"`
+	Plan          string                     `json:"plan"`
+	TOTP          bool                       `json:"totp"`
+	Suspension    *Suspension                `json:"suspension,omitempty"`
+	TokensRevoked *time.Time                 `json:"tokens_revoked,omitempty"`
+	Deletion      *Deletion                  `json:"deletion,omitempty"`
+	Approval      *Approval                  `json:"approval,omitempty"`
+	ProfilePins   ProfilePins                `json:"profile_pins"`
+}
+
+// PersonalData collects all the data of the user for an export
+func (n Accounts) PersonalData(ctx context.Context, uid tid.UserID) (PersonalData, error) {
+	var err error
+	data := PersonalData{Plan: DefaultPlanName}
+	data.Account, err = n.Get(ctx, uid)
+	if err != nil {
+		return PersonalData{}, fmt.Errorf("account personal data: %w", err)
+	}
+	data.Profiles, err = n.profiles(ctx, uid)
+	if err != nil {
+		return PersonalData{}, fmt.Errorf("account personal data: %w", err)
+	}
+	data.Identities, err = n.Identities(ctx, uid)
+	if err != nil {
+		return PersonalData{}, fmt.Errorf("account personal data: %w", err)
+	}
+	data.Passkeys, err = n.Passkeys(ctx, uid)
+	if err != nil {
+		return PersonalData{}, fmt.Errorf("account personal data: %w", err)
+	}
+	data.Devices, err = n.Devices(ctx, uid)
+	if err != nil {
+		return PersonalData{}, fmt.Errorf("account personal data: %w", err)
+	}
+	data.Memberships, err = n.Memberships(ctx, uid)
+	if err != nil {
+		return PersonalData{}, fmt.Errorf("account personal data: %w", err)
+	}
+
+	tenant, err := n.DefaultTenant(ctx, uid)
+	if err == nil {
+		data.DefaultTenant = &tenant
+	} else if !errors.Is(err, jetstream.ErrKeyNotFound) {
+		return PersonalData{}, fmt.Errorf("account personal data: %w", err)
+	}
+	entry, err := n.kv.Get(ctx, userPlanKey(uid))
+	if err == nil {
+		data.Plan = string(entry.Value())
+	} else if !errors.Is(err, jetstream.ErrKeyNotFound) {
+		return PersonalData{}, fmt.Errorf("account personal data: %w", err)
+	}
+	record, err := n.TOTP(ctx, uid)
+	if err == nil {
+		data.TOTP = record.Enabled
+	} else if !errors.Is(err, totp.ErrNotEnrolled) {
+		return PersonalData{}, fmt.Errorf("account personal data: %w", err)
+	}
+	entry, err = n.kv.Get(ctx, suspendedKey(uid))
+	if err == nil {
+		var suspension Suspension
+		err = json.Unmarshal(entry.Value(), &suspension)
+		if err != nil {
+			return PersonalData{}, fmt.Errorf("account personal data: unmarshal suspension: %w", err)
+		}
+		data.Suspension = &suspension
+	} else if !errors.Is(err, jetstream.ErrKeyNotFound) {
+		return PersonalData{}, fmt.Errorf("account personal data: %w", err)
+	}
+	entry, err = n.kv.Get(ctx, revokedKey(uid))
+	if err == nil {
+		revoked, err := strconv.ParseInt(string(entry.Value()), 10, 64)
+		if err != nil {
+			return PersonalData{}, fmt.Errorf("account personal data: parse revoked: %w", err)
+		}
+		at := time.Unix(revoked, 0).UTC()
+		data.TokensRevoked = &at
+	} else if !errors.Is(err, jetstream.ErrKeyNotFound) {
+		return PersonalData{}, fmt.Errorf("account personal data: %w", err)
+	}
+	deletion, err := n.Deletion(ctx, uid)
+	if err == nil {
+		data.Deletion = &deletion
+	} else if !errors.Is(err, jetstream.ErrKeyNotFound) {
+		return PersonalData{}, fmt.Errorf("account personal data: %w", err)
+	}
+	approval, err := n.approval(ctx, uid)
+	if err == nil {
+		data.Approval = &approval
+	} else if !errors.Is(err, jetstream.ErrKeyNotFound) {
+		return PersonalData{}, fmt.Errorf("account personal data: %w", err)
+	}
+	data.ProfilePins, err = n.ProfilePins(ctx, uid)
+	if err != nil {
+		return PersonalData{}, fmt.Errorf("account personal data: %w", err)
+	}
+	return data, nil
+}
+
+// Identities returns the logins linked with the account
+func (n Accounts) Identities(ctx context.Context, uid tid.UserID) ([]Identity, error) {
+	keys, err := n.pointers(ctx, "auth_link.>", uid, jetstream.IgnoreDeletes())
+	if err != nil {
+		return nil, fmt.Errorf("account identities: %w", err)
+	}
+	identities := make([]Identity, 0, len(keys))
+	for _, key := range keys {
+		// auth_link.$provider.$id
+		parts := strings.SplitN(key, ".", 3)
+		identities = append(identities, Identity{Provider: parts[1], ID: parts[2]})
+	}
+	return identities, nil
+}
+
+// profiles returns the raw user info stored by UpdateUserInfo by the provider
+func (n Accounts) profiles(ctx context.Context, uid tid.UserID) (map[string]json.RawMessage, error) {
+	prefix := "user_info." + uid.String() + "."
+	entries, err := WatchEntries(ctx, n.kv, prefix+"*", jetstream.IgnoreDeletes())
+	if err != nil {
+		return nil, err
+	}
+
+	profiles := make(map[string]json.RawMessage)
+	for _, entry := range entries {
+		provider := strings.TrimPrefix(entry.Key(), prefix)
+		if provider == "app" {
+			continue
+		}
+		profiles[provider] = json.RawMessage(entry.Value())
+	}
+	return profiles, nil
+}
+
+// pointers returns keys matching the pattern, whose value is the user id
+func (n Accounts) pointers(ctx context.Context, pattern string, uid tid.UserID, opts ...jetstream.WatchOpt) ([]string, error) {
+	entries, err := WatchEntries(ctx, n.kv, pattern, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	u := uid.String()
+	seen := make(map[string]bool)
+	keys := make([]string, 0)
+	for _, entry := range entries {
+		if string(entry.Value()) != u || seen[entry.Key()] {
+			continue
+		}
+		seen[entry.Key()] = true
+		keys = append(keys, entry.Key())
+	}
+	return keys, nil
+}
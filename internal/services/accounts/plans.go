@@ -0,0 +1,184 @@
+package accounts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/gomoni/amble/internal/tid"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// DefaultPlanName is the plan of users without an assigned plan
+const DefaultPlanName = "default"
+
+// ConnectionTypes a plan can allow
+var ConnectionTypes = []string{
+	jwt.ConnectionTypeStandard,
+	jwt.ConnectionTypeWebsocket,
+	jwt.ConnectionTypeMqtt,
+	jwt.ConnectionTypeLeafnode,
+}
+
+// Plan limits the NATS connections of users. nats-server (as of 2.15)
+// ignores the limits of subscriptions, payload and data of users issued by
+// auth callout, so a plan has none, use account limits of the tenant for
+// them. Enforced are the expiry of the web token and the connection types.
+type Plan struct {
+	Name string `json:"name"`
+	// ConnectionTypes like jwt.ConnectionTypeWebsocket for browsers, all
+	// types are allowed if empty
+	ConnectionTypes []string `json:"connection_types,omitempty"`
+}
+
+func planKey(name string) string {
+	return "plan." + name
+}
+
+func userPlanKey(uid tid.UserID) string {
+	return "user_plan." + uid.String()
+}
+
+// PutPlan stores the plan replacing the stored one. Stored in `plan.$name`
+func (n Accounts) PutPlan(ctx context.Context, plan Plan) error {
+	_, err := n.UpdatePlan(ctx, plan.Name, func(Plan, bool) (Plan, error) {
+		return plan, nil
+	})
+	if err != nil {
+		return fmt.Errorf("account put plan: %w", err)
+	}
+	return nil
+}
+
+// UpdatePlan changes the plan by merge, which gets the zero plan and false
+// if it does not exist yet. Merge is retried on a concurrent write. The name
+// can't be changed.
+func (n Accounts) UpdatePlan(ctx context.Context, name string, merge func(current Plan, exists bool) (Plan, error)) (Plan, error) {
+	if name == "" || strings.ContainsAny(name, ". *>") {
+		return Plan{}, fmt.Errorf("account update plan: invalid name %q", name)
+	}
+	plan, _, err := updateJSON(ctx, n.kv, planKey(name), func(current Plan, exists bool) (Plan, error) {
+		next, err := merge(current, exists)
+		if err != nil {
+			return Plan{}, err
+		}
+		for _, ct := range next.ConnectionTypes {
+			if !slices.Contains(ConnectionTypes, ct) {
+				return Plan{}, fmt.Errorf("unknown connection type %q", ct)
+			}
+		}
+		next.Name = name
+		return next, nil
+	})
+	if err != nil {
+		return Plan{}, fmt.Errorf("account update plan: %w", err)
+	}
+	return plan, nil
+}
+
+func (n Accounts) Plan(ctx context.Context, name string) (Plan, error) {
+	entry, err := n.kv.Get(ctx, planKey(name))
+	if err != nil {
+		return Plan{}, fmt.Errorf("account get plan: %w", err)
+	}
+	var plan Plan
+	err = json.Unmarshal(entry.Value(), &plan)
+	if err != nil {
+		return Plan{}, fmt.Errorf("account get plan: unmarshal: %w", err)
+	}
+	return plan, nil
+}
+
+// Plans returns all stored plans
+func (n Accounts) Plans(ctx context.Context) ([]Plan, error) {
+	entries, err := WatchEntries(ctx, n.kv, "plan.*", jetstream.IgnoreDeletes())
+	if err != nil {
+		return nil, fmt.Errorf("account plans: %w", err)
+	}
+
+	plans := make([]Plan, 0)
+	for _, entry := range entries {
+		var plan Plan
+		err = json.Unmarshal(entry.Value(), &plan)
+		if err != nil {
+			return nil, fmt.Errorf("account plans: unmarshal %s: %w", entry.Key(), err)
+		}
+		plans = append(plans, plan)
+	}
+	return plans, nil
+}
+
+// SetUserPlan assigns the plan to the user. Stored in `user_plan.$uid`
+func (n Accounts) SetUserPlan(ctx context.Context, uid tid.UserID, name string) error {
+	_, err := update(ctx, n.kv, userPlanKey(uid), func([]byte, bool) ([]byte, error) {
+		// checked on every attempt, so the retry sees a deleted plan
+		_, err := n.Plan(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(name), nil
+	})
+	if err != nil {
+		return fmt.Errorf("account set user plan: %w", err)
+	}
+	return nil
+}
+
+// UserPlan returns the plan of the user, DefaultPlanName one if none is
+// assigned or an unlimited plan if there is no default
+func (n Accounts) UserPlan(ctx context.Context, uid tid.UserID) (Plan, error) {
+	name := DefaultPlanName
+	entry, err := n.kv.Get(ctx, userPlanKey(uid))
+	if err == nil {
+		name = string(entry.Value())
+	} else if !errors.Is(err, jetstream.ErrKeyNotFound) {
+		return Plan{}, fmt.Errorf("account user plan: %w", err)
+	}
+	plan, err := n.Plan(ctx, name)
+	if errors.Is(err, jetstream.ErrKeyNotFound) && name == DefaultPlanName {
+		return Plan{Name: DefaultPlanName}, nil
+	} else if err != nil {
+		return Plan{}, fmt.Errorf("account user plan: %w", err)
+	}
+	return plan, nil
+}
+
+// Allows returns an error if the plan does not allow the connection type of
+// the client. nats-server does not check allowed connection types of users
+// issued by auth callout, so the callout does it.
+func (p Plan) Allows(ci jwt.ClientInformation) error {
+	if len(p.ConnectionTypes) == 0 {
+		return nil
+	}
+	ct := connectionType(ci)
+	if !slices.Contains(p.ConnectionTypes, ct) {
+		return fmt.Errorf("connection type %s is not allowed by plan %s", ct, p.Name)
+	}
+	return nil
+}
+
+// connectionType maps client information to jwt connection types
+func connectionType(ci jwt.ClientInformation) string {
+	if ci.Kind == "Leafnode" {
+		return jwt.ConnectionTypeLeafnode
+	}
+	switch ci.Type {
+	case "websocket":
+		return jwt.ConnectionTypeWebsocket
+	case "mqtt":
+		return jwt.ConnectionTypeMqtt
+	default:
+		return jwt.ConnectionTypeStandard
+	}
+}
+
+// Apply sets the connection types of the plan to the user claims, they are
+// checked by Allows as nats-server does not do it for auth callout users
+func (p Plan) Apply(claims *jwt.UserClaims) {
+	claims.AllowedConnectionTypes = nil
+	claims.AllowedConnectionTypes.Add(p.ConnectionTypes...)
+}
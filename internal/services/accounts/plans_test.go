@@ -0,0 +1,77 @@
+package accounts
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gomoni/amble/internal/tid"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthCalloutPlan(t *testing.T) {
+	// given users may ask the server about themselves
+	policy := DefaultPolicy()
+	policy.Publish = append(policy.Publish, "$SYS.REQ.USER.INFO")
+	endpoint, store, encoder := requireCallout(t, policy)
+
+	ctx := context.Background()
+	pla, err := store.CreateTenant(ctx, "plainsof", "PLA")
+	require.NoError(t, err)
+	octocat := requireUser(t, store, "543219", "Octocat")
+	hubot := requireUser(t, store, "583231", "Hubot")
+	require.NoError(t, store.AddMember(ctx, pla.ID, octocat))
+	require.NoError(t, store.AddMember(ctx, pla.ID, hubot))
+
+	connect := func(githubID string, uid tid.UserID) (*nats.Conn, error) {
+		token, err := encoder.Encode(webClaims(githubID))
+		require.NoError(t, err)
+		return nats.Connect(endpoint, nats.Token(token), nats.CustomInboxPrefix("_INBOX."+uid.String()))
+	}
+
+	// when octocat without a plan connects
+	nc, err := connect("543219", octocat)
+	require.NoError(t, err)
+	t.Cleanup(nc.Close)
+
+	// then connection expires with the web token
+	msg, err := nc.Request("$SYS.REQ.USER.INFO", nil, time.Second)
+	require.NoError(t, err)
+	var info struct {
+		Data struct {
+			Expires time.Duration `json:"expires"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(msg.Data, &info))
+	require.Positive(t, info.Data.Expires)
+	require.LessOrEqual(t, info.Data.Expires, 10*time.Second)
+
+	// when hubot is allowed to use websockets only
+	require.NoError(t, store.PutPlan(ctx, Plan{Name: "browser", ConnectionTypes: []string{jwt.ConnectionTypeWebsocket}}))
+	require.NoError(t, store.SetUserPlan(ctx, hubot, "browser"))
+	plans, err := store.Plans(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []Plan{{Name: "browser", ConnectionTypes: []string{jwt.ConnectionTypeWebsocket}}}, plans)
+
+	// then hubot can't connect via tcp
+	_, err = connect("583231", hubot)
+	require.ErrorIs(t, err, nats.ErrAuthorization)
+
+	// and unknown plan can't be assigned
+	err = store.SetUserPlan(ctx, hubot, "gold")
+	require.Error(t, err)
+}
+
+func TestPlanApply(t *testing.T) {
+	claims := jwt.NewUserClaims("UAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA")
+	Plan{Name: "free", ConnectionTypes: []string{jwt.ConnectionTypeWebsocket}}.Apply(claims)
+	require.True(t, claims.Limits.NatsLimits.IsUnlimited())
+	require.Equal(t, jwt.StringList{jwt.ConnectionTypeWebsocket}, claims.AllowedConnectionTypes)
+
+	Plan{Name: DefaultPlanName}.Apply(claims)
+	require.True(t, claims.Limits.NatsLimits.IsUnlimited())
+	require.Empty(t, claims.AllowedConnectionTypes)
+}
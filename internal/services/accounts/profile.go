@@ -0,0 +1,314 @@
+package accounts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/gomoni/amble/internal/auth"
+	"github.com/gomoni/amble/internal/tid"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// ErrProfileProvider is returned for a pin of a provider, which has no
+// profile of the user
+var ErrProfileProvider = errors.New("no profile of the provider")
+
+// ProfileField is a field of the canonical profile with own precedence
+type ProfileField string
+
+const (
+	FieldName    ProfileField = "name"
+	FieldEmail   ProfileField = "email"
+	FieldPicture ProfileField = "picture"
+)
+
+// Profile is what a provider tells about the user
+type Profile struct {
+	Name          string `json:"name,omitempty"`
+	Email         string `json:"email,omitempty"`
+	Picture       string `json:"picture,omitempty"`
+	EmailVerified bool   `json:"email_verified,omitempty"`
+}
+
+// ProfileMapper reads the profile from the raw user info of a provider
+type ProfileMapper func(raw map[string]any) Profile
+
+// ProfilePins are the providers the user chose the name and the picture
+// from, empty means the precedence decides. Stored at `profile_pins.$uid`.
+type ProfilePins struct {
+	Name    string `json:"name,omitempty"`
+	Picture string `json:"picture,omitempty"`
+}
+
+func profilePinsKey(uid tid.UserID) string {
+	return "profile_pins." + uid.String()
+}
+
+// ProfileResolver computes the canonical profile stored at
+// `user_info.$uid.app` from the raw profiles `user_info.$uid.$provider`.
+// A field is taken from the first provider of its precedence having it, the
+// providers not listed follow by name. A field no provider has stays as is,
+// so values of the sign up are kept.
+type ProfileResolver struct {
+	mappers    map[string]ProfileMapper
+	precedence map[ProfileField][]string
+}
+
+// NewProfileResolver returns a resolver of github and email profiles. Name
+// and picture are taken from github, the email from the email login.
+func NewProfileResolver() ProfileResolver {
+	return ProfileResolver{
+		mappers: map[string]ProfileMapper{
+			"github": githubProfile,
+			"email":  emailProfile,
+		},
+		precedence: map[ProfileField][]string{
+			FieldName:    {"github", "email"},
+			FieldEmail:   {"email", "github"},
+			FieldPicture: {"github"},
+		},
+	}
+}
+
+// WithProvider returns a resolver reading profiles of the provider by the
+// mapper, profiles of providers without a mapper are ignored
+func (r ProfileResolver) WithProvider(provider string, mapper ProfileMapper) ProfileResolver {
+	r.mappers = maps.Clone(r.mappers)
+	if r.mappers == nil {
+		r.mappers = make(map[string]ProfileMapper)
+	}
+	r.mappers[provider] = mapper
+	return r
+}
+
+// WithPrecedence returns a resolver taking the field from the providers in
+// the given order
+func (r ProfileResolver) WithPrecedence(field ProfileField, providers ...string) ProfileResolver {
+	r.precedence = maps.Clone(r.precedence)
+	if r.precedence == nil {
+		r.precedence = make(map[ProfileField][]string)
+	}
+	r.precedence[field] = slices.Clone(providers)
+	return r
+}
+
+// Profiles maps the raw profiles by the provider, the unknown ones are left
+// out
+func (r ProfileResolver) Profiles(raw map[string]map[string]any) map[string]Profile {
+	profiles := make(map[string]Profile, len(raw))
+	for provider, userInfo := range raw {
+		mapper, ok := r.mappers[provider]
+		if !ok {
+			continue
+		}
+		profiles[provider] = mapper(userInfo)
+	}
+	return profiles
+}
+
+// Resolve returns the current account with the fields of the profiles. The
+// pinned provider goes first for the name and the picture. A verified email
+// wins over an unverified one, which never replaces the verified email of
+// the account.
+func (r ProfileResolver) Resolve(current auth.UserInfo, raw map[string]map[string]any, pins ProfilePins) auth.UserInfo {
+	profiles := r.Profiles(raw)
+	resolved := current
+	for _, provider := range r.order(FieldName, pins.Name, profiles) {
+		if name := profiles[provider].Name; name != "" {
+			resolved.Name = name
+			break
+		}
+	}
+	for _, provider := range r.order(FieldPicture, pins.Picture, profiles) {
+		if picture := profiles[provider].Picture; picture != "" {
+			resolved.Picture = picture
+			break
+		}
+	}
+
+	var unverified string
+	for _, provider := range r.order(FieldEmail, "", profiles) {
+		profile := profiles[provider]
+		if profile.Email == "" {
+			continue
+		}
+		if profile.EmailVerified {
+			resolved.Email = profile.Email
+			resolved.EmailVerified = true
+			return resolved
+		}
+		if unverified == "" {
+			unverified = profile.Email
+		}
+	}
+	if unverified != "" && !current.EmailVerified {
+		resolved.Email = unverified
+		resolved.EmailVerified = false
+	}
+	return resolved
+}
+
+// order returns providers of the profiles in the precedence of the field
+func (r ProfileResolver) order(field ProfileField, pin string, profiles map[string]Profile) []string {
+	order := make([]string, 0, len(profiles))
+	add := func(provider string) {
+		if _, ok := profiles[provider]; ok && !slices.Contains(order, provider) {
+			order = append(order, provider)
+		}
+	}
+	add(pin)
+	for _, provider := range r.precedence[field] {
+		add(provider)
+	}
+	for _, provider := range slices.Sorted(maps.Keys(profiles)) {
+		add(provider)
+	}
+	return order
+}
+
+func githubProfile(raw map[string]any) Profile {
+	profile := Profile{
+		Name:    stringField(raw, "name"),
+		Email:   stringField(raw, "email"),
+		Picture: stringField(raw, "avatar_url"),
+	}
+	// only a verified email can be the public email of a github user
+	profile.EmailVerified = profile.Email != ""
+	return profile
+}
+
+func emailProfile(raw map[string]any) Profile {
+	verified, _ := raw["email_verified"].(bool)
+	return Profile{
+		Email:         stringField(raw, "email"),
+		EmailVerified: verified,
+	}
+}
+
+func stringField(raw map[string]any, key string) string {
+	s, _ := raw[key].(string)
+	return s
+}
+
+// WithProfileResolver returns accounts, which compute the profile by the
+// resolver
+func (n Accounts) WithProfileResolver(resolver ProfileResolver) Accounts {
+	n.resolver = resolver
+	return n
+}
+
+// Profiles returns the profiles of the linked providers known to the
+// resolver
+func (n Accounts) Profiles(ctx context.Context, uid tid.UserID) (map[string]Profile, error) {
+	raw, err := n.rawProfiles(ctx, uid)
+	if err != nil {
+		return nil, fmt.Errorf("account profiles: %w", err)
+	}
+	return n.resolver.Profiles(raw), nil
+}
+
+// ProfilePins returns the pins of the user, zero if there are none
+func (n Accounts) ProfilePins(ctx context.Context, uid tid.UserID) (ProfilePins, error) {
+	entry, err := n.kv.Get(ctx, profilePinsKey(uid))
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return ProfilePins{}, nil
+	} else if err != nil {
+		return ProfilePins{}, fmt.Errorf("account profile pins: %w", err)
+	}
+	var pins ProfilePins
+	err = json.Unmarshal(entry.Value(), &pins)
+	if err != nil {
+		return ProfilePins{}, fmt.Errorf("account profile pins: unmarshal: %w", err)
+	}
+	return pins, nil
+}
+
+// PinProfile stores the providers the user chose and recomputes the
+// profile. It fails with ErrProfileProvider if a pinned provider has no
+// profile of the user.
+func (n Accounts) PinProfile(ctx context.Context, uid tid.UserID, pins ProfilePins) (auth.UserInfo, error) {
+	_, _, err := updateJSON(ctx, n.kv, profilePinsKey(uid), func(ProfilePins, bool) (ProfilePins, error) {
+		// profiles are read on every attempt, so the retry sees an unlinked
+		// provider
+		profiles, err := n.Profiles(ctx, uid)
+		if err != nil {
+			return ProfilePins{}, err
+		}
+		for _, provider := range []string{pins.Name, pins.Picture} {
+			if _, ok := profiles[provider]; provider != "" && !ok {
+				return ProfilePins{}, fmt.Errorf("%w: %s", ErrProfileProvider, provider)
+			}
+		}
+		return pins, nil
+	})
+	if err != nil {
+		return auth.UserInfo{}, fmt.Errorf("account pin profile: %w", err)
+	}
+	return n.RefreshProfile(ctx, uid)
+}
+
+// errUnchanged skips the write of a profile resolved to the stored one
+var errUnchanged = errors.New("unchanged")
+
+// RefreshProfile recomputes the account from the profiles and the pins, it
+// is written only if it changed. The email is kept if the resolved one is
+// verified by another account.
+func (n Accounts) RefreshProfile(ctx context.Context, uid tid.UserID) (auth.UserInfo, error) {
+	raw, err := n.rawProfiles(ctx, uid)
+	if err != nil {
+		return auth.UserInfo{}, fmt.Errorf("account refresh profile: %w", err)
+	}
+	pins, err := n.ProfilePins(ctx, uid)
+	if err != nil {
+		return auth.UserInfo{}, fmt.Errorf("account refresh profile: %w", err)
+	}
+
+	refresh := func(keepEmail bool) (auth.UserInfo, error) {
+		var unchanged auth.UserInfo
+		account, err := n.Update(ctx, uid, func(current auth.UserInfo) (auth.UserInfo, error) {
+			resolved := n.resolver.Resolve(current, raw, pins)
+			if keepEmail {
+				resolved.Email, resolved.EmailVerified = current.Email, current.EmailVerified
+			}
+			if resolved == current {
+				unchanged = current
+				return auth.UserInfo{}, errUnchanged
+			}
+			return resolved, nil
+		})
+		if errors.Is(err, errUnchanged) {
+			return unchanged, nil
+		}
+		return account, err
+	}
+	account, err := refresh(false)
+	if errors.Is(err, ErrEmailTaken) {
+		account, err = refresh(true)
+	}
+	if err != nil {
+		return auth.UserInfo{}, fmt.Errorf("account refresh profile: %w", err)
+	}
+	return account, nil
+}
+
+// rawProfiles returns the decoded user info stored by UpdateUserInfo
+func (n Accounts) rawProfiles(ctx context.Context, uid tid.UserID) (map[string]map[string]any, error) {
+	profiles, err := n.profiles(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	raw := make(map[string]map[string]any, len(profiles))
+	for provider, b := range profiles {
+		var userInfo map[string]any
+		err = json.Unmarshal(b, &userInfo)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal %s profile: %w", provider, err)
+		}
+		raw[provider] = userInfo
+	}
+	return raw, nil
+}
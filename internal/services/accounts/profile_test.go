@@ -0,0 +1,104 @@
+package accounts
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gomoni/amble/internal/auth"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProfileResolver(t *testing.T) {
+	t.Parallel()
+	resolver := NewProfileResolver().WithProvider("gitlab", func(raw map[string]any) Profile {
+		return Profile{Name: stringField(raw, "name"), Picture: stringField(raw, "avatar")}
+	})
+	current := auth.UserInfo{Name: "cat", Email: "cat@octocat.example.net", EmailVerified: true}
+	raw := map[string]map[string]any{
+		"github": {"name": "The Octocat", "email": "octocat@github.example.net", "avatar_url": "https://github.example.net/octocat.png"},
+		"email":  {"email": "cat@octocat.example.net", "email_verified": true},
+		"gitlab": {"name": "Octo Lab", "avatar": "https://gitlab.example.net/octocat.png"},
+		"google": {"name": "ignored"},
+	}
+
+	// when resolved by default precedence, then github names and the email
+	// login gives the email
+	resolved := resolver.Resolve(current, raw, ProfilePins{})
+	require.Equal(t, auth.UserInfo{
+		Name:          "The Octocat",
+		Email:         "cat@octocat.example.net",
+		Picture:       "https://github.example.net/octocat.png",
+		EmailVerified: true,
+	}, resolved)
+
+	// when the user pins gitlab, then it wins over the precedence
+	resolved = resolver.Resolve(current, raw, ProfilePins{Name: "gitlab", Picture: "gitlab"})
+	require.Equal(t, "Octo Lab", resolved.Name)
+	require.Equal(t, "https://gitlab.example.net/octocat.png", resolved.Picture)
+
+	// when precedence is changed, then it applies to the field only
+	resolved = resolver.WithPrecedence(FieldEmail, "github").Resolve(current, raw, ProfilePins{})
+	require.Equal(t, "octocat@github.example.net", resolved.Email)
+	require.Equal(t, "The Octocat", resolved.Name)
+
+	// when no provider has a field, then the current one stays
+	resolved = resolver.Resolve(current, map[string]map[string]any{"email": {"email": "cat@octocat.example.net"}}, ProfilePins{})
+	require.Equal(t, current, resolved)
+}
+
+func TestPinProfile(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewMemory()
+
+	// given an account signed in by github and email
+	account, err := store.SignIn(ctx, "github", "583231", auth.UserInfo{Name: "The Octocat"}, map[string]any{
+		"name":       "The Octocat",
+		"avatar_url": "https://github.example.net/octocat.png",
+	})
+	require.NoError(t, err)
+	uid := account.UserID
+	require.NoError(t, store.Link(ctx, "email", "c4t", uid))
+	account, err = store.SignIn(ctx, "email", "c4t", auth.UserInfo{}, map[string]any{"email": "cat@octocat.example.net", "email_verified": true})
+	require.NoError(t, err)
+
+	// then the email login verified the email and github gave the rest
+	require.Equal(t, auth.UserInfo{
+		UserID:        uid,
+		Name:          "The Octocat",
+		Email:         "cat@octocat.example.net",
+		Picture:       "https://github.example.net/octocat.png",
+		EmailVerified: true,
+	}, account)
+	byEmail, err := store.ByEmail(ctx, "cat@octocat.example.net")
+	require.NoError(t, err)
+	require.Equal(t, uid, byEmail.UserID)
+
+	// when a provider without a profile is pinned, then it fails
+	_, err = store.PinProfile(ctx, uid, ProfilePins{Picture: "gitlab"})
+	require.ErrorIs(t, err, ErrProfileProvider)
+
+	// when github renames the user on the next login, then the account follows
+	account, err = store.SignIn(ctx, "github", "583231", auth.UserInfo{}, map[string]any{"name": "Mona"})
+	require.NoError(t, err)
+	require.Equal(t, "Mona", account.Name)
+	require.Equal(t, "https://github.example.net/octocat.png", account.Picture)
+
+	// when the user pins the name of the email login, which has none, then
+	// github stays the fallback
+	account, err = store.PinProfile(ctx, uid, ProfilePins{Name: "email"})
+	require.NoError(t, err)
+	require.Equal(t, "Mona", account.Name)
+	pins, err := store.ProfilePins(ctx, uid)
+	require.NoError(t, err)
+	require.Equal(t, ProfilePins{Name: "email"}, pins)
+
+	// when nothing changes, then the record is not written
+	_, rev, err := store.GetVersioned(ctx, uid)
+	require.NoError(t, err)
+	_, err = store.RefreshProfile(ctx, uid)
+	require.NoError(t, err)
+	_, again, err := store.GetVersioned(ctx, uid)
+	require.NoError(t, err)
+	require.Equal(t, rev, again)
+}
@@ -0,0 +1,207 @@
+package accounts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gomoni/amble/internal/auth"
+	"github.com/gomoni/amble/internal/tid"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// SchemaVersion is the version of account records written to
+// `user_info.$uid.app`
+const SchemaVersion = 2
+
+// ErrSchemaVersion is returned for a record newer than SchemaVersion, it was
+// written by a newer release
+var ErrSchemaVersion = errors.New("unsupported account schema version")
+
+// Migration upgrades a decoded record from its version to the next one
+type Migration func(doc map[string]any) error
+
+// migrations are keyed by the version they upgrade from
+var migrations = map[int]Migration{
+	// v1 is auth.UserInfo without the version
+	1: func(map[string]any) error { return nil },
+}
+
+// record is the stored account, v is missing in v1 records
+type record struct {
+	Version int `json:"v"`
+	auth.UserInfo
+}
+
+// encodeAccount returns the record of the current version
+func encodeAccount(userInfo auth.UserInfo) ([]byte, error) {
+	return json.Marshal(record{Version: SchemaVersion, UserInfo: userInfo})
+}
+
+// decodeAccount returns the account upgraded to SchemaVersion and the version
+// it was stored with
+func decodeAccount(b []byte) (auth.UserInfo, int, error) {
+	version, upgraded, err := upgrade(b, migrations, SchemaVersion)
+	if err != nil {
+		return auth.UserInfo{}, version, err
+	}
+	var r record
+	err = json.Unmarshal(upgraded, &r)
+	if err != nil {
+		return auth.UserInfo{}, version, err
+	}
+	return r.UserInfo, version, nil
+}
+
+// upgrade runs the migrations of a record from its version to the target
+// one and returns the version it had
+func upgrade(b []byte, migrations map[int]Migration, target int) (int, []byte, error) {
+	var head struct {
+		Version int `json:"v"`
+	}
+	err := json.Unmarshal(b, &head)
+	if err != nil {
+		return 0, nil, err
+	}
+	version := max(head.Version, 1)
+	if version > target {
+		return version, nil, fmt.Errorf("%w: %d", ErrSchemaVersion, version)
+	}
+	if version == target {
+		return version, b, nil
+	}
+
+	var doc map[string]any
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	err = d.Decode(&doc)
+	if err != nil {
+		return version, nil, err
+	}
+	for v := version; v < target; v++ {
+		migrate, ok := migrations[v]
+		if !ok {
+			return version, nil, fmt.Errorf("%w: no migration from %d", ErrSchemaVersion, v)
+		}
+		err = migrate(doc)
+		if err != nil {
+			return version, nil, fmt.Errorf("migrate from %d: %w", v, err)
+		}
+	}
+	doc["v"] = target
+	upgraded, err := json.Marshal(doc)
+	if err != nil {
+		return version, nil, err
+	}
+	return version, upgraded, nil
+}
+
+// MigrationProgress is reported after every account
+type MigrationProgress struct {
+	Done  int
+	Total int
+	// Migrated are the records of an older version, in dry run they are
+	// counted only
+	Migrated int
+	Failed   int
+}
+
+// MigrationReport is the final progress and the accounts failed to migrate
+type MigrationReport struct {
+	MigrationProgress
+	Errors map[tid.UserID]error
+}
+
+// Migrator upgrades stored accounts to SchemaVersion in bulk. Accounts are
+// upgraded on read anyway, the migrator persists it, so the older versions
+// can be dropped later.
+type Migrator struct {
+	accounts Accounts
+	dryRun   bool
+	progress func(MigrationProgress)
+}
+
+func (n Accounts) Migrator() Migrator {
+	return Migrator{accounts: n}
+}
+
+// WithDryRun returns a migrator, which only counts the records to migrate
+func (m Migrator) WithDryRun() Migrator {
+	m.dryRun = true
+	return m
+}
+
+// WithProgress returns a migrator calling the report after every account
+func (m Migrator) WithProgress(report func(MigrationProgress)) Migrator {
+	m.progress = report
+	return m
+}
+
+// Run migrates all the accounts. A record failed to migrate is reported and
+// the others continue.
+func (m Migrator) Run(ctx context.Context) (MigrationReport, error) {
+	keys, err := watchKeys(ctx, m.accounts.kv, "user_info.*.app", jetstream.IgnoreDeletes())
+	if err != nil {
+		return MigrationReport{}, fmt.Errorf("account migrate: %w", err)
+	}
+	report := MigrationReport{
+		MigrationProgress: MigrationProgress{Total: len(keys)},
+		Errors:            make(map[tid.UserID]error),
+	}
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			return report, fmt.Errorf("account migrate: %w", ctx.Err())
+		}
+		migrated, err := m.migrate(ctx, key)
+		if err != nil {
+			uid, _ := tid.ParseUserID(strings.Split(key, ".")[1])
+			report.Errors[uid] = err
+			report.Failed++
+		} else if migrated {
+			report.Migrated++
+		}
+		report.Done++
+		if m.progress != nil {
+			m.progress(report.MigrationProgress)
+		}
+	}
+	return report, nil
+}
+
+var (
+	// errUpToDate skips the write of a record of the current version
+	errUpToDate = errors.New("up to date")
+	// errDryRun skips the write of a record to migrate
+	errDryRun = errors.New("dry run")
+)
+
+// migrate rewrites the record of an older version
+func (m Migrator) migrate(ctx context.Context, key string) (bool, error) {
+	_, err := update(ctx, m.accounts.kv, key, func(current []byte, exists bool) ([]byte, error) {
+		if !exists {
+			// deleted in the meantime
+			return nil, errUpToDate
+		}
+		version, upgraded, err := upgrade(current, migrations, SchemaVersion)
+		if err != nil {
+			return nil, err
+		}
+		if version == SchemaVersion {
+			return nil, errUpToDate
+		}
+		if m.dryRun {
+			return nil, errDryRun
+		}
+		return upgraded, nil
+	})
+	switch {
+	case errors.Is(err, errUpToDate):
+		return false, nil
+	case errors.Is(err, errDryRun):
+		return true, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,117 @@
+package accounts
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/gomoni/amble/internal/auth"
+	"github.com/gomoni/amble/internal/tid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrator(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewMemory()
+
+	// given two v1 records written by Create before the versions and a current one
+	v1 := func(name string) tid.UserID {
+		uid, err := tid.NewUserID()
+		require.NoError(t, err)
+		b, err := json.Marshal(auth.UserInfo{UserID: uid, Name: name, Email: name + "@octocat.example.net"})
+		require.NoError(t, err)
+		_, err = store.kv.Create(ctx, "user_info."+uid.String()+".app", b)
+		require.NoError(t, err)
+		return uid
+	}
+	octocat := v1("octocat")
+	hubot := v1("hubot")
+	_, err := store.Create(ctx, auth.UserInfo{Name: "mona"})
+	require.NoError(t, err)
+	version := func(uid tid.UserID) int {
+		t.Helper()
+		entry, err := store.kv.Get(ctx, "user_info."+uid.String()+".app")
+		require.NoError(t, err)
+		_, version, err := decodeAccount(entry.Value())
+		require.NoError(t, err)
+		return version
+	}
+
+	// then v1 records are upgraded on read, but not written
+	account, err := store.Get(ctx, octocat)
+	require.NoError(t, err)
+	require.Equal(t, auth.UserInfo{UserID: octocat, Name: "octocat", Email: "octocat@octocat.example.net"}, account)
+	require.Equal(t, 1, version(octocat))
+
+	// when the migration is a dry run, then the records are counted only
+	var progress []MigrationProgress
+	report, err := store.Migrator().WithDryRun().WithProgress(func(p MigrationProgress) {
+		progress = append(progress, p)
+	}).Run(ctx)
+	require.NoError(t, err)
+	require.Equal(t, MigrationProgress{Done: 3, Total: 3, Migrated: 2}, report.MigrationProgress)
+	require.Len(t, progress, 3)
+	require.Equal(t, 1, progress[0].Done)
+	require.Equal(t, 1, version(octocat))
+
+	// when migrated, then the records are written in the current version
+	report, err = store.Migrator().Run(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, report.Migrated)
+	require.Empty(t, report.Errors)
+	require.Equal(t, SchemaVersion, version(octocat))
+	require.Equal(t, SchemaVersion, version(hubot))
+	account, err = store.Get(ctx, octocat)
+	require.NoError(t, err)
+	require.Equal(t, "octocat", account.Name)
+
+	// and migration can be repeated
+	report, err = store.Migrator().Run(ctx)
+	require.NoError(t, err)
+	require.Zero(t, report.Migrated)
+
+	// when a record was written by a newer release, then it is reported
+	future, err := tid.NewUserID()
+	require.NoError(t, err)
+	_, err = store.kv.Create(ctx, "user_info."+future.String()+".app", []byte(`{"v":99,"uid":"`+future.String()+`"}`))
+	require.NoError(t, err)
+	_, err = store.Get(ctx, future)
+	require.ErrorIs(t, err, ErrSchemaVersion)
+	report, err = store.Migrator().Run(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, report.Failed)
+	require.ErrorIs(t, report.Errors[future], ErrSchemaVersion)
+}
+
+func TestUpgrade(t *testing.T) {
+	t.Parallel()
+	// given v2 renamed picture to avatar and v3 dropped it
+	migrations := map[int]Migration{
+		1: func(doc map[string]any) error {
+			doc["avatar"] = doc["picture"]
+			delete(doc, "picture")
+			return nil
+		},
+		2: func(doc map[string]any) error {
+			delete(doc, "avatar")
+			return nil
+		},
+	}
+
+	// when a v1 record is upgraded to v2, then only the first migration runs
+	version, upgraded, err := upgrade([]byte(`{"name":"octocat","picture":"octocat.png","n":12345678901234567}`), migrations, 2)
+	require.NoError(t, err)
+	require.Equal(t, 1, version)
+	require.JSONEq(t, `{"v":2,"name":"octocat","avatar":"octocat.png","n":12345678901234567}`, string(upgraded))
+
+	// when it is upgraded to v3, then both run
+	version, upgraded, err = upgrade(upgraded, migrations, 3)
+	require.NoError(t, err)
+	require.Equal(t, 2, version)
+	require.JSONEq(t, `{"v":3,"name":"octocat","n":12345678901234567}`, string(upgraded))
+
+	// and a missing migration is an error
+	_, _, err = upgrade(upgraded, migrations, 4)
+	require.ErrorIs(t, err, ErrSchemaVersion)
+}
@@ -4,25 +4,39 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
 
+	"github.com/gomoni/amble/internal/auth"
+	"github.com/gomoni/amble/internal/auth/impersonate"
 	appJWT "github.com/gomoni/amble/internal/auth/jwt"
+	"github.com/gomoni/amble/internal/services/audit"
+	"github.com/gomoni/amble/internal/tid"
 	"github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nats.go/micro"
 	"github.com/nats-io/nkeys"
 )
 
-const StatusBadRequest = "400"
-
 type Decoder interface {
 	Decode(string) (appJWT.Claims, error)
 }
 
+type Auditor interface {
+	Record(context.Context, audit.Event) error
+}
+
 type Service struct {
 	accounts      Accounts
 	xKeyPair      nkeys.KeyPair
 	issuerKeyPair nkeys.KeyPair
 	decoder       Decoder
+	auditor       Auditor
+	policy        Policy
+	accountKeys   AccountKeys
+	cache         *Cache
+	logger        *slog.Logger
 }
 
 func NewService(xkey nkeys.KeyPair, issuer nkeys.KeyPair, accounts Accounts, decoder Decoder) (Service, error) {
@@ -42,48 +56,325 @@ func NewService(xkey nkeys.KeyPair, issuer nkeys.KeyPair, accounts Accounts, dec
 		issuerKeyPair: issuer,
 		accounts:      accounts,
 		decoder:       decoder,
+		policy:        DefaultPolicy(),
+		logger:        slog.Default(),
 	}, nil
 }
 
+// WithAudit returns a service, which records accepted and rejected connections
+func (s Service) WithAudit(auditor Auditor) Service {
+	s.auditor = auditor
+	return s
+}
+
+// WithLogger returns a service logging refused connections with the detailed
+// reasons to the logger
+func (s Service) WithLogger(logger *slog.Logger) Service {
+	s.logger = logger
+	return s
+}
+
+// WithPolicy returns a service granting users the permissions of the policy
+func (s Service) WithPolicy(policy Policy) Service {
+	s.policy = policy
+	return s
+}
+
+// WithAccountKeys returns a service for the operator mode. Users are issued
+// by the signing key of the tenant's account instead of the callout issuer.
+func (s Service) WithAccountKeys(keys AccountKeys) Service {
+	s.accountKeys = keys
+	return s
+}
+
+// WithCache returns a service looking links, accounts, admissions, plans and
+// placements up in the cache.
+// Run the cache to invalidate changed entries.
+func (s Service) WithCache(cache *Cache) Service {
+	s.cache = cache
+	return s
+}
+
 func (s Service) AuthCallout(r micro.Request) {
+	_ = s.authCallout(r)
+}
+
+// authCallout handles the request and returns nil if the user was accepted or
+// a CalloutError. Client gets a generic message of the error class only.
+func (s Service) authCallout(r micro.Request) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	requestClaims, err := s.decodeAuthorizationRequestClaims(r)
 	if err != nil {
-		log.Printf("[auth.Handle]: %s", err)
-		r.Error(StatusBadRequest, err.Error(), nil)
-		return
+		// there is no user nkey to reply to
+		err = refuse(ClassMalformedRequest, err)
+		s.logger.Warn("auth callout refused", "class", ClassMalformedRequest, "reason", err)
+		s.reject(ctx, audit.Event{}, err.Error())
+		_ = r.Error(ClassMalformedRequest.Code(), ClassMalformedRequest.Message(), nil)
+		return err
 	}
 
-	userNkey := requestClaims.UserNkey
-	serverId := requestClaims.Server.ID
+	event := calloutEvent(requestClaims)
+	token, err := s.authorize(ctx, requestClaims, &event)
+	if err != nil {
+		class := classOf(err)
+		s.logger.Warn("auth callout refused",
+			"class", class,
+			"reason", err,
+			"uid", event.UserID.String(),
+			"provider", event.Provider,
+			"host", requestClaims.ClientInformation.Host,
+		)
+		s.reject(ctx, event, err.Error())
+		response := s.encodeAuthorizationResponseClaims(requestClaims, "", class.Message())
+		_ = r.Error(class.Code(), class.Message(), response)
+		return err
+	}
+
+	s.logger.Info("auth callout accepted",
+		"uid", event.UserID.String(),
+		"provider", event.Provider,
+		"host", requestClaims.ClientInformation.Host,
+		"jwt", Redact(token),
+	)
+	event.Type = audit.CalloutAccept
+	s.record(ctx, event)
+	err = r.Respond(s.encodeAuthorizationResponseClaims(requestClaims, token, ""))
+	if err != nil {
+		s.logger.Error("auth callout respond", "reason", err)
+		return refuse(ClassInternal, err)
+	}
+	return nil
+}
+
+// authorize authenticates the connection and returns the signed user JWT
+func (s Service) authorize(ctx context.Context, requestClaims *jwt.AuthorizationRequestClaims, event *audit.Event) (string, error) {
 	userClaims := jwt.NewUserClaims(requestClaims.UserNkey)
 
+	// web token or a nkey (or .creds) of a registered device
+	var id identity
+	var err error
+	if requestClaims.ConnectOptions.Token != "" {
+		id, err = s.authenticateToken(ctx, requestClaims, event)
+	} else {
+		id, err = s.authenticateNkey(ctx, requestClaims, event)
+	}
+	if err != nil {
+		return "", err
+	}
+	uid := id.uid
+	event.UserID = uid
+	err = s.admit(ctx, uid, id.issuedAt)
+	switch {
+	case errors.Is(err, ErrSuspended):
+		return "", refuse(ClassSuspended, err)
+	case errors.Is(err, ErrDeletionPending):
+		return "", refuse(ClassDeletionPending, err)
+	case errors.Is(err, ErrPendingApproval):
+		return "", refuse(ClassPendingApproval, err)
+	case errors.Is(err, ErrRevoked):
+		return "", refuse(ClassBadToken, err)
+	case errors.Is(err, ErrErased):
+		return "", refuse(ClassUnknownIdentity, err)
+	case err != nil:
+		return "", refuse(ClassInternal, err)
+	}
+	userClaims.Permissions = id.permissions
+	// connection must not outlive the web token
+	if !id.expires.IsZero() {
+		userClaims.Expires = id.expires.Unix()
+	}
+
+	plan, err := s.userPlan(ctx, uid)
+	if err != nil {
+		return "", refuse(ClassInternal, err)
+	}
+	err = plan.Allows(requestClaims.ClientInformation)
+	if err != nil {
+		return "", refuse(ClassForbidden, err)
+	}
+	plan.Apply(userClaims)
+
+	// user may select the tenant by the user connect option like nats.UserInfo($tenant_id, "")
+	tenant, err := s.placement(ctx, uid, requestClaims.ConnectOptions.Username)
+	switch {
+	case errors.Is(err, ErrInvalidTenant):
+		return "", refuse(ClassMalformedRequest, err)
+	case errors.Is(err, ErrNoMembership), errors.Is(err, ErrNotMember), errors.Is(err, ErrAmbiguousTenant):
+		return "", refuse(ClassForbidden, err)
+	case err != nil:
+		return "", refuse(ClassInternal, err)
+	}
+	userClaims.ID = uid.String()
+	// connections are named by the user id, so Kicker can find them
+	userClaims.Name = uid.String()
+
+	token, err := s.signUser(ctx, tenant, userClaims)
+	if err != nil {
+		return "", refuse(ClassInternal, err)
+	}
+	return token, nil
+}
+
+// identity is the authenticated user of a connection
+type identity struct {
+	uid         tid.UserID
+	permissions jwt.Permissions
+	// expires is zero for credentials without expiry
+	expires time.Time
+	// issuedAt is zero for credentials without a token
+	issuedAt time.Time
+}
+
+// authenticateToken returns the user of a web token
+func (s Service) authenticateToken(ctx context.Context, rc *jwt.AuthorizationRequestClaims, event *audit.Event) (identity, error) {
 	// decode provided token to give claims from a web
-	webClaims, err := s.decoder.Decode(requestClaims.ConnectOptions.Token)
+	webClaims, err := s.decoder.Decode(rc.ConnectOptions.Token)
 	if err != nil {
-		log.Printf("[auth.Handle]: can't decode user token: %s", err)
-		r.Error(StatusBadRequest, err.Error(), nil)
-		return
+		return identity{}, refuse(ClassBadToken, fmt.Errorf("can't decode user token: %w", err))
+	}
+
+	// first factor only token must not be accepted
+	if slices.Contains(webClaims.Audience, appJWT.AudiencePending) {
+		return identity{}, refuse(ClassBadToken, errors.New("second factor required"))
+	}
+	// neither a download nor an email link
+	if !slices.Contains(webClaims.Audience, appJWT.AudienceApp) {
+		return identity{}, refuse(ClassBadToken, errors.New("not a session token"))
 	}
 
 	// need to find a issuer and sub
 	issuer, _ := webClaims.GetIssuer()
 	sub, _ := webClaims.GetSubject()
+	event.Provider = issuer
+	event.Subject = sub
+	var expires, issuedAt time.Time
+	if exp, _ := webClaims.GetExpirationTime(); exp != nil {
+		expires = exp.Time
+	}
+	if iat, _ := webClaims.GetIssuedAt(); iat != nil {
+		issuedAt = iat.Time
+	}
 
-	uid, err := s.accounts.Linked(ctx, issuer, sub)
+	if webClaims.Impersonated() {
+		// token issued by us to an admin acting as the user
+		uid := webClaims.UserID
+		event.Actor = webClaims.Act.UserID.String()
+		if issuer != impersonate.Issuer {
+			return identity{}, refuse(ClassBadToken, fmt.Errorf("unexpected issuer of impersonation token: %s", issuer))
+		}
+		_, err = s.get(ctx, uid)
+		if err != nil {
+			return identity{}, lookupError(err)
+		}
+		// admin can see, but not change anything
+		return identity{uid: uid, permissions: s.policy.ReadOnly(uid), expires: expires, issuedAt: issuedAt}, nil
+	}
+
+	uid, err := s.linked(ctx, issuer, sub)
 	if err != nil {
-		log.Printf("[auth.Handle]: %s", err)
-		r.Error(StatusBadRequest, err.Error(), nil)
-		return
+		return identity{}, lookupError(err)
 	}
-	userClaims.ID = uid.String()
-	userClaims.Audience = "PLA" // aka plainsof
-	// TODO: which permissions do we need?
+	return identity{uid: uid, permissions: s.policy.Permissions(uid), expires: expires, issuedAt: issuedAt}, nil
+}
+
+func (s Service) linked(ctx context.Context, provider, id string) (tid.UserID, error) {
+	if s.cache != nil {
+		return s.cache.Linked(ctx, provider, id)
+	}
+	return s.accounts.Linked(ctx, provider, id)
+}
+
+func (s Service) get(ctx context.Context, uid tid.UserID) (auth.UserInfo, error) {
+	if s.cache != nil {
+		return s.cache.Get(ctx, uid)
+	}
+	return s.accounts.Get(ctx, uid)
+}
+
+func (s Service) admit(ctx context.Context, uid tid.UserID, issuedAt time.Time) error {
+	if s.cache != nil {
+		return s.cache.Admit(ctx, uid, issuedAt)
+	}
+	return s.accounts.Admit(ctx, uid, issuedAt)
+}
+
+func (s Service) userPlan(ctx context.Context, uid tid.UserID) (Plan, error) {
+	if s.cache != nil {
+		return s.cache.UserPlan(ctx, uid)
+	}
+	return s.accounts.UserPlan(ctx, uid)
+}
+
+func (s Service) placement(ctx context.Context, uid tid.UserID, requested string) (Tenant, error) {
+	if s.cache != nil {
+		return s.cache.Placement(ctx, uid, requested)
+	}
+	return s.accounts.Placement(ctx, uid, requested)
+}
+
+// authenticateNkey returns the user of a registered device, which signed the
+// nonce by its user nkey. The nkey comes from the connect options or from
+// the user JWT of a .creds file. Note nats-server discards the JWT in config
+// mode, so only the nkey is there.
+func (s Service) authenticateNkey(ctx context.Context, rc *jwt.AuthorizationRequestClaims, event *audit.Event) (identity, error) {
+	public := rc.ConnectOptions.Nkey
+	if rc.ConnectOptions.JWT != "" {
+		uc, err := jwt.DecodeUserClaims(rc.ConnectOptions.JWT)
+		if err != nil {
+			return identity{}, refuse(ClassBadToken, fmt.Errorf("can't decode user jwt: %w", err))
+		}
+		public = uc.Subject
+	}
+	if public == "" {
+		return identity{}, refuse(ClassMalformedRequest, errors.New("missing token or nkey"))
+	}
+	event.Provider = "nkey"
+	event.Subject = public
+
+	err := verifyNonce(public, rc.ClientInformation.Nonce, rc.ConnectOptions.SignedNonce)
+	if err != nil {
+		return identity{}, refuse(ClassBadToken, err)
+	}
+	device, err := s.accounts.Device(ctx, public)
+	if err != nil {
+		return identity{}, lookupError(err)
+	}
+	policy := s.policy
+	if device.Policy != nil {
+		policy = *device.Policy
+	}
+	return identity{uid: device.UserID, permissions: policy.Permissions(device.UserID)}, nil
+}
+
+// calloutEvent returns an audit event with the client information of
+// the connection
+func calloutEvent(rc *jwt.AuthorizationRequestClaims) audit.Event {
+	userAgent := rc.ConnectOptions.Name
+	if rc.ConnectOptions.Lang != "" {
+		userAgent = strings.TrimSpace(userAgent + " " + rc.ConnectOptions.Lang + "/" + rc.ConnectOptions.Version)
+	}
+	return audit.Event{
+		Type:      audit.CalloutReject,
+		IP:        rc.ClientInformation.Host,
+		UserAgent: userAgent,
+	}
+}
 
-	token, err := validateAndSign(userClaims, s.issuerKeyPair)
-	log.Printf("[auth.Handle]: ValidateAndSign(): %s, %+v", token, err)
-	s.replyAuthorizationResponseClaims(r, userNkey, serverId, token, err)
+func (s Service) reject(ctx context.Context, event audit.Event, reason string) {
+	event.Type = audit.CalloutReject
+	event.Reason = reason
+	s.record(ctx, event)
+}
+
+func (s Service) record(ctx context.Context, event audit.Event) {
+	if s.auditor == nil {
+		return
+	}
+	err := s.auditor.Record(ctx, event)
+	if err != nil {
+		s.logger.Error("auth callout audit", "reason", err)
+	}
 }
 
 // from nasts-server source code
@@ -111,21 +402,35 @@ func (s Service) decodeAuthorizationRequestClaims(r micro.Request) (*jwt.Authori
 	return rc, nil
 }
 
-func (s Service) replyAuthorizationResponseClaims(req micro.Request, userNKey, serverId, userJWT string, err error) {
-	rc := jwt.NewAuthorizationResponseClaims(userNKey)
-	rc.Audience = serverId
+// encodeAuthorizationResponseClaims returns the response with the user JWT or
+// the client facing error message
+func (s Service) encodeAuthorizationResponseClaims(requestClaims *jwt.AuthorizationRequestClaims, userJWT, errMessage string) []byte {
+	rc := jwt.NewAuthorizationResponseClaims(requestClaims.UserNkey)
+	rc.Audience = requestClaims.Server.ID
 	rc.Jwt = userJWT
-	if err != nil {
-		rc.Error = err.Error()
-	}
+	rc.Error = errMessage
 
 	token, err := rc.Encode(s.issuerKeyPair)
 	if err != nil {
-		log.Println("error encoding response jwt:", err)
+		s.logger.Error("auth callout encode response", "reason", err)
 	}
+	return []byte(token)
+}
 
-	err = req.Respond([]byte(token))
-	log.Printf("[auth.Respond]: Respond: token: %s, err: %+v", token, err)
+// signUser places the user into the tenant's account. In server config mode
+// the account is named in audience and the callout issuer signs the user. In
+// operator mode the signing key of the account signs the user.
+func (s Service) signUser(ctx context.Context, tenant Tenant, claims *jwt.UserClaims) (string, error) {
+	if s.accountKeys == nil {
+		claims.Audience = tenant.Account
+		return validateAndSign(claims, s.issuerKeyPair)
+	}
+	kp, err := s.accountKeys.SigningKey(ctx, tenant.Account)
+	if err != nil {
+		return "", err
+	}
+	claims.IssuerAccount = tenant.Account
+	return validateAndSign(claims, kp)
 }
 
 func validateAndSign(claims *jwt.UserClaims, kp nkeys.KeyPair) (string, error) {
@@ -136,6 +441,5 @@ func validateAndSign(claims *jwt.UserClaims, kp nkeys.KeyPair) (string, error) {
 		return "", errors.Join(vr.Errors()...)
 	}
 
-	// Sign it with the issuer key since this is non-operator mode.
 	return claims.Encode(kp)
 }
@@ -0,0 +1,196 @@
+package accounts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/gomoni/amble/internal/tid"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+var (
+	// ErrPendingApproval is returned for users of an account waiting for an
+	// admin in the approval queue mode
+	ErrPendingApproval = errors.New("account is pending approval")
+	// ErrTransition is returned for a status change not allowed from the
+	// current status
+	ErrTransition = errors.New("status transition not allowed")
+)
+
+// Status of an account
+type Status string
+
+const (
+	StatusPendingApproval Status = "pending_approval"
+	StatusActive          Status = "active"
+	StatusSuspended       Status = "suspended"
+	StatusDeletionPending Status = "deletion_pending"
+	StatusDeleted         Status = "deleted"
+)
+
+// transitions are the statuses reachable from a status. Canceling a pending
+// deletion returns the account to the status it had before.
+var transitions = map[Status][]Status{
+	StatusPendingApproval: {StatusActive, StatusDeletionPending, StatusDeleted},
+	StatusActive:          {StatusSuspended, StatusDeletionPending},
+	StatusSuspended:       {StatusActive, StatusDeletionPending},
+	StatusDeletionPending: {StatusActive, StatusDeleted},
+}
+
+// AccountStatus is the status of an account with the reason and the time it
+// was entered. By is the user, who requested the deletion.
+type AccountStatus struct {
+	Status Status     `json:"status"`
+	Reason string     `json:"reason,omitempty"`
+	Since  time.Time  `json:"since"`
+	By     tid.UserID `json:"by"`
+}
+
+// Approval of a sign up in the approval queue mode
+type Approval struct {
+	RequestedAt time.Time `json:"requested_at"`
+}
+
+func approvalKey(uid tid.UserID) string {
+	return "approval." + uid.String()
+}
+
+// WithApprovalQueue returns accounts, which Create waiting for an admin to
+// approve them. Users are refused by Admit until then.
+func (n Accounts) WithApprovalQueue() Accounts {
+	n.approvalQueue = true
+	return n
+}
+
+// Status returns the status of the account derived from `erased.$uid`,
+// `deletion.$uid`, `suspended.$uid` and `approval.$uid` in this order
+func (n Accounts) Status(ctx context.Context, uid tid.UserID) (AccountStatus, error) {
+	entry, err := n.kv.Get(ctx, erasedKey(uid))
+	if err == nil {
+		var tombstone Tombstone
+		err = json.Unmarshal(entry.Value(), &tombstone)
+		if err != nil {
+			return AccountStatus{}, fmt.Errorf("account status: unmarshal tombstone: %w", err)
+		}
+		return AccountStatus{Status: StatusDeleted, Since: tombstone.ErasedAt}, nil
+	} else if !errors.Is(err, jetstream.ErrKeyNotFound) {
+		return AccountStatus{}, fmt.Errorf("account status: %w", err)
+	}
+	_, err = n.Get(ctx, uid)
+	if err != nil {
+		return AccountStatus{}, fmt.Errorf("account status: %w", err)
+	}
+
+	deletion, err := n.Deletion(ctx, uid)
+	if err == nil {
+		return AccountStatus{
+			Status: StatusDeletionPending,
+			Reason: "erased at " + deletion.EraseAt.Format(time.RFC3339),
+			Since:  deletion.RequestedAt,
+			By:     deletion.By,
+		}, nil
+	} else if !errors.Is(err, jetstream.ErrKeyNotFound) {
+		return AccountStatus{}, fmt.Errorf("account status: %w", err)
+	}
+	entry, err = n.kv.Get(ctx, suspendedKey(uid))
+	if err == nil {
+		var suspension Suspension
+		err = json.Unmarshal(entry.Value(), &suspension)
+		if err != nil {
+			return AccountStatus{}, fmt.Errorf("account status: unmarshal suspension: %w", err)
+		}
+		return AccountStatus{Status: StatusSuspended, Reason: suspension.Reason, Since: suspension.At}, nil
+	} else if !errors.Is(err, jetstream.ErrKeyNotFound) {
+		return AccountStatus{}, fmt.Errorf("account status: %w", err)
+	}
+	approval, err := n.approval(ctx, uid)
+	if err == nil {
+		return AccountStatus{Status: StatusPendingApproval, Since: approval.RequestedAt}, nil
+	} else if !errors.Is(err, jetstream.ErrKeyNotFound) {
+		return AccountStatus{}, fmt.Errorf("account status: %w", err)
+	}
+	return AccountStatus{Status: StatusActive, Since: uid.CreatedAt()}, nil
+}
+
+// Transition changes the status of the account if allowed from the current
+// one and returns the new status. Moving to the same status is a no-op,
+// except a suspension, which changes the reason. A deletion requested by
+// Transition has DefaultGracePeriod. Use Kicker.Transition to disconnect
+// the user too.
+func (n Accounts) Transition(ctx context.Context, uid tid.UserID, to Status, reason string, by tid.UserID) (AccountStatus, error) {
+	current, err := n.Status(ctx, uid)
+	if err != nil {
+		return AccountStatus{}, fmt.Errorf("account transition: %w", err)
+	}
+	from := current.Status
+	if from == to && to != StatusSuspended {
+		return current, nil
+	}
+	if from != to && !slices.Contains(transitions[from], to) {
+		return current, fmt.Errorf("account transition: %w: %s to %s", ErrTransition, from, to)
+	}
+
+	switch {
+	case to == StatusSuspended:
+		err = n.Suspend(ctx, uid, reason)
+	case to == StatusDeletionPending:
+		_, err = n.RequestDeletion(ctx, uid, by, DefaultGracePeriod)
+	case to == StatusDeleted:
+		err = n.Erase(ctx, uid)
+	case from == StatusPendingApproval:
+		err = n.approve(ctx, uid)
+	case from == StatusSuspended:
+		err = n.Unsuspend(ctx, uid)
+	case from == StatusDeletionPending:
+		err = n.CancelDeletion(ctx, uid)
+	}
+	if err != nil {
+		return current, fmt.Errorf("account transition: %w", err)
+	}
+	return n.Status(ctx, uid)
+}
+
+func (n Accounts) approval(ctx context.Context, uid tid.UserID) (Approval, error) {
+	entry, err := n.kv.Get(ctx, approvalKey(uid))
+	if err != nil {
+		return Approval{}, err
+	}
+	var approval Approval
+	err = json.Unmarshal(entry.Value(), &approval)
+	if err != nil {
+		return Approval{}, fmt.Errorf("unmarshal approval: %w", err)
+	}
+	return approval, nil
+}
+
+// requestApproval puts the new account into the approval queue
+func (n Accounts) requestApproval(ctx context.Context, uid tid.UserID) error {
+	b, err := json.Marshal(Approval{RequestedAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	_, err = n.kv.Create(ctx, approvalKey(uid), b)
+	return err
+}
+
+func (n Accounts) approve(ctx context.Context, uid tid.UserID) error {
+	entry, err := n.kv.Get(ctx, approvalKey(uid))
+	if err != nil {
+		return err
+	}
+	return n.kv.Delete(ctx, approvalKey(uid), jetstream.LastRevision(entry.Revision()))
+}
+
+func (n Accounts) pendingApproval(ctx context.Context, uid tid.UserID) error {
+	_, err := n.kv.Get(ctx, approvalKey(uid))
+	if err == nil {
+		return ErrPendingApproval
+	} else if !errors.Is(err, jetstream.ErrKeyNotFound) {
+		return err
+	}
+	return nil
+}
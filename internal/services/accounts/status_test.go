@@ -0,0 +1,83 @@
+package accounts
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gomoni/amble/internal/auth"
+	"github.com/gomoni/amble/internal/tid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransition(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewMemory().WithApprovalQueue()
+	admin, err := tid.NewUserID()
+	require.NoError(t, err)
+
+	// given a new sign up in the approval queue mode
+	octocat, err := store.Create(ctx, auth.UserInfo{Name: "Octocat"})
+	require.NoError(t, err)
+	status := func(want Status) AccountStatus {
+		t.Helper()
+		got, err := store.Status(ctx, octocat)
+		require.NoError(t, err)
+		require.Equal(t, want, got.Status)
+		return got
+	}
+
+	// then it waits for an admin and is refused
+	status(StatusPendingApproval)
+	require.ErrorIs(t, store.Admit(ctx, octocat, time.Time{}), ErrPendingApproval)
+	queue, err := store.Lister().WithStatus(StatusPendingApproval).Page(ctx)
+	require.NoError(t, err)
+	require.Len(t, queue.Accounts, 1)
+	_, err = store.Transition(ctx, octocat, StatusSuspended, "spam", admin)
+	require.ErrorIs(t, err, ErrTransition)
+
+	// when approved, then it is admitted
+	approved, err := store.Transition(ctx, octocat, StatusActive, "", admin)
+	require.NoError(t, err)
+	require.Equal(t, StatusActive, approved.Status)
+	require.NoError(t, store.Admit(ctx, octocat, time.Time{}))
+	queue, err = store.Lister().WithStatus(StatusPendingApproval).Page(ctx)
+	require.NoError(t, err)
+	require.Empty(t, queue.Accounts)
+
+	// when suspended again, then the reason changes but not the time
+	suspended, err := store.Transition(ctx, octocat, StatusSuspended, "spam", admin)
+	require.NoError(t, err)
+	require.Equal(t, "spam", suspended.Reason)
+	again, err := store.Transition(ctx, octocat, StatusSuspended, "abuse", admin)
+	require.NoError(t, err)
+	require.Equal(t, "abuse", again.Reason)
+	require.Equal(t, suspended.Since, again.Since)
+	require.ErrorIs(t, store.Admit(ctx, octocat, time.Time{}), ErrSuspended)
+
+	// when a deletion of the suspended account is canceled, then it stays suspended
+	pending, err := store.Transition(ctx, octocat, StatusDeletionPending, "", admin)
+	require.NoError(t, err)
+	require.Equal(t, StatusDeletionPending, pending.Status)
+	require.Equal(t, admin, pending.By)
+	_, err = store.Transition(ctx, octocat, StatusActive, "", admin)
+	require.NoError(t, err)
+	status(StatusSuspended)
+
+	// and an active account can't be erased without a pending deletion
+	_, err = store.Transition(ctx, octocat, StatusActive, "", admin)
+	require.NoError(t, err)
+	status(StatusActive)
+	_, err = store.Transition(ctx, octocat, StatusDeleted, "", admin)
+	require.ErrorIs(t, err, ErrTransition)
+
+	// when erased, then there is no way back
+	_, err = store.Transition(ctx, octocat, StatusDeletionPending, "", admin)
+	require.NoError(t, err)
+	_, err = store.Transition(ctx, octocat, StatusDeleted, "", admin)
+	require.NoError(t, err)
+	status(StatusDeleted)
+	_, err = store.Transition(ctx, octocat, StatusActive, "", admin)
+	require.ErrorIs(t, err, ErrTransition)
+}
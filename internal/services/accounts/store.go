@@ -0,0 +1,36 @@
+package accounts
+
+import (
+	"context"
+	"iter"
+
+	"github.com/gomoni/amble/internal/auth"
+	"github.com/gomoni/amble/internal/tid"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Bucket of accounts, all the keys of the package are stored in it
+const Bucket = "accounts"
+
+// KeyValueConfig is a configuration of a bucket accounts are stored in
+func KeyValueConfig() jetstream.KeyValueConfig {
+	return jetstream.KeyValueConfig{
+		Bucket: Bucket,
+	}
+}
+
+// Store is the core of accounts: user info and links of login providers.
+// Accounts returned by NewNats and NewMemory implement it the same way, a
+// missing account or link is reported as jetstream.ErrKeyNotFound.
+type Store interface {
+	Create(ctx context.Context, userInfo auth.UserInfo) (tid.UserID, error)
+	Get(ctx context.Context, uid tid.UserID) (auth.UserInfo, error)
+	Link(ctx context.Context, provider, id string, uid tid.UserID) error
+	Linked(ctx context.Context, provider, id string) (tid.UserID, error)
+	ByEmail(ctx context.Context, address string) (auth.UserInfo, error)
+	UpdateUserInfo(ctx context.Context, provider string, uid tid.UserID, userInfo map[string]any) error
+	Lister() Lister
+	Watch(ctx context.Context, filter WatchFilter) iter.Seq2[Event, error]
+}
+
+var _ Store = Accounts{}
@@ -0,0 +1,218 @@
+package accounts_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gomoni/amble/internal/auth"
+	"github.com/gomoni/amble/internal/services/accounts"
+	"github.com/gomoni/amble/internal/test"
+	"github.com/gomoni/amble/internal/tid"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testStore(t, accounts.NewMemory())
+	})
+	t.Run("nats", func(t *testing.T) {
+		server, err := test.NewNatsContainer(context.Background(), test.NatsContainerOpts{})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			err := server.Terminate()
+			require.NoError(t, err)
+		})
+		nc, err := nats.Connect(server.Endpoint())
+		require.NoError(t, err)
+		t.Cleanup(nc.Close)
+		js, err := jetstream.New(nc)
+		require.NoError(t, err)
+		kv, err := js.CreateKeyValue(context.Background(), accounts.KeyValueConfig())
+		require.NoError(t, err)
+		testStore(t, accounts.NewNats(kv))
+	})
+}
+
+// testStore is the conformance suite every Store must pass
+func testStore(t *testing.T, store accounts.Store) {
+	ctx := context.Background()
+	octocat := auth.UserInfo{
+		Name:    "Octocat",
+		Email:   "cat@octocat.example.net",
+		Picture: "https://example.net/octocat.png",
+	}
+	uid, err := store.Create(ctx, octocat)
+	require.NoError(t, err)
+	require.False(t, uid.IsZero())
+
+	t.Run("get", func(t *testing.T) {
+		account, err := store.Get(ctx, uid)
+		require.NoError(t, err)
+		octocat.UserID = uid
+		require.Equal(t, octocat, account)
+
+		other, err := tid.NewUserID()
+		require.NoError(t, err)
+		_, err = store.Get(ctx, other)
+		require.ErrorIs(t, err, jetstream.ErrKeyNotFound)
+	})
+
+	t.Run("create", func(t *testing.T) {
+		// every account gets a new id
+		uid2, err := store.Create(ctx, octocat)
+		require.NoError(t, err)
+		require.NotEqual(t, uid, uid2)
+	})
+
+	t.Run("link", func(t *testing.T) {
+		const githubID = "583231"
+		_, err := store.Linked(ctx, "github", githubID)
+		require.ErrorIs(t, err, jetstream.ErrKeyNotFound)
+
+		require.NoError(t, store.Link(ctx, "github", githubID, uid))
+		linked, err := store.Linked(ctx, "github", githubID)
+		require.NoError(t, err)
+		require.Equal(t, uid, linked)
+
+		// login can't be linked twice
+		other, err := tid.NewUserID()
+		require.NoError(t, err)
+		err = store.Link(ctx, "github", githubID, other)
+		require.ErrorIs(t, err, jetstream.ErrKeyExists)
+		linked, err = store.Linked(ctx, "github", githubID)
+		require.NoError(t, err)
+		require.Equal(t, uid, linked)
+	})
+
+	t.Run("update user info", func(t *testing.T) {
+		err := store.UpdateUserInfo(ctx, "github", uid, map[string]any{"login": "octocat"})
+		require.NoError(t, err)
+		err = store.UpdateUserInfo(ctx, "github", uid, map[string]any{"login": "the-octocat"})
+		require.NoError(t, err)
+
+		// provider's data does not change the account
+		account, err := store.Get(ctx, uid)
+		require.NoError(t, err)
+		require.Equal(t, "Octocat", account.Name)
+	})
+
+	t.Run("list", func(t *testing.T) {
+		var listed []tid.UserID
+		for account, err := range store.Lister().WithLimit(1).Iter(ctx) {
+			require.NoError(t, err)
+			listed = append(listed, account.UserID)
+		}
+		require.Len(t, listed, 2)
+		require.Equal(t, uid, listed[0])
+
+		page, err := store.Lister().WithProvider("github").Page(ctx)
+		require.NoError(t, err)
+		require.Len(t, page.Accounts, 1)
+		require.Equal(t, uid, page.Accounts[0].UserID)
+		require.Empty(t, page.Next)
+	})
+
+	t.Run("by email", func(t *testing.T) {
+		// unverified emails are not indexed
+		_, err := store.ByEmail(ctx, octocat.Email)
+		require.ErrorIs(t, err, jetstream.ErrKeyNotFound)
+
+		hubot := auth.UserInfo{Name: "Hubot", Email: "Hubot@Octocat.example.net", EmailVerified: true}
+		hid, err := store.Create(ctx, hubot)
+		require.NoError(t, err)
+		account, err := store.ByEmail(ctx, " hubot@octocat.example.net")
+		require.NoError(t, err)
+		require.Equal(t, hid, account.UserID)
+
+		// verified email is unique
+		_, err = store.Create(ctx, auth.UserInfo{Name: "Hubot2", Email: "hubot@octocat.example.net", EmailVerified: true})
+		require.ErrorIs(t, err, accounts.ErrEmailTaken)
+		var conflict *accounts.EmailConflictError
+		require.ErrorAs(t, err, &conflict)
+		require.Equal(t, hid, conflict.Owner)
+	})
+
+	t.Run("watch", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		events := make(chan accounts.Event, 64)
+		go func() {
+			for event, err := range store.Watch(ctx, accounts.WatchFilter{}) {
+				if err != nil {
+					return
+				}
+				events <- event
+			}
+		}()
+
+		// accounts created before the watch is live are not reported, so
+		// create them until one is
+		var created accounts.Event
+		require.Eventually(t, func() bool {
+			_, err := store.Create(ctx, auth.UserInfo{Name: "Mona"})
+			if err != nil {
+				return false
+			}
+			select {
+			case created = <-events:
+				return true
+			case <-time.After(50 * time.Millisecond):
+				return false
+			}
+		}, 5*time.Second, time.Millisecond)
+		require.Equal(t, accounts.EventCreated, created.Type)
+		require.Equal(t, "Mona", created.Account.Name)
+		mona := created.UserID
+
+		// when mona links github and updates the profile
+		require.NoError(t, store.Link(ctx, "github", "1", mona))
+		require.NoError(t, store.UpdateUserInfo(ctx, "github", mona, map[string]any{"login": "mona"}))
+
+		// then the events follow
+		next := func() accounts.Event {
+			t.Helper()
+			for {
+				select {
+				case event := <-events:
+					if event.UserID == mona {
+						return event
+					}
+				case <-time.After(5 * time.Second):
+					require.FailNow(t, "no event")
+				}
+			}
+		}
+		linked := next()
+		require.Equal(t, accounts.EventLinked, linked.Type)
+		require.Equal(t, "github", linked.Provider)
+		require.Equal(t, "1", linked.ID)
+		profile := next()
+		require.Equal(t, accounts.EventProfileUpdated, profile.Type)
+		require.JSONEq(t, `{"login":"mona"}`, string(profile.Profile))
+		require.Greater(t, profile.Revision, linked.Revision)
+
+		// when resumed from the creation, then the changes are replayed
+		var replayed []accounts.Event
+		for event, err := range store.Watch(ctx, accounts.WatchFilter{UserID: mona, FromRevision: created.Revision}) {
+			require.NoError(t, err)
+			replayed = append(replayed, event)
+			if len(replayed) == 3 {
+				break
+			}
+		}
+		require.Equal(t, []accounts.EventType{accounts.EventCreated, accounts.EventLinked, accounts.EventProfileUpdated},
+			[]accounts.EventType{replayed[0].Type, replayed[1].Type, replayed[2].Type})
+		require.Equal(t, profile.Revision, replayed[2].Revision)
+
+		// when resumed after the link, then the account is not created again
+		for event, err := range store.Watch(ctx, accounts.WatchFilter{UserID: mona, FromRevision: linked.Revision}) {
+			require.NoError(t, err)
+			require.Equal(t, accounts.EventLinked, event.Type)
+			break
+		}
+	})
+}
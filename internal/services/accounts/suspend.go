@@ -0,0 +1,152 @@
+package accounts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gomoni/amble/internal/tid"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+var (
+	// ErrSuspended is returned for users of a suspended account
+	ErrSuspended = errors.New("account is suspended")
+	// ErrRevoked is returned for tokens issued before the revocation
+	ErrRevoked = errors.New("token was revoked")
+)
+
+// Suspension of the account
+type Suspension struct {
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+func suspendedKey(uid tid.UserID) string {
+	return "suspended." + uid.String()
+}
+
+func revokedKey(uid tid.UserID) string {
+	return "revoked." + uid.String()
+}
+
+// Suspend refuses all connections of the user until Unsuspend is called.
+// Stored in `suspended.$uid`
+// Suspending again changes the reason, but keeps the time.
+func (n Accounts) Suspend(ctx context.Context, uid tid.UserID, reason string) error {
+	_, _, err := updateJSON(ctx, n.kv, suspendedKey(uid), func(current Suspension, exists bool) (Suspension, error) {
+		if !exists {
+			current.At = time.Now().UTC()
+		}
+		current.Reason = reason
+		return current, nil
+	})
+	if err != nil {
+		return fmt.Errorf("account suspend: %w", err)
+	}
+	return nil
+}
+
+// Unsuspend admits the user again, it fails if the suspension changed since
+// it was read
+func (n Accounts) Unsuspend(ctx context.Context, uid tid.UserID) error {
+	err := deleteRead(ctx, n.kv, suspendedKey(uid))
+	if err != nil {
+		return fmt.Errorf("account unsuspend: %w", err)
+	}
+	return nil
+}
+
+// RevokeTokens refuses all web tokens of the user issued until now. Tokens
+// carry seconds only, so tokens issued in the same second are revoked too.
+// Stored in `revoked.$uid` as unix time.
+func (n Accounts) RevokeTokens(ctx context.Context, uid tid.UserID) error {
+	now := time.Now().Unix()
+	_, err := update(ctx, n.kv, revokedKey(uid), func(current []byte, exists bool) ([]byte, error) {
+		// never move the revocation back because of a skewed clock
+		if revoked, err := strconv.ParseInt(string(current), 10, 64); exists && err == nil {
+			now = max(now, revoked)
+		}
+		return []byte(strconv.FormatInt(now, 10)), nil
+	})
+	if err != nil {
+		return fmt.Errorf("account revoke tokens: %w", err)
+	}
+	return nil
+}
+
+// Admit returns ErrErased for erased accounts, ErrSuspended if the account of
+// the user is suspended, ErrRevoked if the token issued at issuedAt was revoked,
+// ErrDeletionPending if the account is scheduled for deletion or
+// ErrPendingApproval if it was not approved yet. Zero issuedAt means
+// credentials without a token like device nkeys.
+func (n Accounts) Admit(ctx context.Context, uid tid.UserID, issuedAt time.Time) error {
+	err := n.erased(ctx, uid)
+	if err != nil {
+		return fmt.Errorf("account admit: %w", err)
+	}
+	entry, err := n.kv.Get(ctx, suspendedKey(uid))
+	if err == nil {
+		var suspension Suspension
+		err = json.Unmarshal(entry.Value(), &suspension)
+		if err != nil {
+			return fmt.Errorf("account admit: unmarshal: %w", err)
+		}
+		return fmt.Errorf("%w: %s", ErrSuspended, suspension.Reason)
+	} else if !errors.Is(err, jetstream.ErrKeyNotFound) {
+		return fmt.Errorf("account admit: %w", err)
+	}
+
+	err = n.revoked(ctx, uid, issuedAt)
+	if err != nil {
+		return fmt.Errorf("account admit: %w", err)
+	}
+	err = n.deletionPending(ctx, uid)
+	if err != nil {
+		return fmt.Errorf("account admit: %w", err)
+	}
+	err = n.pendingApproval(ctx, uid)
+	if err != nil {
+		return fmt.Errorf("account admit: %w", err)
+	}
+	return nil
+}
+
+// revoked returns ErrRevoked if the token issued at issuedAt was revoked
+func (n Accounts) revoked(ctx context.Context, uid tid.UserID, issuedAt time.Time) error {
+	if issuedAt.IsZero() {
+		return nil
+	}
+	revoked, err := n.revokedAt(ctx, uid)
+	if err != nil {
+		return err
+	}
+	return revokedSince(issuedAt, revoked)
+}
+
+// revokedAt returns the unix time of the last revocation, zero if there is none
+func (n Accounts) revokedAt(ctx context.Context, uid tid.UserID) (int64, error) {
+	entry, err := n.kv.Get(ctx, revokedKey(uid))
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	revoked, err := strconv.ParseInt(string(entry.Value()), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse revoked: %w", err)
+	}
+	return revoked, nil
+}
+
+// revokedSince returns ErrRevoked for a token issued at issuedAt before the
+// revocation
+func revokedSince(issuedAt time.Time, revoked int64) error {
+	if revoked > 0 && !issuedAt.IsZero() && issuedAt.Unix() <= revoked {
+		return ErrRevoked
+	}
+	return nil
+}
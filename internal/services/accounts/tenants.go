@@ -0,0 +1,258 @@
+package accounts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gomoni/amble/internal/tid"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+var (
+	// ErrNoMembership is returned if the user can't be placed into any tenant
+	ErrNoMembership = errors.New("user is not a member of any tenant")
+	// ErrNotMember is returned if the user is not a member of a selected tenant
+	ErrNotMember = errors.New("user is not a member of the tenant")
+	// ErrAmbiguousTenant is returned if the user must select one of more tenants
+	ErrAmbiguousTenant = errors.New("member of more tenants, select one or set a default")
+	// ErrInvalidTenant is returned if the selected tenant id is not valid
+	ErrInvalidTenant = errors.New("invalid tenant id")
+)
+
+// Tenant is a group of users placed into the same NATS account
+type Tenant struct {
+	ID      tid.TenantID `json:"id"`
+	Name    string       `json:"name"`
+	Account string       `json:"account"`
+}
+
+func tenantKey(id tid.TenantID) string {
+	return "tenant." + id.String()
+}
+
+func memberKey(uid tid.UserID, id tid.TenantID) string {
+	return "member." + uid.String() + "." + id.String()
+}
+
+func defaultTenantKey(uid tid.UserID) string {
+	return "default_tenant." + uid.String()
+}
+
+// WithDefaultTenant returns accounts, which add every new account signed up
+// by SignIn into the tenant, so users can connect without an admin placing
+// them
+func (n Accounts) WithDefaultTenant(id tid.TenantID) Accounts {
+	n.defaultTenant = id
+	return n
+}
+
+// CreateTenant stores a new tenant mapped to the NATS account. Stored in `tenant.$tenant_id`
+func (n Accounts) CreateTenant(ctx context.Context, name, account string) (Tenant, error) {
+	if account == "" {
+		return Tenant{}, errors.New("account create tenant: empty NATS account")
+	}
+	id, err := tid.NewTenantID()
+	if err != nil {
+		return Tenant{}, fmt.Errorf("account create tenant: generate tenant id: %w", err)
+	}
+	tenant := Tenant{ID: id, Name: name, Account: account}
+	b, err := json.Marshal(tenant)
+	if err != nil {
+		return Tenant{}, fmt.Errorf("account create tenant: marshal: %w", err)
+	}
+	_, err = n.kv.Create(ctx, tenantKey(id), b)
+	if err != nil {
+		return Tenant{}, fmt.Errorf("account create tenant: %w", err)
+	}
+	return tenant, nil
+}
+
+func (n Accounts) Tenant(ctx context.Context, id tid.TenantID) (Tenant, error) {
+	entry, err := n.kv.Get(ctx, tenantKey(id))
+	if err != nil {
+		return Tenant{}, fmt.Errorf("account get tenant: %w", err)
+	}
+	var tenant Tenant
+	err = json.Unmarshal(entry.Value(), &tenant)
+	if err != nil {
+		return Tenant{}, fmt.Errorf("account get tenant: unmarshal: %w", err)
+	}
+	return tenant, nil
+}
+
+// Tenants returns all tenants
+func (n Accounts) Tenants(ctx context.Context) ([]Tenant, error) {
+	entries, err := WatchEntries(ctx, n.kv, "tenant.*", jetstream.IgnoreDeletes())
+	if err != nil {
+		return nil, fmt.Errorf("account tenants: %w", err)
+	}
+
+	tenants := make([]Tenant, 0)
+	for _, entry := range entries {
+		var tenant Tenant
+		err = json.Unmarshal(entry.Value(), &tenant)
+		if err != nil {
+			return nil, fmt.Errorf("account tenants: unmarshal %s: %w", entry.Key(), err)
+		}
+		tenants = append(tenants, tenant)
+	}
+	return tenants, nil
+}
+
+// Members returns the ids of users, which are members of the tenant
+func (n Accounts) Members(ctx context.Context, id tid.TenantID) ([]tid.UserID, error) {
+	keys, err := watchKeys(ctx, n.kv, "member.*."+id.String(), jetstream.IgnoreDeletes())
+	if err != nil {
+		return nil, fmt.Errorf("account members: %w", err)
+	}
+	uids := make([]tid.UserID, 0, len(keys))
+	for _, key := range keys {
+		// member.$uid.$tenant_id
+		uid, err := tid.ParseUserID(strings.Split(key, ".")[1])
+		if err != nil {
+			return nil, fmt.Errorf("account members: parse %s: %w", key, err)
+		}
+		uids = append(uids, uid)
+	}
+	return uids, nil
+}
+
+// AddMember adds the user into the tenant. Stored in `member.$uid.$tenant_id`
+func (n Accounts) AddMember(ctx context.Context, id tid.TenantID, uid tid.UserID) error {
+	_, err := update(ctx, n.kv, memberKey(uid, id), func([]byte, bool) ([]byte, error) {
+		_, err := n.Tenant(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(id.String()), nil
+	})
+	if err != nil {
+		return fmt.Errorf("account add member: %w", err)
+	}
+	return nil
+}
+
+// RemoveMember removes the user from the tenant and clears the default
+// tenant if it was the removed one
+func (n Accounts) RemoveMember(ctx context.Context, id tid.TenantID, uid tid.UserID) error {
+	err := deleteRead(ctx, n.kv, memberKey(uid, id))
+	if err != nil {
+		return fmt.Errorf("account remove member: %w", err)
+	}
+	entry, err := n.kv.Get(ctx, defaultTenantKey(uid))
+	if err == nil && string(entry.Value()) == id.String() {
+		// the default changed meanwhile is kept
+		err = n.kv.Delete(ctx, defaultTenantKey(uid), jetstream.LastRevision(entry.Revision()))
+		if err != nil && !errors.Is(err, jetstream.ErrKeyExists) {
+			return fmt.Errorf("account remove member: clear default tenant: %w", err)
+		}
+	}
+	return nil
+}
+
+// Memberships returns the ids of tenants the user is a member of
+func (n Accounts) Memberships(ctx context.Context, uid tid.UserID) ([]tid.TenantID, error) {
+	entries, err := WatchEntries(ctx, n.kv, "member."+uid.String()+".*", jetstream.IgnoreDeletes())
+	if err != nil {
+		return nil, fmt.Errorf("account memberships: %w", err)
+	}
+
+	ids := make([]tid.TenantID, 0)
+	for _, entry := range entries {
+		id, err := tid.ParseTenantID(string(entry.Value()))
+		if err != nil {
+			return nil, fmt.Errorf("account memberships: parse %s: %w", entry.Key(), err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// SetDefaultTenant selects the tenant used when user does not ask for one.
+// User must be a member of it. Stored in `default_tenant.$uid`
+func (n Accounts) SetDefaultTenant(ctx context.Context, uid tid.UserID, id tid.TenantID) error {
+	member := func() error {
+		_, err := n.kv.Get(ctx, memberKey(uid, id))
+		if errors.Is(err, jetstream.ErrKeyNotFound) {
+			return ErrNotMember
+		}
+		return err
+	}
+	rev, err := update(ctx, n.kv, defaultTenantKey(uid), func([]byte, bool) ([]byte, error) {
+		err := member()
+		if err != nil {
+			return nil, err
+		}
+		return []byte(id.String()), nil
+	})
+	if err != nil {
+		return fmt.Errorf("account set default tenant: %w", err)
+	}
+	// RemoveMember racing with the write may have missed the new default,
+	// so it is cleared here unless it changed again
+	err = member()
+	if errors.Is(err, ErrNotMember) {
+		derr := n.kv.Delete(ctx, defaultTenantKey(uid), jetstream.LastRevision(rev))
+		if derr != nil && !errors.Is(derr, jetstream.ErrKeyExists) {
+			err = errors.Join(err, derr)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("account set default tenant: %w", err)
+	}
+	return nil
+}
+
+func (n Accounts) DefaultTenant(ctx context.Context, uid tid.UserID) (tid.TenantID, error) {
+	entry, err := n.kv.Get(ctx, defaultTenantKey(uid))
+	if err != nil {
+		return tid.TenantID{}, fmt.Errorf("account default tenant: %w", err)
+	}
+	id, err := tid.ParseTenantID(string(entry.Value()))
+	if err != nil {
+		return tid.TenantID{}, fmt.Errorf("account default tenant: parse: %w", err)
+	}
+	return id, nil
+}
+
+// Placement returns the tenant the user connects to. The requested tenant id
+// wins if user is a member of it, then the default tenant and then the only
+// membership. It fails with ErrNoMembership otherwise.
+func (n Accounts) Placement(ctx context.Context, uid tid.UserID, requested string) (Tenant, error) {
+	if requested != "" {
+		id, err := tid.ParseTenantID(requested)
+		if err != nil {
+			return Tenant{}, fmt.Errorf("account placement: %w: %w", ErrInvalidTenant, err)
+		}
+		_, err = n.kv.Get(ctx, memberKey(uid, id))
+		if errors.Is(err, jetstream.ErrKeyNotFound) {
+			return Tenant{}, fmt.Errorf("account placement: %s: %w", id, ErrNotMember)
+		} else if err != nil {
+			return Tenant{}, fmt.Errorf("account placement: %w", err)
+		}
+		return n.Tenant(ctx, id)
+	}
+
+	id, err := n.DefaultTenant(ctx, uid)
+	if err == nil {
+		return n.Tenant(ctx, id)
+	} else if !errors.Is(err, jetstream.ErrKeyNotFound) {
+		return Tenant{}, fmt.Errorf("account placement: %w", err)
+	}
+
+	ids, err := n.Memberships(ctx, uid)
+	if err != nil {
+		return Tenant{}, fmt.Errorf("account placement: %w", err)
+	}
+	switch len(ids) {
+	case 0:
+		return Tenant{}, fmt.Errorf("account placement: %w", ErrNoMembership)
+	case 1:
+		return n.Tenant(ctx, ids[0])
+	default:
+		return Tenant{}, fmt.Errorf("account placement: %w", ErrAmbiguousTenant)
+	}
+}
@@ -0,0 +1,49 @@
+package accounts
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gomoni/amble/internal/auth"
+	"github.com/gomoni/amble/internal/tid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTenants(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	// given a tenant configured as the default one
+	store := NewMemory()
+	pla, err := store.CreateTenant(ctx, "plainsof", "PLA")
+	require.NoError(t, err)
+	ddi, err := store.CreateTenant(ctx, "devdist", "DDI")
+	require.NoError(t, err)
+	store = store.WithDefaultTenant(pla.ID)
+
+	// when octocat signs up, then it is placed into the default tenant
+	octocat, err := store.SignIn(ctx, "github", "583231", auth.UserInfo{Name: "The Octocat"}, nil)
+	require.NoError(t, err)
+	tenant, err := store.Placement(ctx, octocat.UserID, "")
+	require.NoError(t, err)
+	require.Equal(t, pla, tenant)
+
+	// when an admin adds octocat to another tenant, then both are listed
+	require.NoError(t, store.AddMember(ctx, ddi.ID, octocat.UserID))
+	tenants, err := store.Tenants(ctx)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []Tenant{pla, ddi}, tenants)
+	members, err := store.Members(ctx, ddi.ID)
+	require.NoError(t, err)
+	require.Equal(t, []tid.UserID{octocat.UserID}, members)
+	_, err = store.Placement(ctx, octocat.UserID, "")
+	require.ErrorIs(t, err, ErrAmbiguousTenant)
+
+	// when removed from the tenant, then it is not a member anymore
+	require.NoError(t, store.RemoveMember(ctx, ddi.ID, octocat.UserID))
+	members, err = store.Members(ctx, ddi.ID)
+	require.NoError(t, err)
+	require.Empty(t, members)
+	err = store.SetDefaultTenant(ctx, octocat.UserID, ddi.ID)
+	require.ErrorIs(t, err, ErrNotMember)
+}
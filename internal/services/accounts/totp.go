@@ -0,0 +1,50 @@
+package accounts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/gomoni/amble/internal/auth/totp"
+	"github.com/gomoni/amble/internal/tid"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// TOTP returns the second factor record stored in `totp.$uid` key, fails
+// with totp.ErrNotEnrolled if there is none
+func (n Accounts) TOTP(ctx context.Context, uid tid.UserID) (totp.Record, error) {
+	entry, err := n.kv.Get(ctx, "totp."+uid.String())
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return totp.Record{}, fmt.Errorf("account totp: %w", totp.ErrNotEnrolled)
+	} else if err != nil {
+		return totp.Record{}, fmt.Errorf("account totp: %w", err)
+	}
+	var record totp.Record
+	err = json.Unmarshal(entry.Value(), &record)
+	if err != nil {
+		return totp.Record{}, fmt.Errorf("account totp: unmarshal: %w", err)
+	}
+	return record, nil
+}
+
+// UpdateTOTP changes the record by merge, which is called again with a fresh
+// record if a concurrent write wins. Counters and recovery codes are checked
+// in merge, so racing requests never use the same code twice.
+func (n Accounts) UpdateTOTP(ctx context.Context, uid tid.UserID, merge func(current totp.Record, exists bool) (totp.Record, error)) (totp.Record, error) {
+	record, _, err := updateJSON(ctx, n.kv, "totp."+uid.String(), merge)
+	if err != nil {
+		return totp.Record{}, fmt.Errorf("account update totp: %w", err)
+	}
+	return record, nil
+}
+
+// DeleteTOTP removes the second factor, it fails if a concurrent write changed
+// the record
+func (n Accounts) DeleteTOTP(ctx context.Context, uid tid.UserID) error {
+	err := deleteRead(ctx, n.kv, "totp."+uid.String())
+	if err != nil {
+		return fmt.Errorf("account delete totp: %w", err)
+	}
+	return nil
+}
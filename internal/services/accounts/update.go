@@ -0,0 +1,207 @@
+package accounts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/gomoni/amble/internal/auth"
+	"github.com/gomoni/amble/internal/auth/email"
+	"github.com/gomoni/amble/internal/tid"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// UpdateAttempts is how many times a read-modify-write is tried before
+// ConflictError is returned
+const UpdateAttempts = 8
+
+// ErrConflict matches ConflictError
+var ErrConflict = errors.New("update conflict")
+
+// ConflictError is returned when concurrent writers changed the key on every
+// attempt of an update
+type ConflictError struct {
+	Key      string
+	Attempts int
+	// Err is the last error of kv.Update
+	Err error
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s: key %s changed concurrently %d times: %v", ErrConflict, e.Key, e.Attempts, e.Err)
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+func (e *ConflictError) Unwrap() error {
+	return e.Err
+}
+
+// GetVersioned returns the account with the revision of its entry
+func (n Accounts) GetVersioned(ctx context.Context, uid tid.UserID) (auth.UserInfo, uint64, error) {
+	entry, err := n.kv.Get(ctx, "user_info."+uid.String()+".app")
+	if err != nil {
+		return auth.UserInfo{}, 0, fmt.Errorf("account get: %w", err)
+	}
+	userInfo, _, err := decodeAccount(entry.Value())
+	if err != nil {
+		return auth.UserInfo{}, 0, fmt.Errorf("account get: unmarshal user data: %w", err)
+	}
+	return userInfo, entry.Revision(), nil
+}
+
+// Update changes the account by merge. Merge gets the stored account and
+// is called again with a fresh one if a concurrent write wins, so it must
+// not have side effects. The user id can't be changed. A new verified email
+// is indexed before the write, it fails with EmailConflictError if another
+// account has it.
+func (n Accounts) Update(ctx context.Context, uid tid.UserID, merge func(auth.UserInfo) (auth.UserInfo, error)) (auth.UserInfo, error) {
+	var previous, userInfo auth.UserInfo
+	var claimed []string
+	// the record is written in the current schema version
+	_, err := update(ctx, n.kv, "user_info."+uid.String()+".app", func(b []byte, exists bool) ([]byte, error) {
+		if !exists {
+			return nil, jetstream.ErrKeyNotFound
+		}
+		current, _, err := decodeAccount(b)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal user data: %w", err)
+		}
+		previous = current
+		userInfo, err = merge(current)
+		if err != nil {
+			return nil, err
+		}
+		userInfo.UserID = uid
+		err = n.claimEmail(ctx, userInfo)
+		if err != nil {
+			return nil, err
+		}
+		if userInfo.EmailVerified {
+			claimed = append(claimed, userInfo.Email)
+		}
+		return encodeAccount(userInfo)
+	})
+
+	// release emails the stored account does not have
+	stored := previous
+	if err == nil {
+		stored = userInfo
+		claimed = append(claimed, previous.Email)
+	}
+	for _, address := range claimed {
+		if stored.EmailVerified && email.Normalize(address) == email.Normalize(stored.Email) {
+			continue
+		}
+		rerr := n.releaseEmail(ctx, uid, address)
+		if rerr != nil {
+			err = errors.Join(err, fmt.Errorf("release email: %w", rerr))
+		}
+	}
+	if err != nil {
+		return auth.UserInfo{}, fmt.Errorf("account update: %w", err)
+	}
+	return userInfo, nil
+}
+
+// update is a read-modify-write of a key. The new value is written by
+// kv.Update with the revision read, or kv.Create for a missing key, so
+// concurrent writes are never lost. Merge is retried with the fresh value
+// if the key changed meanwhile.
+func update(ctx context.Context, kv jetstream.KeyValue, key string, merge func(current []byte, exists bool) ([]byte, error)) (uint64, error) {
+	var conflict error
+	for attempt := range UpdateAttempts {
+		if attempt > 0 {
+			err := backoff(ctx, attempt, conflict)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		var current []byte
+		var revision uint64
+		entry, err := kv.Get(ctx, key)
+		exists := err == nil
+		if exists {
+			current = entry.Value()
+			revision = entry.Revision()
+		} else if !errors.Is(err, jetstream.ErrKeyNotFound) {
+			return 0, err
+		}
+
+		next, err := merge(current, exists)
+		if err != nil {
+			return 0, err
+		}
+		var rev uint64
+		if exists {
+			rev, err = kv.Update(ctx, key, next, revision)
+		} else {
+			rev, err = kv.Create(ctx, key, next)
+		}
+		// wrong last sequence, key was changed meanwhile
+		if errors.Is(err, jetstream.ErrKeyExists) {
+			conflict = err
+			continue
+		}
+		return rev, err
+	}
+	return 0, &ConflictError{Key: key, Attempts: UpdateAttempts, Err: conflict}
+}
+
+// updateJSON is update of a json encoded value
+func updateJSON[T any](ctx context.Context, kv jetstream.KeyValue, key string, merge func(current T, exists bool) (T, error)) (T, uint64, error) {
+	var next T
+	rev, err := update(ctx, kv, key, func(b []byte, exists bool) ([]byte, error) {
+		var current T
+		if exists {
+			err := json.Unmarshal(b, &current)
+			if err != nil {
+				return nil, fmt.Errorf("unmarshal %s: %w", key, err)
+			}
+		}
+		var err error
+		next, err = merge(current, exists)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(next)
+	})
+	if err != nil {
+		var zero T
+		return zero, 0, err
+	}
+	return next, rev, nil
+}
+
+// deleteRead deletes the key with the revision read, so a value written
+// concurrently is never deleted unseen. A missing key is not an error.
+func deleteRead(ctx context.Context, kv jetstream.KeyValue, key string) error {
+	entry, err := kv.Get(ctx, key)
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return kv.Delete(ctx, key, jetstream.LastRevision(entry.Revision()))
+}
+
+// backoff waits a jittered time growing with attempts, so the writers racing
+// for the same key spread out. It returns the last error if ctx is done.
+func backoff(ctx context.Context, attempt int, last error) error {
+	d := time.Duration(attempt) * time.Millisecond
+	d += rand.N(d)
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return errors.Join(ctx.Err(), last)
+	}
+}
@@ -0,0 +1,163 @@
+package accounts
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/gomoni/amble/internal/auth"
+	"github.com/gomoni/amble/internal/tid"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdate(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	kv := newMemoryKV("accounts", 1)
+	increment := func(current int, _ bool) (int, error) {
+		return current + 1, nil
+	}
+
+	// when writers race for the key
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var updated int
+	var errs []error
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				_, _, err := updateJSON(ctx, kv, "counter", increment)
+				mu.Lock()
+				if err == nil {
+					updated++
+				} else if !errors.Is(err, ErrConflict) {
+					errs = append(errs, err)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	require.Empty(t, errs)
+
+	// then no update is lost
+	counter, _, err := updateJSON(ctx, kv, "counter", func(current int, _ bool) (int, error) {
+		return current, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, updated, counter)
+
+	// when the key changes on every attempt, then retries run out
+	_, _, err = updateJSON(ctx, kv, "counter", func(current int, _ bool) (int, error) {
+		_, err := kv.Put(ctx, "counter", []byte("0"))
+		return current + 1, err
+	})
+	require.ErrorIs(t, err, ErrConflict)
+	var conflict *ConflictError
+	require.ErrorAs(t, err, &conflict)
+	require.Equal(t, "counter", conflict.Key)
+	require.Equal(t, UpdateAttempts, conflict.Attempts)
+	require.ErrorIs(t, err, jetstream.ErrKeyExists)
+}
+
+// racingKV writes the key right after it was read
+type racingKV struct {
+	jetstream.KeyValue
+}
+
+func (kv racingKV) Get(ctx context.Context, key string) (jetstream.KeyValueEntry, error) {
+	entry, err := kv.KeyValue.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	_, err = kv.Put(ctx, key, []byte("changed"))
+	return entry, err
+}
+
+func TestDeleteRead(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	kv := newMemoryKV("accounts", 1)
+
+	// when the key is missing, then there is nothing to delete
+	require.NoError(t, deleteRead(ctx, kv, "suspended.missing"))
+
+	// when the key was read, then it is deleted
+	_, err := kv.Put(ctx, "suspended.x", []byte("{}"))
+	require.NoError(t, err)
+	require.NoError(t, deleteRead(ctx, kv, "suspended.x"))
+	_, err = kv.Get(ctx, "suspended.x")
+	require.ErrorIs(t, err, jetstream.ErrKeyNotFound)
+
+	// when the key changes after it was read, then the new value is kept
+	_, err = kv.Put(ctx, "suspended.x", []byte("{}"))
+	require.NoError(t, err)
+	require.Error(t, deleteRead(ctx, racingKV{kv}, "suspended.x"))
+	entry, err := kv.Get(ctx, "suspended.x")
+	require.NoError(t, err)
+	require.Equal(t, "changed", string(entry.Value()))
+}
+
+func TestAccountsUpdate(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewMemory()
+	uid, err := store.Create(ctx, auth.UserInfo{Name: "Octocat"})
+	require.NoError(t, err)
+	_, rev, err := store.GetVersioned(ctx, uid)
+	require.NoError(t, err)
+
+	// when the account is updated, then revision changes and id is kept
+	account, err := store.Update(ctx, uid, func(current auth.UserInfo) (auth.UserInfo, error) {
+		current.Name = "The Octocat"
+		current.UserID = tid.UserID{}
+		return current, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, uid, account.UserID)
+	stored, rev2, err := store.GetVersioned(ctx, uid)
+	require.NoError(t, err)
+	require.Equal(t, account, stored)
+	require.Greater(t, rev2, rev)
+
+	// missing accounts are not created
+	other, err := tid.NewUserID()
+	require.NoError(t, err)
+	_, err = store.Update(ctx, other, func(current auth.UserInfo) (auth.UserInfo, error) {
+		return current, nil
+	})
+	require.ErrorIs(t, err, jetstream.ErrKeyNotFound)
+}
+
+func TestSignInRace(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewMemory()
+
+	// when first logins race, then all of them get the same account
+	var wg sync.WaitGroup
+	uids := make([]tid.UserID, 8)
+	errs := make([]error, len(uids))
+	for i := range uids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			account, err := store.SignIn(ctx, "github", "583231", auth.UserInfo{Name: "Octocat"}, nil)
+			uids[i], errs[i] = account.UserID, err
+		}()
+	}
+	wg.Wait()
+	for i, uid := range uids {
+		require.NoError(t, errs[i])
+		require.Equal(t, uids[0], uid)
+	}
+
+	// and the losers' accounts are dropped
+	keys, err := watchKeys(ctx, store.kv, "user_info.*.app", jetstream.IgnoreDeletes())
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+}
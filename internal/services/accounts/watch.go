@@ -0,0 +1,286 @@
+package accounts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gomoni/amble/internal/auth"
+	"github.com/gomoni/amble/internal/tid"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// ErrWatchClosed is yielded when the watcher stops before the context is
+// done, like on a lost connection. Watch again from the next revision.
+var ErrWatchClosed = errors.New("account watch closed")
+
+type EventType string
+
+const (
+	EventCreated        EventType = "created"
+	EventProfileUpdated EventType = "profile_updated"
+	EventLinked         EventType = "linked"
+	EventUnlinked       EventType = "unlinked"
+	EventDeleted        EventType = "deleted"
+	// EventStatusChanged is a change of a suspension, a revocation, an
+	// approval, a deletion or an erasure of the account
+	EventStatusChanged    EventType = "status_changed"
+	EventPlanChanged      EventType = "plan_changed"
+	EventPlacementChanged EventType = "placement_changed"
+)
+
+// Event is a change of an account. Revision is the revision of the entry in
+// the bucket, it grows with every change.
+type Event struct {
+	Type     EventType  `json:"type"`
+	UserID   tid.UserID `json:"uid"`
+	Revision uint64     `json:"revision"`
+	Time     time.Time  `json:"time"`
+	// Provider is the login provider of a link or a profile, `app` for the
+	// account itself
+	Provider string `json:"provider,omitempty"`
+	// ID is the provider id of a link, the name of a plan or the tenant id of
+	// a placement
+	ID string `json:"id,omitempty"`
+	// Account is set for created and profile updated by `app`
+	Account *auth.UserInfo `json:"account,omitempty"`
+	// Profile is the raw user info of the provider
+	Profile json.RawMessage `json:"profile,omitempty"`
+}
+
+// WatchFilter selects the events. Zero values mean no filter.
+type WatchFilter struct {
+	UserID tid.UserID
+	Types  []EventType
+	// FromRevision replays the changes from the revision on, pass the
+	// revision of the last event plus one to resume. Zero watches new
+	// changes only.
+	FromRevision uint64
+}
+
+// Watch yields changes of accounts and links of their logins until ctx is
+// done. Decoding errors are yielded and the watch continues, ErrWatchClosed
+// ends it.
+func (n Accounts) Watch(ctx context.Context, filter WatchFilter) iter.Seq2[Event, error] {
+	return func(yield func(Event, error) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		f := feed{
+			filter:   filter,
+			accounts: make(map[string]bool),
+			links:    make(map[string]string),
+		}
+		var opts []jetstream.WatchOpt
+		live := filter.FromRevision == 0
+		if !live {
+			err := f.seed(ctx, n.kv, filter.FromRevision)
+			if err != nil {
+				yield(Event{}, fmt.Errorf("account watch: %w", err))
+				return
+			}
+			opts = append(opts, jetstream.ResumeFromRevision(filter.FromRevision))
+		}
+		// a single watcher keeps the order of revisions across the key prefixes
+		w, err := n.kv.Watch(ctx, ">", opts...)
+		if err != nil {
+			yield(Event{}, fmt.Errorf("account watch: %w", err))
+			return
+		}
+		defer func() { _ = w.Stop() }()
+
+		// initial values of a live watch are the current state
+		seeding := live
+		for {
+			var entry jetstream.KeyValueEntry
+			var ok bool
+			select {
+			case <-ctx.Done():
+				return
+			case entry, ok = <-w.Updates():
+			}
+			if !ok {
+				if ctx.Err() == nil {
+					yield(Event{}, ErrWatchClosed)
+				}
+				return
+			}
+			// nil entry marks all initial values were delivered
+			if entry == nil {
+				seeding = false
+				continue
+			}
+			if seeding {
+				f.track(entry)
+				continue
+			}
+			event, ok, err := f.event(entry)
+			if err != nil {
+				if !yield(Event{}, fmt.Errorf("account watch: %s: %w", entry.Key(), err)) {
+					return
+				}
+				continue
+			}
+			if ok && f.matches(event) && !yield(event, nil) {
+				return
+			}
+		}
+	}
+}
+
+// feed tracks existing accounts and owners of links, so it can tell created
+// from updated and whose link was deleted
+type feed struct {
+	filter WatchFilter
+	// accounts are user ids with `user_info.$uid.app`
+	accounts map[string]bool
+	// links are `auth_link` keys and their user ids
+	links map[string]string
+	// before is the time of the last entry before a replay
+	before time.Time
+}
+
+// seed tracks the state before the revision of a replay
+func (f *feed) seed(ctx context.Context, kv jetstream.KeyValue, revision uint64) error {
+	entries, err := WatchEntries(ctx, kv, ">", jetstream.IgnoreDeletes())
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Revision() >= revision {
+			continue
+		}
+		f.track(entry)
+		if entry.Created().After(f.before) {
+			f.before = entry.Created()
+		}
+	}
+	return nil
+}
+
+// track records the state without an event
+func (f *feed) track(entry jetstream.KeyValueEntry) {
+	_, _, _ = f.event(entry)
+}
+
+// event decodes the entry and updates the state, ok is false for entries
+// without an event
+func (f *feed) event(entry jetstream.KeyValueEntry) (Event, bool, error) {
+	event := Event{Revision: entry.Revision(), Time: entry.Created()}
+	put := entry.Operation() == jetstream.KeyValuePut
+	parts := strings.SplitN(entry.Key(), ".", 3)
+	if len(parts) < 2 {
+		return Event{}, false, nil
+	}
+	switch parts[0] {
+	case "erased", "deletion", "suspended", "revoked", "approval":
+		// $status.$uid
+		event.Type = EventStatusChanged
+		return userEvent(event, parts[1])
+	case "user_plan":
+		// user_plan.$uid -> $name
+		event.Type = EventPlanChanged
+		return userEvent(event, parts[1])
+	case "plan":
+		// plan.$name
+		event.Type = EventPlanChanged
+		event.ID = parts[1]
+		return event, true, nil
+	case "member", "default_tenant":
+		// member.$uid.$tenant_id or default_tenant.$uid
+		event.Type = EventPlacementChanged
+		if len(parts) == 3 {
+			event.ID = parts[2]
+		}
+		return userEvent(event, parts[1])
+	case "tenant":
+		// tenant.$tenant_id
+		event.Type = EventPlacementChanged
+		event.ID = parts[1]
+		return event, true, nil
+	case "user_info":
+		if len(parts) != 3 {
+			return Event{}, false, nil
+		}
+		// user_info.$uid.$provider
+		uid, err := tid.ParseUserID(parts[1])
+		if err != nil {
+			return Event{}, false, fmt.Errorf("parse user id: %w", err)
+		}
+		event.UserID = uid
+		event.Provider = parts[2]
+		if event.Provider != "app" {
+			if !put {
+				return Event{}, false, nil
+			}
+			event.Type = EventProfileUpdated
+			event.Profile = json.RawMessage(entry.Value())
+			return event, true, nil
+		}
+		if !put {
+			delete(f.accounts, parts[1])
+			event.Type = EventDeleted
+			return event, true, nil
+		}
+		account, _, err := decodeAccount(entry.Value())
+		if err != nil {
+			return Event{}, false, fmt.Errorf("unmarshal: %w", err)
+		}
+		event.Account = &account
+		event.Type = EventProfileUpdated
+		// an account not seen yet is new unless it is older than a replay,
+		// user ids have a millisecond precision
+		if !f.accounts[parts[1]] && !uid.CreatedAt().Before(f.before.Truncate(time.Millisecond)) {
+			event.Type = EventCreated
+		}
+		f.accounts[parts[1]] = true
+		return event, true, nil
+	case "auth_link":
+		// auth_link.$provider.$id -> $uid
+		if len(parts) != 3 {
+			return Event{}, false, nil
+		}
+		event.Provider = parts[1]
+		event.ID = parts[2]
+		value := f.links[entry.Key()]
+		if put {
+			value = string(entry.Value())
+			f.links[entry.Key()] = value
+			event.Type = EventLinked
+		} else {
+			delete(f.links, entry.Key())
+			event.Type = EventUnlinked
+		}
+		if value != "" {
+			uid, err := tid.ParseUserID(value)
+			if err != nil {
+				return Event{}, false, fmt.Errorf("parse user id: %w", err)
+			}
+			event.UserID = uid
+		}
+		return event, true, nil
+	}
+	return Event{}, false, nil
+}
+
+// userEvent returns the event of the user
+func userEvent(event Event, uid string) (Event, bool, error) {
+	var err error
+	event.UserID, err = tid.ParseUserID(uid)
+	if err != nil {
+		return Event{}, false, fmt.Errorf("parse user id: %w", err)
+	}
+	return event, true, nil
+}
+
+func (f *feed) matches(event Event) bool {
+	if !f.filter.UserID.IsZero() && f.filter.UserID != event.UserID {
+		return false
+	}
+	return len(f.filter.Types) == 0 || slices.Contains(f.filter.Types, event.Type)
+}
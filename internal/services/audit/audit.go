@@ -0,0 +1,245 @@
+/*
+Package audit records authentication events into a dedicated JetStream stream.
+
+Events are published to `audit.$uid.$type` subjects, so the stream can be
+filtered by a user without reading all the events. Events without a known
+user (like failed logins) are published to `audit.anonymous.$type`.
+*/
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gomoni/amble/internal/tid"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	StreamName = "AUDIT"
+	anonymous  = "anonymous"
+)
+
+type Type string
+
+const (
+	LoginSuccess  Type = "login_success"
+	LoginFailure  Type = "login_failure"
+	CalloutAccept Type = "callout_accept"
+	CalloutReject Type = "callout_reject"
+	Logout        Type = "logout"
+	Revocation    Type = "revocation"
+
+	ImpersonationStart   Type = "impersonation_start"
+	ImpersonationStop    Type = "impersonation_stop"
+	ImpersonationRefused Type = "impersonation_refused"
+	ImpersonationAction  Type = "impersonation_action"
+
+	DeletionRequest Type = "deletion_request"
+	DeletionCancel  Type = "deletion_cancel"
+	Erasure         Type = "erasure"
+
+	StatusChange Type = "status_change"
+
+	TenantCreate Type = "tenant_create"
+	MemberAdd    Type = "member_add"
+	MemberRemove Type = "member_remove"
+
+	PlanPut    Type = "plan_put"
+	PlanAssign Type = "plan_assign"
+)
+
+// Event is a single record in the audit trail. Provider and Subject identifies
+// the IDP login, UserID is the linked amble user if known. Actor is the admin
+// user id acting on behalf of the user.
+type Event struct {
+	Time      time.Time  `json:"time"`
+	Type      Type       `json:"type"`
+	Provider  string     `json:"provider,omitempty"`
+	Subject   string     `json:"sub,omitempty"`
+	UserID    tid.UserID `json:"uid"`
+	IP        string     `json:"ip,omitempty"`
+	UserAgent string     `json:"user_agent,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	Actor     string     `json:"act,omitempty"`
+}
+
+// FromRequest returns an event with the client address and user agent of an
+// http request filled in
+func FromRequest(r *http.Request, typ Type) Event {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return Event{
+		Type:      typ,
+		IP:        ip,
+		UserAgent: r.UserAgent(),
+	}
+}
+
+func (e Event) subject() string {
+	uid := anonymous
+	if !e.UserID.IsZero() {
+		uid = e.UserID.String()
+	}
+	return "audit." + uid + "." + string(e.Type)
+}
+
+// StreamConfig is a configuration of a stream audit events are stored in
+func StreamConfig() jetstream.StreamConfig {
+	return jetstream.StreamConfig{
+		Name:     StreamName,
+		Subjects: []string{"audit.>"},
+	}
+}
+
+type Log struct {
+	js jetstream.JetStream
+}
+
+func NewNats(js jetstream.JetStream) Log {
+	return Log{js: js}
+}
+
+// Record publishes the event to the audit stream
+func (l Log) Record(ctx context.Context, e Event) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("audit record: marshal event: %w", err)
+	}
+	_, err = l.js.Publish(ctx, e.subject(), b)
+	if err != nil {
+		return fmt.Errorf("audit record: publish %s: %w", e.Type, err)
+	}
+	return nil
+}
+
+// Erase purges all events of the user from the stream, the trail of an erased
+// account must not keep its addresses and logins
+func (l Log) Erase(ctx context.Context, uid tid.UserID) error {
+	if uid.IsZero() {
+		return errors.New("audit erase: missing user id")
+	}
+	stream, err := l.js.Stream(ctx, StreamName)
+	if err != nil {
+		return fmt.Errorf("audit erase: get stream: %w", err)
+	}
+	err = stream.Purge(ctx, jetstream.WithPurgeSubject("audit."+uid.String()+".>"))
+	if err != nil {
+		return fmt.Errorf("audit erase: purge: %w", err)
+	}
+	return nil
+}
+
+// Query filters the audit trail. Zero values mean no filter.
+type Query struct {
+	UserID tid.UserID
+	Since  time.Time
+	Until  time.Time
+	Limit  int // return the Limit most recent events
+}
+
+// Query returns the events matching the query ordered from the oldest. The
+// events are fetched in batches and only the Limit most recent ones are kept.
+// The most recent events of all users are read from the end of the stream.
+func (l Log) Query(ctx context.Context, q Query) ([]Event, error) {
+	cfg := jetstream.ConsumerConfig{
+		FilterSubject:     "audit.>",
+		DeliverPolicy:     jetstream.DeliverAllPolicy,
+		AckPolicy:         jetstream.AckNonePolicy,
+		InactiveThreshold: time.Minute,
+	}
+	if !q.UserID.IsZero() {
+		cfg.FilterSubject = "audit." + q.UserID.String() + ".>"
+	}
+	if !q.Since.IsZero() {
+		cfg.DeliverPolicy = jetstream.DeliverByStartTimePolicy
+		cfg.OptStartTime = &q.Since
+	}
+	stream, err := l.js.Stream(ctx, StreamName)
+	if err != nil {
+		return nil, fmt.Errorf("audit query: get stream: %w", err)
+	}
+	// every message of the stream matches, so the last Limit ones are the
+	// most recent, older ones than Since are skipped below. Erased events
+	// leave gaps in the sequence.
+	state := stream.CachedInfo().State
+	if q.UserID.IsZero() && q.Until.IsZero() && q.Limit > 0 && state.Msgs > uint64(q.Limit) {
+		cfg.DeliverPolicy = jetstream.DeliverByStartSequencePolicy
+		cfg.OptStartTime = nil
+		cfg.OptStartSeq = state.FirstSeq
+		if back := uint64(q.Limit) + uint64(state.NumDeleted); state.LastSeq-state.FirstSeq >= back {
+			cfg.OptStartSeq = state.LastSeq - back + 1
+		}
+	}
+	cons, err := stream.CreateConsumer(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("audit query: create consumer: %w", err)
+	}
+	defer func() {
+		_ = stream.DeleteConsumer(context.Background(), cons.CachedInfo().Name)
+	}()
+
+	events := make([]Event, 0)
+	pending := cons.CachedInfo().NumPending
+	for pending > 0 {
+		batch, err := cons.Fetch(int(min(pending, queryBatch)), jetstream.FetchMaxWait(5*time.Second))
+		if err != nil {
+			return nil, fmt.Errorf("audit query: fetch events: %w", err)
+		}
+		fetched := 0
+		for msg := range batch.Messages() {
+			fetched++
+			meta, err := msg.Metadata()
+			if err != nil {
+				return nil, fmt.Errorf("audit query: event metadata: %w", err)
+			}
+			pending = meta.NumPending
+			if !q.Until.IsZero() && meta.Timestamp.After(q.Until) {
+				return keepLast(events, q.Limit), nil
+			}
+			if !q.Since.IsZero() && meta.Timestamp.Before(q.Since) {
+				continue
+			}
+			var e Event
+			err = json.Unmarshal(msg.Data(), &e)
+			if err != nil {
+				return nil, fmt.Errorf("audit query: unmarshal event %d: %w", meta.Sequence.Stream, err)
+			}
+			events = append(events, e)
+			// keep at most twice the limit in memory
+			if q.Limit > 0 && len(events) >= 2*q.Limit {
+				events = append(events[:0], events[len(events)-q.Limit:]...)
+			}
+		}
+		if err := batch.Error(); err != nil && !errors.Is(err, nats.ErrTimeout) {
+			return nil, fmt.Errorf("audit query: fetch events: %w", err)
+		}
+		if fetched == 0 {
+			// events expired meanwhile
+			break
+		}
+	}
+	return keepLast(events, q.Limit), nil
+}
+
+// queryBatch is the number of events fetched at once by Query
+const queryBatch = 256
+
+// keepLast returns the limit last events, all of them for zero limit
+func keepLast(events []Event, limit int) []Event {
+	if limit > 0 && len(events) > limit {
+		return events[len(events)-limit:]
+	}
+	return events
+}
@@ -0,0 +1,96 @@
+package audit_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gomoni/amble/internal/services/audit"
+	"github.com/gomoni/amble/internal/test"
+	"github.com/gomoni/amble/internal/tid"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAudit(t *testing.T) {
+	server, err := test.NewNatsContainer(context.Background(), test.NatsContainerOpts{})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := server.Terminate()
+		require.NoError(t, err)
+	})
+
+	nc, err := nats.Connect(server.Endpoint())
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	js, err := jetstream.New(nc)
+	require.NoError(t, err)
+	_, err = js.CreateStream(ctx, audit.StreamConfig())
+	require.NoError(t, err)
+	log := audit.NewNats(js)
+
+	// empty stream returns no events
+	events, err := log.Query(ctx, audit.Query{})
+	require.NoError(t, err)
+	require.Empty(t, events)
+
+	octocat, err := tid.NewUserID()
+	require.NoError(t, err)
+	hubot, err := tid.NewUserID()
+	require.NoError(t, err)
+
+	// given there are events for two users and an anonymous failure
+	start := time.Now().UTC()
+	for _, e := range []audit.Event{
+		{Type: audit.LoginFailure, Provider: "github", Reason: "code exchange failed"},
+		{Type: audit.LoginSuccess, Provider: "github", Subject: "583231", UserID: octocat, IP: "192.0.2.1"},
+		{Type: audit.CalloutAccept, Provider: "github", Subject: "583231", UserID: octocat},
+		{Type: audit.LoginSuccess, Provider: "github", Subject: "42", UserID: hubot},
+		{Type: audit.Logout, UserID: octocat},
+	} {
+		err = log.Record(ctx, e)
+		require.NoError(t, err)
+	}
+
+	// when all events are queried
+	events, err = log.Query(ctx, audit.Query{})
+	require.NoError(t, err)
+	require.Len(t, events, 5)
+	require.Equal(t, audit.LoginFailure, events[0].Type)
+	require.True(t, events[0].UserID.IsZero())
+	require.False(t, events[0].Time.Before(start.Truncate(time.Second)))
+
+	// when events are filtered by user
+	events, err = log.Query(ctx, audit.Query{UserID: octocat})
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	for _, e := range events {
+		require.Equal(t, octocat, e.UserID)
+	}
+	require.Equal(t, "192.0.2.1", events[0].IP)
+
+	// when limited, the most recent events are returned
+	events, err = log.Query(ctx, audit.Query{UserID: octocat, Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, audit.Logout, events[0].Type)
+
+	// when all events are limited, the most recent ones are returned
+	events, err = log.Query(ctx, audit.Query{Limit: 2})
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	require.Equal(t, audit.LoginSuccess, events[0].Type)
+	require.Equal(t, hubot, events[0].UserID)
+	require.Equal(t, audit.Logout, events[1].Type)
+
+	// when events are filtered by time range
+	events, err = log.Query(ctx, audit.Query{Since: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+	require.Empty(t, events)
+	events, err = log.Query(ctx, audit.Query{Since: start.Add(-time.Hour), Until: start.Add(-time.Minute)})
+	require.NoError(t, err)
+	require.Empty(t, events)
+}
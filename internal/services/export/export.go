@@ -0,0 +1,534 @@
+/*
+Package export builds a personal data export of a user account.
+
+  - user requests an export, a pending job is stored to `export.$uid.$job_id`
+  - Run picks pending jobs up, collects the account data and the audit trail
+    of the user into a versioned Document and stores the file in an object
+    store under the job key
+  - the user downloads the file by a link signed by amble, the link and the
+    file expire after LinkTTL
+
+Both buckets are expected to have LinkTTL as TTL, see KeyValueConfig and
+ObjectStoreConfig.
+
+Web sessions are stateless tokens, so they are exported as login, logout and
+revocation events of the audit trail. Registered devices are the only records
+of user's hosts.
+*/
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gomoni/amble/internal/auth"
+	"github.com/gomoni/amble/internal/auth/jwt"
+	"github.com/gomoni/amble/internal/services/accounts"
+	"github.com/gomoni/amble/internal/services/audit"
+	"github.com/gomoni/amble/internal/tid"
+
+	gojwt "github.com/golang-jwt/jwt/v5"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	// Version of the Document, increased on incompatible changes
+	Version = 1
+	// LinkTTL is how long the download link and the file are valid
+	LinkTTL = 24 * time.Hour
+	// Issuer of download links, the subject is the user id
+	Issuer = "export"
+	// RunTimeout is how long a job can be running, older ones were
+	// interrupted and are marked failed
+	RunTimeout = 15 * time.Minute
+
+	Bucket       = "exports"
+	linkAudience = "export_download"
+	documentName = "export.json"
+)
+
+var (
+	// ErrInProgress is returned when the user has an export being built
+	ErrInProgress = errors.New("export in progress")
+	// ErrInvalidFormat is returned for an unknown format
+	ErrInvalidFormat = errors.New("invalid export format")
+	// ErrNotReady is returned for a download of an export not built yet
+	ErrNotReady = errors.New("export not ready")
+)
+
+type Format string
+
+const (
+	FormatJSON Format = "json"
+	FormatZip  Format = "zip"
+)
+
+type Status string
+
+const (
+	StatusPending Status = "pending"
+	StatusRunning Status = "running"
+	StatusReady   Status = "ready"
+	StatusFailed  Status = "failed"
+)
+
+// Document is the exported data. PersonalData fields are inlined.
+type Document struct {
+	Version    int        `json:"version"`
+	ExportedAt time.Time  `json:"exported_at"`
+	UserID     tid.UserID `json:"uid"`
+	accounts.PersonalData
+	Audit []audit.Event `json:"audit"`
+}
+
+// Job is a requested export
+type Job struct {
+	ID          string     `json:"id"`
+	UserID      tid.UserID `json:"uid"`
+	Format      Format     `json:"format"`
+	Status      Status     `json:"status"`
+	RequestedAt time.Time  `json:"requested_at"`
+	DoneAt      time.Time  `json:"done_at"`
+	Size        uint64     `json:"size,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+func (j Job) key() string {
+	return "export." + j.UserID.String() + "." + j.ID
+}
+
+// Filename is the name of the downloaded file
+func (j Job) Filename() string {
+	return "amble-" + j.UserID.String() + "." + string(j.Format)
+}
+
+type Accounts interface {
+	PersonalData(ctx context.Context, uid tid.UserID) (accounts.PersonalData, error)
+}
+
+type Auditor interface {
+	Query(ctx context.Context, q audit.Query) ([]audit.Event, error)
+}
+
+type Encoder interface {
+	Encode(jwt.Claims) (string, error)
+}
+
+type Decoder interface {
+	Decode(string) (jwt.Claims, error)
+}
+
+type Service struct {
+	jobs       jetstream.KeyValue
+	files      jetstream.ObjectStore
+	accounts   Accounts
+	auditor    Auditor
+	jwtEncoder Encoder
+	jwtDecoder Decoder
+	runTimeout time.Duration
+}
+
+// NewService returns a service storing jobs to the key value bucket and
+// files to the object store
+func NewService(jobs jetstream.KeyValue, files jetstream.ObjectStore, accounts Accounts, auditor Auditor, encoder Encoder, decoder Decoder) Service {
+	return Service{
+		jobs:       jobs,
+		files:      files,
+		accounts:   accounts,
+		auditor:    auditor,
+		jwtEncoder: encoder,
+		jwtDecoder: decoder,
+		runTimeout: RunTimeout,
+	}
+}
+
+// WithRunTimeout returns a service, which marks jobs running longer than
+// timeout failed
+func (s Service) WithRunTimeout(timeout time.Duration) Service {
+	s.runTimeout = timeout
+	return s
+}
+
+// KeyValueConfig is a configuration of a bucket jobs are stored in
+func KeyValueConfig() jetstream.KeyValueConfig {
+	return jetstream.KeyValueConfig{
+		Bucket: Bucket,
+		TTL:    LinkTTL,
+	}
+}
+
+// ObjectStoreConfig is a configuration of a bucket files are stored in
+func ObjectStoreConfig() jetstream.ObjectStoreConfig {
+	return jetstream.ObjectStoreConfig{
+		Bucket: Bucket,
+		TTL:    LinkTTL,
+	}
+}
+
+// Request stores a pending export of the user. It fails with ErrInProgress if
+// there is a pending or running one.
+func (s Service) Request(ctx context.Context, uid tid.UserID, format Format) (Job, error) {
+	if format != FormatJSON && format != FormatZip {
+		return Job{}, fmt.Errorf("export request: %w %q", ErrInvalidFormat, format)
+	}
+	jobs, err := s.Jobs(ctx, uid)
+	if err != nil {
+		return Job{}, fmt.Errorf("export request: %w", err)
+	}
+	for _, job := range jobs {
+		if job.Status == StatusPending || job.Status == StatusRunning {
+			return Job{}, fmt.Errorf("export request: %w", ErrInProgress)
+		}
+	}
+
+	id, err := newID()
+	if err != nil {
+		return Job{}, fmt.Errorf("export request: generate id: %w", err)
+	}
+	job := Job{
+		ID:          id,
+		UserID:      uid,
+		Format:      format,
+		Status:      StatusPending,
+		RequestedAt: time.Now().UTC(),
+	}
+	b, err := json.Marshal(job)
+	if err != nil {
+		return Job{}, fmt.Errorf("export request: marshal: %w", err)
+	}
+	_, err = s.jobs.Create(ctx, job.key(), b)
+	if err != nil {
+		return Job{}, fmt.Errorf("export request: %w", err)
+	}
+	return job, nil
+}
+
+// Job returns the export of the user
+func (s Service) Job(ctx context.Context, uid tid.UserID, id string) (Job, error) {
+	job, _, err := s.job(ctx, Job{ID: id, UserID: uid}.key())
+	if err != nil {
+		return Job{}, fmt.Errorf("export job: %w", err)
+	}
+	return job, nil
+}
+
+// Jobs returns the exports of the user, newest first
+func (s Service) Jobs(ctx context.Context, uid tid.UserID) ([]Job, error) {
+	entries, err := accounts.WatchEntries(ctx, s.jobs, "export."+uid.String()+".*", jetstream.IgnoreDeletes())
+	if err != nil {
+		return nil, fmt.Errorf("export jobs: %w", err)
+	}
+
+	jobs := make([]Job, 0)
+	for _, entry := range entries {
+		var job Job
+		err = json.Unmarshal(entry.Value(), &job)
+		if err != nil {
+			return nil, fmt.Errorf("export jobs: unmarshal %s: %w", entry.Key(), err)
+		}
+		jobs = append(jobs, job)
+	}
+	slices.SortFunc(jobs, func(a, b Job) int {
+		return b.RequestedAt.Compare(a.RequestedAt)
+	})
+	return jobs, nil
+}
+
+// Build collects the data of the user
+func (s Service) Build(ctx context.Context, uid tid.UserID) (Document, error) {
+	data, err := s.accounts.PersonalData(ctx, uid)
+	if err != nil {
+		return Document{}, fmt.Errorf("export build: %w", err)
+	}
+	events, err := s.auditor.Query(ctx, audit.Query{UserID: uid})
+	if err != nil {
+		return Document{}, fmt.Errorf("export build: %w", err)
+	}
+	return Document{
+		Version:      Version,
+		ExportedAt:   time.Now().UTC(),
+		UserID:       uid,
+		PersonalData: data,
+		Audit:        events,
+	}, nil
+}
+
+// Write encodes the document as json or as a zip archive with the json inside
+func Write(w io.Writer, doc Document, format Format) error {
+	switch format {
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(doc)
+	case FormatZip:
+		zw := zip.NewWriter(w)
+		f, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     documentName,
+			Method:   zip.Deflate,
+			Modified: doc.ExportedAt,
+		})
+		if err != nil {
+			return err
+		}
+		err = Write(f, doc, FormatJSON)
+		if err != nil {
+			return err
+		}
+		return zw.Close()
+	default:
+		return fmt.Errorf("%w %q", ErrInvalidFormat, format)
+	}
+}
+
+// Run builds pending exports until the context is done. Jobs are claimed by
+// a revision check, so several instances can run at once. Jobs left running
+// by a crashed instance are marked failed after the run timeout, on start and
+// by a periodic check, so the user can request the export again.
+func (s Service) Run(ctx context.Context) error {
+	w, err := s.jobs.Watch(ctx, "export.*.*", jetstream.IgnoreDeletes())
+	if err != nil {
+		return fmt.Errorf("export run: watch: %w", err)
+	}
+	defer func() { _ = w.Stop() }()
+	ticker := time.NewTicker(max(s.runTimeout, time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			entries, err := accounts.WatchEntries(ctx, s.jobs, "export.*.*", jetstream.IgnoreDeletes())
+			if err != nil {
+				log.Printf("export run: %s", err)
+				continue
+			}
+			for _, entry := range entries {
+				err = s.runJob(ctx, entry)
+				if err != nil {
+					log.Printf("export %s: %s", entry.Key(), err)
+				}
+			}
+		case entry, ok := <-w.Updates():
+			if !ok {
+				return nil
+			}
+			// nil entry marks all initial values were delivered
+			if entry == nil {
+				continue
+			}
+			err = s.runJob(ctx, entry)
+			if err != nil {
+				log.Printf("export %s: %s", entry.Key(), err)
+			}
+		}
+	}
+}
+
+// runJob builds the export if the entry is a pending job and fails the job
+// running longer than the run timeout
+func (s Service) runJob(ctx context.Context, entry jetstream.KeyValueEntry) error {
+	var job Job
+	err := json.Unmarshal(entry.Value(), &job)
+	if err != nil {
+		return fmt.Errorf("unmarshal: %w", err)
+	}
+	if job.Status == StatusRunning && time.Since(entry.Created()) > s.runTimeout {
+		job.Status = StatusFailed
+		job.Error = "interrupted"
+		job.DoneAt = time.Now().UTC()
+		_, err = s.putJob(ctx, job, entry.Revision())
+		if err != nil && !errors.Is(err, jetstream.ErrKeyExists) {
+			return fmt.Errorf("fail interrupted: %w", err)
+		}
+		return nil
+	}
+	if job.Status != StatusPending {
+		return nil
+	}
+	job.Status = StatusRunning
+	revision, err := s.putJob(ctx, job, entry.Revision())
+	if errors.Is(err, jetstream.ErrKeyExists) {
+		// claimed by someone else
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("claim: %w", err)
+	}
+
+	size, err := s.store(ctx, job)
+	job.DoneAt = time.Now().UTC()
+	if err != nil {
+		job.Status = StatusFailed
+		job.Error = err.Error()
+	} else {
+		job.Status = StatusReady
+		job.Size = size
+	}
+	_, err = s.putJob(ctx, job, revision)
+	if err != nil {
+		return fmt.Errorf("update: %w", err)
+	}
+	return nil
+}
+
+// Erase deletes the jobs and the files of the user
+func (s Service) Erase(ctx context.Context, uid tid.UserID) error {
+	prefix := "export." + uid.String() + "."
+	entries, err := accounts.WatchEntries(ctx, s.jobs, prefix+"*")
+	if err != nil {
+		return fmt.Errorf("export erase: %w", err)
+	}
+	for _, entry := range entries {
+		err = s.jobs.Purge(ctx, entry.Key())
+		if err != nil {
+			return fmt.Errorf("export erase: purge %s: %w", entry.Key(), err)
+		}
+	}
+	// files may outlive their jobs
+	files, err := s.files.List(ctx)
+	if errors.Is(err, jetstream.ErrNoObjectsFound) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("export erase: list files: %w", err)
+	}
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name, prefix) {
+			continue
+		}
+		err = s.files.Delete(ctx, file.Name)
+		if err != nil && !errors.Is(err, jetstream.ErrObjectNotFound) {
+			return fmt.Errorf("export erase: delete %s: %w", file.Name, err)
+		}
+	}
+	return nil
+}
+
+// store builds the export and stores the file under the job key
+func (s Service) store(ctx context.Context, job Job) (uint64, error) {
+	doc, err := s.Build(ctx, job.UserID)
+	if err != nil {
+		return 0, err
+	}
+	var buf bytes.Buffer
+	err = Write(&buf, doc, job.Format)
+	if err != nil {
+		return 0, fmt.Errorf("write: %w", err)
+	}
+	info, err := s.files.Put(ctx, jetstream.ObjectMeta{Name: job.key()}, &buf)
+	if err != nil {
+		return 0, fmt.Errorf("store: %w", err)
+	}
+	return info.Size, nil
+}
+
+func (s Service) putJob(ctx context.Context, job Job, revision uint64) (uint64, error) {
+	b, err := json.Marshal(job)
+	if err != nil {
+		return 0, fmt.Errorf("marshal: %w", err)
+	}
+	return s.jobs.Update(ctx, job.key(), b, revision)
+}
+
+func (s Service) job(ctx context.Context, key string) (Job, uint64, error) {
+	entry, err := s.jobs.Get(ctx, key)
+	if err != nil {
+		return Job{}, 0, err
+	}
+	var job Job
+	err = json.Unmarshal(entry.Value(), &job)
+	if err != nil {
+		return Job{}, 0, fmt.Errorf("unmarshal: %w", err)
+	}
+	return job, entry.Revision(), nil
+}
+
+// Link returns a signed download link of the ready export
+func (s Service) Link(job Job, now time.Time) (string, error) {
+	if job.Status != StatusReady {
+		return "", fmt.Errorf("export link: %w", ErrNotReady)
+	}
+	token, err := s.jwtEncoder.Encode(jwt.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    Issuer,
+			Subject:   job.UserID.String(),
+			Audience:  []string{linkAudience},
+			ExpiresAt: gojwt.NewNumericDate(job.DoneAt.Add(LinkTTL)),
+			NotBefore: gojwt.NewNumericDate(now),
+			IssuedAt:  gojwt.NewNumericDate(now),
+			ID:        job.ID,
+		},
+		UserInfo: auth.UserInfo{UserID: job.UserID},
+	})
+	if err != nil {
+		return "", fmt.Errorf("export link: encode: %w", err)
+	}
+	return "/account/export/download?token=" + token, nil
+}
+
+// DownloadHandler sends the file of a signed link. The link is the only
+// credential, so it works without a session.
+func (s Service) DownloadHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := s.jwtDecoder.Decode(r.URL.Query().Get("token"))
+	if err != nil {
+		http.Error(w, "invalid link: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if claims.Issuer != Issuer || !slices.Contains(claims.Audience, linkAudience) {
+		http.Error(w, "invalid link", http.StatusUnauthorized)
+		return
+	}
+	job, err := s.Job(r.Context(), claims.UserID, claims.ID)
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		http.Error(w, "export expired", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if job.Status != StatusReady {
+		http.Error(w, ErrNotReady.Error(), http.StatusConflict)
+		return
+	}
+	f, err := s.files.Get(r.Context(), job.key())
+	if errors.Is(err, jetstream.ErrObjectNotFound) {
+		http.Error(w, "export expired", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	contentType := "application/json"
+	if job.Format == FormatZip {
+		contentType = "application/zip"
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", job.Filename()))
+	_, err = io.Copy(w, f)
+	if err != nil {
+		log.Printf("export download %s: %s", job.key(), err)
+	}
+}
+
+func newID() (string, error) {
+	var buf [16]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
@@ -0,0 +1,234 @@
+package export_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gomoni/amble/internal/auth"
+	"github.com/gomoni/amble/internal/auth/jwt"
+	"github.com/gomoni/amble/internal/services/accounts"
+	"github.com/gomoni/amble/internal/services/audit"
+	"github.com/gomoni/amble/internal/services/export"
+	"github.com/gomoni/amble/internal/test"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExport(t *testing.T) {
+	server, err := test.NewNatsContainer(context.Background(), test.NatsContainerOpts{})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := server.Terminate()
+		require.NoError(t, err)
+	})
+	nc, err := nats.Connect(server.Endpoint())
+	require.NoError(t, err)
+	t.Cleanup(nc.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	js, err := jetstream.New(nc)
+	require.NoError(t, err)
+	_, err = js.CreateStream(ctx, audit.StreamConfig())
+	require.NoError(t, err)
+	jobs, err := js.CreateKeyValue(ctx, export.KeyValueConfig())
+	require.NoError(t, err)
+	files, err := js.CreateObjectStore(ctx, export.ObjectStoreConfig())
+	require.NoError(t, err)
+	auditLog := audit.NewNats(js)
+	store := accounts.NewMemory()
+
+	var buf [ed25519.SeedSize]byte
+	_, err = rand.Read(buf[:])
+	require.NoError(t, err)
+	secret, err := jwt.LoadSecret(bytes.NewReader(buf[:]))
+	require.NoError(t, err)
+	service := export.NewService(jobs, files, store, auditLog, jwt.NewEncoder(secret), jwt.NewDecoder(secret.Public()))
+
+	// given octocat signed in via github
+	octocat, err := store.SignIn(ctx, "github", "583231", auth.UserInfo{Name: "Octocat"}, map[string]any{"login": "octocat"})
+	require.NoError(t, err)
+	require.NoError(t, auditLog.Record(ctx, audit.Event{Type: audit.LoginSuccess, Provider: "github", Subject: "583231", UserID: octocat.UserID}))
+
+	// when octocat requests an export
+	job, err := service.Request(ctx, octocat.UserID, export.FormatZip)
+	require.NoError(t, err)
+	require.Equal(t, export.StatusPending, job.Status)
+
+	// then another one is refused until it is done
+	_, err = service.Request(ctx, octocat.UserID, export.FormatJSON)
+	require.ErrorIs(t, err, export.ErrInProgress)
+	_, err = service.Link(job, time.Now())
+	require.ErrorIs(t, err, export.ErrNotReady)
+
+	// when the export is built
+	go func() {
+		_ = service.Run(ctx)
+	}()
+	require.Eventually(t, func() bool {
+		job, err = service.Job(ctx, octocat.UserID, job.ID)
+		return err == nil && job.Status == export.StatusReady
+	}, 5*time.Second, 50*time.Millisecond)
+	link, err := service.Link(job, time.Now())
+	require.NoError(t, err)
+
+	// then the signed link downloads the file
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, link, nil)
+	service.DownloadHandler(w, r)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Equal(t, "application/zip", w.Header().Get("Content-Type"))
+	require.Equal(t, job.Size, uint64(w.Body.Len()))
+
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	require.NoError(t, err)
+	require.Len(t, zr.File, 1)
+	f, err := zr.File[0].Open()
+	require.NoError(t, err)
+	var doc export.Document
+	require.NoError(t, json.NewDecoder(f).Decode(&doc))
+	require.NoError(t, f.Close())
+
+	// and contains the data of octocat
+	require.Equal(t, export.Version, doc.Version)
+	require.Equal(t, octocat.UserID, doc.UserID)
+	require.Equal(t, "Octocat", doc.Account.Name)
+	require.Equal(t, []accounts.Identity{{Provider: "github", ID: "583231"}}, doc.Identities)
+	require.JSONEq(t, `{"login":"octocat"}`, string(doc.Profiles["github"]))
+	require.Len(t, doc.Audit, 1)
+	require.Equal(t, audit.LoginSuccess, doc.Audit[0].Type)
+
+	// when the link is tampered, then it is refused
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, link+"x", nil)
+	service.DownloadHandler(w, r)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// and a new export can be requested
+	_, err = service.Request(ctx, octocat.UserID, export.FormatJSON)
+	require.NoError(t, err)
+
+	// given an export of hubot left running by a crashed instance
+	hubot, err := store.SignIn(ctx, "github", "42", auth.UserInfo{Name: "Hubot"}, map[string]any{"login": "hubot"})
+	require.NoError(t, err)
+	crashed := export.Job{ID: "crashed", UserID: hubot.UserID, Format: export.FormatJSON, Status: export.StatusRunning, RequestedAt: time.Now().UTC()}
+	b, err := json.Marshal(crashed)
+	require.NoError(t, err)
+	_, err = jobs.Put(ctx, "export."+hubot.UserID.String()+".crashed", b)
+	require.NoError(t, err)
+	_, err = service.Request(ctx, hubot.UserID, export.FormatJSON)
+	require.ErrorIs(t, err, export.ErrInProgress)
+
+	// when it runs longer than the run timeout, then it is marked failed
+	go func() {
+		_ = service.WithRunTimeout(100 * time.Millisecond).Run(ctx)
+	}()
+	require.Eventually(t, func() bool {
+		crashed, err = service.Job(ctx, hubot.UserID, "crashed")
+		return err == nil && crashed.Status == export.StatusFailed
+	}, 5*time.Second, 50*time.Millisecond)
+	require.Equal(t, "interrupted", crashed.Error)
+
+	// and hubot can request an export again
+	_, err = service.Request(ctx, hubot.UserID, export.FormatJSON)
+	require.NoError(t, err)
+}
+
+func TestErase(t *testing.T) {
+	server, err := test.NewNatsContainer(context.Background(), test.NatsContainerOpts{})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := server.Terminate()
+		require.NoError(t, err)
+	})
+	nc, err := nats.Connect(server.Endpoint())
+	require.NoError(t, err)
+	t.Cleanup(nc.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	js, err := jetstream.New(nc)
+	require.NoError(t, err)
+	_, err = js.CreateStream(ctx, audit.StreamConfig())
+	require.NoError(t, err)
+	kv, err := js.CreateKeyValue(ctx, accounts.KeyValueConfig())
+	require.NoError(t, err)
+	jobs, err := js.CreateKeyValue(ctx, export.KeyValueConfig())
+	require.NoError(t, err)
+	files, err := js.CreateObjectStore(ctx, export.ObjectStoreConfig())
+	require.NoError(t, err)
+	auditLog := audit.NewNats(js)
+	store := accounts.NewNats(kv)
+
+	var buf [ed25519.SeedSize]byte
+	_, err = rand.Read(buf[:])
+	require.NoError(t, err)
+	secret, err := jwt.LoadSecret(bytes.NewReader(buf[:]))
+	require.NoError(t, err)
+	service := export.NewService(jobs, files, store, auditLog, jwt.NewEncoder(secret), jwt.NewDecoder(secret.Public()))
+	store = store.WithErasers(auditLog, service)
+
+	// given octocat with logins, audit events and a built export
+	octocat, err := store.SignIn(ctx, "github", "583231", auth.UserInfo{Name: "Octocat", Email: "octocat@octocat.example.net", EmailVerified: true}, map[string]any{"login": "octocat"})
+	require.NoError(t, err)
+	uid := octocat.UserID
+	require.NoError(t, store.Suspend(ctx, uid, "spam"))
+	require.NoError(t, store.Unsuspend(ctx, uid))
+	require.NoError(t, auditLog.Record(ctx, audit.Event{Type: audit.LoginSuccess, Provider: "github", Subject: "583231", UserID: uid}))
+	hubot, err := store.SignIn(ctx, "github", "1", auth.UserInfo{Name: "Hubot"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, auditLog.Record(ctx, audit.Event{Type: audit.LoginSuccess, Provider: "github", Subject: "1", UserID: hubot.UserID}))
+	job, err := service.Request(ctx, uid, export.FormatJSON)
+	require.NoError(t, err)
+	go func() {
+		_ = service.Run(ctx)
+	}()
+	require.Eventually(t, func() bool {
+		job, err = service.Job(ctx, uid, job.ID)
+		return err == nil && job.Status == export.StatusReady
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// when octocat is erased
+	require.NoError(t, store.Erase(ctx, uid))
+
+	// then no value keyed by or pointing to octocat survives but the
+	// tombstone, purge markers keep the keys only
+	entries, err := accounts.WatchEntries(ctx, kv, ">", jetstream.IncludeHistory())
+	require.NoError(t, err)
+	var left []string
+	for _, entry := range entries {
+		if entry.Operation() != jetstream.KeyValuePut {
+			continue
+		}
+		if strings.Contains(entry.Key(), uid.String()) || strings.Contains(string(entry.Value()), uid.String()) {
+			left = append(left, entry.Key())
+		}
+	}
+	require.Equal(t, []string{"erased." + uid.String()}, left)
+
+	// and the audit trail of octocat is purged, but hubot's stays
+	events, err := auditLog.Query(ctx, audit.Query{UserID: uid})
+	require.NoError(t, err)
+	require.Empty(t, events)
+	events, err = auditLog.Query(ctx, audit.Query{UserID: hubot.UserID})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+
+	// and the exports are gone
+	exports, err := service.Jobs(ctx, uid)
+	require.NoError(t, err)
+	require.Empty(t, exports)
+	_, err = files.List(ctx)
+	require.ErrorIs(t, err, jetstream.ErrNoObjectsFound)
+}
@@ -2,7 +2,12 @@
 
 package tid
 
-import "go.jetify.com/typeid"
+import (
+	"encoding/binary"
+	"time"
+
+	"go.jetify.com/typeid"
+)
 
 type userID struct{}
 
@@ -19,3 +24,34 @@ func NewUserID() (UserID, error) {
 func ParseUserID(s string) (UserID, error) {
 	return typeid.Parse[UserID](s)
 }
+
+// CreatedAt returns the time the id was generated, as encoded in its UUIDv7
+func (id UserID) CreatedAt() time.Time {
+	return createdAt(id.UUIDBytes())
+}
+
+type tenantID struct{}
+
+func (tenantID) Prefix() string { return "tnt" }
+
+type TenantID struct {
+	typeid.TypeID[tenantID]
+}
+
+func NewTenantID() (TenantID, error) {
+	return typeid.New[TenantID]()
+}
+
+func ParseTenantID(s string) (TenantID, error) {
+	return typeid.Parse[TenantID](s)
+}
+
+// createdAt reads the unix milliseconds stored in the first 48 bits of UUIDv7
+func createdAt(uuid []byte) time.Time {
+	if len(uuid) != 16 {
+		return time.Time{}
+	}
+	var b [8]byte
+	copy(b[2:], uuid[:6])
+	return time.UnixMilli(int64(binary.BigEndian.Uint64(b[:])))
+}
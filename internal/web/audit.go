@@ -0,0 +1,82 @@
+package web
+
+import (
+	"time"
+
+	"github.com/gomoni/amble/internal/services/audit"
+
+	. "maragu.dev/gomponents"
+	. "maragu.dev/gomponents/components"
+	. "maragu.dev/gomponents/html"
+)
+
+const dateTimeLocal = "2006-01-02T15:04"
+
+// Audit is an admin page displaying the audit trail filtered by user and time range
+func Audit(query audit.Query, events []audit.Event) Node {
+	var uid string
+	if !query.UserID.IsZero() {
+		uid = query.UserID.String()
+	}
+	return HTML5(HTML5Props{
+		Title: "Amble.app - audit",
+		Body: []Node{
+			H1(Text("Audit trail")),
+			Form(
+				Method("GET"),
+				ID("auditFilter"),
+				Action("/admin/audit"),
+				Label(For("uid"), Text("User")),
+				Input(Type("text"), ID("uid"), Name("uid"), Value(uid)),
+				Label(For("since"), Text("Since")),
+				Input(Type("datetime-local"), ID("since"), Name("since"), Value(formatTime(query.Since))),
+				Label(For("until"), Text("Until")),
+				Input(Type("datetime-local"), ID("until"), Name("until"), Value(formatTime(query.Until))),
+				Button(Type("submit"), Text("Filter")),
+			),
+			Table(
+				THead(Tr(
+					Th(Text("Time")),
+					Th(Text("Event")),
+					Th(Text("User")),
+					Th(Text("Provider")),
+					Th(Text("IP")),
+					Th(Text("User agent")),
+					Th(Text("Reason")),
+					Th(Text("Acted by")),
+				)),
+				TBody(Map(events, func(e audit.Event) Node {
+					var uid string
+					if !e.UserID.IsZero() {
+						uid = e.UserID.String()
+					}
+					return Tr(
+						Td(Text(e.Time.Format(time.RFC3339))),
+						Td(Text(string(e.Type))),
+						Td(Text(uid)),
+						Td(Text(e.Provider+" "+e.Subject)),
+						Td(Text(e.IP)),
+						Td(Text(e.UserAgent)),
+						Td(Text(e.Reason)),
+						Td(Text(e.Actor)),
+					)
+				})),
+			),
+		},
+	})
+}
+
+// ParseTime parses the value of datetime-local input
+func ParseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation(dateTimeLocal, s, time.UTC)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(dateTimeLocal)
+}
@@ -0,0 +1,55 @@
+package web
+
+import (
+	"net/url"
+
+	"github.com/gomoni/amble/internal/auth/jwt"
+
+	. "maragu.dev/gomponents"
+	. "maragu.dev/gomponents/components"
+	. "maragu.dev/gomponents/html"
+)
+
+// Dashboard is the home page of a signed in user
+func Dashboard(csfrName, csfrValue string, claims jwt.Claims) Node {
+	return HTML5(HTML5Props{
+		Title: "Amble.app - dashboard",
+		Body: []Node{
+			H1(Text("Hello, " + claims.Name)),
+			P(Text("Authenticated via " + claims.Issuer)),
+			P(Text("Email address: " + claims.Email)),
+			If(isWebURL(claims.Picture), Img(Src(claims.Picture), Alt("avatar"))),
+			P(A(Href("/account/profile"), Text("Profile"))),
+			P(A(Href("/account/totp"), Text("Two-factor authentication"))),
+			P(A(Href("/account/devices"), Text("Devices"))),
+			P(A(Href("/account/export"), Text("Download my data"))),
+			P(A(Href("/account/delete"), Text("Delete account"))),
+			Button(
+				Type("button"),
+				ID("registerPasskey"),
+				Attr("onclick", "passkeyRegister("+jsString(csfrValue)+").catch(e => alert(e))"),
+				Text("Register a passkey"),
+			),
+			Form(
+				Method("POST"),
+				Action("/auth/logout"),
+				Input(Type("hidden"), Name(csfrName), Value(csfrValue)),
+				Button(Type("submit"), Text("Log out")),
+			),
+			Form(
+				Method("POST"),
+				Action("/auth/logout/everywhere"),
+				Input(Type("hidden"), Name(csfrName), Value(csfrValue)),
+				Button(Type("submit"), Text("Log out everywhere")),
+			),
+			Raw(PasskeyScript),
+		},
+	})
+}
+
+// isWebURL reports an absolute http(s) url, pictures come from the profiles
+// of the login providers
+func isWebURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
@@ -0,0 +1,81 @@
+package web
+
+import (
+	"github.com/gomoni/amble/internal/services/accounts"
+
+	. "maragu.dev/gomponents"
+	. "maragu.dev/gomponents/components"
+	. "maragu.dev/gomponents/html"
+)
+
+// AccountDeletion lets the user delete the account or cancel a pending
+// deletion
+func AccountDeletion(csfrName, csfrValue string, deletion *accounts.Deletion) Node {
+	var body Node
+	if deletion != nil {
+		body = Group{
+			P(Text("Your account will be erased on " + formatTime(deletion.EraseAt) + ".")),
+			Form(
+				Method("POST"),
+				ID("deletionCancel"),
+				Action("/account/delete/cancel"),
+				Input(Type("hidden"), Name(csfrName), Value(csfrValue)),
+				Button(Type("submit"), Text("Keep my account")),
+			),
+		}
+	} else {
+		body = Group{
+			P(Text("Your profiles, logins, passkeys, devices and memberships will be erased and you will be signed out everywhere. Sign in again before the erasure to cancel it.")),
+			Form(
+				Method("POST"),
+				ID("deletion"),
+				Action("/account/delete"),
+				Input(Type("hidden"), Name(csfrName), Value(csfrValue)),
+				Label(
+					Input(Type("checkbox"), Name("confirm"), Value("yes"), Required()),
+					Text(" I want to delete my account"),
+				),
+				Button(Type("submit"), Text("Delete account")),
+			),
+		}
+	}
+	return HTML5(HTML5Props{
+		Title: "Amble.app - delete account",
+		Body: []Node{
+			H1(Text("Delete account")),
+			body,
+		},
+	})
+}
+
+// AdminAccountDeletion is an admin page to delete an account of a user
+func AdminAccountDeletion(csfrName, csfrValue, uid string) Node {
+	return HTML5(HTML5Props{
+		Title: "Amble.app - delete account",
+		Body: []Node{
+			H1(Text("Delete account")),
+			P(Text("The user is signed out and the account is erased after the grace period unless canceled.")),
+			Form(
+				Method("POST"),
+				ID("adminDeletion"),
+				Action("/admin/accounts/delete"),
+				Input(Type("hidden"), Name(csfrName), Value(csfrValue)),
+				Label(For("uid"), Text("User")),
+				Input(Type("text"), ID("uid"), Name("uid"), Value(uid), Required()),
+				Label(
+					Input(Type("checkbox"), Name("now"), Value("yes")),
+					Text(" Erase now, this can't be undone"),
+				),
+				Button(Type("submit"), Text("Delete account")),
+			),
+			Form(
+				Method("POST"),
+				ID("adminDeletionCancel"),
+				Action("/admin/accounts/delete/cancel"),
+				Input(Type("hidden"), Name(csfrName), Value(csfrValue)),
+				Input(Type("text"), Name("uid"), Value(uid), Required()),
+				Button(Type("submit"), Text("Cancel deletion")),
+			),
+		},
+	})
+}
@@ -0,0 +1,94 @@
+package web
+
+import (
+	"strings"
+
+	"github.com/gomoni/amble/internal/services/accounts"
+
+	. "maragu.dev/gomponents"
+	. "maragu.dev/gomponents/components"
+	. "maragu.dev/gomponents/html"
+)
+
+// Devices lists the registered nkeys of the user with forms to download new
+// .creds, register an existing public key or remove a device
+func Devices(csfrName, csfrValue string, devices []accounts.Device) Node {
+	return HTML5(HTML5Props{
+		Title: "Amble.app - devices",
+		Body: []Node{
+			H1(Text("Devices")),
+			If(len(devices) == 0, P(Text("No devices registered."))),
+			If(len(devices) > 0, Table(
+				THead(Tr(
+					Th(Text("Name")),
+					Th(Text("Public key")),
+					Th(Text("Access")),
+					Th(Text("Created")),
+					Th(),
+				)),
+				TBody(Map(devices, func(d accounts.Device) Node {
+					return Tr(
+						Td(Text(d.Name)),
+						Td(Code(Text(d.PublicKey))),
+						Td(Text(deviceAccess(d.Policy))),
+						Td(Text(d.Created.Format("2006-01-02 15:04:05"))),
+						Td(Form(
+							Method("POST"),
+							Action("/account/devices/remove"),
+							Input(Type("hidden"), Name(csfrName), Value(csfrValue)),
+							Input(Type("hidden"), Name("public_key"), Value(d.PublicKey)),
+							Button(Type("submit"), Text("Remove")),
+						)),
+					)
+				})),
+			)),
+			H2(Text("Download credentials")),
+			P(Text("The .creds file contains a new private key. It is not stored, so keep the file safe.")),
+			Form(
+				Method("POST"),
+				ID("devicesCreds"),
+				Action("/account/devices/creds"),
+				Input(Type("hidden"), Name(csfrName), Value(csfrValue)),
+				Input(Type("text"), Name("name"), Placeholder("Device name"), Required()),
+				accessInputs(),
+				Button(Type("submit"), Text("Download")),
+			),
+			H2(Text("Register a public key")),
+			P(Code(Text("nsc generate nkey --user"))),
+			Form(
+				Method("POST"),
+				ID("devicesAdd"),
+				Action("/account/devices/add"),
+				Input(Type("hidden"), Name(csfrName), Value(csfrValue)),
+				Input(Type("text"), Name("name"), Placeholder("Device name"), Required()),
+				Input(Type("text"), Name("public_key"), Placeholder("U..."), Required()),
+				accessInputs(),
+				Button(Type("submit"), Text("Register")),
+			),
+		},
+	})
+}
+
+// accessInputs choose the policy of a new device, a scope limits it to
+// amble.<uid>.<scope>.>
+func accessInputs() Node {
+	return Group{
+		Select(Name("access"),
+			Option(Value("full"), Text("Full access")),
+			Option(Value("read_only"), Text("Read only")),
+			Option(Value("scoped"), Text("Scoped")),
+		),
+		Input(Type("text"), Name("scope"), Placeholder("Scope")),
+	}
+}
+
+func deviceAccess(policy *accounts.Policy) string {
+	switch {
+	case policy == nil:
+		return "full"
+	case len(policy.Publish) == 0:
+		return "read only"
+	default:
+		return strings.Join(policy.Publish, ", ")
+	}
+}
@@ -0,0 +1,57 @@
+package web
+
+import (
+	"strconv"
+
+	"github.com/gomoni/amble/internal/services/export"
+
+	. "maragu.dev/gomponents"
+	. "maragu.dev/gomponents/components"
+	. "maragu.dev/gomponents/html"
+)
+
+// Export lists the data exports of the user with download links of the ready
+// ones and a form to request a new export
+func Export(csfrName, csfrValue string, jobs []export.Job, links map[string]string) Node {
+	return HTML5(HTML5Props{
+		Title: "Amble.app - download my data",
+		Body: []Node{
+			H1(Text("Download my data")),
+			P(Text("The export contains your account, linked logins, passkeys, devices, memberships and the audit trail. It is built in the background and can be downloaded for 24 hours.")),
+			If(len(jobs) > 0, Table(
+				THead(Tr(
+					Th(Text("Requested")),
+					Th(Text("Format")),
+					Th(Text("Status")),
+					Th(),
+				)),
+				TBody(Map(jobs, func(job export.Job) Node {
+					var action Node
+					switch job.Status {
+					case export.StatusReady:
+						action = A(Href(links[job.ID]), Text("Download ("+strconv.FormatUint(job.Size, 10)+" bytes)"))
+					case export.StatusFailed:
+						action = Text(job.Error)
+					}
+					return Tr(
+						Td(Text(formatTime(job.RequestedAt))),
+						Td(Text(string(job.Format))),
+						Td(Text(string(job.Status))),
+						Td(action),
+					)
+				})),
+			)),
+			Form(
+				Method("POST"),
+				ID("export"),
+				Action("/account/export"),
+				Input(Type("hidden"), Name(csfrName), Value(csfrValue)),
+				Select(Name("format"),
+					Option(Value(string(export.FormatZip)), Text("zip")),
+					Option(Value(string(export.FormatJSON)), Text("json")),
+				),
+				Button(Type("submit"), Text("Request export")),
+			),
+		},
+	})
+}
@@ -0,0 +1,59 @@
+package web
+
+import (
+	"time"
+
+	"github.com/gomoni/amble/internal/auth/jwt"
+
+	. "maragu.dev/gomponents"
+	. "maragu.dev/gomponents/components"
+	. "maragu.dev/gomponents/html"
+)
+
+// Impersonate is an admin page to start viewing the application as a user
+func Impersonate(csfrName, csfrValue, uid string) Node {
+	return HTML5(HTML5Props{
+		Title: "Amble.app - view as user",
+		Body: []Node{
+			H1(Text("View as user")),
+			P(Text("Changes of keys and credentials are refused and every action is recorded in the audit trail.")),
+			Form(
+				Method("POST"),
+				ID("impersonate"),
+				Action("/admin/impersonate"),
+				Input(Type("hidden"), Name(csfrName), Value(csfrValue)),
+				Label(For("uid"), Text("User")),
+				Input(Type("text"), ID("uid"), Name("uid"), Value(uid), Required()),
+				Button(Type("submit"), Text("View as user")),
+			),
+		},
+	})
+}
+
+// ImpersonationBanner is displayed on every page while an admin acts as a user
+func ImpersonationBanner(csfrName, csfrValue string, claims jwt.Claims) Node {
+	if !claims.Impersonated() {
+		return Group{}
+	}
+	admin := claims.Act.Name
+	if admin == "" {
+		admin = claims.Act.UserID.String()
+	}
+	var expires string
+	if claims.ExpiresAt != nil {
+		expires = claims.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	return Div(
+		ID("impersonationBanner"),
+		Role("alert"),
+		Style("background: #b00020; color: white; padding: 0.5em;"),
+		Text("You ("+admin+") are viewing as "+claims.Name+" ("+claims.UserID.String()+") until "+expires+". "),
+		Form(
+			Method("POST"),
+			Action("/auth/impersonate/stop"),
+			Style("display: inline;"),
+			Input(Type("hidden"), Name(csfrName), Value(csfrValue)),
+			Button(Type("submit"), Text("Stop")),
+		),
+	)
+}
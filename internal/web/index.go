@@ -1,8 +1,14 @@
 package web
 
 import (
+	"bytes"
+	"encoding/json"
+	"io"
 	"net/http"
 
+	"github.com/gomoni/amble/internal/auth/impersonate"
+	"github.com/justinas/nosurf"
+
 	. "maragu.dev/gomponents"
 	. "maragu.dev/gomponents/components"
 	. "maragu.dev/gomponents/html"
@@ -15,12 +21,45 @@ const githubLogo = `
 </svg>`
 
 func Serve(node Node, w http.ResponseWriter, r *http.Request) {
+	if claims, ok := impersonate.FromContext(r.Context()); ok {
+		node = withBanner(node, ImpersonationBanner(nosurf.FormFieldName, nosurf.Token(r), claims))
+	}
 	h := Adapt(func(w http.ResponseWriter, r *http.Request) (Node, error) {
 		return node, nil
 	})
 	h(w, r)
 }
 
+// withBanner renders the banner at the start of the body of the page
+func withBanner(page, banner Node) Node {
+	return NodeFunc(func(w io.Writer) error {
+		var b bytes.Buffer
+		err := page.Render(&b)
+		if err != nil {
+			return err
+		}
+		head, body, ok := bytes.Cut(b.Bytes(), []byte("<body>"))
+		if !ok {
+			_, err = w.Write(b.Bytes())
+			return err
+		}
+		_, err = w.Write(head)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, "<body>")
+		if err != nil {
+			return err
+		}
+		err = banner.Render(w)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(body)
+		return err
+	})
+}
+
 func Index(csfrName, csfrValue string) Node {
 	return HTML5(HTML5Props{
 		Title:       "Amble.app",
@@ -36,6 +75,38 @@ func Index(csfrName, csfrValue string) Node {
 				Input(Type("hidden"), Name(csfrName), Value(csfrValue)),
 				Button(Type("submit"), Raw(githubLogo), Text("Sign in with GitHub")),
 			),
+			Form(
+				Method("POST"),
+				ID("loginEmail"),
+				Action("/auth/email/login"),
+				Input(Type("hidden"), Name("next_url"), Value("/dashboard")),
+				Input(Type("hidden"), Name(csfrName), Value(csfrValue)),
+				Input(Type("email"), Name("email"), Placeholder("you@example.net"), Required()),
+				Button(Type("submit"), Text("Email me a sign in link")),
+			),
+			Button(
+				Type("button"),
+				ID("loginPasskey"),
+				Attr("onclick", "passkeyLogin("+jsString(csfrValue)+", '/dashboard').catch(e => alert(e))"),
+				Text("Sign in with a passkey"),
+			),
+			Raw(PasskeyScript),
 		},
 	})
 }
+
+// EmailSent is displayed after the sign in link was sent
+func EmailSent() Node {
+	return HTML5(HTML5Props{
+		Title: "Amble.app",
+		Body: []Node{
+			H1(Text("Amble.app")),
+			P(Text("Check your inbox, we sent you a sign in link.")),
+		},
+	})
+}
+
+func jsString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
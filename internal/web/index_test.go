@@ -0,0 +1,77 @@
+package web_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gomoni/amble/internal/auth"
+	"github.com/gomoni/amble/internal/auth/impersonate"
+	"github.com/gomoni/amble/internal/auth/jwt"
+	"github.com/gomoni/amble/internal/tid"
+	"github.com/gomoni/amble/internal/web"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeImpersonationBanner(t *testing.T) {
+	var buf [ed25519.SeedSize]byte
+	_, err := rand.Read(buf[:])
+	require.NoError(t, err)
+	secret, err := jwt.LoadSecret(bytes.NewReader(buf[:]))
+	require.NoError(t, err)
+	encoder := jwt.NewEncoder(secret)
+	service := impersonate.NewService(nil, encoder, jwt.NewDecoder(secret.Public()))
+	adminID, err := tid.NewUserID()
+	require.NoError(t, err)
+	octocatID, err := tid.NewUserID()
+	require.NoError(t, err)
+	handler := service.Recorded(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		web.Serve(web.Devices("csrf", "token", nil), w, r)
+	}))
+
+	// given an admin viewing as octocat
+	admin := jwt.Claims{UserInfo: auth.UserInfo{UserID: adminID, Name: "Admin"}}
+	claims := impersonate.Claims(admin, auth.UserInfo{UserID: octocatID, Name: "Octocat"}, time.Now())
+	token, err := encoder.Encode(claims)
+	require.NoError(t, err)
+
+	// when the devices page is served
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/account/devices", nil)
+	r.AddCookie(&http.Cookie{Name: "Authorization", Value: "Bearer " + token})
+	handler.ServeHTTP(w, r)
+
+	// then the banner is at the start of the body
+	body := w.Body.String()
+	require.Contains(t, body, `<body><div id="impersonationBanner"`)
+	require.Contains(t, body, "viewing as Octocat")
+
+	// when the user views it, then there is no banner
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/account/devices", nil)
+	handler.ServeHTTP(w, r)
+	require.NotContains(t, w.Body.String(), "impersonationBanner")
+}
+
+func TestDashboardEscapes(t *testing.T) {
+	// given a profile with markup
+	claims := jwt.Claims{UserInfo: auth.UserInfo{
+		Name:    "<script>alert(1)</script>",
+		Picture: "javascript:alert(1)",
+	}}
+
+	// when the dashboard is rendered
+	var b strings.Builder
+	require.NoError(t, web.Dashboard("csrf", "token", claims).Render(&b))
+
+	// then the name is escaped and the picture dropped
+	require.NotContains(t, b.String(), "<script>alert")
+	require.Contains(t, b.String(), "&lt;script&gt;")
+	require.NotContains(t, b.String(), "javascript:")
+}
@@ -0,0 +1,63 @@
+package web
+
+// PasskeyScript provides passkeyLogin and passkeyRegister functions calling
+// the WebAuthn browser API. Both expect the CSRF token to be sent in
+// X-CSRF-Token header.
+const PasskeyScript = `
+<script>
+function b64decode(s) {
+	s = s.replace(/-/g, "+").replace(/_/g, "/");
+	return Uint8Array.from(atob(s), c => c.charCodeAt(0));
+}
+function b64encode(buf) {
+	return btoa(String.fromCharCode(...new Uint8Array(buf)))
+		.replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+}
+async function passkeyPost(url, csrf, body) {
+	const resp = await fetch(url, {
+		method: "POST",
+		headers: {"X-CSRF-Token": csrf, "Content-Type": "application/json"},
+		body: body ? JSON.stringify(body) : null,
+	});
+	if (!resp.ok) {
+		throw new Error(await resp.text());
+	}
+	return resp.status === 204 ? null : resp.json();
+}
+async function passkeyLogin(csrf, next) {
+	const opts = await passkeyPost("/auth/passkey/login/begin", csrf);
+	opts.publicKey.challenge = b64decode(opts.publicKey.challenge);
+	(opts.publicKey.allowCredentials || []).forEach(c => c.id = b64decode(c.id));
+	const cred = await navigator.credentials.get(opts);
+	await passkeyPost("/auth/passkey/login/finish", csrf, {
+		id: cred.id,
+		rawId: b64encode(cred.rawId),
+		type: cred.type,
+		response: {
+			authenticatorData: b64encode(cred.response.authenticatorData),
+			clientDataJSON: b64encode(cred.response.clientDataJSON),
+			signature: b64encode(cred.response.signature),
+			userHandle: b64encode(cred.response.userHandle),
+		},
+	});
+	window.location = next;
+}
+async function passkeyRegister(csrf) {
+	const opts = await passkeyPost("/auth/passkey/register/begin", csrf);
+	opts.publicKey.challenge = b64decode(opts.publicKey.challenge);
+	opts.publicKey.user.id = b64decode(opts.publicKey.user.id);
+	(opts.publicKey.excludeCredentials || []).forEach(c => c.id = b64decode(c.id));
+	const cred = await navigator.credentials.create(opts);
+	await passkeyPost("/auth/passkey/register/finish", csrf, {
+		id: cred.id,
+		rawId: b64encode(cred.rawId),
+		type: cred.type,
+		response: {
+			attestationObject: b64encode(cred.response.attestationObject),
+			clientDataJSON: b64encode(cred.response.clientDataJSON),
+		},
+	});
+	alert("Passkey registered");
+}
+</script>
+`
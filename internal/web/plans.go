@@ -0,0 +1,64 @@
+package web
+
+import (
+	"strings"
+
+	"github.com/gomoni/amble/internal/services/accounts"
+
+	. "maragu.dev/gomponents"
+	. "maragu.dev/gomponents/components"
+	. "maragu.dev/gomponents/html"
+)
+
+// AdminPlans is an admin page to store plans and assign them to users
+func AdminPlans(csfrName, csfrValue string, plans []accounts.Plan) Node {
+	return HTML5(HTML5Props{
+		Title: "Amble.app - plans",
+		Body: []Node{
+			H1(Text("Plans")),
+			P(Text("Users without a plan get the " + accounts.DefaultPlanName + " one. A plan allows the connection types, all of them if none is checked.")),
+			Table(
+				THead(Tr(
+					Th(Text("Plan")),
+					Th(Text("Connection types")),
+				)),
+				TBody(Map(plans, func(plan accounts.Plan) Node {
+					return Tr(
+						Td(Text(plan.Name)),
+						Td(Text(strings.Join(plan.ConnectionTypes, ", "))),
+					)
+				})),
+			),
+			H2(Text("Save plan")),
+			Form(
+				Method("POST"),
+				ID("adminPlanPut"),
+				Action("/admin/plans"),
+				Input(Type("hidden"), Name(csfrName), Value(csfrValue)),
+				Label(For("name"), Text("Name")),
+				Input(Type("text"), ID("name"), Name("name"), Required()),
+				Map(accounts.ConnectionTypes, func(ct string) Node {
+					return Label(
+						Input(Type("checkbox"), Name("connection_type"), Value(ct)),
+						Text(ct),
+					)
+				}),
+				Button(Type("submit"), Text("Save")),
+			),
+			H2(Text("Assign plan")),
+			Form(
+				Method("POST"),
+				ID("adminPlanAssign"),
+				Action("/admin/plans/assign"),
+				Input(Type("hidden"), Name(csfrName), Value(csfrValue)),
+				Label(For("uid"), Text("User")),
+				Input(Type("text"), ID("uid"), Name("uid"), Required()),
+				Label(For("plan"), Text("Plan")),
+				Select(ID("plan"), Name("plan"), Map(plans, func(plan accounts.Plan) Node {
+					return Option(Value(plan.Name), Text(plan.Name))
+				})),
+				Button(Type("submit"), Text("Assign")),
+			),
+		},
+	})
+}
@@ -0,0 +1,65 @@
+package web
+
+import (
+	"maps"
+	"slices"
+
+	"github.com/gomoni/amble/internal/auth"
+	"github.com/gomoni/amble/internal/services/accounts"
+
+	. "maragu.dev/gomponents"
+	. "maragu.dev/gomponents/components"
+	. "maragu.dev/gomponents/html"
+)
+
+// Profile shows the account computed from the linked providers with a form
+// to pin the provider of the name and the picture
+func Profile(csfrName, csfrValue string, account auth.UserInfo, profiles map[string]accounts.Profile, pins accounts.ProfilePins) Node {
+	providers := slices.Sorted(maps.Keys(profiles))
+	return HTML5(HTML5Props{
+		Title: "Amble.app - profile",
+		Body: []Node{
+			H1(Text("Profile")),
+			If(account.Picture != "", Img(Src(account.Picture), Alt(account.Name), Width("64"))),
+			P(Text(account.Name)),
+			P(Text(account.Email), If(account.EmailVerified, Text(" (verified)"))),
+			Table(
+				THead(Tr(
+					Th(Text("Provider")),
+					Th(Text("Name")),
+					Th(Text("Email")),
+					Th(Text("Picture")),
+				)),
+				TBody(Map(providers, func(provider string) Node {
+					p := profiles[provider]
+					return Tr(
+						Td(Text(provider)),
+						Td(Text(p.Name)),
+						Td(Text(p.Email)),
+						Td(If(p.Picture != "", Img(Src(p.Picture), Alt(provider), Width("32")))),
+					)
+				})),
+			),
+			Form(
+				Method("POST"),
+				ID("profilePins"),
+				Action("/account/profile"),
+				Input(Type("hidden"), Name(csfrName), Value(csfrValue)),
+				Label(For("name"), Text("Name from")),
+				pinSelect("name", pins.Name, providers),
+				Label(For("picture"), Text("Picture from")),
+				pinSelect("picture", pins.Picture, providers),
+				Button(Type("submit"), Text("Save")),
+			),
+		},
+	})
+}
+
+func pinSelect(name, pinned string, providers []string) Node {
+	return Select(ID(name), Name(name),
+		Option(Value(""), Text("automatic"), If(pinned == "", Selected())),
+		Map(providers, func(provider string) Node {
+			return Option(Value(provider), Text(provider), If(pinned == provider, Selected()))
+		}),
+	)
+}
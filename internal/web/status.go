@@ -0,0 +1,130 @@
+package web
+
+import (
+	"time"
+
+	"github.com/gomoni/amble/internal/auth"
+	"github.com/gomoni/amble/internal/services/accounts"
+
+	. "maragu.dev/gomponents"
+	. "maragu.dev/gomponents/components"
+	. "maragu.dev/gomponents/html"
+)
+
+// AccountStatus is displayed instead of the dashboard to users of an account,
+// which is not active
+func AccountStatus(csfrName, csfrValue string, status accounts.AccountStatus) Node {
+	var message string
+	switch status.Status {
+	case accounts.StatusPendingApproval:
+		message = "Your account is waiting for an approval by an admin."
+	case accounts.StatusSuspended:
+		message = "Your account is suspended: " + status.Reason
+	case accounts.StatusDeletionPending:
+		message = "Your account is scheduled for deletion, it is " + status.Reason + "."
+	default:
+		message = "Your account is " + string(status.Status) + "."
+	}
+	return HTML5(HTML5Props{
+		Title: "Amble.app - account status",
+		Body: []Node{
+			H1(Text("Account status")),
+			P(Text(message)),
+			P(Text("Since " + status.Since.Format(time.RFC3339))),
+			P(A(Href("/account/export"), Text("Download my data"))),
+			P(A(Href("/account/delete"), Text("Delete account"))),
+			Form(
+				Method("POST"),
+				Action("/auth/logout"),
+				Input(Type("hidden"), Name(csfrName), Value(csfrValue)),
+				Button(Type("submit"), Text("Log out")),
+			),
+		},
+	})
+}
+
+// AdminApprovals is an admin page with the sign ups waiting for an approval
+func AdminApprovals(csfrName, csfrValue string, queue []auth.UserInfo) Node {
+	return HTML5(HTML5Props{
+		Title: "Amble.app - approvals",
+		Body: []Node{
+			H1(Text("Approvals")),
+			Table(
+				THead(Tr(
+					Th(Text("Signed up")),
+					Th(Text("User")),
+					Th(Text("Name")),
+					Th(Text("Email")),
+					Th(),
+				)),
+				TBody(Map(queue, func(account auth.UserInfo) Node {
+					return Tr(
+						Td(Text(account.UserID.CreatedAt().Format(time.RFC3339))),
+						Td(Text(account.UserID.String())),
+						Td(Text(account.Name)),
+						Td(Text(account.Email)),
+						Td(
+							statusForm(csfrName, csfrValue, account.UserID.String(), accounts.StatusActive, "Approve"),
+							statusForm(csfrName, csfrValue, account.UserID.String(), accounts.StatusDeleted, "Reject"),
+						),
+					)
+				})),
+			),
+		},
+	})
+}
+
+// AdminAccountStatus is an admin page to change the status of an account
+func AdminAccountStatus(csfrName, csfrValue, uid string, status *accounts.AccountStatus) Node {
+	var current Node
+	if status != nil {
+		current = P(Text("Status: " + string(status.Status) + " since " + status.Since.Format(time.RFC3339) + " " + status.Reason))
+	}
+	options := []accounts.Status{accounts.StatusActive, accounts.StatusSuspended, accounts.StatusDeletionPending, accounts.StatusDeleted}
+	return HTML5(HTML5Props{
+		Title: "Amble.app - account status",
+		Body: []Node{
+			H1(Text("Account status")),
+			Form(
+				Method("GET"),
+				Action("/admin/accounts/status"),
+				Label(For("uid"), Text("User")),
+				Input(Type("text"), ID("uid"), Name("uid"), Value(uid), Required()),
+				Button(Type("submit"), Text("Show")),
+			),
+			current,
+			Form(
+				Method("POST"),
+				ID("adminStatus"),
+				Action("/admin/accounts/status"),
+				Input(Type("hidden"), Name(csfrName), Value(csfrValue)),
+				Input(Type("hidden"), Name("uid"), Value(uid)),
+				Label(For("status"), Text("New status")),
+				Select(ID("status"), Name("status"), Map(options, func(s accounts.Status) Node {
+					return Option(Value(string(s)), Text(string(s)))
+				})),
+				Label(For("reason"), Text("Reason")),
+				Input(Type("text"), ID("reason"), Name("reason")),
+				Button(Type("submit"), Text("Change")),
+			),
+			Form(
+				Method("POST"),
+				Action("/admin/accounts/revoke"),
+				Input(Type("hidden"), Name(csfrName), Value(csfrValue)),
+				Input(Type("hidden"), Name("uid"), Value(uid)),
+				Button(Type("submit"), Text("Log out everywhere")),
+			),
+		},
+	})
+}
+
+func statusForm(csfrName, csfrValue, uid string, status accounts.Status, label string) Node {
+	return Form(
+		Method("POST"),
+		Action("/admin/accounts/status"),
+		Input(Type("hidden"), Name(csfrName), Value(csfrValue)),
+		Input(Type("hidden"), Name("uid"), Value(uid)),
+		Input(Type("hidden"), Name("status"), Value(string(status))),
+		Button(Type("submit"), Text(label)),
+	)
+}
@@ -0,0 +1,74 @@
+package web
+
+import (
+	"strings"
+
+	"github.com/gomoni/amble/internal/services/accounts"
+	"github.com/gomoni/amble/internal/tid"
+
+	. "maragu.dev/gomponents"
+	. "maragu.dev/gomponents/components"
+	. "maragu.dev/gomponents/html"
+)
+
+// AdminTenants is an admin page to create tenants and manage their members
+func AdminTenants(csfrName, csfrValue string, tenants []accounts.Tenant, members map[tid.TenantID][]tid.UserID) Node {
+	return HTML5(HTML5Props{
+		Title: "Amble.app - tenants",
+		Body: []Node{
+			H1(Text("Tenants")),
+			Table(
+				THead(Tr(
+					Th(Text("Tenant")),
+					Th(Text("Name")),
+					Th(Text("NATS account")),
+					Th(Text("Members")),
+				)),
+				TBody(Map(tenants, func(tenant accounts.Tenant) Node {
+					return Tr(
+						Td(Text(tenant.ID.String())),
+						Td(Text(tenant.Name)),
+						Td(Text(tenant.Account)),
+						Td(Map(members[tenant.ID], func(uid tid.UserID) Node {
+							return Form(
+								Method("POST"),
+								Action("/admin/tenants/members/remove"),
+								Input(Type("hidden"), Name(csfrName), Value(csfrValue)),
+								Input(Type("hidden"), Name("tenant"), Value(tenant.ID.String())),
+								Input(Type("hidden"), Name("uid"), Value(uid.String())),
+								Text(uid.String()+" "),
+								Button(Type("submit"), Text("Remove")),
+							)
+						})),
+					)
+				})),
+			),
+			H2(Text("Add member")),
+			Form(
+				Method("POST"),
+				ID("adminMemberAdd"),
+				Action("/admin/tenants/members"),
+				Input(Type("hidden"), Name(csfrName), Value(csfrValue)),
+				Label(For("tenant"), Text("Tenant")),
+				Select(ID("tenant"), Name("tenant"), Map(tenants, func(tenant accounts.Tenant) Node {
+					return Option(Value(tenant.ID.String()), Text(strings.TrimSpace(tenant.Name+" "+tenant.ID.String())))
+				})),
+				Label(For("uid"), Text("User")),
+				Input(Type("text"), ID("uid"), Name("uid"), Required()),
+				Button(Type("submit"), Text("Add")),
+			),
+			H2(Text("Create tenant")),
+			Form(
+				Method("POST"),
+				ID("adminTenantCreate"),
+				Action("/admin/tenants"),
+				Input(Type("hidden"), Name(csfrName), Value(csfrValue)),
+				Label(For("name"), Text("Name")),
+				Input(Type("text"), ID("name"), Name("name")),
+				Label(For("account"), Text("NATS account")),
+				Input(Type("text"), ID("account"), Name("account"), Required()),
+				Button(Type("submit"), Text("Create")),
+			),
+		},
+	})
+}
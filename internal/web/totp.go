@@ -0,0 +1,93 @@
+package web
+
+import (
+	"encoding/base64"
+
+	"github.com/gomoni/amble/internal/auth/totp"
+
+	. "maragu.dev/gomponents"
+	. "maragu.dev/gomponents/components"
+	. "maragu.dev/gomponents/html"
+)
+
+// SecondFactor asks for a code after the first factor succeeded
+func SecondFactor(csfrName, csfrValue, nextURL string) Node {
+	return HTML5(HTML5Props{
+		Title: "Amble.app - two-factor authentication",
+		Body: []Node{
+			H1(Text("Two-factor authentication")),
+			P(Text("Enter the code from your authenticator app or one of your recovery codes.")),
+			Form(
+				Method("POST"),
+				ID("secondFactor"),
+				Action("/auth/mfa"),
+				Input(Type("hidden"), Name("next_url"), Value(nextURL)),
+				Input(Type("hidden"), Name(csfrName), Value(csfrValue)),
+				Input(Type("text"), Name("code"), AutoComplete("one-time-code"), AutoFocus(), Required()),
+				Button(Type("submit"), Text("Verify")),
+			),
+		},
+	})
+}
+
+// TOTP displays the state of the second factor of the user
+func TOTP(csfrName, csfrValue string, enabled bool) Node {
+	var body Node
+	if enabled {
+		body = Group{
+			P(Text("Two-factor authentication is enabled.")),
+			Form(
+				Method("POST"),
+				ID("totpDisable"),
+				Action("/account/totp/disable"),
+				Input(Type("hidden"), Name(csfrName), Value(csfrValue)),
+				Input(Type("text"), Name("code"), AutoComplete("one-time-code"), Required()),
+				Button(Type("submit"), Text("Disable")),
+			),
+		}
+	} else {
+		body = Group{
+			P(Text("Two-factor authentication is disabled.")),
+			Form(
+				Method("POST"),
+				ID("totpEnroll"),
+				Action("/account/totp/enroll"),
+				Input(Type("hidden"), Name(csfrName), Value(csfrValue)),
+				Button(Type("submit"), Text("Enable")),
+			),
+		}
+	}
+	return HTML5(HTML5Props{
+		Title: "Amble.app - two-factor authentication",
+		Body: []Node{
+			H1(Text("Two-factor authentication")),
+			body,
+		},
+	})
+}
+
+// TOTPEnroll displays the QR code, secret and recovery codes. The second
+// factor is enabled once user confirms a code from the app.
+func TOTPEnroll(csfrName, csfrValue string, enrollment totp.Enrollment, qrPNG []byte) Node {
+	return HTML5(HTML5Props{
+		Title: "Amble.app - two-factor authentication",
+		Body: []Node{
+			H1(Text("Set up two-factor authentication")),
+			P(Text("Scan the QR code with your authenticator app or type the secret manually.")),
+			Img(Src("data:image/png;base64,"+base64.StdEncoding.EncodeToString(qrPNG)), Alt(enrollment.URI)),
+			P(Code(Text(enrollment.Secret))),
+			P(Text("Store the recovery codes in a safe place. Each code can be used only once.")),
+			Ul(Map(enrollment.RecoveryCodes, func(code string) Node {
+				return Li(Code(Text(code)))
+			})),
+			Form(
+				Method("POST"),
+				ID("totpConfirm"),
+				Action("/account/totp/confirm"),
+				Input(Type("hidden"), Name(csfrName), Value(csfrValue)),
+				Input(Type("text"), Name("code"), AutoComplete("one-time-code"), Required()),
+				Button(Type("submit"), Text("Confirm")),
+			),
+		},
+	})
+}